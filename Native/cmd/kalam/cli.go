@@ -0,0 +1,855 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"kalam-bridge/kalam"
+)
+
+// cliBackend is the view of the device used by the kalam command
+// *kalam.Client implements it for the connected device
+type cliBackend interface {
+	kalam.DAVBackend
+
+	// Scan detects connected MTP devices
+	Scan(ctx context.Context) ([]kalam.DeviceJSON, error)
+
+	// DownloadFile copies an object to a local file
+	DownloadFile(ctx context.Context, objectID kalam.ObjectID, destPath string) error
+
+	// UploadFile copies a local file into a folder and returns the new object
+	UploadFile(ctx context.Context, storageID kalam.StorageID, parentID kalam.ParentID, srcPath string) (kalam.ObjectID, error)
+
+	// ServeRPC serves the device operations as JSON-RPC 2.0 until r ends
+	ServeRPC(ctx context.Context, r io.Reader, w io.Writer) error
+}
+
+const cliUsage = `Usage: kalam [-json] [-v] [-sim | -ptpip host[:port]] [-record file] [-replay file]
+             <command> [arguments]
+
+Device paths have the form /<storage>/<path>, where <storage> is a storage ID
+or its description, e.g. "/Internal shared storage/DCIM/Camera".
+
+Commands:
+  devices                    list connected devices
+  df                         show storage capacity and free space
+  ls [path]                  list a folder, or the storages for /
+  tree [-depth n] [path]     list a folder recursively
+  stat <path>                show details of a file or folder
+  get <path> [local]         download a file
+  put [-f] <local> <path>    upload a file into a folder, or to a new name
+  rm [-r] <path>             delete a file, or a folder with -r
+  mkdir [-p] <path>          create a folder
+  mv <path> <path>           move or rename a file or folder
+  rpc [-socket path]         serve JSON-RPC 2.0 on stdin/stdout or a Unix socket
+
+Flags:
+  -json          print results as JSON
+  -v             print debug logs of the bridge to stderr
+  -sim           use a simulated demo device instead of USB
+  -ptpip host    connect to a PTP/IP device over TCP, port 15740 by default
+  -record file   write every device transaction to a capture file
+  -replay file   answer device transactions from a capture file
+`
+
+// errCLIUsage marks errors caused by invalid command lines
+var errCLIUsage = errors.New("usage")
+
+// cli runs kalam subcommands against a backend
+type cli struct {
+	ctx        context.Context
+	backend    cliBackend
+	stdin      io.Reader
+	stdout     io.Writer
+	stderr     io.Writer
+	jsonOutput bool
+}
+
+// cliCommands maps subcommand names to their implementation
+var cliCommands = map[string]func(c *cli, args []string) error{
+	"devices": (*cli).runDevices,
+	"df":      (*cli).runDF,
+	"ls":      (*cli).runLS,
+	"tree":    (*cli).runTree,
+	"stat":    (*cli).runStat,
+	"get":     (*cli).runGet,
+	"put":     (*cli).runPut,
+	"rm":      (*cli).runRM,
+	"mkdir":   (*cli).runMkdir,
+	"mv":      (*cli).runMV,
+	"rpc":     (*cli).runRPC,
+}
+
+// globalFlags are the options given before the subcommand
+type globalFlags struct {
+	json    bool
+	verbose bool
+	sim     bool
+	ptpip   string
+	record  string
+	replay  string
+	// args holds the subcommand and its arguments
+	args []string
+}
+
+// parseGlobalFlags parses the options given before the subcommand
+func parseGlobalFlags(args []string) (globalFlags, error) {
+	var g globalFlags
+	fs := flag.NewFlagSet("kalam", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&g.json, "json", false, "")
+	fs.BoolVar(&g.verbose, "v", false, "")
+	fs.BoolVar(&g.sim, "sim", false, "")
+	fs.StringVar(&g.ptpip, "ptpip", "", "")
+	fs.StringVar(&g.record, "record", "", "")
+	fs.StringVar(&g.replay, "replay", "", "")
+	if err := fs.Parse(args); err != nil {
+		return globalFlags{}, err
+	}
+	g.args = fs.Args()
+	return g, nil
+}
+
+// runCLI runs the subcommand named in flags, returning the process exit code
+// Cancelling ctx abandons the running device operation
+func runCLI(ctx context.Context, flags globalFlags, backend cliBackend, stdin io.Reader, stdout, stderr io.Writer) int {
+	c := &cli{ctx: ctx, backend: backend, stdin: stdin, stdout: stdout, stderr: stderr, jsonOutput: flags.json}
+
+	if len(flags.args) == 0 {
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+
+	name := flags.args[0]
+	command, ok := cliCommands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "kalam: unknown command %q\n\n%s", name, cliUsage)
+		return 2
+	}
+
+	if err := command(c, flags.args[1:]); err != nil {
+		c.writeError(name, err)
+		if errors.Is(err, errCLIUsage) {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+// flagSet returns the flag set of a subcommand, accepting -json after the command name too
+func (c *cli) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&c.jsonOutput, "json", c.jsonOutput, "")
+	return fs
+}
+
+// parseArgs parses subcommand flags and checks the number of positional arguments
+func (c *cli) parseArgs(fs *flag.FlagSet, args []string, minArgs, maxArgs int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("%w: %v", errCLIUsage, err)
+	}
+	if fs.NArg() < minArgs || fs.NArg() > maxArgs {
+		return nil, fmt.Errorf("%w: %s expects %d to %d arguments, got %d", errCLIUsage, fs.Name(), minArgs, maxArgs, fs.NArg())
+	}
+	return fs.Args(), nil
+}
+
+// writeJSON prints v as indented JSON
+func (c *cli) writeJSON(v interface{}) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// writeError reports a failed command in the selected output format
+func (c *cli) writeError(command string, err error) {
+	if !c.jsonOutput {
+		fmt.Fprintf(c.stderr, "kalam %s: %v\n", command, err)
+		if errors.Is(err, errCLIUsage) {
+			fmt.Fprint(c.stderr, "\n"+cliUsage)
+		}
+		return
+	}
+
+	code := "COMMAND_FAILED"
+	switch {
+	case errors.Is(err, errCLIUsage):
+		code = "USAGE"
+	case errors.Is(err, kalam.ErrObjectNotFound):
+		code = "NOT_FOUND"
+	}
+	c.writeJSON(map[string]string{"error": code, "message": err.Error()})
+}
+
+// -- Device Paths --
+
+// remoteTarget is a location on the device addressed as /<storage>/<path>
+type remoteTarget struct {
+	storage    kalam.StorageJSON
+	objectPath string
+}
+
+// isDeviceRoot reports whether p addresses the list of storages
+func isDeviceRoot(p string) bool {
+	return strings.Trim(p, "/") == ""
+}
+
+// parseRemote resolves the storage component of a device path
+func (c *cli) parseRemote(p string) (remoteTarget, error) {
+	cleaned := strings.Trim(path.Clean("/"+p), "/")
+	if cleaned == "" {
+		return remoteTarget{}, fmt.Errorf("path %q does not name a storage", p)
+	}
+
+	storageName, objectPath, _ := strings.Cut(cleaned, "/")
+
+	storages, err := c.backend.ListStorages(c.ctx)
+	if err != nil {
+		return remoteTarget{}, err
+	}
+	for _, s := range storages {
+		if strconv.FormatUint(uint64(s.ID), 10) == storageName || strings.EqualFold(s.Description, storageName) {
+			return remoteTarget{storage: s, objectPath: objectPath}, nil
+		}
+	}
+
+	return remoteTarget{}, fmt.Errorf("%w: storage %s", kalam.ErrObjectNotFound, storageName)
+}
+
+// lookup returns the object at a target; a storage root is returned as a folder with ID kalam.RootParentID
+func (c *cli) lookup(t remoteTarget) (kalam.FileJSON, error) {
+	if t.objectPath == "" {
+		return kalam.FileJSON{
+			ID:        uint32(kalam.RootParentID),
+			StorageID: t.storage.ID,
+			Name:      t.storage.Description,
+			IsFolder:  true,
+		}, nil
+	}
+	return kalam.ResolvePath(c.ctx, c.backend, kalam.StorageID(t.storage.ID), t.objectPath)
+}
+
+// lookupParent returns the folder that contains a target
+func (c *cli) lookupParent(t remoteTarget) (kalam.FileJSON, error) {
+	parent := t
+	parent.objectPath = path.Dir(t.objectPath)
+	if parent.objectPath == "." {
+		parent.objectPath = ""
+	}
+
+	folder, err := c.lookup(parent)
+	if err != nil {
+		return kalam.FileJSON{}, err
+	}
+	if !folder.IsFolder {
+		return kalam.FileJSON{}, fmt.Errorf("%s is not a folder", parent.objectPath)
+	}
+	return folder, nil
+}
+
+// -- Commands --
+
+func (c *cli) runDevices(args []string) error {
+	if _, err := c.parseArgs(c.flagSet("devices"), args, 0, 0); err != nil {
+		return err
+	}
+
+	devices, err := c.backend.Scan(c.ctx)
+	if err != nil {
+		return err
+	}
+	if devices == nil {
+		devices = []kalam.DeviceJSON{}
+	}
+
+	if c.jsonOutput {
+		return c.writeJSON(devices)
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSERIAL\tMTP\tSTORAGES")
+	for _, d := range devices {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", d.Name, d.SerialNumber, d.MTPSupport.MtpVersion, len(d.Storage))
+	}
+	return tw.Flush()
+}
+
+func (c *cli) runDF(args []string) error {
+	if _, err := c.parseArgs(c.flagSet("df"), args, 0, 0); err != nil {
+		return err
+	}
+
+	storages, err := c.backend.ListStorages(c.ctx)
+	if err != nil {
+		return err
+	}
+
+	if c.jsonOutput {
+		return c.writeJSON(storages)
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTORAGE\tSIZE\tUSED\tFREE\tUSE%")
+	for _, s := range storages {
+		used := s.MaxCapacity - s.FreeSpace
+		percent := 0
+		if s.MaxCapacity > 0 {
+			percent = int(used * 100 / s.MaxCapacity)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d%%\n", s.ID, s.Description,
+			formatSize(s.MaxCapacity), formatSize(used), formatSize(s.FreeSpace), percent)
+	}
+	return tw.Flush()
+}
+
+func (c *cli) runLS(args []string) error {
+	rest, err := c.parseArgs(c.flagSet("ls"), args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	remote := "/"
+	if len(rest) == 1 {
+		remote = rest[0]
+	}
+
+	if isDeviceRoot(remote) {
+		return c.runDF(nil)
+	}
+
+	t, err := c.parseRemote(remote)
+	if err != nil {
+		return err
+	}
+	file, err := c.lookup(t)
+	if err != nil {
+		return err
+	}
+
+	files := []kalam.FileJSON{file}
+	if file.IsFolder {
+		if files, err = c.backend.ListFiles(c.ctx, kalam.StorageID(t.storage.ID), kalam.ParentID(file.ID)); err != nil {
+			return err
+		}
+		if files == nil {
+			files = []kalam.FileJSON{}
+		}
+	}
+
+	if c.jsonOutput {
+		return c.writeJSON(files)
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0)
+	for _, f := range files {
+		kind, size := "-", formatSize(f.Size)
+		if f.IsFolder {
+			kind, size = "d", "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", kind, size, formatModTime(f.ModTime), f.Name)
+	}
+	return tw.Flush()
+}
+
+// treeNode is a file or folder with its children, as printed by tree -json
+type treeNode struct {
+	kalam.FileJSON
+	Children []*treeNode `json:"children,omitempty"`
+}
+
+func (c *cli) runTree(args []string) error {
+	fs := c.flagSet("tree")
+	depth := fs.Int("depth", 0, "")
+	rest, err := c.parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	t, err := c.parseRemote(rest[0])
+	if err != nil {
+		return err
+	}
+	file, err := c.lookup(t)
+	if err != nil {
+		return err
+	}
+
+	root := &treeNode{FileJSON: file}
+	if err := c.buildTree(kalam.StorageID(t.storage.ID), root, 1, *depth); err != nil {
+		return err
+	}
+
+	if c.jsonOutput {
+		return c.writeJSON(root)
+	}
+
+	fmt.Fprintln(c.stdout, root.Name)
+	c.printTree(root, "")
+	return nil
+}
+
+// buildTree lists the children of folder nodes down to maxDepth levels, or everything for 0
+func (c *cli) buildTree(storageID kalam.StorageID, node *treeNode, level, maxDepth int) error {
+	if !node.IsFolder || (maxDepth > 0 && level > maxDepth) {
+		return nil
+	}
+
+	files, err := c.backend.ListFiles(c.ctx, storageID, kalam.ParentID(node.ID))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		child := &treeNode{FileJSON: f}
+		if err := c.buildTree(storageID, child, level+1, maxDepth); err != nil {
+			return err
+		}
+		node.Children = append(node.Children, child)
+	}
+	return nil
+}
+
+// printTree prints the children of node with box-drawing indentation
+func (c *cli) printTree(node *treeNode, indent string) {
+	for i, child := range node.Children {
+		branch, nextIndent := "├── ", indent+"│   "
+		if i == len(node.Children)-1 {
+			branch, nextIndent = "└── ", indent+"    "
+		}
+
+		name := child.Name
+		if child.IsFolder {
+			name += "/"
+		}
+		fmt.Fprintf(c.stdout, "%s%s%s\n", indent, branch, name)
+		c.printTree(child, nextIndent)
+	}
+}
+
+func (c *cli) runStat(args []string) error {
+	rest, err := c.parseArgs(c.flagSet("stat"), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	t, err := c.parseRemote(rest[0])
+	if err != nil {
+		return err
+	}
+	file, err := c.lookup(t)
+	if err != nil {
+		return err
+	}
+
+	if c.jsonOutput {
+		return c.writeJSON(file)
+	}
+
+	kind := "file"
+	if file.IsFolder {
+		kind = "folder"
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(tw, "Name:\t%s\n", file.Name)
+	fmt.Fprintf(tw, "Type:\t%s\n", kind)
+	fmt.Fprintf(tw, "Size:\t%d (%s)\n", file.Size, formatSize(file.Size))
+	fmt.Fprintf(tw, "Modified:\t%s\n", formatModTime(file.ModTime))
+	fmt.Fprintf(tw, "Object ID:\t%d\n", file.ID)
+	fmt.Fprintf(tw, "Parent ID:\t%d\n", file.ParentID)
+	fmt.Fprintf(tw, "Storage ID:\t%d\n", file.StorageID)
+	return tw.Flush()
+}
+
+// cliTransferJSON describes a completed get or put
+type cliTransferJSON struct {
+	ID     uint32 `json:"id"`
+	Source string `json:"source"`
+	Dest   string `json:"destination"`
+	Size   int64  `json:"size"`
+}
+
+func (c *cli) writeTransfer(result cliTransferJSON) error {
+	if c.jsonOutput {
+		return c.writeJSON(result)
+	}
+	_, err := fmt.Fprintf(c.stdout, "%s -> %s (%s)\n", result.Source, result.Dest, formatSize(uint64(result.Size)))
+	return err
+}
+
+func (c *cli) runGet(args []string) error {
+	rest, err := c.parseArgs(c.flagSet("get"), args, 1, 2)
+	if err != nil {
+		return err
+	}
+
+	t, err := c.parseRemote(rest[0])
+	if err != nil {
+		return err
+	}
+	file, err := c.lookup(t)
+	if err != nil {
+		return err
+	}
+	if file.IsFolder {
+		return fmt.Errorf("%s is a folder", rest[0])
+	}
+
+	local := "."
+	if len(rest) == 2 {
+		local = rest[1]
+	}
+	if info, err := os.Stat(local); err == nil && info.IsDir() {
+		local = filepath.Join(local, file.Name)
+	}
+	local, err = filepath.Abs(local)
+	if err != nil {
+		return err
+	}
+
+	if err := c.backend.DownloadFile(c.ctx, kalam.ObjectID(file.ID), local); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+
+	return c.writeTransfer(cliTransferJSON{ID: file.ID, Source: rest[0], Dest: local, Size: info.Size()})
+}
+
+func (c *cli) runPut(args []string) error {
+	fs := c.flagSet("put")
+	force := fs.Bool("f", false, "")
+	rest, err := c.parseArgs(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	local, err := filepath.Abs(rest[0])
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+
+	t, err := c.parseRemote(rest[1])
+	if err != nil {
+		return err
+	}
+
+	// Upload into an existing folder, or under a new name into its parent
+	name := filepath.Base(local)
+	folder, err := c.lookup(t)
+	if err != nil || !folder.IsFolder {
+		if err != nil && !errors.Is(err, kalam.ErrObjectNotFound) {
+			return err
+		}
+		if folder, err = c.lookupParent(t); err != nil {
+			return err
+		}
+		name = path.Base(t.objectPath)
+	}
+
+	storageID := kalam.StorageID(t.storage.ID)
+	parentID := kalam.ParentID(folder.ID)
+
+	existing, err := c.backend.ListFiles(c.ctx, storageID, parentID)
+	if err != nil {
+		return err
+	}
+	for _, f := range existing {
+		if f.Name != name {
+			continue
+		}
+		if f.IsFolder || !*force {
+			return fmt.Errorf("%s already exists in %s", f.Name, folder.Name)
+		}
+		if err := c.backend.DeleteObject(c.ctx, kalam.ObjectID(f.ID)); err != nil {
+			return err
+		}
+	}
+
+	objectID, err := c.backend.UploadFile(c.ctx, storageID, parentID, local)
+	if err != nil {
+		return err
+	}
+
+	// The transfer code names objects after the local file
+	if name != filepath.Base(local) {
+		if err := c.backend.RenameObject(c.ctx, objectID, name); err != nil {
+			return err
+		}
+	}
+
+	dest := path.Join("/", t.storage.Description, t.objectPath)
+	if name != path.Base(dest) {
+		dest = path.Join(dest, name)
+	}
+	return c.writeTransfer(cliTransferJSON{ID: uint32(objectID), Source: local, Dest: dest, Size: info.Size()})
+}
+
+// cliResultJSON describes an object affected by rm, mkdir or mv
+type cliResultJSON struct {
+	ID     uint32 `json:"id"`
+	Action string `json:"action"`
+	Path   string `json:"path"`
+}
+
+func (c *cli) writeResult(result cliResultJSON) error {
+	if c.jsonOutput {
+		return c.writeJSON(result)
+	}
+	_, err := fmt.Fprintf(c.stdout, "%s %s\n", result.Action, result.Path)
+	return err
+}
+
+func (c *cli) runRM(args []string) error {
+	fs := c.flagSet("rm")
+	recursive := fs.Bool("r", false, "")
+	rest, err := c.parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	t, err := c.parseRemote(rest[0])
+	if err != nil {
+		return err
+	}
+	if t.objectPath == "" {
+		return fmt.Errorf("cannot delete a storage")
+	}
+
+	file, err := c.lookup(t)
+	if err != nil {
+		return err
+	}
+	if file.IsFolder && !*recursive {
+		return fmt.Errorf("%s is a folder, use -r to delete it", rest[0])
+	}
+
+	if err := c.backend.DeleteObject(c.ctx, kalam.ObjectID(file.ID)); err != nil {
+		return err
+	}
+
+	return c.writeResult(cliResultJSON{ID: file.ID, Action: "deleted", Path: rest[0]})
+}
+
+func (c *cli) runMkdir(args []string) error {
+	fs := c.flagSet("mkdir")
+	parents := fs.Bool("p", false, "")
+	rest, err := c.parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	t, err := c.parseRemote(rest[0])
+	if err != nil {
+		return err
+	}
+	if t.objectPath == "" {
+		return fmt.Errorf("%s already exists", rest[0])
+	}
+
+	if existing, err := c.lookup(t); err == nil {
+		if *parents && existing.IsFolder {
+			return c.writeResult(cliResultJSON{ID: existing.ID, Action: "exists", Path: rest[0]})
+		}
+		return fmt.Errorf("%s already exists", rest[0])
+	}
+
+	// Walk down from the storage root, creating missing folders when -p is given
+	storageID := kalam.StorageID(t.storage.ID)
+	components := strings.Split(t.objectPath, "/")
+	current := remoteTarget{storage: t.storage}
+	parentID := kalam.RootParentID
+
+	for i, name := range components {
+		current.objectPath = path.Join(current.objectPath, name)
+
+		folder, err := c.lookup(current)
+		if err == nil {
+			if !folder.IsFolder {
+				return fmt.Errorf("%s is not a folder", current.objectPath)
+			}
+			parentID = kalam.ParentID(folder.ID)
+			continue
+		}
+		if !errors.Is(err, kalam.ErrObjectNotFound) {
+			return err
+		}
+		if i < len(components)-1 && !*parents {
+			return fmt.Errorf("%w: %s, use -p to create parent folders", kalam.ErrObjectNotFound, current.objectPath)
+		}
+
+		newID, err := c.backend.CreateFolder(c.ctx, storageID, parentID, name)
+		if err != nil {
+			return err
+		}
+		parentID = kalam.ParentID(newID)
+	}
+
+	return c.writeResult(cliResultJSON{ID: uint32(parentID), Action: "created", Path: rest[0]})
+}
+
+func (c *cli) runMV(args []string) error {
+	rest, err := c.parseArgs(c.flagSet("mv"), args, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	src, err := c.parseRemote(rest[0])
+	if err != nil {
+		return err
+	}
+	if src.objectPath == "" {
+		return fmt.Errorf("cannot move a storage")
+	}
+	source, err := c.lookup(src)
+	if err != nil {
+		return err
+	}
+
+	dst, err := c.parseRemote(rest[1])
+	if err != nil {
+		return err
+	}
+
+	// Moving onto a folder puts the object inside it, otherwise the last component is the new name
+	name := source.Name
+	folder, err := c.lookup(dst)
+	switch {
+	case err == nil && folder.IsFolder:
+		existing, err := c.backend.ListFiles(c.ctx, kalam.StorageID(dst.storage.ID), kalam.ParentID(folder.ID))
+		if err != nil {
+			return err
+		}
+		for _, f := range existing {
+			if f.Name == name && f.ID != source.ID {
+				return fmt.Errorf("%s already exists in %s", name, rest[1])
+			}
+		}
+	case err == nil:
+		return fmt.Errorf("%s already exists", rest[1])
+	case errors.Is(err, kalam.ErrObjectNotFound):
+		if folder, err = c.lookupParent(dst); err != nil {
+			return err
+		}
+		name = path.Base(dst.objectPath)
+	default:
+		return err
+	}
+
+	if dst.storage.ID != source.StorageID || !kalam.SameParent(source.ParentID, kalam.ParentID(folder.ID)) {
+		if err := c.backend.MoveObject(c.ctx, kalam.ObjectID(source.ID), kalam.StorageID(dst.storage.ID), kalam.ParentID(folder.ID)); err != nil {
+			return err
+		}
+	}
+
+	if name != source.Name {
+		if err := c.backend.RenameObject(c.ctx, kalam.ObjectID(source.ID), name); err != nil {
+			return err
+		}
+	}
+
+	return c.writeResult(cliResultJSON{ID: source.ID, Action: "moved", Path: rest[1]})
+}
+
+// runRPC serves the device to a host process, so a crash in the USB stack only takes down this helper
+func (c *cli) runRPC(args []string) error {
+	fs := c.flagSet("rpc")
+	socketPath := fs.String("socket", "", "")
+	if _, err := c.parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	if *socketPath == "" {
+		return c.backend.ServeRPC(c.ctx, c.stdin, c.stdout)
+	}
+
+	// A socket left behind by a helper that crashed would make Listen fail
+	if info, err := os.Lstat(*socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", *socketPath)
+		}
+		os.Remove(*socketPath)
+	}
+
+	listener, err := net.Listen("unix", *socketPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(*socketPath)
+	defer listener.Close()
+	stop := context.AfterFunc(c.ctx, func() { listener.Close() })
+	defer stop()
+	fmt.Fprintf(c.stderr, "kalam: serving JSON-RPC on %s\n", *socketPath)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			closeOnCancel := context.AfterFunc(c.ctx, func() { conn.Close() })
+			defer closeOnCancel()
+
+			if err := c.backend.ServeRPC(c.ctx, conn, conn); err != nil {
+				fmt.Fprintf(c.stderr, "kalam: rpc connection: %v\n", err)
+			}
+		}()
+	}
+}
+
+// -- Formatting --
+
+// formatSize formats a byte count with binary units
+func formatSize(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// formatModTime formats a Unix modification time, or "-" when the device reports none
+func formatModTime(modTime int64) string {
+	if modTime <= 0 {
+		return "-"
+	}
+	return time.Unix(modTime, 0).Format("2006-01-02 15:04")
+}
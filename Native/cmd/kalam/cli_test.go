@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"kalam-bridge/kalam"
+)
+
+// TestMain keeps the bridge's text records out of the test output, as main does without -v
+func TestMain(m *testing.M) {
+	kalam.SetLogOutput(nil)
+	os.Exit(m.Run())
+}
+
+// testDevice is the simulated phone the commands run against, through the same Client as the bridge
+type testDevice struct {
+	*kalam.SimDevice
+	dcim, clip, notes kalam.ObjectID
+}
+
+// useTestDevice connects the Client to a simulated phone with a folder, a clip and a note
+func useTestDevice(t *testing.T) (*testDevice, *kalam.Client) {
+	t.Helper()
+
+	sim := kalam.NewSimDevice()
+	sim.SetIdentity("Google", "Pixel 8", "ABC123")
+	sim.AddStorage(65537, "Internal shared storage", 4*1024*1024)
+
+	d := &testDevice{SimDevice: sim}
+	d.dcim = sim.AddFolder(65537, kalam.RootParentID, "DCIM")
+	d.clip = sim.AddFile(65537, kalam.ParentID(d.dcim), "clip.mp4", make([]byte, 3*1024*1024))
+	d.notes = sim.AddFile(65537, kalam.RootParentID, "notes.txt", []byte("hello"))
+
+	kalam.SetDeviceOpener(sim.Open)
+	client := kalam.NewClient()
+	client.Open()
+	t.Cleanup(func() {
+		kalam.SetDeviceOpener(nil)
+	})
+	return d, client
+}
+
+// resolve returns the object at a path of the internal storage
+func resolve(t *testing.T, client *kalam.Client, objectPath string) kalam.FileJSON {
+	t.Helper()
+
+	file, err := kalam.ResolvePath(context.Background(), client, 65537, objectPath)
+	if err != nil {
+		t.Fatalf("%s not found: %v", objectPath, err)
+	}
+	return file
+}
+
+func runTestCLI(t *testing.T, backend cliBackend, args ...string) (int, string, string) {
+	t.Helper()
+
+	flags, err := parseGlobalFlags(args)
+	if err != nil {
+		t.Fatalf("parsing %q failed: %v", args, err)
+	}
+	var stdout, stderr bytes.Buffer
+	code := runCLI(context.Background(), flags, backend, strings.NewReader(""), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCLIUsage(t *testing.T) {
+	_, backend := useTestDevice(t)
+
+	if code, _, stderr := runTestCLI(t, backend); code != 2 || !strings.Contains(stderr, "Usage:") {
+		t.Errorf("no command: code %d, stderr %q", code, stderr)
+	}
+	if code, _, _ := runTestCLI(t, backend, "format"); code != 2 {
+		t.Errorf("unknown command: code %d, want 2", code)
+	}
+	if code, _, _ := runTestCLI(t, backend, "stat"); code != 2 {
+		t.Errorf("missing argument: code %d, want 2", code)
+	}
+}
+
+func TestParseGlobalFlags(t *testing.T) {
+	flags, err := parseGlobalFlags([]string{"-v", "-json", "-ptpip", "192.168.1.20", "-record", "capture.jsonl", "-replay=old.jsonl", "ls", "-json", "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := globalFlags{json: true, verbose: true, ptpip: "192.168.1.20", record: "capture.jsonl", replay: "old.jsonl", args: []string{"ls", "-json", "/"}}
+	if !reflect.DeepEqual(flags, want) {
+		t.Errorf("parseGlobalFlags = %+v, want %+v", flags, want)
+	}
+
+	if _, err := parseGlobalFlags([]string{"-format", "ls"}); err == nil {
+		t.Error("an unknown global flag should fail")
+	}
+}
+
+func TestCLIDevicesAndDF(t *testing.T) {
+	_, backend := useTestDevice(t)
+
+	code, stdout, _ := runTestCLI(t, backend, "-json", "devices")
+	if code != 0 {
+		t.Fatalf("devices failed with code %d", code)
+	}
+	var devices []kalam.DeviceJSON
+	if err := json.Unmarshal([]byte(stdout), &devices); err != nil || len(devices) != 1 || devices[0].SerialNumber != "ABC123" {
+		t.Errorf("devices -json = %q (%v)", stdout, err)
+	}
+
+	code, stdout, _ = runTestCLI(t, backend, "df")
+	if code != 0 || !strings.Contains(stdout, "Internal shared storage") || !strings.Contains(stdout, "75%") {
+		t.Errorf("df = %d %q", code, stdout)
+	}
+}
+
+func TestCLIListAndStat(t *testing.T) {
+	device, backend := useTestDevice(t)
+
+	// Storages can be addressed by ID or case-insensitive description
+	code, stdout, _ := runTestCLI(t, backend, "ls", "-json", "/internal shared storage")
+	if code != 0 {
+		t.Fatalf("ls failed with code %d", code)
+	}
+	var files []kalam.FileJSON
+	if err := json.Unmarshal([]byte(stdout), &files); err != nil || len(files) != 2 {
+		t.Errorf("ls -json = %q (%v)", stdout, err)
+	}
+
+	code, stdout, _ = runTestCLI(t, backend, "ls", "/65537/DCIM")
+	if code != 0 || !strings.Contains(stdout, "clip.mp4") || !strings.Contains(stdout, "3.0 MiB") {
+		t.Errorf("ls DCIM = %d %q", code, stdout)
+	}
+
+	code, stdout, _ = runTestCLI(t, backend, "-json", "stat", "/65537/notes.txt")
+	var file kalam.FileJSON
+	if err := json.Unmarshal([]byte(stdout), &file); code != 0 || err != nil || kalam.ObjectID(file.ID) != device.notes {
+		t.Errorf("stat -json = %d %q (%v)", code, stdout, err)
+	}
+
+	code, stdout, _ = runTestCLI(t, backend, "-json", "stat", "/65537/missing.txt")
+	if code != 1 || !strings.Contains(stdout, `"NOT_FOUND"`) {
+		t.Errorf("stat missing = %d %q", code, stdout)
+	}
+}
+
+func TestCLITree(t *testing.T) {
+	_, backend := useTestDevice(t)
+
+	code, stdout, _ := runTestCLI(t, backend, "tree", "/65537")
+	want := "Internal shared storage\n├── DCIM/\n│   └── clip.mp4\n└── notes.txt\n"
+	if code != 0 || stdout != want {
+		t.Errorf("tree = %d\n%s\nwant\n%s", code, stdout, want)
+	}
+
+	code, stdout, _ = runTestCLI(t, backend, "tree", "-json", "-depth", "1", "/65537")
+	var root treeNode
+	if err := json.Unmarshal([]byte(stdout), &root); code != 0 || err != nil {
+		t.Fatalf("tree -json = %d %q (%v)", code, stdout, err)
+	}
+	if len(root.Children) != 2 || len(root.Children[0].Children) != 0 {
+		t.Errorf("tree -depth 1 should not descend into DCIM: %+v", root)
+	}
+}
+
+func TestCLIGetAndPut(t *testing.T) {
+	device, backend := useTestDevice(t)
+	dir := t.TempDir()
+
+	code, _, stderr := runTestCLI(t, backend, "get", "/65537/notes.txt", dir)
+	if code != 0 {
+		t.Fatalf("get failed: %s", stderr)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "notes.txt")); err != nil || string(data) != "hello" {
+		t.Errorf("downloaded %q (%v)", data, err)
+	}
+
+	local := filepath.Join(dir, "song.mp3")
+	if err := os.WriteFile(local, []byte("la la la"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _, stderr := runTestCLI(t, backend, "put", local, "/65537/DCIM"); code != 0 {
+		t.Fatalf("put into folder failed: %s", stderr)
+	}
+	if code, _, _ := runTestCLI(t, backend, "put", local, "/65537/DCIM"); code != 1 {
+		t.Errorf("put over existing file without -f: code %d, want 1", code)
+	}
+	if code, _, stderr := runTestCLI(t, backend, "put", "-f", local, "/65537/DCIM"); code != 0 {
+		t.Errorf("put -f failed: %s", stderr)
+	}
+
+	code, stdout, stderr := runTestCLI(t, backend, "-json", "put", local, "/65537/renamed.mp3")
+	if code != 0 {
+		t.Fatalf("put to new name failed: %s", stderr)
+	}
+	var result cliTransferJSON
+	if err := json.Unmarshal([]byte(stdout), &result); err != nil || result.Size != 8 {
+		t.Errorf("put -json = %q (%v)", stdout, err)
+	}
+	if file := resolve(t, backend, "renamed.mp3"); file.ID != result.ID || file.Size != 8 {
+		t.Errorf("renamed upload is %+v, want object %d", file, result.ID)
+	}
+
+	if files, _ := backend.ListFiles(context.Background(), 65537, kalam.ParentID(device.dcim)); len(files) != 2 {
+		t.Errorf("DCIM should hold clip.mp4 and one song.mp3, got %+v", files)
+	}
+}
+
+func TestCLIMkdirMoveRemove(t *testing.T) {
+	device, backend := useTestDevice(t)
+
+	if code, _, _ := runTestCLI(t, backend, "mkdir", "/65537/Music/Albums"); code != 1 {
+		t.Errorf("mkdir without -p: code %d, want 1", code)
+	}
+	if code, _, stderr := runTestCLI(t, backend, "mkdir", "-p", "/65537/Music/Albums"); code != 0 {
+		t.Fatalf("mkdir -p failed: %s", stderr)
+	}
+	if albums := resolve(t, backend, "Music/Albums"); !albums.IsFolder {
+		t.Fatalf("Music/Albums is %+v, want a folder", albums)
+	}
+
+	// Move into a folder keeps the name
+	if code, _, stderr := runTestCLI(t, backend, "mv", "/65537/notes.txt", "/65537/Music/Albums"); code != 0 {
+		t.Fatalf("mv into folder failed: %s", stderr)
+	}
+	if f := resolve(t, backend, "Music/Albums/notes.txt"); kalam.ObjectID(f.ID) != device.notes {
+		t.Errorf("after mv got %+v", f)
+	}
+
+	// Move to a new path renames as well
+	if code, _, stderr := runTestCLI(t, backend, "mv", "/65537/Music/Albums/notes.txt", "/65537/todo.txt"); code != 0 {
+		t.Fatalf("mv to new name failed: %s", stderr)
+	}
+	if f := resolve(t, backend, "todo.txt"); kalam.ObjectID(f.ID) != device.notes {
+		t.Errorf("after rename got %+v", f)
+	}
+
+	if code, _, _ := runTestCLI(t, backend, "rm", "/65537/Music"); code != 1 {
+		t.Errorf("rm folder without -r: code %d, want 1", code)
+	}
+	if code, _, stderr := runTestCLI(t, backend, "rm", "-r", "/65537/Music"); code != 0 {
+		t.Errorf("rm -r failed: %s", stderr)
+	}
+	if _, err := kalam.ResolvePath(context.Background(), backend, 65537, "Music"); !errors.Is(err, kalam.ErrObjectNotFound) {
+		t.Errorf("Music after rm -r: %v, want not found", err)
+	}
+	if code, _, _ := runTestCLI(t, backend, "rm", "/65537"); code != 1 {
+		t.Errorf("rm storage: code %d, want 1", code)
+	}
+}
+
+func TestCLIRPC(t *testing.T) {
+	_, backend := useTestDevice(t)
+
+	var stdout, stderr bytes.Buffer
+	request := `{"jsonrpc":"2.0","id":1,"method":"scan"}` + "\n"
+	if code := runCLI(context.Background(), globalFlags{args: []string{"rpc"}}, backend, strings.NewReader(request), &stdout, &stderr); code != 0 || !strings.Contains(stdout.String(), `"serialNumber":"ABC123"`) {
+		t.Fatalf("rpc on stdio = %d %q %q", code, stdout.String(), stderr.String())
+	}
+
+	// Unix socket paths are short, so the socket does not go into t.TempDir
+	dir, err := os.MkdirTemp("", "kalam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "rpc.sock")
+
+	// A stale socket from a crashed helper is replaced
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int, 1)
+	go func() {
+		done <- runCLI(ctx, globalFlags{args: []string{"rpc", "-socket", socketPath}}, backend, strings.NewReader(""), io.Discard, io.Discard)
+	}()
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", socketPath); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial %s: %v", socketPath, err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.Contains(reply, `"serialNumber":"ABC123"`) {
+		t.Fatalf("rpc on socket = %q, %v", reply, err)
+	}
+
+	cancel()
+	if code := <-done; code != 0 {
+		t.Errorf("rpc -socket exited with %d after cancel", code)
+	}
+	if _, err := os.Stat(socketPath); err == nil {
+		t.Errorf("expected the socket to be removed")
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := map[uint64]string{
+		0:                      "0 B",
+		1023:                   "1023 B",
+		1024:                   "1.0 KiB",
+		3 * 1024 * 1024:        "3.0 MiB",
+		5 * 1024 * 1024 * 1024: "5.0 GiB",
+	}
+	for size, want := range tests {
+		if got := formatSize(size); got != want {
+			t.Errorf("formatSize(%d) = %q, want %q", size, got, want)
+		}
+	}
+}
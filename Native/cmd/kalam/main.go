@@ -0,0 +1,63 @@
+// Command kalam browses and transfers files on a connected MTP device
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+
+	"kalam-bridge/kalam"
+)
+
+func main() {
+	flags, err := parseGlobalFlags(os.Args[1:])
+	if err != nil {
+		fmt.Fprint(os.Stderr, cliUsage)
+		os.Exit(2)
+	}
+
+	// Bridge logs would interleave with command output, they go to stderr only with -v
+	kalam.SetLogOutput(nil)
+	if flags.verbose {
+		kalam.SetLogOutput(os.Stderr)
+		kalam.SetLogLevel(slog.LevelDebug)
+	}
+	if flags.sim {
+		demo := kalam.NewDemoDevice()
+		kalam.SetDeviceOpener(demo.Open)
+		kalam.SetPresenceProbe(demo.Presence)
+	}
+	if flags.ptpip != "" {
+		kalam.SetDeviceOpener(kalam.PTPIPOpener(flags.ptpip))
+	}
+	if flags.replay != "" {
+		replay, err := kalam.LoadReplay(flags.replay)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "kalam: %v\n", err)
+			os.Exit(1)
+		}
+		kalam.SetDeviceOpener(replay.Open)
+	}
+	if flags.record != "" {
+		if err := kalam.StartRecording(flags.record); err != nil {
+			fmt.Fprintf(os.Stderr, "kalam: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Ctrl-C cancels the running device operation
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+
+	client := kalam.NewClient()
+	code := runCLI(ctx, flags, client, os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	client.Close()
+	if flags.record != "" {
+		if err := kalam.StopRecording(); err != nil {
+			fmt.Fprintf(os.Stderr, "kalam: %v\n", err)
+		}
+	}
+	os.Exit(code)
+}
@@ -5,10 +5,10 @@ go 1.26.0
 require (
 	github.com/ganeshrvel/go-mtpfs v1.0.4-0.20240426083057-1c3302b3c476
 	github.com/ganeshrvel/go-mtpx v0.0.0-20240426092756-18f12db021cc
+	github.com/ganeshrvel/usb v0.0.0-20210103155855-14d96f5ae403
 )
 
 require (
-	github.com/ganeshrvel/usb v0.0.0-20210103155855-14d96f5ae403 // indirect
 	github.com/gopherjs/gopherjs v1.20.0 // indirect
 	github.com/smartystreets/goconvey v1.8.1 // indirect
 )
@@ -0,0 +1,201 @@
+package kalam
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/usb"
+)
+
+// BreakerState is the state of the circuit breaker in front of the device
+type BreakerState string
+
+const (
+	// BreakerClosed lets operations through
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen fails operations fast after Retry.MaxConsecutiveFailures failures in a row
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen is the state while a probe decides between closed and open
+	BreakerHalfOpen BreakerState = "halfOpen"
+)
+
+// ErrDeviceUnresponsive is returned without contacting the device while the circuit breaker is open
+var ErrDeviceUnresponsive = errors.New("device unresponsive")
+
+// circuitBreaker stops sending operations to a device that keeps failing
+// After Retry.BreakerCooldown the heartbeat probes the device, one answer closes the breaker again
+type circuitBreaker struct {
+	mu       sync.Mutex
+	serial   string
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	lastErr  error
+
+	// lastScan is reported by scans while the breaker is not closed
+	lastScan []DeviceJSON
+}
+
+// breaker guards the device behind the session
+var breaker = &circuitBreaker{state: BreakerClosed}
+
+// get returns the current state
+func (b *circuitBreaker) get() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// forDevice starts over when a session is opened with another device
+func (b *circuitBreaker) forDevice(serial string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.serial != serial {
+		b.serial = serial
+		b.lastScan = nil
+		b.reset()
+	}
+}
+
+// forget starts over without a device, e.g. when another opener is set
+func (b *circuitBreaker) forget() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.serial = ""
+	b.lastScan = nil
+	b.reset()
+}
+
+// rememberScan keeps the result of a successful scan and marks it with the breaker state
+func (b *circuitBreaker) rememberScan(devices []DeviceJSON) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i := range devices {
+		devices[i].Breaker = b.state
+	}
+	b.lastScan = append([]DeviceJSON(nil), devices...)
+}
+
+// scanWhileOpen returns the last scan marked with the breaker state, nil when there is none
+func (b *circuitBreaker) scanWhileOpen() []DeviceJSON {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.lastScan == nil {
+		return nil
+	}
+	devices := append([]DeviceJSON(nil), b.lastScan...)
+	for i := range devices {
+		devices[i].Breaker = b.state
+	}
+	return devices
+}
+
+// reset closes the breaker and forgets the failures, the caller holds b.mu
+func (b *circuitBreaker) reset() {
+	if b.state != BreakerClosed {
+		usbLog.Info("circuit breaker closed")
+	}
+	b.state = BreakerClosed
+	b.failures = 0
+	b.lastErr = nil
+}
+
+// allow returns ErrDeviceUnresponsive while the breaker is not closed
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerClosed {
+		return nil
+	}
+	return fmt.Errorf("%w: %d consecutive failures since %s, last: %v",
+		ErrDeviceUnresponsive, b.failures, b.openedAt.Format(time.TimeOnly), b.lastErr)
+}
+
+// record counts the outcome of an operation, errors that do not point at a stuck device are ignored
+func (b *circuitBreaker) record(err error) {
+	failed, answered := breakerOutcome(err)
+	if !failed && !answered {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != BreakerClosed {
+		return
+	}
+	if answered {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	b.lastErr = err
+	if max := cfg().Retry.MaxConsecutiveFailures; max > 0 && b.failures >= max {
+		b.open()
+	}
+}
+
+// open fails operations fast until the next probe, the caller holds b.mu
+func (b *circuitBreaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	usbLog.Warn("circuit breaker opened", "failures", b.failures, "error", b.lastErr)
+}
+
+// startProbe moves an open breaker to half-open once cooldown passed, the caller then probes the device
+func (b *circuitBreaker) startProbe(cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != BreakerOpen || time.Since(b.openedAt) < cooldown {
+		return false
+	}
+	b.state = BreakerHalfOpen
+	usbLog.Info("circuit breaker half-open, probing device")
+	return true
+}
+
+// probed closes the breaker when the probe succeeded and opens it for another cooldown otherwise
+func (b *circuitBreaker) probed(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != BreakerHalfOpen {
+		return
+	}
+	if err == nil {
+		b.reset()
+		return
+	}
+	b.lastErr = err
+	b.open()
+}
+
+// breakerOutcome tells failures of a stuck device from answers, anything else is neither
+// A device that left the bus is not stuck, the health monitor and reconnects handle it
+func breakerOutcome(err error) (failed, answered bool) {
+	var rc mtp.RCError
+	var usbErr usb.Error
+	var syncErr mtp.SyncError
+	switch {
+	case err == nil:
+		return false, true
+	case errors.Is(err, usb.ERROR_NO_DEVICE):
+		return false, false
+	case errors.As(err, &rc):
+		return rc == mtp.RCError(mtp.RC_DeviceBusy), rc != mtp.RCError(mtp.RC_DeviceBusy)
+	case errors.As(err, &usbErr), errors.As(err, &syncErr):
+		return true, false
+	default:
+		return false, false
+	}
+}
@@ -0,0 +1,123 @@
+package kalam
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/usb"
+)
+
+// useBreaker opens the circuit breaker after failures in a row and probes the device every few milliseconds
+func useBreaker(t *testing.T, failures int, cooldown time.Duration) {
+	useConfig(t, func(c *Config) {
+		c.Retry.MaxConsecutiveFailures = failures
+		c.Retry.BreakerCooldown = cooldown
+		c.Health.Interval = 10 * time.Millisecond
+	})
+}
+
+// waitForBreaker waits until the circuit breaker reaches state
+func waitForBreaker(t *testing.T, state BreakerState) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for breaker.get() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("circuit breaker is %s, expected %s", breaker.get(), state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBreakerFailsFast(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useBreaker(t, 2, time.Hour)
+	ctx := context.Background()
+
+	devices, err := client.Scan(ctx)
+	if err != nil || len(devices) != 1 || devices[0].Breaker != BreakerClosed {
+		t.Fatalf("Scan = %+v, %v", devices, err)
+	}
+
+	// Every attempt of a listing times out, the breaker counts the listings
+	sim.InjectFault(SimFault{Op: mtp.OC_GetObjectHandles, Err: usb.ERROR_TIMEOUT})
+	attempts := cfg().Retry.Metadata.Attempts
+	for i := 1; i <= 2; i++ {
+		if _, err := client.ListFiles(ctx, 65537, RootParentID); !errors.Is(err, usb.ERROR_TIMEOUT) {
+			t.Fatalf("listing %d: expected the timeout, got %v", i, err)
+		}
+		if calls := sim.Calls(mtp.OC_GetObjectHandles); calls != i*attempts {
+			t.Errorf("listing %d: expected every attempt to reach the device, got %d calls", i, calls)
+		}
+	}
+	if state := breaker.get(); state != BreakerOpen {
+		t.Fatalf("expected the breaker to open after 2 failed listings, it is %s", state)
+	}
+
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); !errors.Is(err, ErrDeviceUnresponsive) {
+		t.Fatalf("expected the open breaker to fail the listing, got %v", err)
+	}
+	if calls := sim.Calls(mtp.OC_GetObjectHandles); calls != 2*attempts {
+		t.Errorf("expected no calls while the breaker is open, got %d", calls-2*attempts)
+	}
+
+	devices, err = client.Scan(ctx)
+	if err != nil || len(devices) != 1 || devices[0].SerialNumber != "SIMDEMO01" || devices[0].Breaker != BreakerOpen {
+		t.Fatalf("expected the last scan with the open breaker, got %+v, %v", devices, err)
+	}
+}
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useBreaker(t, 1, 30*time.Millisecond)
+	ctx := context.Background()
+
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The device times out on everything, so the probes keep the breaker open
+	sim.InjectFault(SimFault{Err: usb.ERROR_TIMEOUT})
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); !errors.Is(err, usb.ERROR_TIMEOUT) {
+		t.Fatalf("expected the listing to time out, got %v", err)
+	}
+	if state := breaker.get(); state != BreakerOpen {
+		t.Fatalf("expected the breaker to open, it is %s", state)
+	}
+	probes := sim.Calls(mtp.OC_GetDeviceInfo)
+	time.Sleep(100 * time.Millisecond)
+	if sim.Calls(mtp.OC_GetDeviceInfo) == probes {
+		t.Fatalf("expected the breaker to probe the device after the cooldown")
+	}
+	if state := breaker.get(); state == BreakerClosed {
+		t.Fatalf("a failed probe closed the breaker")
+	}
+
+	sim.ClearFaults()
+	waitForBreaker(t, BreakerClosed)
+	if files, err := client.ListFiles(ctx, 65537, RootParentID); err != nil || len(files) != 3 {
+		t.Fatalf("ListFiles after the probe = %d files, %v", len(files), err)
+	}
+}
+
+func TestBreakerIgnoresAnswers(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useBreaker(t, 1, time.Hour)
+	ctx := context.Background()
+
+	// A response code is an answer, the device is not stuck
+	sim.InjectFault(SimFault{Op: mtp.OC_GetObjectHandles, Err: mtp.RCError(mtp.RC_InvalidStorageId), Times: 3})
+	for i := 0; i < 3; i++ {
+		if _, err := client.ListFiles(ctx, 65537, RootParentID); err == nil || errors.Is(err, ErrDeviceUnresponsive) {
+			t.Fatalf("expected the device error, got %v", err)
+		}
+	}
+	if state := breaker.get(); state != BreakerClosed {
+		t.Errorf("expected the breaker to stay closed, got %s", state)
+	}
+}
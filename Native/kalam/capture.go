@@ -0,0 +1,471 @@
+package kalam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/usb"
+)
+
+// CaptureEntry is one recorded MTP transaction, a capture file holds one JSON entry per line
+// Data phases are kept up to Config.Capture.MaxDataSize, the Size fields hold their full length
+type CaptureEntry struct {
+	Seq            int           `json:"seq"`
+	Time           time.Time     `json:"time"`
+	Duration       time.Duration `json:"durationNs"`
+	Op             uint16        `json:"op"`
+	OpName         string        `json:"opName"`
+	Params         []uint32      `json:"params,omitempty"`
+	DataOut        []byte        `json:"dataOut,omitempty"`
+	DataOutSize    int64         `json:"dataOutSize,omitempty"`
+	DataIn         []byte        `json:"dataIn,omitempty"`
+	DataInSize     int64         `json:"dataInSize,omitempty"`
+	Response       uint16        `json:"response,omitempty"`
+	ResponseName   string        `json:"responseName,omitempty"`
+	ResponseParams []uint32      `json:"responseParams,omitempty"`
+	Error          string        `json:"error,omitempty"`
+	ErrorKind      string        `json:"errorKind,omitempty"`
+	USBError       int           `json:"usbError,omitempty"`
+}
+
+// Error kinds of a CaptureEntry, replay turns them back into the matching error type
+const (
+	CaptureErrorRC    = "rc"
+	CaptureErrorUSB   = "usb"
+	CaptureErrorSync  = "sync"
+	CaptureErrorOther = "other"
+)
+
+// captureName names an operation or response code, unknown codes are printed in hex
+func captureName(names map[int]string, code uint16) string {
+	if name, ok := names[int(code)]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", code)
+}
+
+// setError stores the outcome of the transaction
+func (e *CaptureEntry) setError(err error) {
+	if err == nil {
+		if e.Response == 0 {
+			e.Response = mtp.RC_OK
+		}
+		e.ResponseName = captureName(mtp.RC_names, e.Response)
+		return
+	}
+
+	e.Error = err.Error()
+	e.ErrorKind = captureErrorKind(err)
+	var rc mtp.RCError
+	var usbErr usb.Error
+	switch {
+	case errors.As(err, &rc):
+		e.Response = uint16(rc)
+		e.ResponseName = captureName(mtp.RC_names, e.Response)
+	case errors.As(err, &usbErr):
+		e.USBError = int(usbErr)
+	}
+}
+
+// captureErrorKind classifies an error returned by a transaction
+func captureErrorKind(err error) string {
+	var rc mtp.RCError
+	var usbErr usb.Error
+	var syncErr mtp.SyncError
+	switch {
+	case errors.As(err, &rc):
+		return CaptureErrorRC
+	case errors.As(err, &usbErr):
+		return CaptureErrorUSB
+	case errors.As(err, &syncErr):
+		return CaptureErrorSync
+	default:
+		return CaptureErrorOther
+	}
+}
+
+// Err rebuilds the error returned by the recorded transaction
+func (e *CaptureEntry) Err() error {
+	switch e.ErrorKind {
+	case "":
+		return nil
+	case CaptureErrorRC:
+		return mtp.RCError(e.Response)
+	case CaptureErrorUSB:
+		return usb.Error(e.USBError)
+	case CaptureErrorSync:
+		return mtp.SyncError(e.Error)
+	default:
+		return errors.New(e.Error)
+	}
+}
+
+// captureBuffer keeps the start of a data phase and counts its full length
+type captureBuffer struct {
+	data []byte
+	size int64
+	max  int
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	if room := b.max - len(b.data); room > 0 {
+		b.data = append(b.data, p[:min(room, len(p))]...)
+	}
+	b.size += int64(len(p))
+	return len(p), nil
+}
+
+// -- Recording --
+
+// Recorder writes every transaction of the sessions it records to a capture
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	seq int
+	err error
+}
+
+// NewRecorder returns a recorder writing capture entries to w
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Opener wraps open so every session it opens is recorded, nil records the USB device
+func (r *Recorder) Opener(open DeviceOpener) DeviceOpener {
+	if open == nil {
+		open = openUSBDevice
+	}
+	return func() (Device, error) {
+		dev, err := open()
+		if err != nil {
+			return nil, err
+		}
+		d := &recordingDevice{dev: dev, rec: r}
+		d.run = d.RunTransaction
+		return d, nil
+	}
+}
+
+// Err returns the first error writing the capture
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// write numbers an entry and appends it to the capture
+func (r *Recorder) write(e *CaptureEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.seq++
+	e.Seq = r.seq
+	if r.err == nil {
+		r.err = r.enc.Encode(e)
+	}
+}
+
+var (
+	activeRecorder *Recorder
+	recordingFile  *os.File
+	recordingPrev  DeviceOpener
+	recordingMu    sync.Mutex
+)
+
+// StartRecording records every transaction with the device to a capture file at path
+// The open session is closed so the capture starts with a fresh session
+func StartRecording(path string) error {
+	recordingMu.Lock()
+	defer recordingMu.Unlock()
+
+	if activeRecorder != nil {
+		return fmt.Errorf("already recording to %s", recordingFile.Name())
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("cannot create capture file: %w", err)
+	}
+
+	var prev DeviceOpener
+	session.control(func() {
+		prev = openDevice
+	})
+
+	rec := NewRecorder(f)
+	SetDeviceOpener(rec.Opener(prev))
+	activeRecorder, recordingFile, recordingPrev = rec, f, prev
+
+	usbLog.Info("recording transactions", "path", path)
+	return nil
+}
+
+// StopRecording restores the device opener used before StartRecording and closes the capture file
+func StopRecording() error {
+	recordingMu.Lock()
+	defer recordingMu.Unlock()
+
+	if activeRecorder == nil {
+		return fmt.Errorf("not recording")
+	}
+
+	SetDeviceOpener(recordingPrev)
+	err := activeRecorder.Err()
+	if closeErr := recordingFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	activeRecorder.mu.Lock()
+	usbLog.Info("recording stopped", "path", recordingFile.Name(), "transactions", activeRecorder.seq)
+	activeRecorder.mu.Unlock()
+	activeRecorder, recordingFile, recordingPrev = nil, nil, nil
+	return err
+}
+
+// recordingDevice passes transactions on to dev and records them as they cross the wire
+// Dataset operations run as raw transactions, so a capture holds the bytes the device sent before anything decoded
+// them, also of transactions that failed half-way
+type recordingDevice struct {
+	transactionOps
+	dev Device
+	rec *Recorder
+}
+
+// begin starts the entry of a transaction
+func (d *recordingDevice) begin(op uint16, params ...uint32) *CaptureEntry {
+	return &CaptureEntry{
+		Time:   time.Now(),
+		Op:     op,
+		OpName: captureName(mtp.OC_names, op),
+		Params: params,
+	}
+}
+
+// buffer returns a buffer for a data phase
+func (d *recordingDevice) buffer() *captureBuffer {
+	return &captureBuffer{max: cfg().Capture.MaxDataSize}
+}
+
+// finish completes the entry with the outcome of the transaction and writes it
+// Operations on a closed session never reach the device and are not recorded, replay fails them itself
+func (d *recordingDevice) finish(e *CaptureEntry, err error) error {
+	if err != nil && strings.Contains(err.Error(), "device is not open") {
+		return err
+	}
+
+	e.Duration = time.Since(e.Time)
+	e.setError(err)
+	d.rec.write(e)
+	return err
+}
+
+// RunTransaction records a raw transaction with both data phases
+func (d *recordingDevice) RunTransaction(req *mtp.Container, rep *mtp.Container, dest io.Writer, src io.Reader, writeSize int64, progressCb mtp.ProgressFunc) error {
+	e := d.begin(req.Code, slices.Clone(req.Param)...)
+	in, out := d.buffer(), d.buffer()
+	if dest != nil {
+		dest = io.MultiWriter(dest, in)
+	}
+	if src != nil {
+		src = io.TeeReader(src, out)
+	}
+
+	err := d.dev.RunTransaction(req, rep, dest, src, writeSize, progressCb)
+	e.DataIn, e.DataInSize = in.data, in.size
+	e.DataOut, e.DataOutSize = out.data, out.size
+	e.Response = rep.Code
+	e.ResponseParams = slices.Clone(rep.Param)
+	return d.finish(e, err)
+}
+
+// SetTimeout sets the timeout of the recorded session
+func (d *recordingDevice) SetTimeout(timeout time.Duration) {
+	d.dev.SetTimeout(timeout)
+}
+
+// CloseSession records the end of the session
+func (d *recordingDevice) CloseSession() error {
+	e := d.begin(mtp.OC_CloseSession)
+	return d.finish(e, d.dev.CloseSession())
+}
+
+// ResetSession records the new session as an OpenSession
+func (d *recordingDevice) ResetSession() error {
+	e := d.begin(mtp.OC_OpenSession)
+	return d.finish(e, d.dev.ResetSession())
+}
+
+// DeviceReset passes on the reset events of the recorded device, if it reports them
+func (d *recordingDevice) DeviceReset() <-chan struct{} {
+	if n, ok := d.dev.(resetNotifier); ok {
+		return n.DeviceReset()
+	}
+	return nil
+}
+
+// Close closes the recorded session
+func (d *recordingDevice) Close() error {
+	return d.dev.Close()
+}
+
+// -- Replay --
+
+// Replay is a device that answers with the transactions of a capture
+// Each transaction gets the first unused recorded one with the same operation and parameters,
+// so a capture from a user's phone becomes a deterministic regression test
+type Replay struct {
+	mu      sync.Mutex
+	entries []CaptureEntry
+	used    []bool
+}
+
+// ReadCapture reads the entries of a capture
+func ReadCapture(r io.Reader) ([]CaptureEntry, error) {
+	var entries []CaptureEntry
+	dec := json.NewDecoder(r)
+	for {
+		var e CaptureEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid capture entry %d: %w", len(entries)+1, err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+// NewReplay returns a replay of entries
+func NewReplay(entries []CaptureEntry) *Replay {
+	return &Replay{entries: entries, used: make([]bool, len(entries))}
+}
+
+// LoadReplay returns a replay of the capture file at path
+func LoadReplay(path string) (*Replay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open capture file: %w", err)
+	}
+	defer f.Close()
+
+	entries, err := ReadCapture(f)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplay(entries), nil
+}
+
+// Open opens a session answered from the capture, it is a DeviceOpener
+func (r *Replay) Open() (Device, error) {
+	s := &replaySession{replay: r}
+	s.run = s.RunTransaction
+	return s, nil
+}
+
+// Unused returns the recorded transactions that were not replayed
+func (r *Replay) Unused() []CaptureEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var unused []CaptureEntry
+	for i, e := range r.entries {
+		if !r.used[i] {
+			unused = append(unused, e)
+		}
+	}
+	return unused
+}
+
+// next takes the recorded answer to a transaction
+func (r *Replay) next(op uint16, params []uint32) (*CaptureEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.entries {
+		if !r.used[i] && r.entries[i].Op == op && slices.Equal(r.entries[i].Params, params) {
+			r.used[i] = true
+			return &r.entries[i], nil
+		}
+	}
+	return nil, fmt.Errorf("replay: %s %v was not recorded", captureName(mtp.OC_names, op), params)
+}
+
+// replaySession is an open session with a Replay
+type replaySession struct {
+	transactionOps
+	replay *Replay
+	closed atomic.Bool
+}
+
+// RunTransaction answers a transaction with its recorded data phase, response and error
+func (s *replaySession) RunTransaction(req *mtp.Container, rep *mtp.Container, dest io.Writer, src io.Reader, writeSize int64, progressCb mtp.ProgressFunc) error {
+	if s.closed.Load() {
+		return fmt.Errorf("mtp: cannot run operation %v, device is not open", mtp.OC_names[int(req.Code)])
+	}
+
+	e, err := s.replay.next(req.Code, req.Param)
+	if err != nil {
+		return err
+	}
+
+	if src != nil {
+		n, _ := io.Copy(io.Discard, io.LimitReader(src, writeSize))
+		if progressCb != nil && n > 0 {
+			if err := progressCb(n); err != nil {
+				return err
+			}
+		}
+	}
+
+	if dest != nil && e.DataInSize > 0 {
+		if _, err := dest.Write(e.DataIn); err != nil {
+			return err
+		}
+		// Data beyond the recorded limit is replayed as zeros
+		if pad := e.DataInSize - int64(len(e.DataIn)); pad > 0 {
+			if _, err := io.CopyN(dest, zeroReader{}, pad); err != nil {
+				return err
+			}
+		}
+		if progressCb != nil {
+			if err := progressCb(e.DataInSize); err != nil {
+				return err
+			}
+		}
+	}
+
+	rep.Code = e.Response
+	rep.Param = slices.Clone(e.ResponseParams)
+	rep.SessionID, rep.TransactionID = req.SessionID, req.TransactionID
+
+	// mtp.Device closes the connection after USB and sync errors
+	if e.ErrorKind == CaptureErrorUSB || e.ErrorKind == CaptureErrorSync {
+		s.Close()
+	}
+	return e.Err()
+}
+
+// zeroReader reads zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// SetTimeout does nothing, replayed transactions answer immediately
+func (s *replaySession) SetTimeout(timeout time.Duration) {}
+
+// Close ends the session
+func (s *replaySession) Close() error {
+	s.closed.Store(true)
+	return nil
+}
@@ -0,0 +1,167 @@
+package kalam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/usb"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	ctx := context.Background()
+
+	var capture bytes.Buffer
+	SetDeviceOpener(NewRecorder(&capture).Opener(sim.Open))
+	sim.InjectFault(SimFault{Op: mtp.OC_DeleteObject, Err: mtp.RCError(mtp.RC_ObjectWriteProtected)})
+
+	// run is the session replayed below, it returns everything the bridge saw
+	run := func() []interface{} {
+		dir := t.TempDir()
+		files, filesErr := client.ListFiles(ctx, 65537, RootParentID)
+		storages, storagesErr := client.ListStorages(ctx)
+		downloadErr := client.DownloadFile(ctx, 4, filepath.Join(dir, "IMG_0002.jpg"))
+		data, _ := os.ReadFile(filepath.Join(dir, "IMG_0002.jpg"))
+		part, partErr := client.ReadRange(ctx, 4, 10, 20)
+		deleteErr := client.DeleteObject(ctx, 1)
+		return []interface{}{files, filesErr, storages, storagesErr, downloadErr, data, part, partErr, deleteErr}
+	}
+
+	recorded := run()
+	if !errors.Is(recorded[8].(error), mtp.RCError(mtp.RC_ObjectWriteProtected)) {
+		t.Fatalf("expected the injected fault to be recorded, got %v", recorded[8])
+	}
+
+	entries, err := ReadCapture(&capture)
+	if err != nil || len(entries) == 0 {
+		t.Fatalf("ReadCapture = %d entries, %v", len(entries), err)
+	}
+	if e := entries[0]; e.Seq != 1 || e.OpName != "GetDeviceInfo" || e.ResponseName != "OK" || len(e.DataIn) == 0 {
+		t.Fatalf("unexpected first entry %+v", e)
+	}
+
+	replay := NewReplay(entries)
+	SetDeviceOpener(replay.Open)
+	replayed := run()
+
+	for i := range recorded {
+		if e, ok := recorded[i].(error); ok {
+			if r, _ := replayed[i].(error); r == nil || r.Error() != e.Error() {
+				t.Errorf("result %d: recorded error %v, replayed %v", i, e, replayed[i])
+			}
+			continue
+		}
+		if !reflect.DeepEqual(recorded[i], replayed[i]) {
+			t.Errorf("result %d: recorded %+v, replayed %+v", i, recorded[i], replayed[i])
+		}
+	}
+	if unused := replay.Unused(); len(unused) != 0 {
+		t.Errorf("expected the whole capture to be replayed, %d entries left, first %+v", len(unused), unused[0])
+	}
+}
+
+func TestReplayUnrecordedTransaction(t *testing.T) {
+	client := useSimDevice(t, NewSimDevice())
+	SetDeviceOpener(NewReplay(nil).Open)
+
+	_, err := client.ListStorages(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "was not recorded") {
+		t.Fatalf("expected an unrecorded transaction error, got %v", err)
+	}
+}
+
+func TestReplayTruncatedData(t *testing.T) {
+	replay := NewReplay([]CaptureEntry{{Op: mtp.OC_GetObject, Params: []uint32{7}, DataIn: []byte("abc"), DataInSize: 5, Response: mtp.RC_OK}})
+	dev, _ := replay.Open()
+
+	var buf bytes.Buffer
+	if err := dev.GetObject(7, &buf, mtp.EmptyProgressFunc); err != nil || buf.String() != "abc\x00\x00" {
+		t.Fatalf("GetObject = %q, %v", buf.String(), err)
+	}
+	if err := dev.GetObject(7, &buf, mtp.EmptyProgressFunc); err == nil {
+		t.Fatalf("expected the entry to be used only once")
+	}
+}
+
+func TestCaptureEntryErrors(t *testing.T) {
+	for _, err := range []error{
+		mtp.RCError(mtp.RC_DeviceBusy),
+		usb.ERROR_TIMEOUT,
+		mtp.SyncError("transaction ID mismatch"),
+		errors.New("short read"),
+	} {
+		var e CaptureEntry
+		e.setError(err)
+		if got := e.Err(); reflect.TypeOf(got) != reflect.TypeOf(err) || got.Error() != err.Error() {
+			t.Errorf("%v (%T) replays as %v (%T)", err, err, got, got)
+		}
+	}
+
+	var ok CaptureEntry
+	ok.setError(nil)
+	if ok.Err() != nil || ok.Response != mtp.RC_OK {
+		t.Errorf("successful entry = %+v", ok)
+	}
+}
+
+func TestStartRecording(t *testing.T) {
+	client := useSimDevice(t, NewDemoDevice())
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+
+	if err := StartRecording(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartRecording(path); err == nil {
+		t.Fatalf("expected a second recording to be refused")
+	}
+	if _, err := client.ListStorages(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := StopRecording(); err != nil {
+		t.Fatal(err)
+	}
+	if err := StopRecording(); err == nil {
+		t.Fatalf("expected StopRecording to fail when not recording")
+	}
+
+	replay, err := LoadReplay(path)
+	if err != nil || len(replay.Unused()) == 0 {
+		t.Fatalf("LoadReplay = %v", err)
+	}
+
+	// The simulated device is used again after recording
+	if _, err := client.ListStorages(context.Background()); err != nil {
+		t.Fatalf("ListStorages after recording failed: %v", err)
+	}
+}
+
+func TestRecordUndecodableDataset(t *testing.T) {
+	// A device answering with a dataset the bridge cannot decode is exactly what a capture is for
+	replay := NewReplay([]CaptureEntry{{Op: mtp.OC_GetStorageIDs, DataIn: []byte{0xff}, DataInSize: 1, Response: mtp.RC_OK}})
+
+	var capture bytes.Buffer
+	dev, err := NewRecorder(&capture).Opener(replay.Open)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids mtp.Uint32Array
+	if err := dev.GetStorageIDs(&ids); err == nil {
+		t.Fatalf("expected the truncated dataset not to decode")
+	}
+
+	entries, err := ReadCapture(&capture)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("ReadCapture = %+v, %v", entries, err)
+	}
+	if e := entries[0]; !bytes.Equal(e.DataIn, []byte{0xff}) || e.ResponseName != "OK" || e.Error != "" {
+		t.Fatalf("recorded %+v, want the raw data phase and the device's OK", e)
+	}
+}
@@ -0,0 +1,134 @@
+// Package kalam talks to MTP devices over USB
+// The C bridge, the HTTP/WebDAV gateway and the command-line tool are all built on Client
+package kalam
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// Client is a handle on the bridge, which is a process-wide singleton
+// All clients share the device opener, the configuration and the one device session their operations are queued on,
+// so Close, Shutdown and Eject on any client act on every client in the process
+// The session goroutine starts with the first operation, or with Open
+type Client struct{}
+
+// NewClient returns a handle on the bridge, it does not start the session goroutine
+func NewClient() *Client {
+	return &Client{}
+}
+
+// Open starts the session goroutine, also allowing device operations again after Close or Shutdown
+func (c *Client) Open() {
+	operations.mu.Lock()
+	operations.shutdown = false
+	operations.mu.Unlock()
+	session.start()
+}
+
+// Close cancels the running operations, waits for the running device transaction and closes the device session
+// Operations started after Close fail until Open is called, on every client of the process
+func (c *Client) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Shutdown(ctx)
+	return nil
+}
+
+// Scan detects the connected device and its storages
+func (c *Client) Scan(ctx context.Context) ([]DeviceJSON, error) {
+	return deviceMgr.Scan(ctx)
+}
+
+// ListStorages lists the storages of the connected device
+func (c *Client) ListStorages(ctx context.Context) ([]StorageJSON, error) {
+	storages, err := deviceMgr.GetStorages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []StorageJSON{}
+	for _, s := range storages {
+		result = append(result, StorageJSON{
+			ID:          s.Sid,
+			Description: s.Info.StorageDescription,
+			FreeSpace:   s.Info.FreeSpaceInBytes,
+			MaxCapacity: s.Info.MaxCapability,
+		})
+	}
+	return result, nil
+}
+
+// ListFiles lists files in a directory
+func (c *Client) ListFiles(ctx context.Context, storageID StorageID, parentID ParentID) ([]FileJSON, error) {
+	if err := storageID.Validate(); err != nil {
+		return nil, err
+	}
+	if err := parentID.Validate(); err != nil {
+		return nil, err
+	}
+	return fileSystemMgr.ListFiles(ctx, storageID, parentID)
+}
+
+// CreateFolder creates a new folder
+func (c *Client) CreateFolder(ctx context.Context, storageID StorageID, parentID ParentID, name string) (ObjectID, error) {
+	if err := storageID.Validate(); err != nil {
+		return 0, err
+	}
+	if err := parentID.Validate(); err != nil {
+		return 0, err
+	}
+	return fileSystemMgr.CreateFolder(ctx, storageID, parentID, name)
+}
+
+// DeleteObject deletes a file or folder
+func (c *Client) DeleteObject(ctx context.Context, objectID ObjectID) error {
+	if err := objectID.Validate(); err != nil {
+		return err
+	}
+	return fileSystemMgr.DeleteObject(ctx, objectID)
+}
+
+// RenameObject renames a file or folder
+func (c *Client) RenameObject(ctx context.Context, objectID ObjectID, newName string) error {
+	if err := objectID.Validate(); err != nil {
+		return err
+	}
+	return fileSystemMgr.RenameObject(ctx, objectID, newName)
+}
+
+// MoveObject moves a file or folder to another parent, possibly on another storage
+func (c *Client) MoveObject(ctx context.Context, objectID ObjectID, storageID StorageID, parentID ParentID) error {
+	if err := objectID.Validate(); err != nil {
+		return err
+	}
+	if err := storageID.Validate(); err != nil {
+		return err
+	}
+	if err := parentID.Validate(); err != nil {
+		return err
+	}
+	return fileSystemMgr.MoveObject(ctx, objectID, storageID, parentID)
+}
+
+// RefreshStorage re-reads storage info so the device drops stale caches
+func (c *Client) RefreshStorage(ctx context.Context, storageID StorageID) error {
+	if err := storageID.Validate(); err != nil {
+		return err
+	}
+	return fileSystemMgr.RefreshStorage(ctx, storageID)
+}
+
+// ResetDeviceCache checks the session is alive so a stale one is replaced, the next scan asks the device again
+func (c *Client) ResetDeviceCache(ctx context.Context) error {
+	scans.forget()
+	return withDevice(ctx, func(dev Device) error {
+		var info mtp.DeviceInfo
+		if err := dev.GetDeviceInfo(&info); err != nil {
+			return fmt.Errorf("GetDeviceInfo failed: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,417 @@
+package kalam
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds all configuration settings as a single source of truth
+type Config struct {
+	// Timeout settings (milliseconds)
+	Timeouts struct {
+		QuickScan         time.Duration
+		NormalOperation   time.Duration
+		LargeFileDownload time.Duration
+	}
+
+	// Security settings
+	Security struct {
+		MaxPathLength       int
+		MaxCStringSize      int
+		MaxFolderNameLength int
+	}
+
+	// Device session settings, the session is closed after EntryTTL without operations
+	Pool struct {
+		EntryTTL    time.Duration
+		CleanupTick time.Duration
+	}
+
+	// Shared mode settings, when enabled the device is released to other processes after IdleRelease without operations
+	Shared struct {
+		Enabled     bool
+		IdleRelease time.Duration
+	}
+
+	// Device health settings, an idle session is probed every Interval
+	Health struct {
+		Interval time.Duration
+		Timeout  time.Duration
+	}
+
+	// Reconnect settings, operations wait up to GracePeriod for a device that dropped off the bus, 0 disables waiting
+	Reconnect struct {
+		GracePeriod time.Duration
+	}
+
+	// File size limits
+	FileSize struct {
+		LargeThreshold int64
+		MaxSize        int64
+	}
+
+	// Download settings
+	Download struct {
+		DefaultDir string
+	}
+
+	// Retry settings, a policy per operation class and the circuit breaker
+	Retry struct {
+		Scan     RetryPolicy
+		Metadata RetryPolicy
+		Transfer RetryPolicy
+		Mutation RetryPolicy
+
+		MaxConsecutiveFailures int
+		BreakerCooldown        time.Duration
+	}
+
+	// Thumbnail settings
+	Thumbnail struct {
+		PartialReadSize    uint32
+		MaxPartialReadSize uint32
+	}
+
+	// Stream settings
+	Stream struct {
+		ChunkSize uint32
+	}
+
+	// HTTP server settings
+	HTTP struct {
+		DefaultAddr string
+		Metrics     bool
+	}
+
+	// Capture settings
+	Capture struct {
+		MaxDataSize int
+	}
+
+	// Logging settings
+	Logging struct {
+		RingSize    int
+		MaxFileSize int64
+		MaxBackups  int
+	}
+}
+
+// DefaultConfig returns the default configuration
+func DefaultConfig() *Config {
+	c := &Config{}
+
+	// Timeout settings
+	c.Timeouts.QuickScan = 5 * time.Second
+	c.Timeouts.NormalOperation = 45 * time.Second
+	c.Timeouts.LargeFileDownload = 5 * time.Minute
+
+	// Security settings
+	c.Security.MaxPathLength = 4096
+	c.Security.MaxCStringSize = 1024 * 1024
+	c.Security.MaxFolderNameLength = 255
+
+	// Device session settings
+	c.Pool.EntryTTL = 2 * time.Minute
+	c.Pool.CleanupTick = 1 * time.Minute
+
+	// Shared mode settings
+	c.Shared.Enabled = false
+	c.Shared.IdleRelease = 10 * time.Second
+
+	// Device health settings
+	c.Health.Interval = 5 * time.Second
+	c.Health.Timeout = 2 * time.Second
+
+	// Reconnect settings
+	c.Reconnect.GracePeriod = 30 * time.Second
+
+	// File size limits
+	c.FileSize.LargeThreshold = 100 * 1024 * 1024 // 100MB
+	c.FileSize.MaxSize = 10 * 1024 * 1024 * 1024  // 10GB
+
+	// Download settings
+	c.Download.DefaultDir = getDefaultDownloadDir()
+
+	// Retry settings
+	c.Retry.Scan = RetryPolicy{Attempts: 1, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second, JitterPercent: 20}
+	c.Retry.Metadata = RetryPolicy{Attempts: 3, BaseDelay: 500 * time.Millisecond, MaxDelay: 2 * time.Second, JitterPercent: 20}
+	c.Retry.Transfer = RetryPolicy{Attempts: 3, BaseDelay: time.Second, MaxDelay: 4 * time.Second, JitterPercent: 20}
+	c.Retry.Mutation = RetryPolicy{Attempts: 2, BaseDelay: 500 * time.Millisecond, MaxDelay: 2 * time.Second, JitterPercent: 20}
+	c.Retry.MaxConsecutiveFailures = 3
+	c.Retry.BreakerCooldown = 15 * time.Second
+
+	// Thumbnail settings
+	c.Thumbnail.PartialReadSize = 64 * 1024     // 64KB
+	c.Thumbnail.MaxPartialReadSize = 128 * 1024 // 128KB
+
+	// Stream settings
+	c.Stream.ChunkSize = 1024 * 1024 // 1MB
+
+	// HTTP server settings
+	c.HTTP.DefaultAddr = "127.0.0.1:8765"
+	c.HTTP.Metrics = true // Prometheus text on /metrics
+
+	// Capture settings
+	c.Capture.MaxDataSize = 1024 * 1024 // 1MB per data phase
+
+	// Logging settings
+	c.Logging.RingSize = 1000
+	c.Logging.MaxFileSize = 10 * 1024 * 1024 // 10MB
+	c.Logging.MaxBackups = 3
+
+	return c
+}
+
+// LoadConfig returns the default configuration overridden by the file named in KALAM_CONFIG, if set,
+// and then by KALAM_* environment variables such as KALAM_POOL_ENTRY_TTL=5m
+func LoadConfig() (*Config, error) {
+	c := DefaultConfig()
+
+	// DOWNLOAD_DIR predates the KALAM_* variables and is still honoured
+	if dir := os.Getenv("DOWNLOAD_DIR"); dir != "" {
+		c.Download.DefaultDir = dir
+	}
+
+	if path := os.Getenv(ConfigFileEnv); path != "" {
+		if err := c.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.LoadEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// activeConfig is the configuration in use, SetConfig replaces it as a whole so readers never see a partial update
+var activeConfig atomic.Pointer[Config]
+
+// configLoaded is initialized with the package variables, so the configuration is in place before any init function
+var configLoaded = loadActiveConfig()
+
+// loadActiveConfig stores the startup configuration, an invalid one falls back to the defaults
+func loadActiveConfig() bool {
+	activeConfig.Store(DefaultConfig())
+
+	loaded, err := LoadConfig()
+	if err != nil {
+		bridgeLog.Warn("invalid configuration, using defaults", "error", err)
+		return false
+	}
+	activeConfig.Store(loaded)
+	return true
+}
+
+// cfg returns the configuration in use, callers must not modify it
+func cfg() *Config {
+	return activeConfig.Load()
+}
+
+// CurrentConfig returns a copy of the configuration used by the package
+func CurrentConfig() *Config {
+	c := *cfg()
+	return &c
+}
+
+// SetConfig validates c and makes it the configuration of the package
+// Operations already running keep the settings they started with, the session timers follow the new settings
+func SetConfig(c *Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	next := *c
+	prev := activeConfig.Swap(&next)
+	if prev.Pool.CleanupTick != next.Pool.CleanupTick || prev.Health.Interval != next.Health.Interval {
+		notifySessionConfig()
+	}
+
+	bridgeLog.Info("configuration updated")
+	return nil
+}
+
+// Validate checks that the settings are usable
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Timeouts.QuickScan > 0, "timeouts.quickScan must be positive")
+	check(c.Timeouts.NormalOperation > 0, "timeouts.normalOperation must be positive")
+	check(c.Timeouts.LargeFileDownload > 0, "timeouts.largeFileDownload must be positive")
+	for _, class := range OperationClasses {
+		p, section := c.retryPolicy(class), "retry."+string(class)
+		check(p.Attempts >= 1, "%s.attempts must be at least 1", section)
+		check(p.BaseDelay >= 0, "%s.baseDelay must not be negative", section)
+		check(p.MaxDelay >= p.BaseDelay, "%s.maxDelay must not be below %s.baseDelay", section, section)
+		check(p.JitterPercent >= 0 && p.JitterPercent <= 100, "%s.jitterPercent must be between 0 and 100", section)
+	}
+	check(c.Security.MaxPathLength > 0, "security.maxPathLength must be positive")
+	check(c.Security.MaxCStringSize > 0, "security.maxCStringSize must be positive")
+	check(c.Security.MaxFolderNameLength > 0, "security.maxFolderNameLength must be positive")
+	check(c.Pool.EntryTTL > 0, "pool.entryTTL must be positive")
+	check(c.Pool.CleanupTick > 0, "pool.cleanupTick must be positive")
+	check(c.Shared.IdleRelease > 0, "shared.idleRelease must be positive")
+	check(c.Health.Interval > 0, "health.interval must be positive")
+	check(c.Health.Timeout > 0, "health.timeout must be positive")
+	check(c.Reconnect.GracePeriod >= 0, "reconnect.gracePeriod must not be negative")
+	check(c.FileSize.LargeThreshold > 0, "fileSize.largeThreshold must be positive")
+	check(c.FileSize.MaxSize >= c.FileSize.LargeThreshold, "fileSize.maxSize must not be below fileSize.largeThreshold")
+	check(c.Download.DefaultDir != "", "download.defaultDir must not be empty")
+	check(c.Retry.MaxConsecutiveFailures >= 0, "retry.maxConsecutiveFailures must not be negative")
+	check(c.Retry.BreakerCooldown > 0, "retry.breakerCooldown must be positive")
+	check(c.Thumbnail.PartialReadSize > 0, "thumbnail.partialReadSize must be positive")
+	check(c.Thumbnail.MaxPartialReadSize >= c.Thumbnail.PartialReadSize, "thumbnail.maxPartialReadSize must not be below thumbnail.partialReadSize")
+	check(c.Stream.ChunkSize > 0, "stream.chunkSize must be positive")
+	check(c.HTTP.DefaultAddr != "", "http.defaultAddr must not be empty")
+	check(c.Capture.MaxDataSize >= 0, "capture.maxDataSize must not be negative")
+	check(c.Logging.RingSize >= 0, "logging.ringSize must not be negative")
+	check(c.Logging.MaxFileSize >= 0, "logging.maxFileSize must not be negative")
+	check(c.Logging.MaxBackups >= 0, "logging.maxBackups must not be negative")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// getDefaultDownloadDir returns the default download directory for the current user
+func getDefaultDownloadDir() string {
+	// Try from environment variable first
+	if dir := os.Getenv("DOWNLOAD_DIR"); dir != "" {
+		return dir
+	}
+
+	// Get user's home directory
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		bridgeLog.Warn("failed to get home directory", "error", err)
+		return "/tmp"
+	}
+
+	// Return Downloads directory
+	return filepath.Join(homeDir, "Downloads")
+}
+
+// MARK: - Path Security Validation
+
+// validateAndCleanPath validates and cleans the path to prevent path traversal attacks
+func validateAndCleanPath(path string, allowedBaseDir string) (string, error) {
+	// 1. Validate path length
+	if len(path) == 0 {
+		return "", fmt.Errorf("path cannot be empty")
+	}
+
+	if len(path) > cfg().Security.MaxPathLength {
+		return "", fmt.Errorf("path exceeds maximum length of %d", cfg().Security.MaxPathLength)
+	}
+
+	// 2. Check for dangerous characters
+	dangerousChars := []string{"\x00", "\n", "\r", "\t"}
+	for _, char := range dangerousChars {
+		if strings.Contains(path, char) {
+			return "", fmt.Errorf("path contains invalid character")
+		}
+	}
+
+	// 3. Clean the path
+	cleanPath := filepath.Clean(path)
+
+	// 4. Resolve to absolute path
+	absPath, err := filepath.Abs(cleanPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	// 5. Check if path is within allowed directory
+	allowedAbs, err := filepath.Abs(allowedBaseDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to get allowed base dir: %w", err)
+	}
+
+	relPath, err := filepath.Rel(allowedAbs, absPath)
+	if err != nil {
+		return "", fmt.Errorf("path is not relative to allowed dir: %w", err)
+	}
+
+	// 6. Check if path contains ".."
+	if strings.Contains(relPath, "..") {
+		return "", fmt.Errorf("path contains parent directory references")
+	}
+
+	// 7. Check if path starts with ".."
+	if strings.HasPrefix(relPath, "..") {
+		return "", fmt.Errorf("path starts with parent directory reference")
+	}
+
+	return absPath, nil
+}
+
+// ValidateDestinationPath validates a host path chosen by the user as a write target
+// No directory restriction is applied since the location comes from NSSavePanel
+func ValidateDestinationPath(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("destination path cannot be empty")
+	}
+
+	cleanPath := filepath.Clean(path)
+
+	// Check for path traversal attempts
+	if strings.Contains(cleanPath, "..") {
+		return "", fmt.Errorf("path contains traversal attempt: %s", path)
+	}
+
+	// Ensure path is absolute
+	if !filepath.IsAbs(cleanPath) {
+		return "", fmt.Errorf("path must be absolute: %s", path)
+	}
+
+	return cleanPath, nil
+}
+
+// validateObjectName validates a file or folder name created on the device
+func validateObjectName(name string) error {
+	if name == "" {
+		return fmt.Errorf("name cannot be empty")
+	}
+
+	if len(name) > cfg().Security.MaxFolderNameLength {
+		return fmt.Errorf("name too long (%d chars)", len(name))
+	}
+
+	if name == "." || name == ".." {
+		return fmt.Errorf("invalid name: %s", name)
+	}
+
+	invalidChars := []string{"/", "\\", ":", "*", "?", "\"", "<", ">", "|", "\x00"}
+	for _, char := range invalidChars {
+		if strings.Contains(name, char) {
+			return fmt.Errorf("name contains invalid character: %q", char)
+		}
+	}
+
+	return nil
+}
+
+// MTP object formats
+const (
+	// Folder format
+	ObjectFormatFolder = 0x3001
+	// Generic file format
+	ObjectFormatGenericFile = 0x3000
+)
+
+// Helper function
+func containsIgnoreCase(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
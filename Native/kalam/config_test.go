@@ -0,0 +1,171 @@
+package kalam
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useConfig changes the configuration for the duration of a test
+func useConfig(t *testing.T, change func(c *Config)) {
+	t.Helper()
+
+	prev := cfg()
+	next := *prev
+	change(&next)
+	activeConfig.Store(&next)
+	notifySessionConfig()
+	t.Cleanup(func() {
+		activeConfig.Store(prev)
+		notifySessionConfig()
+	})
+}
+
+func TestConfigLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "kalam.json")
+	tomlPath := filepath.Join(dir, "kalam.toml")
+	os.WriteFile(jsonPath, []byte(`{"pool": {"entryTTL": "30s", "cleanupTick": "10s"}, "http": {"metrics": false}, "retry": {"scan": {"attempts": 2}}}`), 0600)
+	os.WriteFile(tomlPath, []byte(`# overrides
+[timeouts]
+normalOperation = "10s" # per transfer
+
+[fileSize]
+largeThreshold = 50_000_000
+
+[download]
+defaultDir = '/tmp/kalam # downloads'
+
+[retry.transfer]
+attempts = 5
+
+[retry]
+mutation.maxDelay = "3s"
+`), 0600)
+
+	c := DefaultConfig()
+	if err := c.LoadFile(jsonPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LoadFile(tomlPath); err != nil {
+		t.Fatal(err)
+	}
+	if c.Pool.CleanupTick != 10*time.Second || c.Pool.EntryTTL != 30*time.Second || c.HTTP.Metrics {
+		t.Errorf("JSON settings not applied: %+v %+v", c.Pool, c.HTTP)
+	}
+	if c.Timeouts.NormalOperation != 10*time.Second || c.FileSize.LargeThreshold != 50000000 || c.Download.DefaultDir != "/tmp/kalam # downloads" {
+		t.Errorf("TOML settings not applied: %+v %+v %+v", c.Timeouts, c.FileSize, c.Download)
+	}
+	if c.Retry.Scan.Attempts != 2 || c.Retry.Transfer.Attempts != 5 || c.Retry.Mutation.MaxDelay != 3*time.Second {
+		t.Errorf("retry policies not applied: %+v %+v %+v", c.Retry.Scan, c.Retry.Transfer, c.Retry.Mutation)
+	}
+	if c.Retry.Metadata != DefaultConfig().Retry.Metadata {
+		t.Errorf("settings missing from the files should keep their value")
+	}
+
+	os.WriteFile(jsonPath, []byte(`{"pool": {"entryTTLs": "5s"}}`), 0600)
+	if err := c.LoadFile(jsonPath); err == nil || !strings.Contains(err.Error(), "unknown setting") {
+		t.Errorf("expected an unknown setting to be rejected, got %v", err)
+	}
+}
+
+func TestConfigLoadEnv(t *testing.T) {
+	c := DefaultConfig()
+	err := c.LoadEnv([]string{"KALAM_POOL_ENTRY_TTL=5m", "KALAM_SECURITY_MAX_C_STRING_SIZE=2048", "KALAM_HTTP_DEFAULT_ADDR=127.0.0.1:9000", "KALAM_RETRY_SCAN_ATTEMPTS=4", "PATH=/bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Pool.EntryTTL != 5*time.Minute || c.Security.MaxCStringSize != 2048 || c.HTTP.DefaultAddr != "127.0.0.1:9000" || c.Retry.Scan.Attempts != 4 {
+		t.Errorf("environment not applied: %+v %+v %+v %+v", c.Pool, c.Security, c.HTTP, c.Retry.Scan)
+	}
+
+	if err := c.LoadEnv([]string{"KALAM_RETRY_TRANSFER_ATTEMPTS=many"}); err == nil || !strings.Contains(err.Error(), "KALAM_RETRY_TRANSFER_ATTEMPTS") {
+		t.Errorf("expected an invalid value to name its variable, got %v", err)
+	}
+}
+
+func TestConfigJSON(t *testing.T) {
+	data, err := json.Marshal(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"normalOperation":"45s"`) || !strings.Contains(string(data), `"maxCStringSize":1048576`) || !strings.Contains(string(data), `"scan":{"attempts":1,`) {
+		t.Errorf("unexpected JSON %s", data)
+	}
+
+	c := DefaultConfig()
+	c.Pool.EntryTTL = time.Hour
+	if err := json.Unmarshal(data, c); err != nil {
+		t.Fatal(err)
+	}
+	if *c != *DefaultConfig() {
+		t.Errorf("JSON round trip changed the configuration")
+	}
+
+	if err := json.Unmarshal([]byte(`{"stream": {"chunkSize": "big"}}`), c); err == nil {
+		t.Errorf("expected an invalid value to be rejected")
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	useConfig(t, func(c *Config) {})
+
+	invalid := CurrentConfig()
+	invalid.Pool.CleanupTick = 0
+	invalid.Retry.Transfer.Attempts = 0
+	if err := SetConfig(invalid); err == nil || !strings.Contains(err.Error(), "pool.cleanupTick") || !strings.Contains(err.Error(), "retry.transfer.attempts") {
+		t.Fatalf("expected validation errors, got %v", err)
+	}
+
+	next := CurrentConfig()
+	next.Pool.CleanupTick = time.Hour
+	next.Retry.Transfer.Attempts = 5
+	if err := SetConfig(next); err != nil {
+		t.Fatal(err)
+	}
+	next.Retry.Transfer.Attempts = 7
+	if got := CurrentConfig().Retry.Transfer.Attempts; got != 5 {
+		t.Errorf("SetConfig should keep its own copy, got %d retries", got)
+	}
+}
+
+func TestContainsIgnoreCase(t *testing.T) {
+	if !containsIgnoreCase("Samsung Galaxy", "samsung") {
+		t.Fatalf("expected case-insensitive match")
+	}
+	if containsIgnoreCase("Pixel", "iphone") {
+		t.Fatalf("unexpected match")
+	}
+}
+
+func TestValidateAndCleanPath(t *testing.T) {
+	baseDir := t.TempDir()
+	validPath := filepath.Join(baseDir, "sub", "file.txt")
+
+	got, err := validateAndCleanPath(validPath, baseDir)
+	if err != nil {
+		t.Fatalf("validateAndCleanPath(valid) returned error: %v", err)
+	}
+	expected, err := filepath.Abs(validPath)
+	if err != nil {
+		t.Fatalf("filepath.Abs failed: %v", err)
+	}
+	if got != expected {
+		t.Fatalf("validateAndCleanPath(valid) = %q, want %q", got, expected)
+	}
+
+	if _, err := validateAndCleanPath(filepath.Join(baseDir, "..", "etc", "passwd"), baseDir); err == nil {
+		t.Fatalf("expected traversal path to be rejected")
+	}
+
+	if _, err := validateAndCleanPath("bad\npath", baseDir); err == nil {
+		t.Fatalf("expected dangerous characters to be rejected")
+	}
+
+	if _, err := validateAndCleanPath("", baseDir); err == nil {
+		t.Fatalf("expected empty path to be rejected")
+	}
+}
@@ -0,0 +1,389 @@
+package kalam
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ConfigFileEnv names the JSON or TOML file read by LoadConfig
+const ConfigFileEnv = "KALAM_CONFIG"
+
+// configEnvPrefix starts the environment variable of every setting, e.g. KALAM_TIMEOUTS_QUICK_SCAN
+const configEnvPrefix = "KALAM_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// configField is one setting, named "section.key" in files and JSON, e.g. "pool.entryTTL"
+// Settings of a nested table have a dotted section, e.g. "retry.scan.attempts"
+type configField struct {
+	section string
+	key     string
+	value   reflect.Value
+}
+
+// fields lists the settings of c in declaration order
+func (c *Config) fields() []configField {
+	var fields []configField
+	root := reflect.ValueOf(c).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Field(i)
+		sectionName := configName(root.Type().Field(i).Name)
+		for j := 0; j < section.NumField(); j++ {
+			value, key := section.Field(j), configName(section.Type().Field(j).Name)
+			if value.Kind() != reflect.Struct {
+				fields = append(fields, configField{section: sectionName, key: key, value: value})
+				continue
+			}
+			for k := 0; k < value.NumField(); k++ {
+				fields = append(fields, configField{
+					section: sectionName + "." + key,
+					key:     configName(value.Type().Field(k).Name),
+					value:   value.Field(k),
+				})
+			}
+		}
+	}
+	return fields
+}
+
+// field finds a setting, names are matched case-insensitively
+// The dot between a nested table and its key may fall on either side, as TOML allows both [retry] scan.attempts and [retry.scan] attempts
+func (c *Config) field(section, key string) (configField, bool) {
+	for _, f := range c.fields() {
+		if strings.EqualFold(f.section+"."+f.key, section+"."+key) {
+			return f, true
+		}
+	}
+	return configField{}, false
+}
+
+// set parses raw into the setting, durations use time.ParseDuration syntax such as "45s"
+func (f configField) set(raw string) error {
+	raw = strings.TrimSpace(raw)
+	v := f.value
+
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%s.%s: invalid duration %q", f.section, f.key, raw)
+		}
+		v.SetInt(int64(d))
+	case v.CanInt():
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%s.%s: invalid integer %q", f.section, f.key, raw)
+		}
+		v.SetInt(n)
+	case v.CanUint():
+		n, err := strconv.ParseUint(raw, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%s.%s: invalid unsigned integer %q", f.section, f.key, raw)
+		}
+		v.SetUint(n)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s.%s: invalid boolean %q", f.section, f.key, raw)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	default:
+		return fmt.Errorf("%s.%s: unsupported setting type %s", f.section, f.key, v.Type())
+	}
+	return nil
+}
+
+// apply sets the values of a file or JSON document, given as section → key → value
+func (c *Config) apply(values map[string]map[string]string) error {
+	for section, keys := range values {
+		for key, raw := range keys {
+			f, ok := c.field(section, key)
+			if !ok {
+				return fmt.Errorf("unknown setting %s.%s", section, key)
+			}
+			if err := f.set(raw); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LoadFile overrides the settings found in a JSON file, or a TOML file when the name ends in .toml
+// Settings missing from the file keep their value
+func (c *Config) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var values map[string]map[string]string
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		values, err = parseTOMLConfig(data)
+	} else {
+		values, err = parseJSONConfig(data)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	if err := c.apply(values); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// LoadEnv overrides settings from KALAM_<SECTION>_<KEY> variables in environ, as returned by os.Environ
+func (c *Config) LoadEnv(environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if name, value, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(name, configEnvPrefix) {
+			env[name] = value
+		}
+	}
+
+	for _, f := range c.fields() {
+		name := configEnvName(f.section, f.key)
+		value, ok := env[name]
+		if !ok {
+			continue
+		}
+		if err := f.set(value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// MarshalJSON writes the settings as {"section": {"key": value}}, durations as strings such as "45s"
+// Nested tables are nested objects, e.g. {"retry": {"scan": {"attempts": 1}}}
+func (c Config) MarshalJSON() ([]byte, error) {
+	sections := make(map[string]map[string]interface{})
+	for _, f := range c.fields() {
+		section, table, nested := strings.Cut(f.section, ".")
+		if sections[section] == nil {
+			sections[section] = make(map[string]interface{})
+		}
+		keys := sections[section]
+		if nested {
+			t, ok := keys[table].(map[string]interface{})
+			if !ok {
+				t = make(map[string]interface{})
+				keys[table] = t
+			}
+			keys = t
+		}
+
+		if f.value.Type() == durationType {
+			keys[f.key] = time.Duration(f.value.Int()).String()
+		} else {
+			keys[f.key] = f.value.Interface()
+		}
+	}
+	return json.Marshal(sections)
+}
+
+// UnmarshalJSON overrides the settings present in data, the format written by MarshalJSON
+func (c *Config) UnmarshalJSON(data []byte) error {
+	values, err := parseJSONConfig(data)
+	if err != nil {
+		return err
+	}
+	return c.apply(values)
+}
+
+// parseJSONConfig reads {"section": {"key": value}} with string, number or boolean values
+// A nested object becomes a dotted section, e.g. {"retry": {"scan": {"attempts": 1}}} sets retry.scan.attempts
+func parseJSONConfig(data []byte) (map[string]map[string]string, error) {
+	var doc map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	values := make(map[string]map[string]string)
+	for section, keys := range doc {
+		if err := parseJSONTable(values, section, keys); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// parseJSONTable adds the keys of one JSON object to values[section]
+func parseJSONTable(values map[string]map[string]string, section string, keys map[string]json.RawMessage) error {
+	if values[section] == nil {
+		values[section] = make(map[string]string)
+	}
+	for key, raw := range keys {
+		raw = bytes.TrimSpace(raw)
+		switch {
+		case len(raw) > 0 && raw[0] == '"':
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return fmt.Errorf("%s.%s: %w", section, key, err)
+			}
+			values[section][key] = s
+		case len(raw) > 0 && raw[0] == '{':
+			var table map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &table); err != nil {
+				return fmt.Errorf("%s.%s: %w", section, key, err)
+			}
+			if err := parseJSONTable(values, section+"."+key, table); err != nil {
+				return err
+			}
+		case len(raw) > 0 && (raw[0] == '[' || raw[0] == 'n'):
+			return fmt.Errorf("%s.%s: expected a string, number, boolean or object", section, key)
+		default:
+			values[section][key] = string(raw)
+		}
+	}
+	return nil
+}
+
+// parseTOMLConfig reads the subset of TOML the configuration needs:
+// [section] tables with key = value pairs of strings, integers and booleans, and # comments
+func parseTOMLConfig(data []byte) (map[string]map[string]string, error) {
+	values := make(map[string]map[string]string)
+	section := ""
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripTOMLComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: invalid table header", i+1)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		key = strings.TrimSpace(key)
+
+		// Dotted keys such as pool.entryTTL may be used outside a table
+		keySection := section
+		if s, k, dotted := strings.Cut(key, "."); dotted && section == "" {
+			keySection, key = s, k
+		}
+		if keySection == "" {
+			return nil, fmt.Errorf("line %d: %s is outside a table", i+1, key)
+		}
+
+		value, err := parseTOMLValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		if values[keySection] == nil {
+			values[keySection] = make(map[string]string)
+		}
+		values[keySection][key] = value
+	}
+	return values, nil
+}
+
+// stripTOMLComment removes a # comment that is not inside a string
+func stripTOMLComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseTOMLValue returns a basic or literal string unquoted, and integers without their _ separators
+func parseTOMLValue(raw string) (string, error) {
+	switch {
+	case raw == "":
+		return "", fmt.Errorf("missing value")
+	case raw[0] == '"':
+		s, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return s, nil
+	case raw[0] == '\'':
+		if len(raw) < 2 || raw[len(raw)-1] != '\'' {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	default:
+		n := strings.ReplaceAll(raw, "_", "")
+		if _, err := strconv.ParseInt(n, 10, 64); err != nil {
+			return "", fmt.Errorf("unsupported value %s", raw)
+		}
+		return n, nil
+	}
+}
+
+// configName turns a Go field name into its JSON name, e.g. HTTP → http and MaxCStringSize → maxCStringSize
+func configName(goName string) string {
+	runes := []rune(goName)
+	n := 0
+	for n < len(runes) && unicode.IsUpper(runes[n]) {
+		n++
+	}
+	// In an acronym followed by a word, the last capital starts the word
+	if n > 1 && n < len(runes) {
+		n--
+	}
+	for i := 0; i < n; i++ {
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
+
+// configEnvName returns the environment variable of a setting, e.g. pool.entryTTL → KALAM_POOL_ENTRY_TTL
+// and retry.scan.attempts → KALAM_RETRY_SCAN_ATTEMPTS
+func configEnvName(section, key string) string {
+	return configEnvPrefix + strings.ReplaceAll(envWord(section), ".", "_") + "_" + envWord(key)
+}
+
+// envWord upper-cases a camelCase name with underscores between its words
+func envWord(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || (nextLower && unicode.IsUpper(runes[i-1])) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
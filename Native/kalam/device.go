@@ -0,0 +1,204 @@
+package kalam
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/go-mtpx"
+	"github.com/ganeshrvel/usb"
+)
+
+// Device is an open session with an MTP device
+// usbDevice talks to a phone over libusb, SimDevice simulates one in memory
+type Device interface {
+	GetDeviceInfo(info *mtp.DeviceInfo) error
+	GetStorageIDs(ids *mtp.Uint32Array) error
+	GetStorageInfo(storageID uint32, info *mtp.StorageInfo) error
+	GetObjectHandles(storageID, objFormatCode, parent uint32, handles *mtp.Uint32Array) error
+	GetObjectInfo(handle uint32, info *mtp.ObjectInfo) error
+	GetObjectPropValue(handle uint32, propCode uint16, value interface{}) error
+	SetObjectPropValue(handle uint32, propCode uint16, value interface{}) error
+	GetObject(handle uint32, w io.Writer, progressCb mtp.ProgressFunc) error
+	AndroidGetPartialObject64(handle uint32, w io.Writer, offset int64, size uint32) error
+	SendObjectInfo(wantStorageID, wantParent uint32, info *mtp.ObjectInfo) (storageID, parent, handle uint32, err error)
+	SendObject(r io.Reader, size int64, progressCb mtp.ProgressFunc) error
+	DeleteObject(handle uint32) error
+
+	// RunTransaction runs an operation without a dedicated method, e.g. MoveObject or GetThumb
+	RunTransaction(req *mtp.Container, rep *mtp.Container, dest io.Writer, src io.Reader, writeSize int64, progressCb mtp.ProgressFunc) error
+
+	// SetTimeout sets how long a single transfer may take before failing
+	SetTimeout(timeout time.Duration)
+
+	// CloseSession ends the MTP session, the device stays claimed until Close
+	CloseSession() error
+
+	// ResetSession replaces a session the device lost, e.g. after a reset, with a new one on the same connection
+	ResetSession() error
+
+	// Close ends the session and releases the device
+	Close() error
+}
+
+// DeviceOpener opens a new session with the connected device
+type DeviceOpener func() (Device, error)
+
+// openDevice is the opener of the device session, only used on the session goroutine
+var openDevice DeviceOpener = openUSBDevice
+
+// openDeviceIsUSB reports whether openDevice is the USB opener, diagnostics then probe the USB bus step by step
+var openDeviceIsUSB = true
+
+// SetDeviceOpener changes how the bridge connects to devices, e.g. to SimDevice.Open
+// The session opened by the previous opener is closed and the device health starts over, nil restores the USB opener
+func SetDeviceOpener(open DeviceOpener) {
+	isUSB := open == nil
+	if isUSB {
+		open = openUSBDevice
+	}
+
+	session.control(func() {
+		openDevice = open
+		openDeviceIsUSB = isUSB
+		if isUSB {
+			SetPresenceProbe(usbPresence)
+		} else {
+			SetPresenceProbe(nil)
+		}
+		health.reset()
+		breaker.forget()
+		knownHandles.reset()
+	})
+}
+
+// ErrDeviceInUse is returned when the device is present but another process, e.g. adb or another MTP client, holds its interface
+var ErrDeviceInUse = errors.New("device in use by another process")
+
+// usbDevice is a device connected over USB
+type usbDevice struct {
+	*mtp.Device
+}
+
+// openUSBDevice opens the first MTP device found on the USB bus
+func openUSBDevice() (Device, error) {
+	if cfg().Shared.Enabled {
+		return claimUSBDevice()
+	}
+
+	dev, err := mtpx.Initialize(mtpx.Init{
+		DebugMode: false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usbDevice{dev}, nil
+}
+
+// claimUSBDevice opens the first MTP device found on the USB bus for shared mode
+// Unlike mtpx.Initialize it does not reset a device that refuses the session, which would break the connection of the process using it
+func claimUSBDevice() (Device, error) {
+	cands, err := mtp.FindDevices(usb.NewContext())
+	if err != nil {
+		return nil, err
+	}
+	if len(cands) == 0 {
+		return nil, fmt.Errorf("no MTP devices found")
+	}
+	for _, other := range cands[1:] {
+		other.Done()
+	}
+
+	dev := cands[0]
+	if err := dev.Open(); err != nil {
+		dev.Done()
+		return nil, err
+	}
+	err = dev.OpenSession()
+	if err == mtp.RCError(mtp.RC_SessionAlreadyOpened) {
+		dev.CloseSession()
+		err = dev.OpenSession()
+	}
+	if err != nil {
+		dev.Close()
+		dev.Done()
+		return nil, err
+	}
+	return usbDevice{dev}, nil
+}
+
+// claimRefused reports whether opening a device failed because another process holds its interface
+// mtp.Device.Open ignores a failed ClaimInterface, so the refusal shows up as BUSY or ACCESS from opening the device or the
+// session; mtpx formats these errors with %v, so they are also recognised by their libusb name
+func claimRefused(err error) bool {
+	if errors.Is(err, usb.ERROR_BUSY) || errors.Is(err, usb.ERROR_ACCESS) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, usb.ERROR_BUSY.Error()) || strings.Contains(msg, usb.ERROR_ACCESS.Error())
+}
+
+// SetTimeout sets the libusb transfer timeout
+func (d usbDevice) SetTimeout(timeout time.Duration) {
+	d.Timeout = int(timeout.Milliseconds())
+}
+
+// ResetSession opens a new session on the claimed interface, without enumerating the bus again
+func (d usbDevice) ResetSession() error {
+	// A device that lost the session answers SessionNotOpen, CloseSession forgets it on our side either way
+	d.Device.CloseSession()
+	return d.Device.OpenSession()
+}
+
+// resetNotifier is implemented by devices that report the EC_DeviceReset event
+type resetNotifier interface {
+	// DeviceReset receives when the device reported that it was reset
+	DeviceReset() <-chan struct{}
+}
+
+// fetchDeviceInfo retrieves the DeviceInfo dataset
+func fetchDeviceInfo(dev Device) (*mtp.DeviceInfo, error) {
+	var info mtp.DeviceInfo
+	if err := dev.GetDeviceInfo(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// fetchStorages retrieves the info of every storage of the device
+func fetchStorages(dev Device) ([]mtpx.StorageData, error) {
+	var sids mtp.Uint32Array
+	if err := dev.GetStorageIDs(&sids); err != nil {
+		return nil, err
+	}
+
+	if len(sids.Values) < 1 {
+		return nil, fmt.Errorf("no storage found")
+	}
+
+	var result []mtpx.StorageData
+	for _, sid := range sids.Values {
+		var info mtp.StorageInfo
+		if err := dev.GetStorageInfo(sid, &info); err != nil {
+			return nil, err
+		}
+		result = append(result, mtpx.StorageData{Sid: sid, Info: info})
+	}
+	return result, nil
+}
+
+// objectSize returns the size of an object, asking the device when it does not fit in ObjectInfo
+func objectSize(dev Device, info *mtp.ObjectInfo, handle uint32) (int64, error) {
+	if info.CompressedSize != 0xFFFFFFFF {
+		return int64(info.CompressedSize), nil
+	}
+
+	var val mtp.Uint64Value
+	if err := dev.GetObjectPropValue(handle, mtp.OPC_ObjectSize, &val); err != nil {
+		return 0, fmt.Errorf("GetObjectPropValue handle %d failed: %w", handle, err)
+	}
+	return int64(val.Value), nil
+}
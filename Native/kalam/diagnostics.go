@@ -0,0 +1,372 @@
+package kalam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/usb"
+)
+
+// Diagnostic steps in the order they run
+const (
+	DiagEnumerate    = "enumerate"
+	DiagClaim        = "claimInterface"
+	DiagOpenSession  = "openSession"
+	DiagDeviceInfo   = "deviceInfo"
+	DiagStorages     = "listStorages"
+	DiagCreateFolder = "createFolder"
+	DiagWriteFile    = "writeFile"
+	DiagReadBack     = "readBack"
+	DiagDelete       = "delete"
+)
+
+// Outcomes of a diagnostic step
+const (
+	DiagOK      = "ok"
+	DiagFailed  = "failed"
+	DiagSkipped = "skipped"
+)
+
+// diagFileSize is the size of the file written and read back
+const diagFileSize = 64 * 1024
+
+// DiagnosticStep is the outcome of one step of the self-test
+type DiagnosticStep struct {
+	Name         string      `json:"name"`
+	Status       string      `json:"status"`
+	DurationMs   float64     `json:"durationMs"`
+	Detail       interface{} `json:"detail,omitempty"`
+	Error        string      `json:"error,omitempty"`
+	ErrorKind    string      `json:"errorKind,omitempty"`
+	ResponseCode uint16      `json:"responseCode,omitempty"`
+	Response     string      `json:"response,omitempty"`
+}
+
+// DiagnosticsReport is the result of RunDiagnostics, FailedStep and the response code name the first failure
+type DiagnosticsReport struct {
+	Started      time.Time        `json:"started"`
+	DurationMs   float64          `json:"durationMs"`
+	Transport    string           `json:"transport"`
+	Passed       bool             `json:"passed"`
+	FailedStep   string           `json:"failedStep,omitempty"`
+	ResponseCode uint16           `json:"responseCode,omitempty"`
+	Response     string           `json:"response,omitempty"`
+	Steps        []DiagnosticStep `json:"steps"`
+}
+
+type diagUSBInfo struct {
+	VendorID     uint16 `json:"vendorId"`
+	ProductID    uint16 `json:"productId"`
+	Manufacturer string `json:"manufacturer"`
+	Product      string `json:"product"`
+	SerialNumber string `json:"serialNumber"`
+}
+
+type diagDeviceInfo struct {
+	Manufacturer  string   `json:"manufacturer"`
+	Model         string   `json:"model"`
+	DeviceVersion string   `json:"deviceVersion"`
+	SerialNumber  string   `json:"serialNumber"`
+	MTPExtension  string   `json:"mtpExtension"`
+	Operations    []string `json:"operations"`
+}
+
+type diagObject struct {
+	StorageID uint32 `json:"storageId"`
+	ObjectID  uint32 `json:"objectId"`
+	Name      string `json:"name"`
+	Size      int    `json:"size,omitempty"`
+}
+
+// diagRun records the steps of one self-test
+type diagRun struct {
+	ctx    context.Context
+	report *DiagnosticsReport
+}
+
+// RunDiagnostics probes the device step by step: enumerate USB candidates, claim the interface, open a session,
+// read DeviceInfo and the storages, then create a temporary folder, write a file, read it back and delete both
+// It runs on a session of its own, the shared session is closed first and no other operation runs meanwhile
+// The report describes every step; a failing device is reported in it, not as an error
+func (c *Client) RunDiagnostics(ctx context.Context) (*DiagnosticsReport, error) {
+	ctx, end, err := beginOperation(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	run := &diagRun{ctx: ctx, report: &DiagnosticsReport{Started: time.Now(), Transport: "custom"}}
+	err = session.exclusive(ctx, func() error {
+		if openDeviceIsUSB {
+			run.report.Transport = "usb"
+		}
+		if dev := run.open(); dev != nil {
+			run.exercise(dev)
+			disposeDevice(dev)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := run.report
+	report.DurationMs = millis(time.Since(report.Started))
+	report.Passed = report.FailedStep == ""
+	if report.Passed {
+		usbLog.Info("diagnostics passed", "durationMs", report.DurationMs)
+	} else {
+		usbLog.Warn("diagnostics failed", "step", report.FailedStep, "response", report.Response)
+	}
+	return report, nil
+}
+
+// step runs fn as the named step unless an earlier step failed or ctx is done
+func (r *diagRun) step(name string, fn func() (interface{}, error)) bool {
+	if r.report.FailedStep != "" {
+		r.skip(name, "an earlier step failed")
+		return false
+	}
+	if err := r.ctx.Err(); err != nil {
+		return r.record(name, func() (interface{}, error) { return nil, err })
+	}
+	return r.record(name, fn)
+}
+
+// record runs fn as the named step, the report keeps the first failure
+func (r *diagRun) record(name string, fn func() (interface{}, error)) bool {
+	start := time.Now()
+	detail, err := fn()
+
+	s := DiagnosticStep{Name: name, Status: DiagOK, DurationMs: millis(time.Since(start)), Detail: detail}
+	if err != nil {
+		s.Status = DiagFailed
+		s.Error = err.Error()
+		s.ErrorKind = captureErrorKind(err)
+		var rc mtp.RCError
+		if errors.As(err, &rc) {
+			s.ResponseCode = uint16(rc)
+			s.Response = captureName(mtp.RC_names, uint16(rc))
+		}
+		if r.report.FailedStep == "" {
+			r.report.FailedStep = name
+			r.report.ResponseCode = s.ResponseCode
+			r.report.Response = s.Response
+		}
+	}
+	r.report.Steps = append(r.report.Steps, s)
+	return err == nil
+}
+
+// skip records a step that did not run
+func (r *diagRun) skip(name, reason string) {
+	r.report.Steps = append(r.report.Steps, DiagnosticStep{Name: name, Status: DiagSkipped, Detail: reason})
+}
+
+// open runs the connection steps and returns the open device, or nil when one of them failed
+func (r *diagRun) open() Device {
+	if !openDeviceIsUSB {
+		r.skip(DiagEnumerate, "not a USB device")
+		r.skip(DiagClaim, "not a USB device")
+
+		var dev Device
+		r.step(DiagOpenSession, func() (interface{}, error) {
+			var err error
+			dev, err = openDevice()
+			return nil, err
+		})
+		if dev == nil {
+			return nil
+		}
+		return &metricsDevice{dev: dev}
+	}
+
+	var cand *mtp.Device
+	r.step(DiagEnumerate, func() (interface{}, error) {
+		cands, err := mtp.FindDevices(usb.NewContext())
+		if err != nil {
+			return nil, err
+		}
+		if len(cands) == 0 {
+			return nil, fmt.Errorf("no MTP device found")
+		}
+		for _, other := range cands[1:] {
+			other.Done()
+		}
+		cand = cands[0]
+		return map[string]int{"candidates": len(cands)}, nil
+	})
+
+	opened := r.step(DiagClaim, func() (interface{}, error) {
+		cand.Timeout = int(cfg().Timeouts.NormalOperation.Milliseconds())
+		if err := cand.Open(); err != nil {
+			return nil, err
+		}
+		info, err := cand.GetUsbInfo()
+		if err != nil {
+			return nil, nil
+		}
+		return diagUSBInfo{
+			VendorID:     info.IdVendor,
+			ProductID:    info.IdProduct,
+			Manufacturer: info.Manufacturer,
+			Product:      info.Product,
+			SerialNumber: info.SerialNumber,
+		}, nil
+	})
+
+	session := r.step(DiagOpenSession, func() (interface{}, error) {
+		err := cand.OpenSession()
+		if err == mtp.RCError(mtp.RC_SessionAlreadyOpened) {
+			cand.CloseSession()
+			err = cand.OpenSession()
+		}
+		return nil, err
+	})
+
+	switch {
+	case session:
+		return &metricsDevice{dev: usbDevice{cand}}
+	case opened:
+		cand.Close()
+		cand.Done()
+	case cand != nil:
+		cand.Done()
+	}
+	return nil
+}
+
+// exercise runs the steps on an open session
+// The temporary folder is deleted even when writing or reading the file failed
+func (r *diagRun) exercise(dev Device) {
+	r.step(DiagDeviceInfo, func() (interface{}, error) {
+		info, err := fetchDeviceInfo(dev)
+		if err != nil {
+			return nil, err
+		}
+		detail := diagDeviceInfo{
+			Manufacturer:  info.Manufacturer,
+			Model:         info.Model,
+			DeviceVersion: info.DeviceVersion,
+			SerialNumber:  info.SerialNumber,
+			MTPExtension:  info.MTPExtension,
+			Operations:    []string{},
+		}
+		for _, op := range info.OperationsSupported {
+			detail.Operations = append(detail.Operations, captureName(mtp.OC_names, op))
+		}
+		return detail, nil
+	})
+
+	var storageID uint32
+	r.step(DiagStorages, func() (interface{}, error) {
+		storages, err := fetchStorages(dev)
+		if err != nil {
+			return nil, err
+		}
+
+		var detail []StorageJSON
+		writable := false
+		for _, s := range storages {
+			detail = append(detail, StorageJSON{
+				ID:          s.Sid,
+				Description: s.Info.StorageDescription,
+				FreeSpace:   s.Info.FreeSpaceInBytes,
+				MaxCapacity: s.Info.MaxCapability,
+			})
+			if !writable && s.Info.AccessCapability == 0 {
+				storageID, writable = s.Sid, true
+			}
+		}
+		if !writable {
+			storageID = storages[0].Sid
+		}
+		return detail, nil
+	})
+
+	var folder uint32
+	name := fmt.Sprintf("kalam-diagnostics-%d", time.Now().UnixNano())
+	r.step(DiagCreateFolder, func() (interface{}, error) {
+		info := mtp.ObjectInfo{
+			StorageID:    storageID,
+			ParentObject: uint32(RootParentID),
+			Filename:     name,
+			ObjectFormat: ObjectFormatFolder,
+		}
+		_, _, handle, err := dev.SendObjectInfo(storageID, uint32(RootParentID), &info)
+		if err != nil {
+			return nil, fmt.Errorf("SendObjectInfo failed: %w", err)
+		}
+		folder = handle
+		return diagObject{StorageID: storageID, ObjectID: handle, Name: name}, nil
+	})
+
+	data := diagPattern(diagFileSize)
+	var file uint32
+	r.step(DiagWriteFile, func() (interface{}, error) {
+		info := mtp.ObjectInfo{
+			StorageID:        storageID,
+			ParentObject:     folder,
+			Filename:         "probe.bin",
+			ObjectFormat:     ObjectFormatGenericFile,
+			CompressedSize:   uint32(len(data)),
+			ModificationDate: time.Now(),
+		}
+		_, _, handle, err := dev.SendObjectInfo(storageID, folder, &info)
+		if err != nil {
+			return nil, fmt.Errorf("SendObjectInfo failed: %w", err)
+		}
+		file = handle
+		if err := dev.SendObject(bytes.NewReader(data), int64(len(data)), mtp.EmptyProgressFunc); err != nil {
+			return nil, fmt.Errorf("SendObject failed: %w", err)
+		}
+		return diagObject{StorageID: storageID, ObjectID: handle, Name: info.Filename, Size: len(data)}, nil
+	})
+
+	r.step(DiagReadBack, func() (interface{}, error) {
+		var buf bytes.Buffer
+		if err := dev.GetObject(file, &buf, mtp.EmptyProgressFunc); err != nil {
+			return nil, fmt.Errorf("GetObject failed: %w", err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			return nil, fmt.Errorf("read back %d bytes that differ from the %d bytes written", buf.Len(), len(data))
+		}
+		return map[string]int{"size": buf.Len()}, nil
+	})
+
+	if folder == 0 {
+		r.skip(DiagDelete, "nothing was created")
+		return
+	}
+
+	// Cleanup runs after a failure or cancellation too
+	r.record(DiagDelete, func() (interface{}, error) {
+		if file != 0 {
+			if err := dev.DeleteObject(file); err != nil {
+				return nil, fmt.Errorf("DeleteObject file failed: %w", err)
+			}
+		}
+		if err := dev.DeleteObject(folder); err != nil {
+			return nil, fmt.Errorf("DeleteObject folder failed: %w", err)
+		}
+		return nil, nil
+	})
+}
+
+// diagPattern returns size bytes that are unlikely to be read back by accident
+func diagPattern(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*31 + i/251)
+	}
+	return data
+}
+
+// millis converts a duration to fractional milliseconds
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,97 @@
+package kalam
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+func TestRunDiagnostics(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	ctx := context.Background()
+
+	before, err := client.ListFiles(ctx, 65537, RootParentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := client.RunDiagnostics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Passed || report.FailedStep != "" || report.Transport != "custom" {
+		t.Fatalf("report = %+v", report)
+	}
+
+	want := []string{DiagEnumerate, DiagClaim, DiagOpenSession, DiagDeviceInfo, DiagStorages, DiagCreateFolder, DiagWriteFile, DiagReadBack, DiagDelete}
+	if len(report.Steps) != len(want) {
+		t.Fatalf("steps = %+v", report.Steps)
+	}
+	for i, s := range report.Steps {
+		status := DiagOK
+		if i < 2 {
+			status = DiagSkipped
+		}
+		if s.Name != want[i] || s.Status != status {
+			t.Errorf("step %d = %+v, want %s %s", i, s, want[i], status)
+		}
+	}
+
+	after, err := client.ListFiles(ctx, 65537, RootParentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("diagnostics left %d objects in the root, had %d", len(after), len(before))
+	}
+}
+
+func TestRunDiagnosticsFailedStep(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	ctx := context.Background()
+
+	sim.InjectFault(SimFault{Op: mtp.OC_GetObject, Err: mtp.RCError(mtp.RC_AccessDenied)})
+
+	report, err := client.RunDiagnostics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Passed || report.FailedStep != DiagReadBack || report.ResponseCode != mtp.RC_AccessDenied || report.Response != "AccessDenied" {
+		t.Fatalf("report = %+v", report)
+	}
+
+	// The temporary folder is still removed
+	last := report.Steps[len(report.Steps)-1]
+	if last.Name != DiagDelete || last.Status != DiagOK {
+		t.Errorf("cleanup step = %+v", last)
+	}
+	files, err := client.ListFiles(ctx, 65537, RootParentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("root has %d objects after cleanup", len(files))
+	}
+}
+
+func TestRunDiagnosticsOpenFailure(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	sim.Unplug()
+
+	report, err := client.RunDiagnostics(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Passed || report.FailedStep != DiagOpenSession || report.ResponseCode != 0 {
+		t.Fatalf("report = %+v", report)
+	}
+	for _, s := range report.Steps[3:] {
+		if s.Status != DiagSkipped {
+			t.Errorf("step after the failure = %+v", s)
+		}
+	}
+}
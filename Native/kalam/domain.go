@@ -0,0 +1,470 @@
+package kalam
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/go-mtpx"
+)
+
+// MARK: - Custom Types
+
+// StorageID represents a unique storage identifier on the MTP device
+type StorageID uint32
+
+// Validate checks if the storage ID is valid
+func (id StorageID) Validate() error {
+	if id == 0 {
+		return fmt.Errorf("invalid storage ID: %d", id)
+	}
+	return nil
+}
+
+// String returns the string representation of the storage ID
+func (id StorageID) String() string {
+	return fmt.Sprintf("StorageID(%d)", uint32(id))
+}
+
+// ObjectID represents a unique object identifier on the MTP device
+type ObjectID uint32
+
+// Validate checks if the object ID is valid
+func (id ObjectID) Validate() error {
+	if id == 0 {
+		return fmt.Errorf("invalid object ID: %d", id)
+	}
+	return nil
+}
+
+// String returns the string representation of the object ID
+func (id ObjectID) String() string {
+	return fmt.Sprintf("ObjectID(%d)", uint32(id))
+}
+
+// ParentID represents a parent directory identifier on the MTP device
+type ParentID uint32
+
+// Validate checks if the parent ID is valid
+func (id ParentID) Validate() error {
+	// ParentID can be 0xFFFFFFFF for root directory
+	if id == 0 && id != 0xFFFFFFFF {
+		return fmt.Errorf("invalid parent ID: %d", id)
+	}
+	return nil
+}
+
+// String returns the string representation of the parent ID
+func (id ParentID) String() string {
+	return fmt.Sprintf("ParentID(%d)", uint32(id))
+}
+
+// RootParentID is the parent ID used to list the top level of a storage
+const RootParentID ParentID = 0xFFFFFFFF
+
+// SameParent reports whether the ParentObject of an object refers to parentID
+// Devices report 0 as the parent of top-level objects, while listings use RootParentID
+func SameParent(parentObject uint32, parentID ParentID) bool {
+	if parentObject == 0 {
+		parentObject = uint32(RootParentID)
+	}
+	return parentObject == uint32(parentID)
+}
+
+// MARK: - Interfaces
+
+// DeviceManager defines the contract for device operations
+// This interface abstracts device management operations for better testability
+type DeviceManager interface {
+	// Scan scans for connected MTP devices
+	Scan(ctx context.Context) ([]DeviceJSON, error)
+
+	// Initialize initializes the device connection
+	Initialize() error
+
+	// Dispose disposes the device connection
+	Dispose() error
+
+	// GetDeviceInfo retrieves device information
+	GetDeviceInfo(ctx context.Context) (*mtp.DeviceInfo, error)
+
+	// GetStorages retrieves storage information
+	GetStorages(ctx context.Context) ([]mtpx.StorageData, error)
+}
+
+// FileSystemManager defines the contract for file system operations
+// This interface abstracts file system operations for better testability
+type FileSystemManager interface {
+	// ListFiles lists files in a directory
+	ListFiles(ctx context.Context, storageID StorageID, parentID ParentID) ([]FileJSON, error)
+
+	// CreateFolder creates a new folder
+	CreateFolder(ctx context.Context, storageID StorageID, parentID ParentID, name string) (ObjectID, error)
+
+	// DeleteObject deletes a file or folder
+	DeleteObject(ctx context.Context, objectID ObjectID) error
+
+	// DownloadFile downloads a file from the device
+	DownloadFile(ctx context.Context, objectID ObjectID, destPath string) error
+
+	// UploadFile uploads a file to the device and returns the new object
+	UploadFile(ctx context.Context, storageID StorageID, parentID ParentID, srcPath string) (ObjectID, error)
+
+	// RefreshStorage refreshes the device storage cache
+	RefreshStorage(ctx context.Context, storageID StorageID) error
+
+	// RenameObject renames a file or folder
+	RenameObject(ctx context.Context, objectID ObjectID, newName string) error
+
+	// MoveObject moves a file or folder to another parent, possibly on another storage
+	MoveObject(ctx context.Context, objectID ObjectID, storageID StorageID, parentID ParentID) error
+}
+
+// MARK: - Interface Implementations
+
+// mtpDeviceManager implements the DeviceManager interface
+// This provides a concrete implementation for device management operations
+type mtpDeviceManager struct{}
+
+// Scan scans for connected MTP devices
+// While the circuit breaker is open the device is not asked, the last scan is returned with its breaker state
+// While the same devices stay present on the bus the last scan is returned too, see QuickPresence
+func (m *mtpDeviceManager) Scan(ctx context.Context) ([]DeviceJSON, error) {
+	if err := breaker.allow(); err != nil {
+		if devices := breaker.scanWhileOpen(); devices != nil {
+			return devices, nil
+		}
+		return nil, err
+	}
+
+	present, known := scans.currentPresence()
+	if known {
+		if devices := scans.get(present); devices != nil {
+			scanLog.Debug("devices present did not change, returning the last scan")
+			return devices, nil
+		}
+	}
+
+	var devices []DeviceJSON
+
+	err := withDeviceQuick(ctx, func(dev Device) error {
+		info, err := fetchDeviceInfo(dev)
+		if err != nil {
+			return fmt.Errorf("FetchDeviceInfo failed: %w", err)
+		}
+
+		var storages []mtpx.StorageData
+		storages, err = fetchStorages(dev)
+		if err != nil {
+			scanLog.Warn("FetchStorages failed", "error", err)
+			storages = []mtpx.StorageData{}
+		}
+
+		deviceName := info.Model
+		if info.Manufacturer != "" && !containsIgnoreCase(info.Model, info.Manufacturer) {
+			deviceName = info.Manufacturer + " " + info.Model
+		}
+
+		majorVersion := info.MTPVersion / 100
+		minorVersion := (info.MTPVersion % 100) / 10
+		mtpVersion := fmt.Sprintf("%d.%d", majorVersion, minorVersion)
+
+		mtpSupport := MTPSupportJSON{
+			MtpVersion:      mtpVersion,
+			DeviceVersion:   info.DeviceVersion,
+			VendorExtension: info.Manufacturer,
+		}
+
+		d := DeviceJSON{
+			ID:           ConnectedDeviceID,
+			Name:         deviceName,
+			Manufacturer: info.Manufacturer,
+			Model:        info.Model,
+			SerialNumber: info.SerialNumber,
+			Storage:      []StorageJSON{},
+			MTPSupport:   mtpSupport,
+		}
+
+		for _, s := range storages {
+			d.Storage = append(d.Storage, StorageJSON{
+				ID:          s.Sid,
+				Description: s.Info.StorageDescription,
+				FreeSpace:   s.Info.FreeSpaceInBytes,
+				MaxCapacity: s.Info.MaxCapability,
+			})
+		}
+
+		devices = []DeviceJSON{d}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	breaker.rememberScan(devices)
+	if known {
+		scans.put(present, devices)
+	}
+	return devices, nil
+}
+
+// Initialize opens the device session ahead of the first operation
+func (m *mtpDeviceManager) Initialize() error {
+	return session.do(context.Background(), priorityMetadata, false, func(Device) error {
+		return nil
+	})
+}
+
+// Dispose closes the device session, the next operation opens a new one
+func (m *mtpDeviceManager) Dispose() error {
+	return session.exclusive(context.Background(), func() error {
+		return nil
+	})
+}
+
+// GetDeviceInfo retrieves device information
+func (m *mtpDeviceManager) GetDeviceInfo(ctx context.Context) (*mtp.DeviceInfo, error) {
+	var info *mtp.DeviceInfo
+
+	err := withDeviceQuick(ctx, func(dev Device) error {
+		var devInfo mtp.DeviceInfo
+		if err := dev.GetDeviceInfo(&devInfo); err != nil {
+			return fmt.Errorf("GetDeviceInfo failed: %w", err)
+		}
+		info = &devInfo
+		return nil
+	})
+
+	return info, err
+}
+
+// GetStorages retrieves storage information
+func (m *mtpDeviceManager) GetStorages(ctx context.Context) ([]mtpx.StorageData, error) {
+	var storages []mtpx.StorageData
+
+	err := withDeviceQuick(ctx, func(dev Device) error {
+		var s []mtpx.StorageData
+		var err error
+		s, err = fetchStorages(dev)
+		if err != nil {
+			return fmt.Errorf("FetchStorages failed: %w", err)
+		}
+		storages = s
+		return nil
+	})
+
+	return storages, err
+}
+
+// fileSystemManager implements the FileSystemManager interface
+// This provides a concrete implementation for file system operations
+type fileSystemManager struct{}
+
+// ListFiles lists files in a directory
+func (m *fileSystemManager) ListFiles(ctx context.Context, storageID StorageID, parentID ParentID) ([]FileJSON, error) {
+	var files []FileJSON
+
+	err := withObjectDevice(ctx, ClassMetadata, ObjectID(parentID), func(dev Device, parent uint32) error {
+		var handles mtp.Uint32Array
+		if err := dev.GetObjectHandles(uint32(storageID), 0, parent, &handles); err != nil {
+			return fmt.Errorf("GetObjectHandles failed: %w", err)
+		}
+
+		// Children are recorded by path, so their handles can be found again once the device renumbers them
+		parentLoc, locErr := locateHandle(dev, storageID, parent)
+		if locErr != nil {
+			poolLog.Debug("failed to locate listed folder", "parent", parent, "error", locErr)
+		}
+
+		// A retried attempt lists the folder again from scratch
+		files = []FileJSON{}
+		for _, handle := range handles.Values {
+			var info mtp.ObjectInfo
+			if err := dev.GetObjectInfo(handle, &info); err != nil {
+				poolLog.Debug("GetObjectInfo failed", "handle", handle, "error", err)
+				continue
+			}
+			if locErr == nil {
+				knownHandles.remember(ObjectID(handle), parentLoc.child(info.Filename))
+			}
+
+			// Objects over 4GB report 0xFFFFFFFF, HTTP and WebDAV serve the listed size
+			size, err := objectSize(dev, &info, handle)
+			if err != nil {
+				poolLog.Debug("failed to get object size", "handle", handle, "error", err)
+				size = int64(info.CompressedSize)
+			}
+
+			files = append(files, FileJSON{
+				ID:        handle,
+				ParentID:  info.ParentObject,
+				StorageID: info.StorageID,
+				Name:      info.Filename,
+				Size:      uint64(size),
+				IsFolder:  info.ObjectFormat == 0x3001,
+				ModTime:   info.ModificationDate.Unix(),
+			})
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// CreateFolder creates a new folder
+func (m *fileSystemManager) CreateFolder(ctx context.Context, storageID StorageID, parentID ParentID, name string) (ObjectID, error) {
+	if err := validateObjectName(name); err != nil {
+		return 0, err
+	}
+
+	var newHandle uint32
+	defer objectsChanged()
+
+	err := withObjectDevice(ctx, ClassMutation, ObjectID(parentID), func(dev Device, parent uint32) error {
+		var objInfo mtp.ObjectInfo
+		objInfo.StorageID = uint32(storageID)
+		objInfo.ParentObject = parent
+		objInfo.Filename = name
+		objInfo.ObjectFormat = ObjectFormatFolder
+		objInfo.CompressedSize = 0
+
+		_, _, handle, err := dev.SendObjectInfo(uint32(storageID), parent, &objInfo)
+		if err != nil {
+			return fmt.Errorf("SendObjectInfo failed: %w", err)
+		}
+
+		rememberChild(ObjectID(handle), storageID, ParentID(parent), name)
+		newHandle = handle
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return ObjectID(newHandle), nil
+}
+
+// DeleteObject deletes a file or folder
+func (m *fileSystemManager) DeleteObject(ctx context.Context, objectID ObjectID) error {
+	defer objectsChanged()
+	return withObjectDevice(ctx, ClassMutation, objectID, func(dev Device, handle uint32) error {
+		if err := dev.DeleteObject(handle); err != nil {
+			return fmt.Errorf("DeleteObject failed: %w", err)
+		}
+		knownHandles.forget(ObjectID(handle))
+		return nil
+	})
+}
+
+// DownloadFile downloads a file from the device
+func (m *fileSystemManager) DownloadFile(ctx context.Context, objectID ObjectID, destPath string) error {
+	return downloadFile(ctx, objectID, destPath)
+}
+
+// UploadFile uploads a file to the device and returns the new object
+func (m *fileSystemManager) UploadFile(ctx context.Context, storageID StorageID, parentID ParentID, srcPath string) (ObjectID, error) {
+	return uploadFile(ctx, storageID, parentID, srcPath)
+}
+
+// RefreshStorage refreshes the device storage cache, the next scan asks the device again
+func (m *fileSystemManager) RefreshStorage(ctx context.Context, storageID StorageID) error {
+	scans.forget()
+	return withDevice(ctx, func(dev Device) error {
+		var info mtp.StorageInfo
+		if err := dev.GetStorageInfo(uint32(storageID), &info); err != nil {
+			return fmt.Errorf("GetStorageInfo failed: %w", err)
+		}
+		return nil
+	})
+}
+
+// RenameObject renames a file or folder
+func (m *fileSystemManager) RenameObject(ctx context.Context, objectID ObjectID, newName string) error {
+	if err := validateObjectName(newName); err != nil {
+		return err
+	}
+	defer objectsChanged()
+
+	return withObjectDevice(ctx, ClassMutation, objectID, func(dev Device, handle uint32) error {
+		if err := dev.SetObjectPropValue(handle, mtp.OPC_ObjectFileName, &mtp.StringValue{Value: newName}); err != nil {
+			return fmt.Errorf("SetObjectPropValue failed: %w", err)
+		}
+		knownHandles.renamed(ObjectID(handle), newName)
+		return nil
+	})
+}
+
+// MoveObject moves a file or folder to another parent, possibly on another storage
+func (m *fileSystemManager) MoveObject(ctx context.Context, objectID ObjectID, storageID StorageID, parentID ParentID) error {
+	defer objectsChanged()
+	// The new parent may have been renumbered since it was listed, just like the object
+	return withObject(ctx, ObjectID(parentID), func(parent ObjectID) error {
+		return withObjectDevice(ctx, ClassMutation, objectID, func(dev Device, handle uint32) error {
+			if err := moveObject(dev, handle, uint32(storageID), uint32(parent)); err != nil {
+				return fmt.Errorf("MoveObject failed: %w", err)
+			}
+			knownHandles.movedTo(ObjectID(handle), storageID, parent)
+			return nil
+		})
+	})
+}
+
+// moveObject issues the MTP MoveObject operation, which has no wrapper in the mtp package
+func moveObject(dev Device, handle uint32, storageID uint32, parentID uint32) error {
+	// MTP uses 0 rather than 0xFFFFFFFF for the storage root as a move destination
+	if parentID == uint32(RootParentID) {
+		parentID = 0
+	}
+
+	var req, rep mtp.Container
+	req.Code = mtp.OC_MoveObject
+	req.Param = []uint32{handle, storageID, parentID}
+	return dev.RunTransaction(&req, &rep, nil, nil, 0, mtp.EmptyProgressFunc)
+}
+
+// Global instances of the interface implementations
+var deviceMgr DeviceManager = &mtpDeviceManager{}
+var fileSystemMgr FileSystemManager = &fileSystemManager{}
+
+// -- Data Structures for JSON --
+
+type MTPSupportJSON struct {
+	MtpVersion      string `json:"mtpVersion"`
+	DeviceVersion   string `json:"deviceVersion"`
+	VendorExtension string `json:"vendorExtension"`
+}
+
+type DeviceJSON struct {
+	ID           int            `json:"id"`
+	Name         string         `json:"name"`
+	Manufacturer string         `json:"manufacturer"`
+	Model        string         `json:"model"`
+	SerialNumber string         `json:"serialNumber"`
+	Storage      []StorageJSON  `json:"storage"`
+	MTPSupport   MTPSupportJSON `json:"mtpSupport"`
+	// Breaker is the circuit breaker state, "open" while the device is failed fast
+	Breaker BreakerState `json:"breaker"`
+}
+
+type StorageJSON struct {
+	ID          uint32 `json:"id"`
+	Description string `json:"description"`
+	FreeSpace   uint64 `json:"freeSpace"`
+	MaxCapacity uint64 `json:"maxCapacity"`
+}
+
+type FileJSON struct {
+	ID        uint32 `json:"id"`
+	ParentID  uint32 `json:"parentId"`
+	StorageID uint32 `json:"storageId"`
+	Name      string `json:"name"`
+	Size      uint64 `json:"size"`
+	IsFolder  bool   `json:"isFolder"`
+	ModTime   int64  `json:"modTime"`
+}
@@ -0,0 +1,314 @@
+package kalam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// maxKnownHandles bounds the handle index, it starts over once it grows beyond
+const maxKnownHandles = 100000
+
+// objectChanges counts the changes the bridge made to objects on the device, caches of the object tree compare it
+var objectChanges atomic.Uint64
+
+// objectsChanged records that objects were created, deleted, renamed or moved, or may have been
+// The cached scan goes too, its storages report the free space from before the change
+func objectsChanged() {
+	objectChanges.Add(1)
+	scans.forget()
+}
+
+// objectLocation is where the bridge last saw an object
+type objectLocation struct {
+	storageID uint32
+	path      []string
+}
+
+func (l objectLocation) String() string {
+	return "/" + strings.Join(l.path, "/")
+}
+
+// child returns the location of an object named name in the folder at l
+func (l objectLocation) child(name string) objectLocation {
+	return objectLocation{storageID: l.storageID, path: append(slices.Clip(l.path), name)}
+}
+
+// handleIndex maps the object handles handed out by the bridge to their paths
+// Android renumbers its objects after the media scanner ran, so a handle the app kept may answer
+// InvalidObjectHandle later; the index finds the object again by its path
+type handleIndex struct {
+	mu     sync.Mutex
+	serial string
+	paths  map[ObjectID]objectLocation
+	// renumbered maps stale handles to the handles their paths resolved to, until the next handle epoch
+	renumbered map[ObjectID]ObjectID
+	epoch      uint64
+}
+
+// knownHandles is the handle index of the connected device
+var knownHandles = &handleIndex{
+	paths:      make(map[ObjectID]objectLocation),
+	renumbered: make(map[ObjectID]ObjectID),
+}
+
+// forDevice starts over when a session is opened with another device
+func (x *handleIndex) forDevice(serial string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.serial != serial {
+		x.serial = serial
+		x.clear()
+	}
+}
+
+// reset forgets every handle, e.g. when another opener is set
+func (x *handleIndex) reset() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.serial = ""
+	x.clear()
+}
+
+// clear empties the index, the caller holds x.mu
+func (x *handleIndex) clear() {
+	x.paths = make(map[ObjectID]objectLocation)
+	x.renumbered = make(map[ObjectID]ObjectID)
+}
+
+// remember records the location of an object
+func (x *handleIndex) remember(id ObjectID, loc objectLocation) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if len(x.paths) >= maxKnownHandles {
+		poolLog.Debug("handle index is full, starting over", "handles", len(x.paths))
+		x.clear()
+	}
+	x.paths[id] = loc
+}
+
+// location returns where an object was last seen, the storage root is a folder with an empty path
+func (x *handleIndex) location(storageID StorageID, id ObjectID) (objectLocation, bool) {
+	if id == ObjectID(RootParentID) || id == 0 {
+		return objectLocation{storageID: uint32(storageID)}, true
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	loc, ok := x.paths[id]
+	return loc, ok
+}
+
+// current returns the handle a stale handle was found at again, or id itself
+// A reconnect or session reset may renumber the objects once more, so the mapping is dropped then
+func (x *handleIndex) current(id ObjectID) ObjectID {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if epoch := handleEpoch.Load(); epoch != x.epoch {
+		x.epoch = epoch
+		x.renumbered = make(map[ObjectID]ObjectID)
+	}
+	if fresh, ok := x.renumbered[id]; ok {
+		return fresh
+	}
+	return id
+}
+
+// renumber records that the object of a stale handle was found again at fresh
+func (x *handleIndex) renumber(stale, fresh ObjectID, loc objectLocation) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.renumbered[stale] = fresh
+	x.paths[fresh] = loc
+}
+
+// renamed records the new name of an object
+func (x *handleIndex) renamed(id ObjectID, name string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if loc, ok := x.paths[id]; ok && len(loc.path) > 0 {
+		parent := objectLocation{storageID: loc.storageID, path: loc.path[:len(loc.path)-1]}
+		x.relocate(id, parent.child(name))
+	}
+}
+
+// movedTo records that an object was moved into another folder
+func (x *handleIndex) movedTo(id ObjectID, storageID StorageID, parent ObjectID) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	loc, ok := x.paths[id]
+	if !ok || len(loc.path) == 0 {
+		return
+	}
+	parentLoc, ok := x.paths[parent]
+	if parent == ObjectID(RootParentID) || parent == 0 {
+		parentLoc, ok = objectLocation{storageID: uint32(storageID)}, true
+	}
+	if !ok {
+		x.drop(id)
+		return
+	}
+	x.relocate(id, parentLoc.child(loc.path[len(loc.path)-1]))
+}
+
+// relocate moves an object and the objects below it to loc, the caller holds x.mu
+func (x *handleIndex) relocate(id ObjectID, loc objectLocation) {
+	old := x.paths[id]
+	for other, l := range x.paths {
+		if other != id && below(l, old) {
+			x.paths[other] = objectLocation{storageID: loc.storageID, path: append(slices.Clip(loc.path), l.path[len(old.path):]...)}
+		}
+	}
+	x.paths[id] = loc
+}
+
+// forget drops an object and the objects below it
+func (x *handleIndex) forget(id ObjectID) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.drop(id)
+}
+
+// drop forgets an object and the objects below it, the caller holds x.mu
+func (x *handleIndex) drop(id ObjectID) {
+	loc, ok := x.paths[id]
+	delete(x.paths, id)
+	if !ok {
+		return
+	}
+	for other, l := range x.paths {
+		if below(l, loc) {
+			delete(x.paths, other)
+		}
+	}
+}
+
+// below reports whether l is inside the folder at parent
+func below(l, parent objectLocation) bool {
+	return l.storageID == parent.storageID && len(l.path) > len(parent.path) && slices.Equal(l.path[:len(parent.path)], parent.path)
+}
+
+// staleHandle reports whether the device no longer knows a handle
+func staleHandle(err error) bool {
+	var rc mtp.RCError
+	return errors.As(err, &rc) && (rc == mtp.RCError(mtp.RC_InvalidObjectHandle) || rc == mtp.RCError(mtp.RC_InvalidParentObject))
+}
+
+// withObject runs fn with the handle of an object the bridge handed out
+// When the device answers InvalidObjectHandle, the object is looked up by the path the bridge saw it at
+// and fn runs once more with the handle found there
+func withObject(ctx context.Context, id ObjectID, fn func(handle ObjectID) error) error {
+	if id == ObjectID(RootParentID) || id == 0 {
+		return fn(id)
+	}
+
+	handle := knownHandles.current(id)
+	err := fn(handle)
+	// The object of a partial success exists on the device, running fn again would duplicate it
+	var partial *partialSuccessError
+	if !staleHandle(err) || errors.As(err, &partial) {
+		return err
+	}
+
+	loc, ok := knownHandles.location(0, handle)
+	if !ok {
+		return err
+	}
+
+	var fresh uint32
+	resolveErr := withDevice(ctx, func(dev Device) error {
+		h, _, err := findByPath(dev, loc)
+		fresh = h
+		return err
+	})
+	if resolveErr != nil {
+		poolLog.Info("stale object handle not found by its path", "handle", handle, "path", loc, "error", resolveErr)
+		return err
+	}
+
+	poolLog.Info("stale object handle found again by its path", "path", loc, "old", handle, "new", fresh)
+	knownHandles.renumber(id, ObjectID(fresh), loc)
+	return fn(ObjectID(fresh))
+}
+
+// withObjectDevice runs fn on the device session with the handle of an object the bridge handed out, see withObject
+func withObjectDevice(ctx context.Context, class OperationClass, id ObjectID, fn func(dev Device, handle uint32) error) error {
+	return withObject(ctx, id, func(handle ObjectID) error {
+		return withDeviceFor(ctx, class, func(dev Device) error {
+			return fn(dev, uint32(handle))
+		})
+	})
+}
+
+// rememberChild records the location of a new object when the location of its parent is known
+func rememberChild(id ObjectID, storageID StorageID, parentID ParentID, name string) {
+	if loc, ok := knownHandles.location(storageID, ObjectID(parentID)); ok {
+		knownHandles.remember(id, loc.child(name))
+	}
+}
+
+// findByPath walks a path from the storage root, the way GetObjectFromPath does, and returns the object at its end
+func findByPath(dev Device, loc objectLocation) (uint32, mtp.ObjectInfo, error) {
+	parent := uint32(RootParentID)
+	var info mtp.ObjectInfo
+	for _, name := range loc.path {
+		var handles mtp.Uint32Array
+		if err := dev.GetObjectHandles(loc.storageID, 0, parent, &handles); err != nil {
+			return 0, info, fmt.Errorf("GetObjectHandles failed: %w", err)
+		}
+
+		found := false
+		for _, h := range handles.Values {
+			if err := dev.GetObjectInfo(h, &info); err == nil && info.Filename == name {
+				parent, found = h, true
+				break
+			}
+		}
+		if !found {
+			return 0, info, fmt.Errorf("%w: %s", ErrObjectNotFound, loc)
+		}
+	}
+	return parent, info, nil
+}
+
+// locate returns the location of an object from its info, walking up its parents unless the index knows them
+func locate(dev Device, info *mtp.ObjectInfo) (objectLocation, error) {
+	parent, err := locateHandle(dev, StorageID(info.StorageID), info.ParentObject)
+	if err != nil {
+		return objectLocation{}, err
+	}
+	return parent.child(info.Filename), nil
+}
+
+// locateHandle returns the location of an object, asking the device unless the index knows it
+func locateHandle(dev Device, storageID StorageID, handle uint32) (objectLocation, error) {
+	if loc, ok := knownHandles.location(storageID, ObjectID(handle)); ok {
+		return loc, nil
+	}
+
+	var info mtp.ObjectInfo
+	if err := dev.GetObjectInfo(handle, &info); err != nil {
+		return objectLocation{}, fmt.Errorf("failed to get object info: %w", err)
+	}
+	loc, err := locate(dev, &info)
+	if err != nil {
+		return objectLocation{}, err
+	}
+	knownHandles.remember(ObjectID(handle), loc)
+	return loc, nil
+}
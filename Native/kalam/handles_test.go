@@ -0,0 +1,107 @@
+package kalam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// listPath lists the folders named by path from the root of the internal storage and returns the last listing
+func listPath(t *testing.T, client *Client, names ...string) []FileJSON {
+	t.Helper()
+
+	parent := RootParentID
+	files, err := client.ListFiles(context.Background(), 65537, parent)
+	for _, name := range names {
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, f := range files {
+			if f.Name == name {
+				parent, found = ParentID(f.ID), true
+			}
+		}
+		if !found {
+			t.Fatalf("%s not listed", name)
+		}
+		files, err = client.ListFiles(context.Background(), 65537, parent)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestStaleHandlesResolvedByPath(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	ctx := context.Background()
+
+	files := listPath(t, client, "DCIM", "Camera")
+	if len(files) != 3 {
+		t.Fatalf("listed %d photos, want 3", len(files))
+	}
+	photo, other := ObjectID(files[0].ID), ObjectID(files[1].ID)
+	want, _ := sim.FileData(photo)
+
+	// The media scanner ran, every handle the app holds is stale
+	sim.RenumberObjects()
+
+	dest := filepath.Join(t.TempDir(), "photo.jpg")
+	if err := client.DownloadFile(ctx, photo, dest); err != nil {
+		t.Fatalf("DownloadFile with a stale handle: %v", err)
+	}
+	if got, err := os.ReadFile(dest); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("downloaded %d bytes, want %d (%v)", len(got), len(want), err)
+	}
+
+	if err := client.RenameObject(ctx, other, "renamed.jpg"); err != nil {
+		t.Fatalf("RenameObject with a stale handle: %v", err)
+	}
+	// The renamed object is found again by its new name
+	sim.RenumberObjects()
+	if err := client.DeleteObject(ctx, other); err != nil {
+		t.Fatalf("DeleteObject with a stale handle: %v", err)
+	}
+
+	if files := listPath(t, client, "DCIM", "Camera"); len(files) != 2 {
+		t.Fatalf("listed %d photos after the delete, want 2", len(files))
+	}
+}
+
+func TestStaleFolderHandleResolvedByPath(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+
+	var camera ParentID
+	for _, f := range listPath(t, client, "DCIM") {
+		if f.Name == "Camera" {
+			camera = ParentID(f.ID)
+		}
+	}
+	sim.RenumberObjects()
+
+	files, err := client.ListFiles(context.Background(), 65537, camera)
+	if err != nil || len(files) != 3 {
+		t.Fatalf("ListFiles with a stale folder handle = %d files, %v", len(files), err)
+	}
+	if _, err := client.CreateFolder(context.Background(), 65537, camera, "Edits"); err != nil {
+		t.Fatalf("CreateFolder in a stale folder handle: %v", err)
+	}
+}
+
+func TestUnknownHandleStaysInvalid(t *testing.T) {
+	client := useSimDevice(t, NewDemoDevice())
+
+	// The bridge never handed out this handle, there is no path to find it by
+	err := client.DeleteObject(context.Background(), 4242)
+	if rc := mtp.RCError(0); !errors.As(err, &rc) || rc != mtp.RCError(mtp.RC_InvalidObjectHandle) {
+		t.Fatalf("DeleteObject of an unknown handle = %v, want InvalidObjectHandle", err)
+	}
+}
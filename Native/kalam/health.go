@@ -0,0 +1,198 @@
+package kalam
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/usb"
+)
+
+// DeviceState is the connection health of the device
+type DeviceState string
+
+const (
+	// DeviceUnknown is reported until the first operation or heartbeat
+	DeviceUnknown DeviceState = "unknown"
+	// DeviceConnected means the device answered the last operation or heartbeat
+	DeviceConnected DeviceState = "connected"
+	// DeviceDisconnected means the device left the bus or no session could be opened
+	DeviceDisconnected DeviceState = "disconnected"
+	// DeviceUnresponsive means the device is present but timed out
+	DeviceUnresponsive DeviceState = "unresponsive"
+	// DeviceEjected means the session was closed by Eject, the next operation opens it again
+	DeviceEjected DeviceState = "ejected"
+	// DeviceReleased means shared mode released the idle device to other processes, the next operation claims it again
+	DeviceReleased DeviceState = "released"
+	// DeviceInUse means the device is present but another process holds its USB interface
+	DeviceInUse DeviceState = "inUse"
+)
+
+// DeviceHealth is the connection state of the device and when it last changed
+type DeviceHealth struct {
+	State    DeviceState `json:"state"`
+	Since    time.Time   `json:"since"`
+	LastSeen time.Time   `json:"lastSeen,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	// Serial is the serial number of the device last connected, kept while it is away
+	Serial string `json:"serial,omitempty"`
+}
+
+// healthMonitor tracks the device state from operations and heartbeats and publishes its changes
+type healthMonitor struct {
+	mu       sync.Mutex
+	current  DeviceHealth
+	watchers map[chan DeviceHealth]struct{}
+
+	// reconnects counts the returns of the same device after a disconnect
+	reconnects uint64
+}
+
+// health is the state of the device behind the session
+var health = &healthMonitor{
+	current:  DeviceHealth{State: DeviceUnknown, Since: time.Now()},
+	watchers: make(map[chan DeviceHealth]struct{}),
+}
+
+// get returns the current health
+func (h *healthMonitor) get() DeviceHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.current
+}
+
+// reset forgets the device, e.g. when another opener is set
+func (h *healthMonitor) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.current = DeviceHealth{State: DeviceUnknown, Since: time.Now()}
+}
+
+// reconnectCount returns how often the device came back after a disconnect
+func (h *healthMonitor) reconnectCount() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.reconnects
+}
+
+// identify records that a session was opened with the device of the given serial number
+// The same serial after a disconnect is a reconnect, another one is a different device
+func (h *healthMonitor) identify(serial string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	prev := h.current
+	switch {
+	case prev.Serial != "" && prev.Serial != serial:
+		usbLog.Info("a different device was connected", "serial", serial, "previous", prev.Serial)
+	case prev.Serial == serial && prev.State == DeviceDisconnected:
+		h.reconnects++
+		handleEpoch.Add(1)
+		usbLog.Info("device reconnected", "serial", serial, "away", time.Since(prev.Since))
+	}
+
+	h.current.Serial = serial
+	h.update(DeviceConnected, nil)
+}
+
+// eject records that the device was released so it can be unplugged
+func (h *healthMonitor) eject() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.update(DeviceEjected, nil)
+}
+
+// release records that shared mode released the device to other processes
+func (h *healthMonitor) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.update(DeviceReleased, nil)
+}
+
+// observe records the outcome of an operation or heartbeat, err nil meaning the device answered
+// Failures that say nothing about the device, such as a closed session or a cancelled context, are ignored
+func (h *healthMonitor) observe(err error) {
+	state := deviceStateFor(err)
+	if state == DeviceUnknown {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.update(state, err)
+}
+
+// update changes the state and notifies the watchers, the caller holds h.mu
+func (h *healthMonitor) update(state DeviceState, err error) {
+	now := time.Now()
+	if state == DeviceConnected {
+		h.current.LastSeen = now
+	}
+	if state == h.current.State {
+		return
+	}
+
+	h.current.State = state
+	h.current.Since = now
+	h.current.Error = ""
+	if err != nil && state != DeviceConnected {
+		h.current.Error = err.Error()
+	}
+	usbLog.Info("device state changed", "state", state, "error", h.current.Error)
+
+	// Watchers that are not keeping up miss intermediate states, not the latest one
+	for ch := range h.watchers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- h.current
+	}
+}
+
+// watch returns a channel receiving every state change until ctx is done
+func (h *healthMonitor) watch(ctx context.Context) <-chan DeviceHealth {
+	ch := make(chan DeviceHealth, 1)
+
+	h.mu.Lock()
+	h.watchers[ch] = struct{}{}
+	h.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.watchers, ch)
+		close(ch)
+	})
+	return ch
+}
+
+// deviceStateFor maps the outcome of an operation to a device state, DeviceUnknown when it tells nothing
+// A response code is an answer from the device, so it counts as connected
+func deviceStateFor(err error) DeviceState {
+	var rc mtp.RCError
+	switch {
+	case err == nil || errors.As(err, &rc):
+		return DeviceConnected
+	case errors.Is(err, usb.ERROR_TIMEOUT):
+		return DeviceUnresponsive
+	case errors.Is(err, ErrDeviceInUse):
+		return DeviceInUse
+	case errors.Is(err, usb.ERROR_NO_DEVICE), errors.Is(err, errOpenFailed):
+		return DeviceDisconnected
+	default:
+		return DeviceUnknown
+	}
+}
+
+// DeviceHealth returns the connection state of the device as last seen by an operation or heartbeat
+func (c *Client) DeviceHealth() DeviceHealth {
+	return health.get()
+}
+
+// WatchDeviceHealth returns a channel receiving the state changes of the device until ctx is done
+func (c *Client) WatchDeviceHealth(ctx context.Context) <-chan DeviceHealth {
+	return health.watch(ctx)
+}
@@ -0,0 +1,111 @@
+package kalam
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// waitForState reads state changes until the device reaches state
+func waitForState(t *testing.T, changes <-chan DeviceHealth, state DeviceState) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case h := <-changes:
+			if h.State == state {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("device did not become %s, last state %+v", state, health.get())
+		}
+	}
+}
+
+func TestHeartbeatTracksDevice(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useConfig(t, func(c *Config) { c.Health.Interval = 10 * time.Millisecond })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := client.WatchDeviceHealth(ctx)
+
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, changes, DeviceConnected)
+
+	sim.Unplug()
+	waitForState(t, changes, DeviceDisconnected)
+	if h := client.DeviceHealth(); h.Error == "" {
+		t.Errorf("expected the disconnect to carry its error, got %+v", h)
+	}
+
+	sim.Plug()
+	waitForState(t, changes, DeviceConnected)
+	if n := sim.OpenSessions(); n != 1 {
+		t.Errorf("expected the heartbeat to reopen one session, got %d", n)
+	}
+}
+
+func TestHealthFromOperations(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useConfig(t, func(c *Config) { c.Timeouts.NormalOperation = 20 * time.Millisecond })
+	ctx := context.Background()
+
+	if got := client.DeviceHealth().State; got != DeviceUnknown {
+		t.Fatalf("expected a new device to be unknown, got %s", got)
+	}
+
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.DeviceHealth().State; got != DeviceConnected {
+		t.Fatalf("expected connected after a listing, got %s", got)
+	}
+
+	// A device answering with a response code is still connected
+	if _, err := client.ListFiles(ctx, 99, RootParentID); err == nil {
+		t.Fatalf("expected an invalid storage to fail")
+	}
+	if got := client.DeviceHealth().State; got != DeviceConnected {
+		t.Fatalf("expected connected after a response code, got %s", got)
+	}
+
+	sim.SetLatency(mtp.OC_GetObjectHandles, 50*time.Millisecond)
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err == nil {
+		t.Fatalf("expected the slow listing to time out")
+	}
+	if got := client.DeviceHealth().State; got != DeviceUnresponsive {
+		t.Fatalf("expected unresponsive after a timeout, got %s", got)
+	}
+}
+
+func TestOperationsSkipDeviceInfoProbe(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	ctx := context.Background()
+
+	if _, err := client.ListStorages(ctx); err != nil {
+		t.Fatal(err)
+	}
+	before := sim.Calls(mtp.OC_GetDeviceInfo)
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.CreateFolder(ctx, 65537, RootParentID, "probe"+string(rune('a'+i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := sim.Calls(mtp.OC_GetDeviceInfo); got != before {
+		t.Errorf("operations sent %d GetDeviceInfo probes", got-before)
+	}
+}
@@ -0,0 +1,337 @@
+package kalam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPBackend is the view of the device served by the embedded HTTP server, *Client implements it
+type HTTPBackend interface {
+	// ListStorages lists the storages of the connected device
+	ListStorages(ctx context.Context) ([]StorageJSON, error)
+
+	// ListFiles lists files in a directory
+	ListFiles(ctx context.Context, storageID StorageID, parentID ParentID) ([]FileJSON, error)
+
+	// ReadRange reads up to length bytes of an object starting at offset
+	ReadRange(ctx context.Context, objectID ObjectID, offset int64, length uint32) ([]byte, error)
+}
+
+// ErrObjectNotFound is returned when a path does not resolve to an object
+var ErrObjectNotFound = errors.New("object not found")
+
+// storageHandler serves device storages as /storage/<id>/<path>
+// Directories are returned as JSON listings and files honour Range headers through partial object reads
+type storageHandler struct {
+	backend HTTPBackend
+	paths   *pathCache
+}
+
+// ServeHTTP implements http.Handler
+func (h *storageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rest, ok := strings.CutPrefix(path.Clean(r.URL.Path), "/storage")
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		http.NotFound(w, r)
+		return
+	}
+	rest = strings.TrimPrefix(rest, "/")
+
+	// /storage lists all storages
+	if rest == "" {
+		storages, err := h.backend.ListStorages(r.Context())
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		writeJSON(w, storages)
+		return
+	}
+
+	idPart, objectPath, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseUint(idPart, 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid storage ID: %s", idPart), http.StatusBadRequest)
+		return
+	}
+	storageID := StorageID(id)
+	if err := storageID.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The storage root is a directory without an object of its own
+	if objectPath == "" {
+		h.serveDirectory(w, r, storageID, RootParentID)
+		return
+	}
+
+	file, err := resolvePath(r.Context(), h.backend, h.paths, storageID, objectPath)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	if file.IsFolder {
+		h.serveDirectory(w, r, storageID, ParentID(file.ID))
+		return
+	}
+
+	serveObjectContent(w, r, h.backend, file)
+}
+
+// serveDirectory writes the JSON listing of a directory
+func (h *storageHandler) serveDirectory(w http.ResponseWriter, r *http.Request, storageID StorageID, parentID ParentID) {
+	files, err := h.backend.ListFiles(r.Context(), storageID, parentID)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	if files == nil {
+		files = []FileJSON{}
+	}
+	writeJSON(w, files)
+}
+
+// ResolvePath walks the folder tree from the storage root to the object at objectPath
+func ResolvePath(ctx context.Context, backend HTTPBackend, storageID StorageID, objectPath string) (FileJSON, error) {
+	return resolvePath(ctx, backend, nil, storageID, objectPath)
+}
+
+// resolvePath walks the folder tree to the object at objectPath, starting below the deepest folder in paths, if any
+func resolvePath(ctx context.Context, backend HTTPBackend, paths *pathCache, storageID StorageID, objectPath string) (FileJSON, error) {
+	components := strings.Split(strings.Trim(objectPath, "/"), "/")
+
+	parentID := RootParentID
+	start := 0
+	for i := len(components); i > 0; i-- {
+		if f, ok := paths.get(storageID, components[:i]); ok {
+			if i == len(components) {
+				return f, nil
+			}
+			if !f.IsFolder {
+				return FileJSON{}, fmt.Errorf("%w: %s", ErrObjectNotFound, objectPath)
+			}
+			parentID, start = ParentID(f.ID), i
+			break
+		}
+	}
+
+	var current FileJSON
+	for i := start; i < len(components); i++ {
+		files, err := backend.ListFiles(ctx, storageID, parentID)
+		if err != nil {
+			return FileJSON{}, err
+		}
+		paths.putListing(storageID, components[:i], files)
+
+		found := false
+		for _, f := range files {
+			if f.Name == components[i] {
+				current = f
+				found = true
+				break
+			}
+		}
+
+		if !found || (!current.IsFolder && i < len(components)-1) {
+			return FileJSON{}, fmt.Errorf("%w: %s", ErrObjectNotFound, objectPath)
+		}
+
+		parentID = ParentID(current.ID)
+	}
+
+	return current, nil
+}
+
+// pathCacheTTL bounds how long a resolved path is trusted, changes made on the phone itself are seen after it
+const pathCacheTTL = 30 * time.Second
+
+// maxCachedPaths bounds the path cache, it starts over once it grows beyond
+const maxCachedPaths = 10000
+
+// pathCache remembers the objects URL paths resolved to, so a request only lists the folders below the deepest one known
+// WebDAV clients send a PROPFIND for every folder they show, walking from the storage root each time costs a
+// GetObjectHandles round-trip per level. The cache is dropped whenever the bridge changes objects on the device
+// and whenever the device may have renumbered them. A nil cache caches nothing
+type pathCache struct {
+	mu      sync.Mutex
+	changes uint64
+	epoch   uint64
+	entries map[pathKey]cachedPath
+}
+
+type pathKey struct {
+	storageID StorageID
+	path      string
+}
+
+type cachedPath struct {
+	file    FileJSON
+	expires time.Time
+}
+
+func newPathCache() *pathCache {
+	return &pathCache{entries: make(map[pathKey]cachedPath)}
+}
+
+// dropStale drops the entries cached before the last change to the device objects, the caller holds c.mu
+func (c *pathCache) dropStale() {
+	changes, epoch := objectChanges.Load(), handleEpoch.Load()
+	if changes != c.changes || epoch != c.epoch || len(c.entries) >= maxCachedPaths {
+		c.changes, c.epoch = changes, epoch
+		clear(c.entries)
+	}
+}
+
+// get returns the object at a path when it was resolved recently
+func (c *pathCache) get(storageID StorageID, components []string) (FileJSON, bool) {
+	if c == nil {
+		return FileJSON{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.dropStale()
+	key := pathKey{storageID: storageID, path: strings.Join(components, "/")}
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return FileJSON{}, false
+	}
+	return entry.file, true
+}
+
+// putListing caches the children of the folder at a path
+func (c *pathCache) putListing(storageID StorageID, folder []string, files []FileJSON) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.dropStale()
+	expires := time.Now().Add(pathCacheTTL)
+	for _, f := range files {
+		key := pathKey{storageID: storageID, path: strings.Join(append(slices.Clip(folder), f.Name), "/")}
+		c.entries[key] = cachedPath{file: f, expires: expires}
+	}
+}
+
+// forget drops every cached path
+func (c *pathCache) forget() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.entries)
+}
+
+// serveObjectContent streams a file, letting http.ServeContent handle Range and conditional requests
+func serveObjectContent(w http.ResponseWriter, r *http.Request, backend HTTPBackend, file FileJSON) {
+	objectID := ObjectID(file.ID)
+	stream := newReadStream(int64(file.Size), cfg().Stream.ChunkSize, func(offset int64, length uint32) ([]byte, error) {
+		return backend.ReadRange(r.Context(), objectID, offset, length)
+	})
+	defer stream.Close()
+
+	http.ServeContent(w, r, file.Name, time.Unix(file.ModTime, 0), stream)
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		bridgeLog.Warn("JSON encode failed", "error", err)
+	}
+}
+
+// writeHTTPError maps bridge errors to HTTP status codes
+func writeHTTPError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrObjectNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// localHostOnly rejects requests addressed to another host than the server itself
+// A web page can point its own host name at 127.0.0.1 (DNS rebinding) and read the device from the browser,
+// its requests still carry that host name in the Host header
+func localHostOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLocalHost(r) {
+			bridgeLog.Warn("rejected request for another host", "host", r.Host, "path", r.URL.Path)
+			http.Error(w, "invalid Host header", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLocalHost reports whether the Host header names localhost, a loopback address or the address the request came in on
+// IP addresses cannot be rebound to another server, so the address the server listens on is safe to allow
+func isLocalHost(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	localHost, _, err := net.SplitHostPort(local.String())
+	return err == nil && ip.Equal(net.ParseIP(localHost))
+}
+
+// NewHTTPHandler serves device storages under /storage/<id>/<path>
+// Backends that can modify the device are also exposed over WebDAV under /dav/, and metrics under /metrics
+// Requests must address the server as localhost or by its IP address
+func NewHTTPHandler(backend HTTPBackend) http.Handler {
+	paths := newPathCache()
+	storage := &storageHandler{backend: backend, paths: paths}
+	mux := http.NewServeMux()
+	mux.Handle("/storage", storage)
+	mux.Handle("/storage/", storage)
+
+	if dav, ok := backend.(DAVBackend); ok {
+		mux.Handle(DAVPrefix+"/", &davHandler{backend: dav, paths: paths})
+	}
+
+	if cfg().HTTP.Metrics {
+		mux.HandleFunc("/metrics", serveMetrics)
+	}
+
+	return localHostOnly(mux)
+}
@@ -0,0 +1,194 @@
+package kalam
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// newHTTPTestServer serves a simulated phone holding DCIM/clip.mp4 and notes.txt through the real Client
+func newHTTPTestServer(t *testing.T) (*httptest.Server, *Client) {
+	t.Helper()
+
+	sim := NewSimDevice()
+	sim.AddStorage(65537, "Internal shared storage", 1<<30)
+	dcim := sim.AddFolder(65537, RootParentID, "DCIM")
+	sim.AddFile(65537, ParentID(dcim), "clip.mp4", newTestObject(3*1024*1024))
+	sim.AddFile(65537, RootParentID, "notes.txt", []byte("hello"))
+
+	client := useSimDevice(t, sim)
+	server := httptest.NewServer(NewHTTPHandler(client))
+	t.Cleanup(server.Close)
+	return server, client
+}
+
+func getTestURL(t *testing.T, server *httptest.Server, path string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body of %s failed: %v", path, err)
+	}
+	return resp, body
+}
+
+func TestStorageHandlerListings(t *testing.T) {
+	server, _ := newHTTPTestServer(t)
+
+	resp, body := getTestURL(t, server, "/storage", nil)
+	var storages []StorageJSON
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &storages) != nil || len(storages) != 1 {
+		t.Fatalf("unexpected storage listing: %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = getTestURL(t, server, "/storage/65537/", nil)
+	var files []FileJSON
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &files) != nil || len(files) != 2 {
+		t.Fatalf("unexpected root listing: %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = getTestURL(t, server, "/storage/65537/DCIM", nil)
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &files) != nil || len(files) != 1 || files[0].Name != "clip.mp4" {
+		t.Fatalf("unexpected folder listing: %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestStorageHandlerFileAndRange(t *testing.T) {
+	server, _ := newHTTPTestServer(t)
+
+	resp, body := getTestURL(t, server, "/storage/65537/notes.txt", nil)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("unexpected file response: %d %q", resp.StatusCode, body)
+	}
+
+	video := newTestObject(3 * 1024 * 1024)
+	resp, body = getTestURL(t, server, "/storage/65537/DCIM/clip.mp4", http.Header{"Range": {"bytes=1048570-1048589"}})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected 206 for range request, got %d", resp.StatusCode)
+	}
+	if string(body) != string(video[1048570:1048590]) {
+		t.Fatalf("range body does not match object data")
+	}
+	if got := resp.Header.Get("Content-Range"); got != fmt.Sprintf("bytes 1048570-1048589/%d", len(video)) {
+		t.Fatalf("unexpected Content-Range %q", got)
+	}
+}
+
+func TestStorageHandlerServesSizeOver4GB(t *testing.T) {
+	sim := NewSimDevice()
+	sim.AddStorage(65537, "Internal shared storage", 1<<30)
+	notes := sim.AddFile(65537, RootParentID, "notes.txt", []byte("hello"))
+	server := httptest.NewServer(NewHTTPHandler(useSimDevice(t, sim)))
+	t.Cleanup(server.Close)
+
+	// Objects over 4GB report 0xFFFFFFFF in ObjectInfo, only the size property has their size
+	sim.mu.Lock()
+	sim.objects[uint32(notes)].info.CompressedSize = 0xFFFFFFFF
+	sim.mu.Unlock()
+
+	resp, body := getTestURL(t, server, "/storage/65537/notes.txt", nil)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" || resp.ContentLength != 5 {
+		t.Fatalf("file with a 64-bit size = %d, %d bytes announced, %q", resp.StatusCode, resp.ContentLength, body)
+	}
+}
+
+func TestStorageHandlerErrors(t *testing.T) {
+	server, _ := newHTTPTestServer(t)
+
+	if resp, _ := getTestURL(t, server, "/storage/65537/missing.txt", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for missing file, got %d", resp.StatusCode)
+	}
+	if resp, _ := getTestURL(t, server, "/storage/65537/notes.txt/child", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for path below a file, got %d", resp.StatusCode)
+	}
+	if resp, _ := getTestURL(t, server, "/storage/abc/", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid storage ID, got %d", resp.StatusCode)
+	}
+
+	resp, err := http.Post(server.URL+"/storage/65537/notes.txt", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for POST, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPHandlerRejectsOtherHosts(t *testing.T) {
+	server, _ := newHTTPTestServer(t)
+
+	if resp, _ := getTestURL(t, server, "/storage", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for the server address, got %d", resp.StatusCode)
+	}
+
+	for _, host := range []string{"localhost:8765", "attacker.example:8765", "attacker.example"} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/storage", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		want := http.StatusForbidden
+		if host == "localhost:8765" {
+			want = http.StatusOK
+		}
+		if resp.StatusCode != want {
+			t.Errorf("Host %s: got %d, want %d", host, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestHTTPHandlerCachesResolvedPaths(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	server := httptest.NewServer(NewHTTPHandler(client))
+	defer server.Close()
+
+	photo := "/storage/65537/DCIM/Camera/IMG_0001.jpg"
+	for i := 0; i < 3; i++ {
+		if resp, _ := getTestURL(t, server, photo, http.Header{"Range": {"bytes=0-9"}}); resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("expected 206 for the photo, got %d", resp.StatusCode)
+		}
+	}
+	// The storage root, DCIM and Camera are listed once
+	if n := sim.Calls(mtp.OC_GetObjectHandles); n != 3 {
+		t.Fatalf("three requests listed %d folders, want 3", n)
+	}
+
+	files := listPath(t, client, "DCIM", "Camera")
+	if err := client.RenameObject(context.Background(), ObjectID(files[0].ID), "renamed.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := getTestURL(t, server, photo, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for the old name after a rename, got %d", resp.StatusCode)
+	}
+	if resp, _ := getTestURL(t, server, "/storage/65537/DCIM/Camera/renamed.jpg", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for the new name after a rename, got %d", resp.StatusCode)
+	}
+}
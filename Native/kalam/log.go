@@ -0,0 +1,277 @@
+package kalam
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Logging subsystems, every record carries one in its "subsystem" attribute
+const (
+	LogPool     = "pool"
+	LogTransfer = "transfer"
+	LogScan     = "scan"
+	LogUSB      = "usb"
+	LogBridge   = "bridge"
+)
+
+// logLevel is the minimum level of every log sink
+var logLevel = new(slog.LevelVar)
+
+// logRing keeps the most recent records for RecentLogs
+var logRing = &logBuffer{}
+
+var (
+	logFileMu sync.Mutex
+	logFile   *rotatingFile
+)
+
+// logOutput receives the text records, stderr until SetLogOutput changes it
+// stdout stays free for the host, which may speak a protocol on it as the RPC helper does
+var logOutput = &textLogSink{w: os.Stderr}
+
+// rootLogger writes text to logOutput and JSON to the ring buffer and the log file
+var rootLogger = slog.New(&teeHandler{handlers: []slog.Handler{
+	slog.NewTextHandler(logOutput, &slog.HandlerOptions{Level: logLevel}),
+	slog.NewJSONHandler(jsonLogSink{}, &slog.HandlerOptions{Level: logLevel}),
+}})
+
+// Subsystem loggers of the package
+var (
+	poolLog     = Logger(LogPool)
+	transferLog = Logger(LogTransfer)
+	scanLog     = Logger(LogScan)
+	usbLog      = Logger(LogUSB)
+	bridgeLog   = Logger(LogBridge)
+)
+
+// Logger returns the logger of a subsystem, the bridge uses it for its own records
+func Logger(subsystem string) *slog.Logger {
+	return rootLogger.With("subsystem", subsystem)
+}
+
+// SetLogLevel sets the minimum level that is logged, Info by default
+func SetLogLevel(level slog.Level) {
+	logLevel.Set(level)
+}
+
+// ParseLogLevel parses a level name such as "debug", "info", "warn" or "error"
+func ParseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", name)
+	}
+	return level, nil
+}
+
+// SetLogOutput sets where text records are written, stderr by default, nil drops them
+// The ring buffer and the log file still receive every record
+func SetLogOutput(w io.Writer) {
+	if w == nil {
+		w = io.Discard
+	}
+	logOutput.set(w)
+}
+
+// SetLogFile also writes JSON records to path, rotating it when it reaches Logging.MaxFileSize
+// An empty path stops writing to the file
+func SetLogFile(path string) error {
+	var file *rotatingFile
+	if path != "" {
+		var err error
+		if file, err = openRotatingFile(path, cfg().Logging.MaxFileSize, cfg().Logging.MaxBackups); err != nil {
+			return err
+		}
+	}
+
+	logFileMu.Lock()
+	prev := logFile
+	logFile = file
+	logFileMu.Unlock()
+
+	if prev != nil {
+		return prev.Close()
+	}
+	return nil
+}
+
+// RecentLogs returns the buffered JSON records, oldest first, and empties the buffer
+func RecentLogs() []json.RawMessage {
+	return logRing.drain()
+}
+
+// teeHandler passes records to several handlers
+type teeHandler struct {
+	handlers []slog.Handler
+}
+
+func (h *teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h.handlers {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, handler := range h.handlers {
+		if !handler.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := handler.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (h *teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make([]slog.Handler, len(h.handlers))
+	for i, handler := range h.handlers {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return &teeHandler{handlers: handlers}
+}
+
+func (h *teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make([]slog.Handler, len(h.handlers))
+	for i, handler := range h.handlers {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return &teeHandler{handlers: handlers}
+}
+
+// textLogSink writes text records to a writer that may be changed while the bridge logs
+type textLogSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *textLogSink) set(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w = w
+}
+
+func (s *textLogSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// jsonLogSink receives one JSON record per Write
+type jsonLogSink struct{}
+
+func (jsonLogSink) Write(p []byte) (int, error) {
+	logRing.add(p)
+
+	logFileMu.Lock()
+	defer logFileMu.Unlock()
+	if logFile != nil {
+		return logFile.Write(p)
+	}
+	return len(p), nil
+}
+
+// logBuffer is a ring buffer of JSON records, holding up to Logging.RingSize of them
+type logBuffer struct {
+	mu      sync.Mutex
+	records []json.RawMessage
+}
+
+func (b *logBuffer) add(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The configuration is nil while it is loaded at startup
+	conf := cfg()
+	if conf == nil || conf.Logging.RingSize <= 0 {
+		return
+	}
+	max := conf.Logging.RingSize
+	if len(b.records) >= max {
+		b.records = b.records[len(b.records)-max+1:]
+	}
+
+	// The handler ends records with a newline and reuses p
+	record := make(json.RawMessage, len(p))
+	copy(record, p)
+	if n := len(record); n > 0 && record[n-1] == '\n' {
+		record = record[:n-1]
+	}
+	b.records = append(b.records, record)
+}
+
+func (b *logBuffer) drain() []json.RawMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	records := b.records
+	b.records = nil
+	return records
+}
+
+// rotatingFile is a log file that is moved to path.1, path.2, ... when it grows past maxSize
+type rotatingFile struct {
+	path       string
+	file       *os.File
+	size       int64
+	maxSize    int64
+	maxBackups int
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat log file: %w", err)
+	}
+	return &rotatingFile{path: path, file: file, size: info.Size(), maxSize: maxSize, maxBackups: maxBackups}, nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups, dropping the oldest, and starts an empty file
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+
+	if f.maxBackups > 0 {
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		os.Rename(f.path, f.path+".1")
+	}
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	f.file = file
+	f.size = 0
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,144 @@
+package kalam
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain drops text records, tests that look at them install their own output
+func TestMain(m *testing.M) {
+	SetLogOutput(nil)
+	os.Exit(m.Run())
+}
+
+// useLogLevel sets the log level for a test and empties the ring buffer
+func useLogLevel(t *testing.T, level slog.Level) {
+	t.Helper()
+
+	prev := logLevel.Level()
+	SetLogLevel(level)
+	RecentLogs()
+	t.Cleanup(func() { SetLogLevel(prev) })
+}
+
+func TestRecentLogs(t *testing.T) {
+	useLogLevel(t, slog.LevelInfo)
+
+	poolLog.Debug("hidden")
+	transferLog.Info("starting download", "name", "song.mp3", "size", 42)
+	scanLog.Warn("FetchStorages failed", "error", "busy")
+
+	records := RecentLogs()
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records above debug, got %d: %s", len(records), records)
+	}
+
+	var first struct {
+		Level     string `json:"level"`
+		Msg       string `json:"msg"`
+		Subsystem string `json:"subsystem"`
+		Name      string `json:"name"`
+		Size      int    `json:"size"`
+	}
+	if err := json.Unmarshal(records[0], &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Level != "INFO" || first.Msg != "starting download" || first.Subsystem != LogTransfer || first.Name != "song.mp3" || first.Size != 42 {
+		t.Errorf("unexpected record %s", records[0])
+	}
+	if !strings.Contains(string(records[1]), `"subsystem":"scan"`) {
+		t.Errorf("expected the scan subsystem in %s", records[1])
+	}
+
+	if records := RecentLogs(); len(records) != 0 {
+		t.Errorf("expected RecentLogs to drain the buffer, got %d records", len(records))
+	}
+}
+
+func TestSetLogOutput(t *testing.T) {
+	useLogLevel(t, slog.LevelInfo)
+	var out bytes.Buffer
+	SetLogOutput(&out)
+	t.Cleanup(func() { SetLogOutput(nil) })
+
+	usbLog.Info("device attached")
+	if !strings.Contains(out.String(), "msg=\"device attached\" subsystem=usb") {
+		t.Fatalf("expected the text record in the log output, got %q", out.String())
+	}
+
+	out.Reset()
+	SetLogOutput(nil)
+	usbLog.Info("device detached")
+	if out.Len() != 0 {
+		t.Fatalf("expected no text records after SetLogOutput(nil), got %q", out.String())
+	}
+	if records := RecentLogs(); len(records) != 2 {
+		t.Fatalf("expected the ring buffer to keep both records, got %d", len(records))
+	}
+}
+
+func TestRecentLogsKeepsNewest(t *testing.T) {
+	useLogLevel(t, slog.LevelInfo)
+	useConfig(t, func(c *Config) { c.Logging.RingSize = 3 })
+
+	for i := 0; i < 5; i++ {
+		poolLog.Info("record", "n", i)
+	}
+
+	records := RecentLogs()
+	if len(records) != 3 || !strings.Contains(string(records[0]), `"n":2`) || !strings.Contains(string(records[2]), `"n":4`) {
+		t.Fatalf("expected the 3 newest records, got %s", records)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for name, want := range map[string]slog.Level{"debug": slog.LevelDebug, "INFO": slog.LevelInfo, "warn": slog.LevelWarn, "error": slog.LevelError} {
+		if got, err := ParseLogLevel(name); err != nil || got != want {
+			t.Errorf("ParseLogLevel(%q) = %v, %v", name, got, err)
+		}
+	}
+	if _, err := ParseLogLevel("chatty"); err == nil {
+		t.Errorf("expected an unknown level to be rejected")
+	}
+}
+
+func TestLogFileRotation(t *testing.T) {
+	useLogLevel(t, slog.LevelInfo)
+	useConfig(t, func(c *Config) { c.Logging.MaxFileSize, c.Logging.MaxBackups = 512, 2 })
+
+	path := filepath.Join(t.TempDir(), "kalam.log")
+	if err := SetLogFile(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		usbLog.Info("transaction", "n", i, "padding", strings.Repeat("x", 40))
+	}
+	if err := SetLogFile(""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil || info.Size() == 0 || info.Size() > 512 {
+			t.Errorf("%s: %v, %v", filepath.Base(name), info, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("expected only 2 backups to be kept")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var last map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil || last["n"] != float64(49) {
+		t.Errorf("expected the newest record last in the log file, got %q (%v)", lines[len(lines)-1], err)
+	}
+}
@@ -0,0 +1,387 @@
+package kalam
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// latencyBuckets are the upper bounds in seconds of the operation latency histograms
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Histogram counts observations per latency bucket
+// Counts[i] holds those up to LatencyBuckets[i], the last entry those above every bound
+type Histogram struct {
+	Counts []int64 `json:"counts"`
+	Sum    float64 `json:"sumSeconds"`
+	Count  int64   `json:"count"`
+}
+
+// OperationStats are the counters of one MTP operation
+// Failures are keyed by error class: rc, usb, sync or other
+type OperationStats struct {
+	Calls    int64            `json:"calls"`
+	Failures map[string]int64 `json:"failures"`
+	BytesIn  int64            `json:"bytesIn"`
+	BytesOut int64            `json:"bytesOut"`
+	Latency  Histogram        `json:"latency"`
+}
+
+// PoolStats count how operations got a device session
+type PoolStats struct {
+	Hits         int64 `json:"hits"`
+	Misses       int64 `json:"misses"`
+	Closed       int64 `json:"closed"`
+	OpenFailures int64 `json:"openFailures"`
+	// SessionResets counts sessions the device lost and that were reopened on the same connection
+	SessionResets int64 `json:"sessionResets"`
+	// SharedReleases counts idle sessions closed in shared mode so other processes could claim the device
+	SharedReleases int64 `json:"sharedReleases"`
+}
+
+// Stats is a snapshot of the bridge metrics since Since
+type Stats struct {
+	Since          time.Time                  `json:"since"`
+	LatencyBuckets []float64                  `json:"latencyBuckets"`
+	Operations     map[string]*OperationStats `json:"operations"`
+	Retries        map[string]int64           `json:"retries"`
+	Pool           PoolStats                  `json:"pool"`
+}
+
+// metricsRegistry holds the counters behind Stats
+type metricsRegistry struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	m := &metricsRegistry{}
+	m.reset()
+	return m
+}
+
+func (m *metricsRegistry) reset() {
+	m.stats = Stats{
+		Since:          time.Now(),
+		LatencyBuckets: latencyBuckets,
+		Operations:     make(map[string]*OperationStats),
+		Retries:        make(map[string]int64),
+	}
+}
+
+// observe records one MTP transaction
+func (m *metricsRegistry) observe(op string, d time.Duration, err error, bytesIn, bytesOut int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.stats.Operations[op]
+	if !ok {
+		s = &OperationStats{Failures: make(map[string]int64), Latency: Histogram{Counts: make([]int64, len(latencyBuckets)+1)}}
+		m.stats.Operations[op] = s
+	}
+
+	s.Calls++
+	if err != nil {
+		s.Failures[captureErrorKind(err)]++
+	}
+	s.BytesIn += bytesIn
+	s.BytesOut += bytesOut
+
+	seconds := d.Seconds()
+	s.Latency.Counts[sort.SearchFloat64s(latencyBuckets, seconds)]++
+	s.Latency.Sum += seconds
+	s.Latency.Count++
+}
+
+// retry counts a retry of an operation of class
+func (m *metricsRegistry) retry(class OperationClass) {
+	m.mu.Lock()
+	m.stats.Retries[string(class)]++
+	m.mu.Unlock()
+}
+
+// pool updates the pool counters
+func (m *metricsRegistry) pool(update func(p *PoolStats)) {
+	m.mu.Lock()
+	update(&m.stats.Pool)
+	m.mu.Unlock()
+}
+
+// GetStats returns a copy of the metrics collected since the bridge started or ResetStats
+func GetStats() Stats {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	s := metrics.stats
+	s.Operations = make(map[string]*OperationStats, len(metrics.stats.Operations))
+	for op, o := range metrics.stats.Operations {
+		c := *o
+		c.Failures = make(map[string]int64, len(o.Failures))
+		for class, n := range o.Failures {
+			c.Failures[class] = n
+		}
+		c.Latency.Counts = append([]int64(nil), o.Latency.Counts...)
+		s.Operations[op] = &c
+	}
+	s.Retries = make(map[string]int64, len(metrics.stats.Retries))
+	for scope, n := range metrics.stats.Retries {
+		s.Retries[scope] = n
+	}
+	return s
+}
+
+// ResetStats clears all metrics
+func ResetStats() {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.reset()
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format
+func WritePrometheus(w io.Writer) error {
+	s := GetStats()
+
+	ops := make([]string, 0, len(s.Operations))
+	for op := range s.Operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	p := &promWriter{w: w}
+	p.header("kalam_mtp_operations_total", "counter", "MTP transactions run by the bridge.")
+	for _, op := range ops {
+		p.sample("kalam_mtp_operations_total", fmt.Sprintf(`op=%q`, op), float64(s.Operations[op].Calls))
+	}
+
+	p.header("kalam_mtp_operation_failures_total", "counter", "Failed MTP transactions by error class.")
+	for _, op := range ops {
+		classes := make([]string, 0, len(s.Operations[op].Failures))
+		for class := range s.Operations[op].Failures {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			p.sample("kalam_mtp_operation_failures_total", fmt.Sprintf(`op=%q,class=%q`, op, class), float64(s.Operations[op].Failures[class]))
+		}
+	}
+
+	p.header("kalam_mtp_bytes_total", "counter", "Bytes transferred by MTP transactions.")
+	for _, op := range ops {
+		p.sample("kalam_mtp_bytes_total", fmt.Sprintf(`op=%q,direction="in"`, op), float64(s.Operations[op].BytesIn))
+		p.sample("kalam_mtp_bytes_total", fmt.Sprintf(`op=%q,direction="out"`, op), float64(s.Operations[op].BytesOut))
+	}
+
+	p.header("kalam_mtp_operation_duration_seconds", "histogram", "Duration of MTP transactions.")
+	for _, op := range ops {
+		h := s.Operations[op].Latency
+		var cumulative int64
+		for i, bound := range s.LatencyBuckets {
+			cumulative += h.Counts[i]
+			p.sample("kalam_mtp_operation_duration_seconds_bucket", fmt.Sprintf(`op=%q,le="%s"`, op, strconv.FormatFloat(bound, 'g', -1, 64)), float64(cumulative))
+		}
+		p.sample("kalam_mtp_operation_duration_seconds_bucket", fmt.Sprintf(`op=%q,le="+Inf"`, op), float64(h.Count))
+		p.sample("kalam_mtp_operation_duration_seconds_sum", fmt.Sprintf(`op=%q`, op), h.Sum)
+		p.sample("kalam_mtp_operation_duration_seconds_count", fmt.Sprintf(`op=%q`, op), float64(h.Count))
+	}
+
+	p.header("kalam_retries_total", "counter", "Retries by operation class.")
+	for _, class := range OperationClasses {
+		p.sample("kalam_retries_total", fmt.Sprintf(`scope=%q`, class), float64(s.Retries[string(class)]))
+	}
+
+	p.header("kalam_pool_hits_total", "counter", "Operations that reused the open device session.")
+	p.sample("kalam_pool_hits_total", "", float64(s.Pool.Hits))
+	p.header("kalam_pool_misses_total", "counter", "Operations that opened a new device session.")
+	p.sample("kalam_pool_misses_total", "", float64(s.Pool.Misses))
+	p.header("kalam_pool_closed_total", "counter", "Device sessions found closed and reopened.")
+	p.sample("kalam_pool_closed_total", "", float64(s.Pool.Closed))
+	p.header("kalam_pool_open_failures_total", "counter", "Failed attempts to open a device session.")
+	p.sample("kalam_pool_open_failures_total", "", float64(s.Pool.OpenFailures))
+	p.header("kalam_pool_session_resets_total", "counter", "Sessions the device lost and that were reopened on the same connection.")
+	p.sample("kalam_pool_session_resets_total", "", float64(s.Pool.SessionResets))
+	p.header("kalam_pool_shared_releases_total", "counter", "Idle device sessions released to other processes in shared mode.")
+	p.sample("kalam_pool_shared_releases_total", "", float64(s.Pool.SharedReleases))
+
+	return p.err
+}
+
+// promWriter writes Prometheus samples, keeping the first error
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) header(name, kind, help string) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+}
+
+func (p *promWriter) sample(name, labels string, value float64) {
+	if p.err != nil {
+		return
+	}
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	_, p.err = fmt.Fprintf(p.w, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// serveMetrics serves /metrics for Prometheus
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := WritePrometheus(w); err != nil {
+		bridgeLog.Warn("failed to write metrics", "error", err)
+	}
+}
+
+// metricsDevice passes operations on to dev and records their metrics
+type metricsDevice struct {
+	dev Device
+}
+
+// observe records a finished transaction and returns its error
+func (d *metricsDevice) observe(op uint16, start time.Time, err error, bytesIn, bytesOut int64) error {
+	metrics.observe(captureName(mtp.OC_names, op), time.Since(start), err, bytesIn, bytesOut)
+	return err
+}
+
+func (d *metricsDevice) GetDeviceInfo(info *mtp.DeviceInfo) error {
+	start := time.Now()
+	err := d.dev.GetDeviceInfo(info)
+	return d.observe(mtp.OC_GetDeviceInfo, start, err, 0, 0)
+}
+
+func (d *metricsDevice) GetStorageIDs(ids *mtp.Uint32Array) error {
+	start := time.Now()
+	err := d.dev.GetStorageIDs(ids)
+	return d.observe(mtp.OC_GetStorageIDs, start, err, 0, 0)
+}
+
+func (d *metricsDevice) GetStorageInfo(storageID uint32, info *mtp.StorageInfo) error {
+	start := time.Now()
+	err := d.dev.GetStorageInfo(storageID, info)
+	return d.observe(mtp.OC_GetStorageInfo, start, err, 0, 0)
+}
+
+func (d *metricsDevice) GetObjectHandles(storageID, objFormatCode, parent uint32, handles *mtp.Uint32Array) error {
+	start := time.Now()
+	err := d.dev.GetObjectHandles(storageID, objFormatCode, parent, handles)
+	return d.observe(mtp.OC_GetObjectHandles, start, err, 0, 0)
+}
+
+func (d *metricsDevice) GetObjectInfo(handle uint32, info *mtp.ObjectInfo) error {
+	start := time.Now()
+	err := d.dev.GetObjectInfo(handle, info)
+	return d.observe(mtp.OC_GetObjectInfo, start, err, 0, 0)
+}
+
+func (d *metricsDevice) GetObjectPropValue(handle uint32, propCode uint16, value interface{}) error {
+	start := time.Now()
+	err := d.dev.GetObjectPropValue(handle, propCode, value)
+	return d.observe(mtp.OC_MTP_GetObjectPropValue, start, err, 0, 0)
+}
+
+func (d *metricsDevice) SetObjectPropValue(handle uint32, propCode uint16, value interface{}) error {
+	start := time.Now()
+	err := d.dev.SetObjectPropValue(handle, propCode, value)
+	return d.observe(mtp.OC_MTP_SetObjectPropValue, start, err, 0, 0)
+}
+
+func (d *metricsDevice) GetObject(handle uint32, w io.Writer, progressCb mtp.ProgressFunc) error {
+	start := time.Now()
+	counter := &countingWriter{w: w}
+	err := d.dev.GetObject(handle, counter, progressCb)
+	return d.observe(mtp.OC_GetObject, start, err, counter.n, 0)
+}
+
+func (d *metricsDevice) AndroidGetPartialObject64(handle uint32, w io.Writer, offset int64, size uint32) error {
+	start := time.Now()
+	counter := &countingWriter{w: w}
+	err := d.dev.AndroidGetPartialObject64(handle, counter, offset, size)
+	return d.observe(mtp.OC_ANDROID_GET_PARTIAL_OBJECT64, start, err, counter.n, 0)
+}
+
+func (d *metricsDevice) SendObjectInfo(wantStorageID, wantParent uint32, info *mtp.ObjectInfo) (storageID, parent, handle uint32, err error) {
+	start := time.Now()
+	storageID, parent, handle, err = d.dev.SendObjectInfo(wantStorageID, wantParent, info)
+	return storageID, parent, handle, d.observe(mtp.OC_SendObjectInfo, start, err, 0, 0)
+}
+
+func (d *metricsDevice) SendObject(r io.Reader, size int64, progressCb mtp.ProgressFunc) error {
+	start := time.Now()
+	counter := &countingReader{r: r}
+	err := d.dev.SendObject(counter, size, progressCb)
+	return d.observe(mtp.OC_SendObject, start, err, 0, counter.n)
+}
+
+func (d *metricsDevice) DeleteObject(handle uint32) error {
+	start := time.Now()
+	err := d.dev.DeleteObject(handle)
+	return d.observe(mtp.OC_DeleteObject, start, err, 0, 0)
+}
+
+func (d *metricsDevice) RunTransaction(req *mtp.Container, rep *mtp.Container, dest io.Writer, src io.Reader, writeSize int64, progressCb mtp.ProgressFunc) error {
+	start := time.Now()
+	var in *countingWriter
+	var out *countingReader
+	if dest != nil {
+		in = &countingWriter{w: dest}
+		dest = in
+	}
+	if src != nil {
+		out = &countingReader{r: src}
+		src = out
+	}
+
+	err := d.dev.RunTransaction(req, rep, dest, src, writeSize, progressCb)
+
+	var bytesIn, bytesOut int64
+	if in != nil {
+		bytesIn = in.n
+	}
+	if out != nil {
+		bytesOut = out.n
+	}
+	return d.observe(req.Code, start, err, bytesIn, bytesOut)
+}
+
+func (d *metricsDevice) SetTimeout(timeout time.Duration) {
+	d.dev.SetTimeout(timeout)
+}
+
+func (d *metricsDevice) CloseSession() error {
+	start := time.Now()
+	err := d.dev.CloseSession()
+	return d.observe(mtp.OC_CloseSession, start, err, 0, 0)
+}
+
+func (d *metricsDevice) ResetSession() error {
+	start := time.Now()
+	err := d.dev.ResetSession()
+	return d.observe(mtp.OC_OpenSession, start, err, 0, 0)
+}
+
+func (d *metricsDevice) Close() error {
+	return d.dev.Close()
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
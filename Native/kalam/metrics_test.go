@@ -0,0 +1,85 @@
+package kalam
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/usb"
+)
+
+func TestStats(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	ctx := context.Background()
+	ResetStats()
+
+	sim.InjectFault(SimFault{Op: mtp.OC_GetObjectHandles, Err: usb.ERROR_TIMEOUT, Times: 1})
+	sim.InjectFault(SimFault{Op: mtp.OC_DeleteObject, Err: mtp.RCError(mtp.RC_ObjectWriteProtected)})
+
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DownloadFile(ctx, 4, filepath.Join(t.TempDir(), "IMG_0002.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	client.DeleteObject(ctx, 1)
+
+	stats := GetStats()
+	data, _ := sim.FileData(4)
+	if get := stats.Operations["GetObject"]; get == nil || get.Calls != 1 || get.BytesIn != int64(len(data)) || get.Latency.Count != 1 {
+		t.Errorf("GetObject stats = %+v", get)
+	}
+	if handles := stats.Operations["GetObjectHandles"]; handles == nil || handles.Calls != 2 || handles.Failures[CaptureErrorUSB] != 1 {
+		t.Errorf("GetObjectHandles stats = %+v", handles)
+	}
+	if del := stats.Operations["DeleteObject"]; del == nil || del.Failures[CaptureErrorRC] != 1 {
+		t.Errorf("DeleteObject stats = %+v", del)
+	}
+	if stats.Retries[string(ClassMetadata)] != 1 {
+		t.Errorf("expected one metadata retry, got %v", stats.Retries)
+	}
+	if stats.Pool.Misses == 0 || stats.Pool.Hits == 0 {
+		t.Errorf("pool stats = %+v", stats.Pool)
+	}
+
+	// Snapshots are copies
+	stats.Operations["GetObject"].Failures["rc"] = 99
+	if GetStats().Operations["GetObject"].Failures["rc"] != 0 {
+		t.Errorf("GetStats returned shared counters")
+	}
+
+	ResetStats()
+	if stats := GetStats(); len(stats.Operations) != 0 || stats.Pool.Hits != 0 {
+		t.Errorf("ResetStats left %+v", stats)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	ResetStats()
+	metrics.observe("GetObjectInfo", 3e6, nil, 0, 0)
+	metrics.observe("GetObjectInfo", 2e9, mtp.RCError(mtp.RC_DeviceBusy), 0, 0)
+	metrics.retry(ClassScan)
+
+	rec := httptest.NewRecorder()
+	NewHTTPHandler(NewClient()).ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost:8765/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		"# TYPE kalam_mtp_operations_total counter",
+		`kalam_mtp_operations_total{op="GetObjectInfo"} 2`,
+		`kalam_mtp_operation_failures_total{op="GetObjectInfo",class="rc"} 1`,
+		`kalam_mtp_operation_duration_seconds_bucket{op="GetObjectInfo",le="0.005"} 1`,
+		`kalam_mtp_operation_duration_seconds_bucket{op="GetObjectInfo",le="2.5"} 2`,
+		`kalam_mtp_operation_duration_seconds_bucket{op="GetObjectInfo",le="+Inf"} 2`,
+		`kalam_retries_total{scope="scan"} 1`,
+		"kalam_pool_hits_total 0",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package kalam
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// partialReadSupport records which partial read operations a device advertises
+type partialReadSupport struct {
+	standard  bool // GetPartialObject, 32-bit offsets
+	android64 bool // AndroidGetPartialObject64, 64-bit offsets
+}
+
+// partialReadSupportCache caches partialReadSupport per open device connection
+var partialReadSupportCache sync.Map
+
+// detectPartialReadSupport inspects OperationsSupported of the device, caching the result per connection
+func detectPartialReadSupport(dev Device) (partialReadSupport, error) {
+	if cached, ok := partialReadSupportCache.Load(dev); ok {
+		return cached.(partialReadSupport), nil
+	}
+
+	var info mtp.DeviceInfo
+	if err := dev.GetDeviceInfo(&info); err != nil {
+		return partialReadSupport{}, fmt.Errorf("GetDeviceInfo failed: %w", err)
+	}
+
+	support := parsePartialReadSupport(info.OperationsSupported)
+	partialReadSupportCache.Store(dev, support)
+	return support, nil
+}
+
+// parsePartialReadSupport extracts partial read capabilities from an OperationsSupported list
+func parsePartialReadSupport(ops []uint16) partialReadSupport {
+	var support partialReadSupport
+	for _, op := range ops {
+		switch op {
+		case mtp.OC_GetPartialObject:
+			support.standard = true
+		case mtp.OC_ANDROID_GET_PARTIAL_OBJECT64:
+			support.android64 = true
+		}
+	}
+	return support
+}
+
+// selectPartialReadOp picks the operation used to read length bytes at offset
+// GetPartialObject is preferred while the range fits in 32 bits, larger offsets need the Android extension
+func selectPartialReadOp(support partialReadSupport, offset uint64, length uint32) (uint16, error) {
+	fitsIn32Bits := offset+uint64(length) <= math.MaxUint32
+
+	switch {
+	case support.standard && fitsIn32Bits:
+		return mtp.OC_GetPartialObject, nil
+	case support.android64:
+		return mtp.OC_ANDROID_GET_PARTIAL_OBJECT64, nil
+	case support.standard:
+		return 0, fmt.Errorf("offset %d exceeds the 32-bit range of GetPartialObject", offset)
+	default:
+		return 0, fmt.Errorf("device does not support partial object reads")
+	}
+}
+
+// getPartialObject32 reads a section of an object with the standard GetPartialObject operation
+// The vendored mtp.Device.GetPartialObject sends the Android 64-bit opcode with 32-bit params, so it is not used here
+func getPartialObject32(dev Device, handle uint32, w io.Writer, offset uint32, size uint32) error {
+	var req, rep mtp.Container
+	req.Code = mtp.OC_GetPartialObject
+	req.Param = []uint32{handle, offset, size}
+	return dev.RunTransaction(&req, &rep, w, nil, 0, mtp.EmptyProgressFunc)
+}
+
+// readObjectRange reads up to length bytes of an object starting at offset
+func readObjectRange(dev Device, handle uint32, offset uint64, length uint32, w io.Writer) error {
+	support, err := detectPartialReadSupport(dev)
+	if err != nil {
+		return err
+	}
+
+	op, err := selectPartialReadOp(support, offset, length)
+	if err != nil {
+		return err
+	}
+
+	if op == mtp.OC_GetPartialObject {
+		return getPartialObject32(dev, handle, w, uint32(offset), length)
+	}
+	return dev.AndroidGetPartialObject64(handle, w, int64(offset), length)
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ReadRange reads up to length bytes of an object starting at offset
+func (c *Client) ReadRange(ctx context.Context, objectID ObjectID, offset int64, length uint32) ([]byte, error) {
+	if err := objectID.Validate(); err != nil {
+		return nil, err
+	}
+
+	if offset < 0 {
+		return nil, fmt.Errorf("offset cannot be negative")
+	}
+
+	if length == 0 {
+		return nil, fmt.Errorf("length cannot be zero")
+	}
+
+	var buf bytes.Buffer
+	err := withObjectDevice(ctx, ClassMetadata, objectID, func(dev Device, handle uint32) error {
+		buf.Reset()
+		return readObjectRange(dev, handle, uint64(offset), length, &buf)
+	})
+	return buf.Bytes(), err
+}
+
+// DownloadRange writes up to length bytes of an object starting at offset to destPath
+// It returns the number of bytes written; the file is removed if the read fails
+func (c *Client) DownloadRange(ctx context.Context, objectID ObjectID, offset uint64, length uint32, destPath string) (int64, error) {
+	if err := objectID.Validate(); err != nil {
+		return 0, err
+	}
+
+	if length == 0 {
+		return 0, fmt.Errorf("length cannot be zero")
+	}
+
+	validatedPath, err := ValidateDestinationPath(destPath)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Create(validatedPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file %s: %w", validatedPath, err)
+	}
+	defer file.Close()
+
+	var written int64
+
+	err = withObjectDevice(ctx, ClassMetadata, objectID, func(dev Device, handle uint32) error {
+		// Start from an empty file on every attempt
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek file: %w", err)
+		}
+		if err := file.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate file: %w", err)
+		}
+
+		counter := &countingWriter{w: file}
+		if err := readObjectRange(dev, handle, offset, length, counter); err != nil {
+			return fmt.Errorf("partial read failed: %w", err)
+		}
+
+		written = counter.n
+		return nil
+	})
+
+	if err != nil {
+		file.Close()
+		os.Remove(validatedPath)
+		return 0, err
+	}
+
+	return written, nil
+}
@@ -0,0 +1,78 @@
+package kalam
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+func TestParsePartialReadSupport(t *testing.T) {
+	got := parsePartialReadSupport([]uint16{mtp.OC_GetObject, mtp.OC_GetPartialObject, mtp.OC_ANDROID_GET_PARTIAL_OBJECT64})
+	if !got.standard || !got.android64 {
+		t.Fatalf("expected both partial read operations, got %+v", got)
+	}
+
+	got = parsePartialReadSupport([]uint16{mtp.OC_GetObject})
+	if got.standard || got.android64 {
+		t.Fatalf("expected no partial read operations, got %+v", got)
+	}
+}
+
+func TestSelectPartialReadOp(t *testing.T) {
+	const large = uint64(5) << 30 // 5GB
+
+	tests := []struct {
+		name    string
+		support partialReadSupport
+		offset  uint64
+		want    uint16
+		wantErr bool
+	}{
+		{name: "standard for small offsets", support: partialReadSupport{standard: true, android64: true}, offset: 1024, want: mtp.OC_GetPartialObject},
+		{name: "android64 for large offsets", support: partialReadSupport{standard: true, android64: true}, offset: large, want: mtp.OC_ANDROID_GET_PARTIAL_OBJECT64},
+		{name: "android64 only", support: partialReadSupport{android64: true}, offset: 0, want: mtp.OC_ANDROID_GET_PARTIAL_OBJECT64},
+		{name: "standard cannot reach large offsets", support: partialReadSupport{standard: true}, offset: large, wantErr: true},
+		{name: "unsupported", support: partialReadSupport{}, offset: 0, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectPartialReadOp(tt.support, tt.offset, 4096)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectPartialReadOp() error = %v, wantErr = %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Fatalf("selectPartialReadOp() = 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadRangeRejectsInvalidArguments(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		objectID ObjectID
+		offset   int64
+		length   uint32
+	}{
+		{name: "invalid object", objectID: 0, offset: 0, length: 16},
+		{name: "negative offset", objectID: 1, offset: -1, length: 16},
+		{name: "zero length", objectID: 1, offset: 0, length: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := client.ReadRange(ctx, tt.objectID, tt.offset, tt.length); err == nil {
+				t.Fatalf("ReadRange(%d, %d, %d) succeeded", tt.objectID, tt.offset, tt.length)
+			}
+		})
+	}
+	if n := sim.Calls(mtp.OC_ANDROID_GET_PARTIAL_OBJECT64) + sim.Calls(mtp.OC_GetPartialObject); n != 0 {
+		t.Fatalf("invalid reads reached the device %d times", n)
+	}
+}
@@ -0,0 +1,272 @@
+package kalam
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ganeshrvel/usb"
+)
+
+// ErrPresenceUnsupported is returned by QuickPresence when the device opener does not connect over USB
+var ErrPresenceUnsupported = errors.New("presence detection is only available for USB devices")
+
+// PresenceJSON is an MTP device found on the bus without opening a session
+type PresenceJSON struct {
+	VendorID     uint16 `json:"vendorId"`
+	ProductID    uint16 `json:"productId"`
+	SerialNumber string `json:"serialNumber"`
+	// SessionOpen reports whether the bridge holds a session with the device
+	SessionOpen bool `json:"sessionOpen"`
+}
+
+// PresenceProbe lists the MTP devices present, without opening a session with them
+type PresenceProbe func() ([]PresenceJSON, error)
+
+// presence holds the probe used by QuickPresence and the scan cache
+var presence = struct {
+	mu    sync.Mutex
+	probe PresenceProbe
+}{probe: usbPresence}
+
+// SetPresenceProbe changes how devices are detected, e.g. to SimDevice.Presence
+// SetDeviceOpener restores the USB probe for the USB opener and clears it for any other
+func SetPresenceProbe(probe PresenceProbe) {
+	presence.mu.Lock()
+	presence.probe = probe
+	presence.mu.Unlock()
+	scans.forget()
+}
+
+// presenceProbe returns the current probe, nil when presence cannot be detected
+func presenceProbe() PresenceProbe {
+	presence.mu.Lock()
+	defer presence.mu.Unlock()
+	return presence.probe
+}
+
+// QuickPresence lists the MTP devices on the bus from their USB descriptors, without claiming them or opening a session
+// It is cheap enough to poll, unlike Scan
+func (c *Client) QuickPresence() ([]PresenceJSON, error) {
+	devices, err := detectPresence()
+	if err != nil {
+		return nil, err
+	}
+
+	open, serial := session.isOpen(), health.get().Serial
+	for i := range devices {
+		d := &devices[i]
+		d.SessionOpen = open && (d.SerialNumber == serial || d.SerialNumber == "" && len(devices) == 1)
+	}
+	return devices, nil
+}
+
+// detectPresence runs the presence probe
+func detectPresence() ([]PresenceJSON, error) {
+	probe := presenceProbe()
+	if probe == nil {
+		return nil, ErrPresenceUnsupported
+	}
+	devices, err := probe()
+	if err != nil {
+		return nil, fmt.Errorf("presence detection failed: %w", err)
+	}
+	if devices == nil {
+		devices = []PresenceJSON{}
+	}
+	return devices, nil
+}
+
+// presenceContext returns the libusb context presence is detected with, created by the first poll and kept for the
+// life of the process, so polling does not initialise libusb every time
+var presenceContext = sync.OnceValue(usb.NewContext)
+
+// usbPresence lists the USB devices with an MTP interface
+// mtp.FindDevices keeps the descriptors of its candidates to itself, so the bus is enumerated here with the
+// test of candidateFromDeviceDescriptor: an interface with bulk in, bulk out and interrupt in endpoints
+func usbPresence() ([]PresenceJSON, error) {
+	list, err := presenceContext().GetDeviceList()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if len(list) > 0 {
+			list.Done()
+		}
+	}()
+
+	var devices []PresenceJSON
+	seen := make(map[usbAddress]bool)
+	for _, d := range list {
+		dd, err := d.GetDeviceDescriptor()
+		if err != nil || !hasMTPInterface(d, dd) {
+			continue
+		}
+		addr := usbAddress{d.GetBusNumber(), d.GetDeviceAddress(), dd.IdVendor, dd.IdProduct}
+		seen[addr] = true
+		devices = append(devices, PresenceJSON{
+			VendorID:     dd.IdVendor,
+			ProductID:    dd.IdProduct,
+			SerialNumber: usbSerials.lookup(d, addr, dd.SerialNumber),
+		})
+	}
+	usbSerials.keep(seen)
+	return devices, nil
+}
+
+// hasMTPInterface applies the endpoint test of candidateFromDeviceDescriptor
+func hasMTPInterface(d *usb.Device, dd *usb.DeviceDescriptor) bool {
+	for i := byte(0); i < dd.NumConfigurations; i++ {
+		config, err := d.GetConfigDescriptor(i)
+		if err != nil {
+			return false
+		}
+		for _, iface := range config.Interfaces {
+			for _, alt := range iface.AltSetting {
+				if len(alt.EndPoints) != 3 {
+					continue
+				}
+				var send, fetch, event bool
+				for _, ep := range alt.EndPoints {
+					switch {
+					case ep.Direction() == usb.ENDPOINT_IN && ep.TransferType() == usb.TRANSFER_TYPE_INTERRUPT:
+						event = true
+					case ep.Direction() == usb.ENDPOINT_IN && ep.TransferType() == usb.TRANSFER_TYPE_BULK:
+						fetch = true
+					case ep.Direction() == usb.ENDPOINT_OUT && ep.TransferType() == usb.TRANSFER_TYPE_BULK:
+						send = true
+					}
+				}
+				if send && fetch && event {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// usbSerialCache keeps the serial numbers read from devices by bus address, which changes when a device is replugged
+// Reading the serial opens a handle to the device, without claiming it; later polls do not
+type usbSerialCache struct {
+	mu      sync.Mutex
+	serials map[usbAddress]string
+}
+
+type usbAddress struct {
+	bus, address    uint8
+	vendor, product uint16
+}
+
+// usbSerials caches the serial numbers of the devices on the bus
+var usbSerials = &usbSerialCache{serials: make(map[usbAddress]string)}
+
+// lookup returns the serial number of a device from its string descriptor index, "" when it has none or it cannot be read
+func (c *usbSerialCache) lookup(d *usb.Device, addr usbAddress, index uint8) string {
+	if index == 0 {
+		return ""
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if serial, ok := c.serials[addr]; ok {
+		return serial
+	}
+
+	h, err := d.Open()
+	if err != nil {
+		// Devices held exclusively by another process may refuse the handle, the next poll tries again
+		usbLog.Debug("cannot read device serial number", "vendor", addr.vendor, "product", addr.product, "error", err)
+		return ""
+	}
+	defer h.Close()
+
+	serial, err := h.GetStringDescriptorASCII(index)
+	if err != nil {
+		usbLog.Debug("cannot read device serial number", "vendor", addr.vendor, "product", addr.product, "error", err)
+		return ""
+	}
+	c.serials[addr] = serial
+	return serial
+}
+
+// keep forgets the serial numbers of devices no longer on the bus
+func (c *usbSerialCache) keep(present map[usbAddress]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for addr := range c.serials {
+		if !present[addr] {
+			delete(c.serials, addr)
+		}
+	}
+}
+
+// scanCache keeps the last full scan while the devices present stay the same
+type scanCache struct {
+	mu       sync.Mutex
+	presence string
+	devices  []DeviceJSON
+}
+
+// scans caches the result of Scan
+var scans = &scanCache{}
+
+// presenceKey identifies the set of devices present, regardless of their order and sessions
+func presenceKey(devices []PresenceJSON) string {
+	keys := make([]string, 0, len(devices))
+	for _, d := range devices {
+		keys = append(keys, fmt.Sprintf("%04x:%04x:%s", d.VendorID, d.ProductID, d.SerialNumber))
+	}
+	slices.Sort(keys)
+	return strings.Join(keys, ",")
+}
+
+// currentPresence returns the key of the devices present, ok is false when presence is unknown or no device is present
+// A bus without devices forgets the cached scan, so a device plugged in again is scanned again
+func (c *scanCache) currentPresence() (key string, ok bool) {
+	devices, err := detectPresence()
+	if err != nil {
+		if !errors.Is(err, ErrPresenceUnsupported) {
+			scanLog.Debug("presence unknown, scanning", "error", err)
+		}
+		return "", false
+	}
+	if len(devices) == 0 {
+		c.forget()
+		return "", false
+	}
+	return presenceKey(devices), true
+}
+
+// get returns the cached scan when it was made with the same devices present, nil otherwise
+func (c *scanCache) get(presence string) []DeviceJSON {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.devices == nil || c.presence != presence {
+		return nil
+	}
+	return slices.Clone(c.devices)
+}
+
+// put caches a scan made with the given devices present
+func (c *scanCache) put(presence string, devices []DeviceJSON) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.presence = presence
+	c.devices = slices.Clone(devices)
+}
+
+// forget drops the cached scan
+func (c *scanCache) forget() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.presence = ""
+	c.devices = nil
+}
@@ -0,0 +1,138 @@
+package kalam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// useSimPresence detects the simulated device as present on the bus
+func useSimPresence(t *testing.T, sim *SimDevice) {
+	t.Helper()
+
+	SetPresenceProbe(sim.Presence)
+	t.Cleanup(func() {
+		SetPresenceProbe(nil)
+	})
+}
+
+func TestQuickPresenceOpensNoSession(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useSimPresence(t, sim)
+
+	devices, err := client.QuickPresence()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].SerialNumber != "SIMDEMO01" || devices[0].SessionOpen {
+		t.Fatalf("QuickPresence = %+v, want the demo device without a session", devices)
+	}
+	if n := sim.Calls(mtp.OC_OpenSession); n != 0 {
+		t.Fatalf("QuickPresence opened %d sessions", n)
+	}
+
+	if _, err := client.ListStorages(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if devices, err := client.QuickPresence(); err != nil || len(devices) != 1 || !devices[0].SessionOpen {
+		t.Fatalf("QuickPresence with a session = %+v, %v", devices, err)
+	}
+
+	sim.Unplug()
+	if devices, err := client.QuickPresence(); err != nil || len(devices) != 0 {
+		t.Fatalf("QuickPresence of an unplugged device = %+v, %v", devices, err)
+	}
+}
+
+func TestQuickPresenceNeedsProbe(t *testing.T) {
+	client := useSimDevice(t, NewDemoDevice())
+
+	if _, err := client.QuickPresence(); !errors.Is(err, ErrPresenceUnsupported) {
+		t.Fatalf("QuickPresence without a probe = %v, want %v", err, ErrPresenceUnsupported)
+	}
+}
+
+func TestScanCachedUntilPresenceChanges(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useSimPresence(t, sim)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if devices, err := client.Scan(ctx); err != nil || len(devices) != 1 {
+			t.Fatalf("Scan = %+v, %v", devices, err)
+		}
+	}
+	if n := sim.Calls(mtp.OC_GetStorageIDs); n != 1 {
+		t.Fatalf("three scans of the same device asked for its storages %d times, want 1", n)
+	}
+
+	// Another phone shows up in place of the first one
+	sim.SetIdentity("Google", "Pixel 9 (simulated)", "SIMDEMO02")
+	devices, err := client.Scan(ctx)
+	if err != nil || len(devices) != 1 || devices[0].SerialNumber != "SIMDEMO02" {
+		t.Fatalf("Scan after the device changed = %+v, %v", devices, err)
+	}
+	if n := sim.Calls(mtp.OC_GetStorageIDs); n != 2 {
+		t.Fatalf("storages asked %d times, want 2", n)
+	}
+}
+
+func TestResetDeviceCacheForgetsScan(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useSimPresence(t, sim)
+	ctx := context.Background()
+
+	if _, err := client.Scan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ResetDeviceCache(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Scan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := sim.Calls(mtp.OC_GetStorageIDs); n != 2 {
+		t.Fatalf("storages asked %d times, want 2", n)
+	}
+}
+
+func TestScanForgottenAfterChanges(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useSimPresence(t, sim)
+	ctx := context.Background()
+
+	// freeSpace scans and returns the free space of the internal storage
+	freeSpace := func() uint64 {
+		t.Helper()
+		devices, err := client.Scan(ctx)
+		if err != nil || len(devices) != 1 || len(devices[0].Storage) == 0 {
+			t.Fatalf("Scan = %+v, %v", devices, err)
+		}
+		return devices[0].Storage[0].FreeSpace
+	}
+
+	before := freeSpace()
+	data := bytes.Repeat([]byte("x"), 4096)
+	if _, err := client.UploadReader(ctx, 65537, RootParentID, "upload.bin", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if after := freeSpace(); after != before-uint64(len(data)) {
+		t.Fatalf("free space after the upload = %d, want %d", after, before-uint64(len(data)))
+	}
+
+	calls := sim.Calls(mtp.OC_GetStorageIDs)
+	if err := client.RefreshStorage(ctx, 65537); err != nil {
+		t.Fatal(err)
+	}
+	freeSpace()
+	if n := sim.Calls(mtp.OC_GetStorageIDs); n != calls+1 {
+		t.Fatalf("the scan after RefreshStorage asked for the storages %d times, want 1", n-calls)
+	}
+}
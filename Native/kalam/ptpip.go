@@ -0,0 +1,502 @@
+package kalam
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// PTPIPPort is the TCP port PTP/IP responders listen on
+const PTPIPPort = 15740
+
+// PTP/IP packet types
+const (
+	ptpipInitCommandRequest = 1
+	ptpipInitCommandAck     = 2
+	ptpipInitEventRequest   = 3
+	ptpipInitEventAck       = 4
+	ptpipInitFail           = 5
+	ptpipOperationRequest   = 6
+	ptpipOperationResponse  = 7
+	ptpipEvent              = 8
+	ptpipStartData          = 9
+	ptpipData               = 10
+	ptpipCancel             = 11
+	ptpipEndData            = 12
+	ptpipProbeRequest       = 13
+	ptpipProbeResponse      = 14
+)
+
+const (
+	ptpipProtocolVersion = 0x00010000
+	ptpipHostName        = "Kalam"
+
+	// Data phase of an operation request
+	ptpipDataPhaseIn  = 1
+	ptpipDataPhaseOut = 2
+
+	ptpipHeaderSize    = 8
+	ptpipMaxPacketSize = 32 * 1024 * 1024
+	ptpipChunkSize     = 256 * 1024
+)
+
+// ptpipHostGUID identifies this host to responders
+var ptpipHostGUID = func() [16]byte {
+	var guid [16]byte
+	rand.Read(guid[:])
+	return guid
+}()
+
+// PTPIPOpener returns an opener connecting to the PTP/IP responder at addr, e.g. a camera on Wi-Fi
+// The port defaults to PTPIPPort
+func PTPIPOpener(addr string) DeviceOpener {
+	return func() (Device, error) {
+		return OpenPTPIP(addr)
+	}
+}
+
+// ptpipDevice is a device connected over PTP/IP
+// Containers travel on the command connection, the event connection only reports device resets
+type ptpipDevice struct {
+	transactionOps
+
+	mu      sync.Mutex
+	cmd     net.Conn
+	event   net.Conn
+	timeout time.Duration
+
+	// Name the responder reported in the handshake
+	name string
+
+	sessionOpen bool
+	sessionID   uint32
+	tid         uint32
+
+	// resets receives EC_DeviceReset events
+	resets chan struct{}
+}
+
+// OpenPTPIP connects to the PTP/IP responder at addr and opens a session
+func OpenPTPIP(addr string) (Device, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(PTPIPPort))
+	}
+
+	d := &ptpipDevice{timeout: cfg().Timeouts.QuickScan, resets: make(chan struct{}, 1)}
+	d.run = d.RunTransaction
+
+	if err := d.handshake(addr); err != nil {
+		d.closeConns()
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.openSession(); err != nil {
+		d.closeConns()
+		return nil, err
+	}
+
+	go serveEvents(d.event, d.resets)
+
+	usbLog.Info("connected to PTP/IP device", "name", d.name, "addr", addr)
+	return d, nil
+}
+
+// handshake opens the command and event connections
+func (d *ptpipDevice) handshake(addr string) error {
+	cmd, err := net.DialTimeout("tcp", addr, d.timeout)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %w", addr, err)
+	}
+	d.cmd = cmd
+	cmd.SetDeadline(time.Now().Add(d.timeout))
+
+	payload := append([]byte(nil), ptpipHostGUID[:]...)
+	payload = appendPTPIPString(payload, ptpipHostName)
+	payload = binary.LittleEndian.AppendUint32(payload, ptpipProtocolVersion)
+	if err := writePTPIPPacket(cmd, ptpipInitCommandRequest, payload); err != nil {
+		return fmt.Errorf("PTP/IP init failed: %w", err)
+	}
+
+	typ, ack, err := readPTPIPPacket(cmd)
+	if err != nil {
+		return fmt.Errorf("PTP/IP init failed: %w", err)
+	}
+	if err := checkPTPIPAck(typ, ack, ptpipInitCommandAck, 4+16); err != nil {
+		return err
+	}
+	connectionNumber := binary.LittleEndian.Uint32(ack)
+	d.name = readPTPIPString(ack[20:])
+
+	event, err := net.DialTimeout("tcp", addr, d.timeout)
+	if err != nil {
+		return fmt.Errorf("cannot open event connection to %s: %w", addr, err)
+	}
+	d.event = event
+	event.SetDeadline(time.Now().Add(d.timeout))
+
+	if err := writePTPIPPacket(event, ptpipInitEventRequest, binary.LittleEndian.AppendUint32(nil, connectionNumber)); err != nil {
+		return fmt.Errorf("PTP/IP event init failed: %w", err)
+	}
+	typ, ack, err = readPTPIPPacket(event)
+	if err != nil {
+		return fmt.Errorf("PTP/IP event init failed: %w", err)
+	}
+	if err := checkPTPIPAck(typ, ack, ptpipInitEventAck, 0); err != nil {
+		return err
+	}
+
+	event.SetDeadline(time.Time{})
+	return nil
+}
+
+// checkPTPIPAck checks a handshake answer is the wanted ack
+func checkPTPIPAck(typ uint32, payload []byte, want uint32, minSize int) error {
+	if typ == ptpipInitFail {
+		var reason uint32
+		if len(payload) >= 4 {
+			reason = binary.LittleEndian.Uint32(payload)
+		}
+		return fmt.Errorf("PTP/IP responder refused the connection (reason %d)", reason)
+	}
+	if typ != want || len(payload) < minSize {
+		return mtp.SyncError(fmt.Sprintf("got PTP/IP packet type %d with %d bytes in handshake, want type %d", typ, len(payload), want))
+	}
+	return nil
+}
+
+// openSession opens a session with a new ID, the caller holds d.mu or owns d
+func (d *ptpipDevice) openSession() error {
+	sessionID := newSessionID()
+
+	var rep mtp.Container
+	req := mtp.Container{Code: mtp.OC_OpenSession, Param: []uint32{sessionID}}
+	if err := d.runTransaction(&req, &rep, nil, nil, 0, mtp.EmptyProgressFunc); err != nil {
+		return fmt.Errorf("OpenSession failed: %w", err)
+	}
+	d.sessionOpen, d.sessionID, d.tid = true, sessionID, 1
+	return nil
+}
+
+// serveEvents answers probes on the event connection until it is closed and passes on EC_DeviceReset
+// Other events are not used, the bridge re-reads folders instead
+func serveEvents(event net.Conn, resets chan<- struct{}) {
+	for {
+		typ, payload, err := readPTPIPPacket(event)
+		if err != nil {
+			return
+		}
+		switch {
+		case typ == ptpipProbeRequest:
+			if err := writePTPIPPacket(event, ptpipProbeResponse, nil); err != nil {
+				return
+			}
+		case typ == ptpipEvent && len(payload) >= 2 && binary.LittleEndian.Uint16(payload) == mtp.EC_DeviceReset:
+			usbLog.Info("PTP/IP device reported a reset")
+			select {
+			case resets <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// DeviceReset receives the EC_DeviceReset events of the responder
+func (d *ptpipDevice) DeviceReset() <-chan struct{} {
+	return d.resets
+}
+
+// RunTransaction runs an operation over the command connection
+// Any failure other than a response code closes the connection, as the stream is out of sync
+func (d *ptpipDevice) RunTransaction(req *mtp.Container, rep *mtp.Container, dest io.Writer, src io.Reader, writeSize int64, progressCb mtp.ProgressFunc) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cmd == nil {
+		return fmt.Errorf("mtp: cannot run operation %v, device is not open", mtp.OC_names[int(req.Code)])
+	}
+
+	err := d.runTransaction(req, rep, dest, src, writeSize, progressCb)
+	var rc mtp.RCError
+	if err != nil && !errors.As(err, &rc) {
+		usbLog.Warn("PTP/IP transaction failed, closing connection", "error", err)
+		d.closeConns()
+	}
+	return err
+}
+
+// runTransaction sends the request and the data phase, then reads the data and response, the caller holds d.mu
+func (d *ptpipDevice) runTransaction(req *mtp.Container, rep *mtp.Container, dest io.Writer, src io.Reader, writeSize int64, progressCb mtp.ProgressFunc) error {
+	if progressCb == nil {
+		progressCb = mtp.EmptyProgressFunc
+	}
+	if d.sessionOpen {
+		req.SessionID = d.sessionID
+		req.TransactionID = d.tid
+		d.tid++
+	}
+
+	phase := uint32(ptpipDataPhaseIn)
+	if src != nil {
+		phase = ptpipDataPhaseOut
+	}
+	payload := binary.LittleEndian.AppendUint32(nil, phase)
+	payload = binary.LittleEndian.AppendUint16(payload, req.Code)
+	payload = binary.LittleEndian.AppendUint32(payload, req.TransactionID)
+	for _, p := range req.Param {
+		payload = binary.LittleEndian.AppendUint32(payload, p)
+	}
+	if err := d.writeCmd(ptpipOperationRequest, payload); err != nil {
+		return err
+	}
+
+	if src != nil {
+		if err := d.sendDataPhase(req.TransactionID, src, writeSize, progressCb); err != nil {
+			return err
+		}
+	}
+
+	var unexpectedData bool
+	var received int64
+	for {
+		d.cmd.SetDeadline(time.Now().Add(d.timeout))
+		typ, payload, err := readPTPIPPacket(d.cmd)
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case ptpipStartData, ptpipData, ptpipEndData:
+			if len(payload) < 4 {
+				return mtp.SyncError(fmt.Sprintf("short PTP/IP data packet of %d bytes", len(payload)))
+			}
+			if dest == nil {
+				dest = io.Discard
+				unexpectedData = true
+			}
+			if typ == ptpipStartData {
+				continue
+			}
+
+			data := payload[4:]
+			if _, err := dest.Write(data); err != nil {
+				return err
+			}
+			received += int64(len(data))
+			if err := progressCb(received); err != nil {
+				return err
+			}
+
+		case ptpipOperationResponse:
+			if len(payload) < 6 {
+				return mtp.SyncError(fmt.Sprintf("short PTP/IP response of %d bytes", len(payload)))
+			}
+			rep.Code = binary.LittleEndian.Uint16(payload)
+			rep.TransactionID = binary.LittleEndian.Uint32(payload[2:])
+			rep.Param = nil
+			for rest := payload[6:]; len(rest) >= 4; rest = rest[4:] {
+				rep.Param = append(rep.Param, binary.LittleEndian.Uint32(rest))
+			}
+			return d.checkResponse(req, rep, unexpectedData)
+
+		default:
+			return mtp.SyncError(fmt.Sprintf("got PTP/IP packet type %d, want data or response", typ))
+		}
+	}
+}
+
+// sendDataPhase sends the data phase of a request in chunks
+func (d *ptpipDevice) sendDataPhase(tid uint32, src io.Reader, size int64, progressCb mtp.ProgressFunc) error {
+	start := binary.LittleEndian.AppendUint32(nil, tid)
+	start = binary.LittleEndian.AppendUint64(start, uint64(size))
+	if err := d.writeCmd(ptpipStartData, start); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4+min(size, ptpipChunkSize))
+	binary.LittleEndian.PutUint32(buf, tid)
+
+	var sent int64
+	for {
+		n, err := io.ReadFull(src, buf[4:4+min(size-sent, ptpipChunkSize)])
+		if err != nil {
+			return fmt.Errorf("reading data to send: %w", err)
+		}
+		sent += int64(n)
+
+		typ := uint32(ptpipData)
+		if sent == size {
+			typ = ptpipEndData
+		}
+		if err := d.writeCmd(typ, buf[:4+n]); err != nil {
+			return err
+		}
+		if err := progressCb(sent); err != nil {
+			return err
+		}
+		if sent == size {
+			return nil
+		}
+	}
+}
+
+// checkResponse turns the response into an error like mtp.Device does
+func (d *ptpipDevice) checkResponse(req *mtp.Container, rep *mtp.Container, unexpectedData bool) error {
+	if unexpectedData {
+		return mtp.SyncError(fmt.Sprintf("unexpected data for code %s", captureName(mtp.OC_names, req.Code)))
+	}
+	if rep.Code != mtp.RC_OK {
+		return mtp.RCError(rep.Code)
+	}
+	if d.sessionOpen && rep.TransactionID != req.TransactionID {
+		return mtp.SyncError(fmt.Sprintf("transaction ID mismatch got %x want %x", rep.TransactionID, req.TransactionID))
+	}
+	rep.SessionID = req.SessionID
+	return nil
+}
+
+// writeCmd writes a packet to the command connection
+func (d *ptpipDevice) writeCmd(typ uint32, payload []byte) error {
+	d.cmd.SetDeadline(time.Now().Add(d.timeout))
+	return writePTPIPPacket(d.cmd, typ, payload)
+}
+
+// SetTimeout sets how long a single packet may take before the connection fails
+func (d *ptpipDevice) SetTimeout(timeout time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.timeout = timeout
+}
+
+// CloseSession ends the session, Close then only closes the connections
+func (d *ptpipDevice) CloseSession() error {
+	err := d.transactionOps.CloseSession()
+
+	d.mu.Lock()
+	d.sessionOpen = false
+	d.mu.Unlock()
+	return err
+}
+
+// ResetSession ends the session the responder may have lost and opens a new one on the same connections
+func (d *ptpipDevice) ResetSession() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cmd == nil {
+		return fmt.Errorf("mtp: cannot run operation %v, device is not open", mtp.OC_names[int(mtp.OC_OpenSession)])
+	}
+
+	if d.sessionOpen {
+		// A responder that lost the session answers SessionNotOpen
+		var req, rep mtp.Container
+		req.Code = mtp.OC_CloseSession
+		err := d.runTransaction(&req, &rep, nil, nil, 0, mtp.EmptyProgressFunc)
+		var rc mtp.RCError
+		if err != nil && !errors.As(err, &rc) {
+			d.closeConns()
+			return err
+		}
+		d.sessionOpen = false
+	}
+
+	if err := d.openSession(); err != nil {
+		var rc mtp.RCError
+		if !errors.As(err, &rc) {
+			d.closeConns()
+		}
+		return err
+	}
+	return nil
+}
+
+// Close closes the session and both connections
+func (d *ptpipDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cmd == nil {
+		return nil
+	}
+	if d.sessionOpen {
+		var req, rep mtp.Container
+		req.Code = mtp.OC_CloseSession
+		d.runTransaction(&req, &rep, nil, nil, 0, mtp.EmptyProgressFunc)
+	}
+	return d.closeConns()
+}
+
+// closeConns closes both connections, the caller holds d.mu or owns d
+func (d *ptpipDevice) closeConns() error {
+	var err error
+	if d.cmd != nil {
+		err = d.cmd.Close()
+		d.cmd = nil
+	}
+	if d.event != nil {
+		d.event.Close()
+		d.event = nil
+	}
+	d.sessionOpen = false
+	return err
+}
+
+// writePTPIPPacket writes a packet with its length and type header
+func writePTPIPPacket(w io.Writer, typ uint32, payload []byte) error {
+	packet := make([]byte, ptpipHeaderSize, ptpipHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(packet, uint32(ptpipHeaderSize+len(payload)))
+	binary.LittleEndian.PutUint32(packet[4:], typ)
+	_, err := w.Write(append(packet, payload...))
+	return err
+}
+
+// readPTPIPPacket reads a packet and returns its type and payload
+func readPTPIPPacket(r io.Reader) (uint32, []byte, error) {
+	var header [ptpipHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[:])
+	if length < ptpipHeaderSize || length > ptpipMaxPacketSize {
+		return 0, nil, mtp.SyncError(fmt.Sprintf("invalid PTP/IP packet length %d", length))
+	}
+
+	payload := make([]byte, length-ptpipHeaderSize)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return binary.LittleEndian.Uint32(header[4:]), payload, nil
+}
+
+// appendPTPIPString appends a null-terminated UTF-16LE string
+func appendPTPIPString(b []byte, s string) []byte {
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, c)
+	}
+	return binary.LittleEndian.AppendUint16(b, 0)
+}
+
+// readPTPIPString reads a null-terminated UTF-16LE string
+func readPTPIPString(b []byte) string {
+	var chars []uint16
+	for ; len(b) >= 2; b = b[2:] {
+		c := binary.LittleEndian.Uint16(b)
+		if c == 0 {
+			break
+		}
+		chars = append(chars, c)
+	}
+	return string(utf16.Decode(chars))
+}
@@ -0,0 +1,374 @@
+package kalam
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// ptpipResponder serves a SimDevice over PTP/IP on loopback
+type ptpipResponder struct {
+	ln     net.Listener
+	sim    *SimDevice
+	refuse bool
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	nextConn uint32
+	probed   atomic.Bool
+	wg       sync.WaitGroup
+}
+
+func startPTPIPResponder(t *testing.T, sim *SimDevice) *ptpipResponder {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &ptpipResponder{ln: ln, sim: sim}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.conns = append(r.conns, conn)
+			r.mu.Unlock()
+
+			r.wg.Add(1)
+			go func() {
+				defer r.wg.Done()
+				defer conn.Close()
+				r.serve(conn)
+			}()
+		}
+	}()
+
+	// Sessions still pooled by the client are cut off
+	t.Cleanup(func() {
+		ln.Close()
+		r.mu.Lock()
+		for _, conn := range r.conns {
+			conn.Close()
+		}
+		r.mu.Unlock()
+		r.wg.Wait()
+	})
+	return r
+}
+
+func (r *ptpipResponder) addr() string {
+	return r.ln.Addr().String()
+}
+
+// serve answers the init packet of a connection and then its requests
+func (r *ptpipResponder) serve(conn net.Conn) {
+	typ, _, err := readPTPIPPacket(conn)
+	if err != nil {
+		return
+	}
+
+	switch typ {
+	case ptpipInitCommandRequest:
+		if r.refuse {
+			writePTPIPPacket(conn, ptpipInitFail, binary.LittleEndian.AppendUint32(nil, 1))
+			return
+		}
+		dev, err := r.sim.Open()
+		if err != nil {
+			writePTPIPPacket(conn, ptpipInitFail, binary.LittleEndian.AppendUint32(nil, 2))
+			return
+		}
+		defer dev.Close()
+
+		r.mu.Lock()
+		r.nextConn++
+		number := r.nextConn
+		r.mu.Unlock()
+
+		ack := binary.LittleEndian.AppendUint32(nil, number)
+		ack = append(ack, make([]byte, 16)...)
+		ack = appendPTPIPString(ack, "Simulated Camera")
+		ack = binary.LittleEndian.AppendUint32(ack, ptpipProtocolVersion)
+		writePTPIPPacket(conn, ptpipInitCommandAck, ack)
+
+		for r.serveRequest(conn, dev) {
+		}
+
+	case ptpipInitEventRequest:
+		writePTPIPPacket(conn, ptpipInitEventAck, nil)
+
+		// Events are ignored by the client, probes must be answered
+		writePTPIPPacket(conn, ptpipEvent, binary.LittleEndian.AppendUint16(nil, 0x4002))
+		writePTPIPPacket(conn, ptpipProbeRequest, nil)
+		if typ, _, err := readPTPIPPacket(conn); err == nil && typ == ptpipProbeResponse {
+			r.probed.Store(true)
+		}
+		readPTPIPPacket(conn)
+	}
+}
+
+// serveRequest runs one operation request against the simulated device
+func (r *ptpipResponder) serveRequest(conn net.Conn, dev Device) bool {
+	typ, payload, err := readPTPIPPacket(conn)
+	if err != nil || typ != ptpipOperationRequest || len(payload) < 10 {
+		return false
+	}
+	phase := binary.LittleEndian.Uint32(payload)
+	req := mtp.Container{Code: binary.LittleEndian.Uint16(payload[4:]), TransactionID: binary.LittleEndian.Uint32(payload[6:])}
+	for rest := payload[10:]; len(rest) >= 4; rest = rest[4:] {
+		req.Param = append(req.Param, binary.LittleEndian.Uint32(rest))
+	}
+
+	var dataOut []byte
+	if phase == ptpipDataPhaseOut {
+		for {
+			typ, payload, err := readPTPIPPacket(conn)
+			if err != nil {
+				return false
+			}
+			if typ == ptpipData || typ == ptpipEndData {
+				dataOut = append(dataOut, payload[4:]...)
+			}
+			if typ == ptpipEndData {
+				break
+			}
+		}
+	}
+
+	dataIn, repParams, err := r.dispatch(dev, &req, dataOut)
+	code := uint16(mtp.RC_OK)
+	if err != nil {
+		code = mtp.RC_GeneralError
+		var rc mtp.RCError
+		if errors.As(err, &rc) {
+			code = uint16(rc)
+		}
+	}
+
+	if len(dataIn) > 0 {
+		tid := binary.LittleEndian.AppendUint32(nil, req.TransactionID)
+		writePTPIPPacket(conn, ptpipStartData, binary.LittleEndian.AppendUint64(tid, uint64(len(dataIn))))
+		half := len(dataIn) / 2
+		writePTPIPPacket(conn, ptpipData, append(tid, dataIn[:half]...))
+		writePTPIPPacket(conn, ptpipEndData, append(tid, dataIn[half:]...))
+	}
+
+	rep := binary.LittleEndian.AppendUint16(nil, code)
+	rep = binary.LittleEndian.AppendUint32(rep, req.TransactionID)
+	for _, p := range repParams {
+		rep = binary.LittleEndian.AppendUint32(rep, p)
+	}
+	return writePTPIPPacket(conn, ptpipOperationResponse, rep) == nil
+}
+
+// dispatch maps a request onto the Device methods of the simulated session
+func (r *ptpipResponder) dispatch(dev Device, req *mtp.Container, dataOut []byte) ([]byte, []uint32, error) {
+	param := func(i int) uint32 {
+		if i < len(req.Param) {
+			return req.Param[i]
+		}
+		return 0
+	}
+	encode := func(value interface{}, err error) ([]byte, []uint32, error) {
+		if err != nil {
+			return nil, nil, err
+		}
+		var buf bytes.Buffer
+		err = mtp.Encode(&buf, value)
+		return buf.Bytes(), nil, err
+	}
+
+	switch req.Code {
+	case mtp.OC_OpenSession:
+		return nil, nil, dev.ResetSession()
+	case mtp.OC_CloseSession:
+		return nil, nil, nil
+	case mtp.OC_GetDeviceInfo:
+		var info mtp.DeviceInfo
+		return encode(&info, dev.GetDeviceInfo(&info))
+	case mtp.OC_GetStorageIDs:
+		var ids mtp.Uint32Array
+		return encode(&ids, dev.GetStorageIDs(&ids))
+	case mtp.OC_GetStorageInfo:
+		var info mtp.StorageInfo
+		return encode(&info, dev.GetStorageInfo(param(0), &info))
+	case mtp.OC_GetObjectHandles:
+		var handles mtp.Uint32Array
+		return encode(&handles, dev.GetObjectHandles(param(0), param(1), param(2), &handles))
+	case mtp.OC_GetObjectInfo:
+		var info mtp.ObjectInfo
+		return encode(&info, dev.GetObjectInfo(param(0), &info))
+	case mtp.OC_MTP_GetObjectPropValue:
+		if param(1) == mtp.OPC_ObjectFileName {
+			var name mtp.StringValue
+			return encode(&name, dev.GetObjectPropValue(param(0), uint16(param(1)), &name))
+		}
+		var size mtp.Uint64Value
+		return encode(&size, dev.GetObjectPropValue(param(0), uint16(param(1)), &size))
+	case mtp.OC_MTP_SetObjectPropValue:
+		var name mtp.StringValue
+		if err := mtp.Decode(bytes.NewReader(dataOut), &name); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, dev.SetObjectPropValue(param(0), uint16(param(1)), &name)
+	case mtp.OC_GetObject:
+		var buf bytes.Buffer
+		err := dev.GetObject(param(0), &buf, mtp.EmptyProgressFunc)
+		return buf.Bytes(), nil, err
+	case mtp.OC_ANDROID_GET_PARTIAL_OBJECT64:
+		var buf bytes.Buffer
+		err := dev.AndroidGetPartialObject64(param(0), &buf, int64(param(1))|int64(param(2))<<32, param(3))
+		return buf.Bytes(), nil, err
+	case mtp.OC_SendObjectInfo:
+		var info mtp.ObjectInfo
+		if err := mtp.Decode(bytes.NewReader(dataOut), &info); err != nil {
+			return nil, nil, err
+		}
+		sid, parent, handle, err := dev.SendObjectInfo(param(0), param(1), &info)
+		return nil, []uint32{sid, parent, handle}, err
+	case mtp.OC_SendObject:
+		return nil, nil, dev.SendObject(bytes.NewReader(dataOut), int64(len(dataOut)), mtp.EmptyProgressFunc)
+	case mtp.OC_DeleteObject:
+		return nil, nil, dev.DeleteObject(param(0))
+	default:
+		var buf bytes.Buffer
+		var rep mtp.Container
+		err := dev.RunTransaction(req, &rep, &buf, nil, 0, mtp.EmptyProgressFunc)
+		return buf.Bytes(), rep.Param, err
+	}
+}
+
+func TestPTPIPClientEndToEnd(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	responder := startPTPIPResponder(t, sim)
+	SetDeviceOpener(PTPIPOpener(responder.addr()))
+	ctx := context.Background()
+
+	devices, err := client.Scan(ctx)
+	if err != nil || len(devices) != 1 || devices[0].SerialNumber != "SIMDEMO01" {
+		t.Fatalf("Scan = %+v, %v", devices, err)
+	}
+
+	root, err := client.ListFiles(ctx, 65537, RootParentID)
+	if err != nil || len(root) != 3 {
+		t.Fatalf("ListFiles(root) = %+v, %v", root, err)
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "clip.mp4")
+	content := bytes.Repeat([]byte("ptpip"), 120000)
+	if err := os.WriteFile(src, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fileID, err := client.UploadFile(ctx, 65537, RootParentID, src)
+	if err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	if data, ok := sim.FileData(fileID); !ok || !bytes.Equal(data, content) {
+		t.Fatalf("device holds %d bytes after upload, want %d", len(data), len(content))
+	}
+
+	dest := filepath.Join(dir, "copy.mp4")
+	if err := client.DownloadFile(ctx, fileID, dest); err != nil {
+		t.Fatalf("DownloadFile failed: %v", err)
+	}
+	if data, err := os.ReadFile(dest); err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("downloaded file does not match upload (%v)", err)
+	}
+
+	if part, err := client.ReadRange(ctx, fileID, 7, 9); err != nil || !bytes.Equal(part, content[7:16]) {
+		t.Fatalf("ReadRange = %q, %v", part, err)
+	}
+	if err := client.RenameObject(ctx, fileID, "renamed.mp4"); err != nil {
+		t.Fatalf("RenameObject failed: %v", err)
+	}
+	if err := client.DeleteObject(ctx, fileID); err != nil {
+		t.Fatalf("DeleteObject failed: %v", err)
+	}
+	if err := client.DeleteObject(ctx, fileID); !errors.Is(err, mtp.RCError(mtp.RC_InvalidObjectHandle)) {
+		t.Fatalf("expected InvalidObjectHandle for a deleted object, got %v", err)
+	}
+
+	if !responder.probed.Load() {
+		t.Errorf("expected the probe on the event connection to be answered")
+	}
+}
+
+func TestPTPIPSessionReset(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	responder := startPTPIPResponder(t, sim)
+	SetDeviceOpener(PTPIPOpener(responder.addr()))
+	ctx := context.Background()
+
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatal(err)
+	}
+	opened := sim.Calls(mtp.OC_OpenSession)
+
+	sim.Reset(false)
+	if files, err := client.ListFiles(ctx, 65537, RootParentID); err != nil || len(files) != 3 {
+		t.Fatalf("ListFiles after the reset = %d files, %v", len(files), err)
+	}
+	if calls := sim.Calls(mtp.OC_OpenSession) - opened; calls != 1 {
+		t.Errorf("expected one new session on the same connection, got %d OpenSession calls", calls)
+	}
+}
+
+func TestPTPIPRefused(t *testing.T) {
+	responder := startPTPIPResponder(t, NewSimDevice())
+	responder.refuse = true
+
+	_, err := OpenPTPIP(responder.addr())
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("expected the connection to be refused, got %v", err)
+	}
+}
+
+func TestPTPIPTimeoutClosesConnection(t *testing.T) {
+	sim := NewDemoDevice()
+	responder := startPTPIPResponder(t, sim)
+
+	dev, err := OpenPTPIP(responder.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	sim.SetLatency(mtp.OC_GetStorageIDs, 200*time.Millisecond)
+	dev.SetTimeout(20 * time.Millisecond)
+
+	var ids mtp.Uint32Array
+	if err := dev.GetStorageIDs(&ids); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if err := dev.GetStorageIDs(&ids); err == nil || !strings.Contains(err.Error(), "device is not open") {
+		t.Fatalf("expected the connection to be closed after the timeout, got %v", err)
+	}
+}
+
+func TestPTPIPStrings(t *testing.T) {
+	for _, s := range []string{"", "Kalam", "Caméra 📷"} {
+		if got := readPTPIPString(appendPTPIPString(nil, s)); got != s {
+			t.Errorf("round trip of %q = %q", s, got)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package kalam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// errNoReconnect is returned when the device did not come back within Reconnect.GracePeriod
+var errNoReconnect = errors.New("device did not reconnect")
+
+// errDifferentDevice is returned when another device was connected in place of the one an operation waited for
+var errDifferentDevice = errors.New("a different device was connected")
+
+// awaitReconnect waits until the device that was connected before the disconnect is back
+// The grace period counts from the disconnect, so jobs queued later wait only for what is left of it
+func (h *healthMonitor) awaitReconnect(ctx context.Context, grace time.Duration) error {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	changes := h.watch(watchCtx)
+
+	current := h.get()
+	if current.Serial == "" || grace <= 0 {
+		return errNoReconnect
+	}
+	if current.State == DeviceConnected {
+		return nil
+	}
+
+	deadline := time.NewTimer(time.Until(current.Since.Add(grace)))
+	defer deadline.Stop()
+
+	for {
+		select {
+		case changed := <-changes:
+			if changed.State != DeviceConnected {
+				continue
+			}
+			if changed.Serial != current.Serial {
+				return fmt.Errorf("%w: %w", errNoReconnect, errDifferentDevice)
+			}
+			return nil
+		case <-deadline.C:
+			return fmt.Errorf("%w within %s", errNoReconnect, grace)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// doAwaitingReconnect runs a job, when no session can be opened it waits for the same device to return and runs the job again
+// Only jobs that did not start are run again, a job failing part way is left to the retries of the caller
+func doAwaitingReconnect(ctx context.Context, priority int, fn func(Device) error) error {
+	for {
+		err := session.do(ctx, priority, false, fn)
+		if !errors.Is(err, errOpenFailed) || errors.Is(err, ErrDeviceInUse) {
+			// A device held by another process is present, waiting for it to reconnect would not help
+			return err
+		}
+
+		transferLog.Info("device is away, waiting for it to reconnect", "error", err)
+		if waitErr := health.awaitReconnect(ctx, cfg().Reconnect.GracePeriod); waitErr != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			transferLog.Debug("not waiting for the device", "reason", waitErr)
+			if errors.Is(waitErr, errDifferentDevice) {
+				// Not the device the operation was meant for, so it is not attempted again
+				return fmt.Errorf("%w: %w", err, errDifferentDevice)
+			}
+			return err
+		}
+	}
+}
+
+// resumableObject follows an object across reconnects and session resets by its path, the device may give it a new handle
+type resumableObject struct {
+	id    ObjectID
+	loc   objectLocation
+	size  uint32
+	epoch uint64
+}
+
+// newResumableObject records the path of an object from the storage root
+func newResumableObject(dev Device, id ObjectID, info *mtp.ObjectInfo) (*resumableObject, error) {
+	loc, err := locate(dev, info)
+	if err != nil {
+		return nil, err
+	}
+	knownHandles.remember(id, loc)
+
+	return &resumableObject{
+		id:    id,
+		loc:   loc,
+		size:  info.CompressedSize,
+		epoch: handleEpoch.Load(),
+	}, nil
+}
+
+// handle returns the handle of the object, resolving its path again after a reconnect or session reset
+func (o *resumableObject) handle(dev Device) (uint32, error) {
+	epoch := handleEpoch.Load()
+	if epoch == o.epoch {
+		return uint32(o.id), nil
+	}
+
+	handle, info, err := findByPath(dev, o.loc)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the object again after reconnect: %w", err)
+	}
+	if info.CompressedSize != o.size {
+		return 0, fmt.Errorf("object changed while the device was away: %s", o.loc)
+	}
+
+	if ObjectID(handle) != o.id {
+		transferLog.Info("object has a new handle after reconnect", "path", o.loc, "old", o.id, "new", handle)
+		knownHandles.renumber(o.id, ObjectID(handle), o.loc)
+	}
+	o.id = ObjectID(handle)
+	o.epoch = epoch
+	return handle, nil
+}
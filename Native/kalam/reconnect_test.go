@@ -0,0 +1,151 @@
+package kalam
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// useReconnect waits up to grace for unplugged devices and probes for them every few milliseconds
+func useReconnect(t *testing.T, grace time.Duration) {
+	useConfig(t, func(c *Config) {
+		c.Health.Interval = 10 * time.Millisecond
+		c.Reconnect.GracePeriod = grace
+	})
+}
+
+// replugWhenAway plugs the device back in once the bridge noticed it is gone, changing its handles meanwhile
+func replugWhenAway(client *Client, sim *SimDevice) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	changes := client.WatchDeviceHealth(ctx)
+	go func() {
+		defer cancel()
+		for h := range changes {
+			if h.State == DeviceDisconnected {
+				sim.RenumberObjects()
+				sim.Plug()
+				return
+			}
+		}
+	}()
+}
+
+func TestReconnectResumesChunkedDownload(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useReconnect(t, 5*time.Second)
+	useConfig(t, func(c *Config) { c.Stream.ChunkSize = 1024 })
+	ctx := context.Background()
+
+	folder := sim.AddFolder(65537, RootParentID, "Videos")
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	id := sim.AddFile(65537, ParentID(folder), "clip.bin", data)
+	chunks := len(data) / 1024
+
+	sim.InjectFault(SimFault{Op: mtp.OC_GetPartialObject, Skip: chunks / 2, Times: 1, Disconnect: true})
+	replugWhenAway(client, sim)
+
+	dest := filepath.Join(t.TempDir(), "clip.bin")
+	if err := client.DownloadFile(ctx, id, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(dest)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("downloaded %d bytes, want %d (%v)", len(got), len(data), err)
+	}
+	if calls := sim.Calls(mtp.OC_GetPartialObject); calls != chunks+1 {
+		t.Errorf("expected the download to resume with %d partial reads, got %d", chunks+1, calls)
+	}
+	if n := health.reconnectCount(); n == 0 {
+		t.Errorf("expected the reconnect to be counted")
+	}
+}
+
+func TestReconnectRunsQueuedOperations(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useReconnect(t, 5*time.Second)
+	ctx := context.Background()
+
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatal(err)
+	}
+
+	sim.Unplug()
+	replugWhenAway(client, sim)
+
+	files, err := client.ListFiles(ctx, 65537, RootParentID)
+	if err != nil || len(files) != 3 {
+		t.Fatalf("ListFiles after reconnect = %d files, %v", len(files), err)
+	}
+	if h := client.DeviceHealth(); h.State != DeviceConnected || h.Serial != "SIMDEMO01" {
+		t.Errorf("unexpected health after reconnect: %+v", h)
+	}
+}
+
+func TestReconnectGracePeriod(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useReconnect(t, 50*time.Millisecond)
+	ctx := context.Background()
+
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatal(err)
+	}
+
+	sim.Unplug()
+	start := time.Now()
+	_, err := client.ListFiles(ctx, 65537, RootParentID)
+	if err == nil || !strings.Contains(err.Error(), "no MTP devices found") {
+		t.Fatalf("expected the missing device to fail the listing, got %v", err)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("the listing waited %s, beyond the grace period", waited)
+	}
+}
+
+func TestReconnectIgnoresDifferentDevice(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useReconnect(t, 5*time.Second)
+	ctx := context.Background()
+
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatal(err)
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	changes := client.WatchDeviceHealth(watchCtx)
+	sim.Unplug()
+	waitForState(t, changes, DeviceDisconnected)
+
+	// The listing waits for the device, a different one ends the wait
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.ListFiles(ctx, 65537, RootParentID)
+		result <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	sim.SetIdentity("Google", "Pixel 9 (simulated)", "SIMDEMO02")
+	sim.Plug()
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatalf("expected the listing for the previous device to fail")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the listing kept waiting for the previous device")
+	}
+	if h := client.DeviceHealth(); h.Serial != "SIMDEMO02" {
+		t.Errorf("expected the new device to be reported, got %+v", h)
+	}
+}
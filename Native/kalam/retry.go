@@ -0,0 +1,175 @@
+package kalam
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/usb"
+)
+
+// OperationClass groups the operations that share a retry policy
+type OperationClass string
+
+const (
+	// ClassScan is a device scan or device info query, run with the short scan timeout
+	ClassScan OperationClass = "scan"
+	// ClassMetadata reads listings, object and storage info
+	ClassMetadata OperationClass = "metadata"
+	// ClassTransfer moves file data, a chunked download retries each chunk on its own
+	ClassTransfer OperationClass = "transfer"
+	// ClassMutation creates, renames, moves or deletes objects on the device
+	ClassMutation OperationClass = "mutation"
+)
+
+// OperationClasses lists every operation class
+var OperationClasses = []OperationClass{ClassScan, ClassMetadata, ClassTransfer, ClassMutation}
+
+// RetryPolicy sets how often an operation is attempted and how long to wait in between
+// The n-th retry waits BaseDelay·2^(n-1), at most MaxDelay, varied by up to JitterPercent either way
+type RetryPolicy struct {
+	Attempts      int
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	JitterPercent int
+}
+
+// backoff returns the wait before a retry, 1 being the first
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+
+	// Jitter keeps clients that failed together from retrying together
+	if spread := int64(d) * int64(p.JitterPercent) / 100; spread > 0 {
+		d += time.Duration(rand.Int64N(2*spread+1) - spread)
+	}
+	return d
+}
+
+// retryPolicy returns the policy of an operation class
+func (c *Config) retryPolicy(class OperationClass) RetryPolicy {
+	switch class {
+	case ClassScan:
+		return c.Retry.Scan
+	case ClassTransfer:
+		return c.Retry.Transfer
+	case ClassMutation:
+		return c.Retry.Mutation
+	default:
+		return c.Retry.Metadata
+	}
+}
+
+// logger returns the subsystem logger of an operation class
+func (class OperationClass) logger() *slog.Logger {
+	switch class {
+	case ClassScan:
+		return scanLog
+	case ClassTransfer:
+		return transferLog
+	default:
+		return poolLog
+	}
+}
+
+// partialSuccessError is the failure of an operation that already changed the device
+type partialSuccessError struct {
+	err error
+}
+
+func (e *partialSuccessError) Error() string { return e.err.Error() }
+
+func (e *partialSuccessError) Unwrap() error { return e.err }
+
+// partialSuccess marks a failure after a non-idempotent step succeeded, such as SendObject after
+// SendObjectInfo created the object; running the operation again would repeat that step, so it is not retried
+func partialSuccess(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &partialSuccessError{err: err}
+}
+
+// retryable reports whether another attempt of an operation of class may succeed where this one failed
+// A response code is a considered answer of the device, only DeviceBusy and a lost session are worth asking again
+func retryable(class OperationClass, err error) bool {
+	var partial *partialSuccessError
+	var rc mtp.RCError
+	var usbErr usb.Error
+	var syncErr mtp.SyncError
+	switch {
+	case errors.As(err, &partial),
+		errors.Is(err, ErrDeviceInUse),
+		errors.Is(err, errDifferentDevice),
+		errors.Is(err, ErrDeviceUnresponsive),
+		errors.Is(err, errShuttingDown),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, errOpenFailed):
+		// A phone still enumerating or waiting for the user to allow access opens on a later attempt,
+		// transfers and mutations already waited for a reconnect and fail rather than keep the user waiting
+		return class == ClassScan || class == ClassMetadata
+	case isDeviceClosedError(err):
+		// The session was closed, the next attempt opens a new one
+		return true
+	case sessionLost(err):
+		// The session was reset, the next attempt runs in the new one
+		return true
+	case errors.As(err, &rc):
+		return rc == mtp.RCError(mtp.RC_DeviceBusy)
+	case errors.As(err, &usbErr), errors.As(err, &syncErr):
+		return true
+	default:
+		errorStr := strings.ToLower(err.Error())
+		return strings.Contains(errorStr, "timeout") ||
+			strings.Contains(errorStr, "busy") ||
+			strings.Contains(errorStr, "connection")
+	}
+}
+
+// retry runs attempt until it succeeds, fails for good or the policy runs out of attempts
+// ctx cancels the waits between attempts, not an attempt already running
+func retry(ctx context.Context, class OperationClass, policy RetryPolicy, attempt func() error) error {
+	log := class.logger()
+
+	for n := 1; ; n++ {
+		// An open circuit breaker fails fast instead of queueing more work for a stuck device
+		if err := breaker.allow(); err != nil {
+			return err
+		}
+
+		err := attempt()
+		if err == nil {
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		if !retryable(class, err) {
+			log.Debug("operation failed, not retrying", "class", class, "error", err)
+			return err
+		}
+		if n >= policy.Attempts {
+			log.Warn("operation failed, no attempts left", "class", class, "attempts", n, "error", err)
+			return err
+		}
+
+		delay := policy.backoff(n)
+		log.Info("retrying operation", "class", class, "attempt", n+1, "maxAttempts", policy.Attempts, "backoff", delay, "error", err)
+		metrics.retry(class)
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package kalam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/usb"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{Attempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: 350 * time.Millisecond}
+	for retry, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 350 * time.Millisecond, 10: 350 * time.Millisecond} {
+		if got := p.backoff(retry); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", retry, got, want)
+		}
+	}
+
+	p.JitterPercent = 20
+	varied := false
+	for i := 0; i < 100; i++ {
+		d := p.backoff(1)
+		if d < 80*time.Millisecond || d > 120*time.Millisecond {
+			t.Fatalf("backoff with 20%% jitter = %s, want 80ms to 120ms", d)
+		}
+		varied = varied || d != 100*time.Millisecond
+	}
+	if !varied {
+		t.Errorf("expected the jitter to vary the backoff")
+	}
+}
+
+func TestRetryPolicyPerClass(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useConfig(t, func(c *Config) {
+		c.Retry.Metadata.Attempts = 5
+		c.Retry.MaxConsecutiveFailures = 0
+	})
+	ctx := context.Background()
+
+	sim.InjectFault(SimFault{Op: mtp.OC_GetObjectHandles, Err: usb.ERROR_TIMEOUT})
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err == nil {
+		t.Fatalf("expected the timeouts to fail the listing")
+	}
+	if calls := sim.Calls(mtp.OC_GetObjectHandles); calls != 5 {
+		t.Errorf("expected 5 attempts by the metadata policy, got %d", calls)
+	}
+
+	// A response code other than DeviceBusy is not retried
+	sim.ClearFaults()
+	sim.InjectFault(SimFault{Op: mtp.OC_GetObjectHandles, Err: mtp.RCError(mtp.RC_InvalidStorageId)})
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err == nil {
+		t.Fatalf("expected the response code to fail the listing")
+	}
+	if calls := sim.Calls(mtp.OC_GetObjectHandles); calls != 6 {
+		t.Errorf("expected a single attempt for InvalidStorageId, got %d", calls-5)
+	}
+}
+
+func TestDownloadRetriesOnlyByPolicy(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useConfig(t, func(c *Config) { c.Retry.MaxConsecutiveFailures = 0 })
+
+	id := sim.AddFile(65537, RootParentID, "note.txt", []byte("hello"))
+	sim.InjectFault(SimFault{Op: mtp.OC_GetObject, Err: usb.ERROR_TIMEOUT})
+
+	if err := client.DownloadFile(context.Background(), id, filepath.Join(t.TempDir(), "note.txt")); err == nil {
+		t.Fatalf("expected the download to fail")
+	}
+	if calls, want := sim.Calls(mtp.OC_GetObject), cfg().Retry.Transfer.Attempts; calls != want {
+		t.Errorf("expected %d GetObject attempts, got %d", want, calls)
+	}
+}
+
+func TestUploadNotRetriedAfterPartialSuccess(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+
+	sim.InjectFault(SimFault{Op: mtp.OC_SendObject, Times: 1, Err: usb.ERROR_TIMEOUT})
+	data := []byte("report")
+	if _, err := client.UploadReader(context.Background(), 65537, RootParentID, "report.txt", bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Fatalf("expected the upload to fail")
+	}
+	if calls := sim.Calls(mtp.OC_SendObjectInfo); calls != 1 {
+		t.Errorf("expected SendObjectInfo not to be repeated, got %d calls", calls)
+	}
+}
+
+func TestOpenFailureRetriedByClass(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	ctx := context.Background()
+
+	// The phone is still enumerating for the next refusals opens
+	var refusals atomic.Int32
+	SetDeviceOpener(func() (Device, error) {
+		if refusals.Add(-1) >= 0 {
+			return nil, errors.New("no MTP devices found")
+		}
+		return sim.Open()
+	})
+
+	refusals.Store(1)
+	if _, err := client.CreateFolder(ctx, 65537, RootParentID, "Backup"); !errors.Is(err, errOpenFailed) {
+		t.Fatalf("expected the mutation to fail on the open failure, got %v", err)
+	}
+
+	refusals.Store(1)
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatalf("expected the listing to open the device on the next attempt, got %v", err)
+	}
+	if opens := sim.OpenSessions(); opens != 1 {
+		t.Errorf("expected one open session, got %d", opens)
+	}
+}
@@ -0,0 +1,351 @@
+package kalam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// JSON-RPC 2.0 error codes, RPCDeviceError is used for failed device operations
+const (
+	RPCParseError       = -32700
+	RPCInvalidRequest   = -32600
+	RPCMethodNotFound   = -32601
+	RPCInvalidParams    = -32602
+	RPCInternalError    = -32603
+	RPCDeviceError      = -32000
+	RPCRequestCancelled = -32800
+)
+
+// rpcProgressInterval limits how often a transfer sends progress notifications
+const rpcProgressInterval = 100 * time.Millisecond
+
+// RPCError is the error object of a JSON-RPC response
+type RPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      json.RawMessage  `json:"id"`
+	Result  *json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError        `json:"error,omitempty"`
+}
+
+type rpcNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// rpcProgress is sent as "$/progress" while a download or upload runs
+type rpcProgress struct {
+	ID    json.RawMessage `json:"id"`
+	Done  int64           `json:"done"`
+	Total int64           `json:"total"`
+}
+
+// rpcServer serves one JSON-RPC connection
+type rpcServer struct {
+	client *Client
+
+	writeMu sync.Mutex
+	enc     *json.Encoder
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// ServeRPC serves the client operations as JSON-RPC 2.0 over r and w, e.g. stdin and stdout of a helper process
+// Requests run concurrently and can be cancelled with "$/cancelRequest", transfers send "$/progress" notifications
+// It returns when r ends and the running requests are answered, cancelling ctx cancels them
+func (c *Client) ServeRPC(ctx context.Context, r io.Reader, w io.Writer) error {
+	s := &rpcServer{
+		client:  c,
+		enc:     json.NewEncoder(w),
+		running: make(map[string]context.CancelFunc),
+	}
+	defer s.wg.Wait()
+
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return nil
+		} else if err != nil {
+			// The stream cannot be resynchronized after malformed JSON
+			s.reply(nil, nil, &RPCError{Code: RPCParseError, Message: err.Error()})
+			return fmt.Errorf("invalid JSON-RPC input: %w", err)
+		}
+		s.handle(ctx, raw)
+	}
+}
+
+// handle starts a request, or answers it directly when it is invalid
+func (s *rpcServer) handle(ctx context.Context, raw json.RawMessage) {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+		s.reply(req.ID, nil, &RPCError{Code: RPCInvalidRequest, Message: "invalid JSON-RPC 2.0 request"})
+		return
+	}
+
+	if req.Method == "$/cancelRequest" {
+		var params struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err == nil {
+			s.cancel(params.ID)
+		}
+		if req.ID != nil {
+			s.reply(req.ID, nil, nil)
+		}
+		return
+	}
+
+	method, ok := rpcMethods[req.Method]
+	if !ok {
+		if req.ID != nil {
+			s.reply(req.ID, nil, &RPCError{Code: RPCMethodNotFound, Message: fmt.Sprintf("unknown method %q", req.Method)})
+		}
+		return
+	}
+
+	reqCtx, cancel := context.WithCancel(ctx)
+	if req.ID != nil {
+		key := string(req.ID)
+		s.mu.Lock()
+		_, duplicate := s.running[key]
+		if !duplicate {
+			s.running[key] = cancel
+		}
+		s.mu.Unlock()
+
+		if duplicate {
+			cancel()
+			s.reply(req.ID, nil, &RPCError{Code: RPCInvalidRequest, Message: fmt.Sprintf("request %s is already running", key)})
+			return
+		}
+		reqCtx = WithProgress(reqCtx, s.progress(req.ID))
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+
+		result, err := s.call(reqCtx, method, req.Params)
+		if req.ID == nil {
+			return
+		}
+
+		s.mu.Lock()
+		delete(s.running, string(req.ID))
+		s.mu.Unlock()
+		s.reply(req.ID, result, rpcErrorFor(reqCtx, err))
+	}()
+}
+
+// call runs a method, a panic becomes an internal error instead of ending the process
+func (s *rpcServer) call(ctx context.Context, method rpcMethod, params json.RawMessage) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			bridgeLog.Error("panic in JSON-RPC request", "panic", r)
+			err = &RPCError{Code: RPCInternalError, Message: fmt.Sprintf("panic: %v", r)}
+		}
+	}()
+	return method(ctx, s.client, params)
+}
+
+// cancel cancels a running request
+func (s *rpcServer) cancel(id json.RawMessage) {
+	s.mu.Lock()
+	cancel, ok := s.running[string(id)]
+	s.mu.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+// progress returns a ProgressFunc sending throttled "$/progress" notifications for a request
+func (s *rpcServer) progress(id json.RawMessage) ProgressFunc {
+	var last atomic.Int64
+	return func(done, total int64) {
+		now := time.Now().UnixNano()
+		if done < total && now-last.Load() < int64(rpcProgressInterval) {
+			return
+		}
+		last.Store(now)
+		s.write(rpcNotification{JSONRPC: "2.0", Method: "$/progress", Params: rpcProgress{ID: id, Done: done, Total: total}})
+	}
+}
+
+// reply sends the response to a request
+func (s *rpcServer) reply(id json.RawMessage, result interface{}, rpcErr *RPCError) {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	resp := rpcResponse{JSONRPC: "2.0", ID: id, Error: rpcErr}
+	if rpcErr == nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			resp.Error = &RPCError{Code: RPCInternalError, Message: err.Error()}
+		} else {
+			raw := json.RawMessage(data)
+			resp.Result = &raw
+		}
+	}
+	s.write(resp)
+}
+
+// write sends one message per line
+func (s *rpcServer) write(msg interface{}) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if err := s.enc.Encode(msg); err != nil {
+		bridgeLog.Warn("failed to write JSON-RPC message", "error", err)
+	}
+}
+
+// rpcErrorFor turns the error of a method into a JSON-RPC error
+// Response codes from the device are passed on in data so hosts can react to them
+func rpcErrorFor(ctx context.Context, err error) *RPCError {
+	if err == nil {
+		return nil
+	}
+
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+	if ctx.Err() != nil {
+		return &RPCError{Code: RPCRequestCancelled, Message: "request cancelled"}
+	}
+
+	result := &RPCError{Code: RPCDeviceError, Message: err.Error()}
+	var rc mtp.RCError
+	if errors.As(err, &rc) {
+		result.Data = map[string]interface{}{
+			"responseCode": uint16(rc),
+			"response":     captureName(mtp.RC_names, uint16(rc)),
+		}
+	}
+	return result
+}
+
+// rpcMethod runs a request with its raw params
+type rpcMethod func(ctx context.Context, c *Client, params json.RawMessage) (interface{}, error)
+
+// decodeRPCParams decodes params into p, fields missing from params keep their value
+func decodeRPCParams(params json.RawMessage, p interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, p); err != nil {
+		return &RPCError{Code: RPCInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+type rpcObjectIDResult struct {
+	ObjectID ObjectID `json:"objectId"`
+}
+
+type rpcDataResult struct {
+	Data []byte `json:"data"`
+}
+
+// rpcParams are the params of all methods, each method reads the fields it needs
+// parentId defaults to the storage root
+type rpcParams struct {
+	StorageID StorageID `json:"storageId"`
+	ParentID  ParentID  `json:"parentId"`
+	ObjectID  ObjectID  `json:"objectId"`
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	Offset    int64     `json:"offset"`
+	Length    uint32    `json:"length"`
+}
+
+// rpcWithParams decodes the params before running fn
+func rpcWithParams(fn func(ctx context.Context, c *Client, p rpcParams) (interface{}, error)) rpcMethod {
+	return func(ctx context.Context, c *Client, params json.RawMessage) (interface{}, error) {
+		p := rpcParams{ParentID: RootParentID}
+		if err := decodeRPCParams(params, &p); err != nil {
+			return nil, err
+		}
+		return fn(ctx, c, p)
+	}
+}
+
+// rpcMethods maps method names to Client operations
+var rpcMethods = map[string]rpcMethod{
+	"scan": func(ctx context.Context, c *Client, _ json.RawMessage) (interface{}, error) {
+		return c.Scan(ctx)
+	},
+	"listStorages": func(ctx context.Context, c *Client, _ json.RawMessage) (interface{}, error) {
+		return c.ListStorages(ctx)
+	},
+	"deviceHealth": func(ctx context.Context, c *Client, _ json.RawMessage) (interface{}, error) {
+		return c.DeviceHealth(), nil
+	},
+	"listFiles": rpcWithParams(func(ctx context.Context, c *Client, p rpcParams) (interface{}, error) {
+		return c.ListFiles(ctx, p.StorageID, p.ParentID)
+	}),
+	"createFolder": rpcWithParams(func(ctx context.Context, c *Client, p rpcParams) (interface{}, error) {
+		id, err := c.CreateFolder(ctx, p.StorageID, p.ParentID, p.Name)
+		return rpcObjectIDResult{id}, err
+	}),
+	"deleteObject": rpcWithParams(func(ctx context.Context, c *Client, p rpcParams) (interface{}, error) {
+		return nil, c.DeleteObject(ctx, p.ObjectID)
+	}),
+	"renameObject": rpcWithParams(func(ctx context.Context, c *Client, p rpcParams) (interface{}, error) {
+		return nil, c.RenameObject(ctx, p.ObjectID, p.Name)
+	}),
+	"moveObject": rpcWithParams(func(ctx context.Context, c *Client, p rpcParams) (interface{}, error) {
+		return nil, c.MoveObject(ctx, p.ObjectID, p.StorageID, p.ParentID)
+	}),
+	"refreshStorage": rpcWithParams(func(ctx context.Context, c *Client, p rpcParams) (interface{}, error) {
+		return nil, c.RefreshStorage(ctx, p.StorageID)
+	}),
+	"resetDeviceCache": func(ctx context.Context, c *Client, _ json.RawMessage) (interface{}, error) {
+		return nil, c.ResetDeviceCache(ctx)
+	},
+	"downloadFile": rpcWithParams(func(ctx context.Context, c *Client, p rpcParams) (interface{}, error) {
+		return nil, c.DownloadFile(ctx, p.ObjectID, p.Path)
+	}),
+	"uploadFile": rpcWithParams(func(ctx context.Context, c *Client, p rpcParams) (interface{}, error) {
+		id, err := c.UploadFile(ctx, p.StorageID, p.ParentID, p.Path)
+		return rpcObjectIDResult{id}, err
+	}),
+	"readRange": rpcWithParams(func(ctx context.Context, c *Client, p rpcParams) (interface{}, error) {
+		data, err := c.ReadRange(ctx, p.ObjectID, p.Offset, p.Length)
+		return rpcDataResult{data}, err
+	}),
+	"thumbnail": rpcWithParams(func(ctx context.Context, c *Client, p rpcParams) (interface{}, error) {
+		data, err := c.Thumbnail(ctx, p.ObjectID)
+		return rpcDataResult{data}, err
+	}),
+}
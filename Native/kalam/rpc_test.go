@@ -0,0 +1,220 @@
+package kalam
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// rpcMessage is a response or notification read back from ServeRPC
+type rpcMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+// rpcTestConn is the host side of a ServeRPC connection
+type rpcTestConn struct {
+	t        *testing.T
+	in       *io.PipeWriter
+	messages chan rpcMessage
+	done     chan error
+}
+
+func serveTestRPC(t *testing.T, client *Client) *rpcTestConn {
+	t.Helper()
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	conn := &rpcTestConn{t: t, in: inW, messages: make(chan rpcMessage, 100), done: make(chan error, 1)}
+
+	go func() {
+		conn.done <- client.ServeRPC(context.Background(), inR, outW)
+		outW.Close()
+	}()
+	go func() {
+		scanner := bufio.NewScanner(outR)
+		for scanner.Scan() {
+			var msg rpcMessage
+			if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+				t.Errorf("invalid output line %q: %v", scanner.Text(), err)
+			}
+			conn.messages <- msg
+		}
+		close(conn.messages)
+	}()
+
+	t.Cleanup(func() {
+		inW.Close()
+		<-conn.done
+	})
+	return conn
+}
+
+func (c *rpcTestConn) send(line string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.in, line+"\n"); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// next returns the next message, skipping progress notifications when skipProgress is set
+func (c *rpcTestConn) next(skipProgress bool) rpcMessage {
+	c.t.Helper()
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("connection closed")
+			}
+			if skipProgress && msg.Method == "$/progress" {
+				continue
+			}
+			return msg
+		case <-time.After(5 * time.Second):
+			c.t.Fatalf("timed out waiting for a message")
+		}
+	}
+}
+
+func TestServeRPC(t *testing.T) {
+	conn := serveTestRPC(t, useSimDevice(t, NewDemoDevice()))
+
+	conn.send(`{"jsonrpc":"2.0","id":1,"method":"scan"}`)
+	msg := conn.next(true)
+	var devices []DeviceJSON
+	if msg.Error != nil || string(msg.ID) != "1" || json.Unmarshal(msg.Result, &devices) != nil || len(devices) != 1 {
+		t.Fatalf("scan = %s, %+v", msg.Result, msg.Error)
+	}
+
+	conn.send(`{"jsonrpc":"2.0","id":"files","method":"listFiles","params":{"storageId":65537}}`)
+	msg = conn.next(true)
+	var files []FileJSON
+	if msg.Error != nil || string(msg.ID) != `"files"` || json.Unmarshal(msg.Result, &files) != nil || len(files) != 3 {
+		t.Fatalf("listFiles = %s, %+v", msg.Result, msg.Error)
+	}
+
+	conn.send(`{"jsonrpc":"2.0","id":2,"method":"readRange","params":{"objectId":4,"offset":0,"length":16}}`)
+	msg = conn.next(true)
+	var data rpcDataResult
+	if msg.Error != nil || json.Unmarshal(msg.Result, &data) != nil || len(data.Data) != 16 {
+		t.Fatalf("readRange = %s, %+v", msg.Result, msg.Error)
+	}
+
+	conn.send(`{"jsonrpc":"2.0","id":3,"method":"resetDeviceCache"}`)
+	if msg = conn.next(true); msg.Error != nil || string(msg.Result) != "null" {
+		t.Fatalf("resetDeviceCache = %s, %+v", msg.Result, msg.Error)
+	}
+}
+
+func TestServeRPCErrors(t *testing.T) {
+	sim := NewDemoDevice()
+	conn := serveTestRPC(t, useSimDevice(t, sim))
+	sim.InjectFault(SimFault{Op: mtp.OC_DeleteObject, Err: mtp.RCError(mtp.RC_ObjectWriteProtected)})
+
+	for _, tc := range []struct {
+		request string
+		code    int
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"format"}`, RPCMethodNotFound},
+		{`{"jsonrpc":"2.0","id":2,"method":"listFiles","params":{"storageId":"internal"}}`, RPCInvalidParams},
+		{`{"id":3,"method":"scan"}`, RPCInvalidRequest},
+		{`[1,2]`, RPCInvalidRequest},
+		{`{"jsonrpc":"2.0","id":4,"method":"deleteObject","params":{"objectId":1}}`, RPCDeviceError},
+	} {
+		conn.send(tc.request)
+		msg := conn.next(true)
+		if msg.Error == nil || msg.Error.Code != tc.code {
+			t.Errorf("%s: expected error code %d, got %s %+v", tc.request, tc.code, msg.Result, msg.Error)
+		}
+	}
+
+	// Notifications get no response, the next message answers the ping
+	conn.send(`{"jsonrpc":"2.0","method":"format"}`)
+	conn.send(`{"jsonrpc":"2.0","id":5,"method":"listStorages"}`)
+	if msg := conn.next(true); string(msg.ID) != "5" {
+		t.Fatalf("expected the response to request 5, got %+v", msg)
+	}
+
+	// Malformed JSON ends the connection after a parse error
+	conn.send(`{"jsonrpc":`)
+	conn.in.Close()
+	if msg := conn.next(true); msg.Error == nil || msg.Error.Code != RPCParseError || string(msg.ID) != "null" {
+		t.Fatalf("expected a parse error, got %+v", msg)
+	}
+	if err := <-conn.done; err == nil {
+		t.Fatalf("expected ServeRPC to fail after malformed JSON")
+	}
+	conn.done <- nil
+}
+
+func TestServeRPCDeviceErrorData(t *testing.T) {
+	rpcErr := rpcErrorFor(context.Background(), mtp.RCError(mtp.RC_StoreFull))
+	data, _ := rpcErr.Data.(map[string]interface{})
+	if rpcErr.Code != RPCDeviceError || data["responseCode"] != uint16(mtp.RC_StoreFull) || data["response"] != "StoreFull" {
+		t.Fatalf("unexpected error %+v", rpcErr)
+	}
+}
+
+func TestServeRPCDownloadProgress(t *testing.T) {
+	conn := serveTestRPC(t, useSimDevice(t, NewDemoDevice()))
+	path := filepath.Join(t.TempDir(), "IMG_0002.jpg")
+
+	conn.send(`{"jsonrpc":"2.0","id":9,"method":"downloadFile","params":{"objectId":4,"path":` + strconv.Quote(path) + `}}`)
+
+	var last rpcProgress
+	for {
+		msg := conn.next(false)
+		if msg.Method != "$/progress" {
+			if msg.Error != nil || string(msg.ID) != "9" {
+				t.Fatalf("downloadFile = %+v", msg)
+			}
+			break
+		}
+		if err := json.Unmarshal(msg.Params, &last); err != nil || string(last.ID) != "9" {
+			t.Fatalf("invalid progress %s", msg.Params)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Total != info.Size() || last.Done != last.Total {
+		t.Fatalf("last progress %+v, file has %d bytes", last, info.Size())
+	}
+}
+
+func TestServeRPCCancel(t *testing.T) {
+	sim := NewDemoDevice()
+	conn := serveTestRPC(t, useSimDevice(t, sim))
+	sim.SetLatency(mtp.OC_GetObject, 300*time.Millisecond)
+	path := filepath.Join(t.TempDir(), "IMG_0002.jpg")
+
+	conn.send(`{"jsonrpc":"2.0","id":"dl","method":"downloadFile","params":{"objectId":4,"path":` + strconv.Quote(path) + `}}`)
+	conn.send(`{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":"dl"}}`)
+
+	msg := conn.next(true)
+	if msg.Error == nil || msg.Error.Code != RPCRequestCancelled {
+		t.Fatalf("expected the download to be cancelled, got %s %+v", msg.Result, msg.Error)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("expected the partial download to be removed")
+	}
+
+	// The connection keeps serving after a cancelled request
+	conn.send(`{"jsonrpc":"2.0","id":1,"method":"listStorages"}`)
+	if msg := conn.next(true); msg.Error != nil {
+		t.Fatalf("listStorages after cancel = %+v", msg.Error)
+	}
+}
@@ -0,0 +1,592 @@
+package kalam
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/usb"
+)
+
+// Job priorities, lower values run first and jobs of equal priority run in submission order
+const (
+	// priorityControl is used by exclusive jobs such as changing the device opener
+	priorityControl = iota
+	// priorityMetadata is used by listings, storage queries and folder operations
+	priorityMetadata
+	// priorityTransfer is used by transfers, a chunked download queues one job per chunk
+	priorityTransfer
+	// priorityEject runs after the jobs queued before it, so ejecting finishes them first
+	priorityEject
+)
+
+// States of a queued job
+const (
+	jobQueued int32 = iota
+	jobRunning
+	jobCancelled
+)
+
+// sessionJob is a unit of work run by the session goroutine
+type sessionJob struct {
+	priority  int
+	seq       uint64
+	exclusive bool
+	fn        func(dev Device) error
+
+	state atomic.Int32
+	err   error
+	done  chan struct{}
+}
+
+// jobQueue is a heap of jobs ordered by priority, then submission order
+type jobQueue []*sessionJob
+
+func (q jobQueue) Len() int { return len(q) }
+
+func (q jobQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q jobQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *jobQueue) Push(x interface{}) { *q = append(*q, x.(*sessionJob)) }
+
+func (q *jobQueue) Pop() interface{} {
+	old := *q
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return job
+}
+
+// deviceSession owns the one long-lived session with the connected device
+// Its goroutine runs one job at a time from a priority queue, so short metadata jobs
+// run between the chunks of a large transfer instead of waiting for all of it
+type deviceSession struct {
+	mu      sync.Mutex
+	queue   jobQueue
+	seq     uint64
+	wake    chan struct{}
+	running bool
+	stopped bool
+	exited  chan struct{}
+
+	// Only used by the session goroutine
+	dev      Device
+	lastUsed time.Time
+	// resets receives the EC_DeviceReset events of dev, nil when it does not report them
+	resets <-chan struct{}
+
+	// open mirrors dev != nil for readers outside the session goroutine
+	open atomic.Bool
+}
+
+// session is the session with the device found by openDevice
+var session = &deviceSession{wake: make(chan struct{}, 1)}
+
+// sessionConfigChanged tells the session goroutine to restart its timers with the current settings
+var sessionConfigChanged = make(chan struct{}, 1)
+
+// errOpenFailed marks operations that failed because no session could be opened
+var errOpenFailed = errors.New("failed to initialize device")
+
+// errShuttingDown is returned by operations started or still queued during a shutdown
+var errShuttingDown = errors.New("bridge is shutting down")
+
+// errDeviceReset is the cause of a session reset after the device reported EC_DeviceReset
+var errDeviceReset = errors.New("device reported a reset")
+
+// handleEpoch counts the events after which the device may have renumbered its objects, reconnects and session resets
+// Object handles remembered before it changed are resolved again by path
+var handleEpoch atomic.Uint64
+
+// start allows jobs again after stop and runs the session goroutine unless it is running
+// Without it the goroutine starts with the first job
+func (s *deviceSession) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return
+	}
+	s.stopped = false
+	s.launch()
+}
+
+// launch runs the session goroutine, the caller holds s.mu
+func (s *deviceSession) launch() {
+	s.running = true
+	s.exited = make(chan struct{})
+	go s.run()
+}
+
+// stop cancels the queued jobs and waits until the session goroutine closed the session and returned
+// The running job is waited for, its caller cancels it through its context
+func (s *deviceSession) stop() {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	queued := s.queue
+	s.queue = nil
+	exited := s.exited
+	s.mu.Unlock()
+
+	for _, job := range queued {
+		if job.state.CompareAndSwap(jobQueued, jobCancelled) {
+			job.err = errShuttingDown
+			close(job.done)
+		}
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	<-exited
+}
+
+// control runs fn on the session goroutine, or directly once the goroutine is stopped
+func (s *deviceSession) control(fn func()) {
+	for {
+		err := s.exclusive(context.Background(), func() error {
+			fn()
+			return nil
+		})
+		if !errors.Is(err, errShuttingDown) {
+			return
+		}
+
+		s.mu.Lock()
+		if !s.running {
+			fn()
+			s.mu.Unlock()
+			return
+		}
+		exited := s.exited
+		s.mu.Unlock()
+		<-exited
+	}
+}
+
+// run executes queued jobs, probes the device between them and closes the session once it was idle for Pool.EntryTTL
+// In shared mode the session is also closed once it was idle for Shared.IdleRelease
+// It returns after stop, closing the session
+func (s *deviceSession) run() {
+	ticker := time.NewTicker(cfg().Pool.CleanupTick)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(cfg().Health.Interval)
+	defer heartbeat.Stop()
+	release := time.NewTimer(cfg().Shared.IdleRelease)
+	defer release.Stop()
+	release.Stop()
+
+	for {
+		if s.isStopped() {
+			s.closeDevice()
+
+			s.mu.Lock()
+			s.running = false
+			close(s.exited)
+			s.mu.Unlock()
+			poolLog.Info("device session goroutine stopped")
+			return
+		}
+
+		if job := s.next(); job != nil {
+			s.execute(job)
+			if conf := cfg(); conf.Shared.Enabled && s.dev != nil {
+				release.Reset(conf.Shared.IdleRelease)
+			}
+			continue
+		}
+
+		select {
+		case <-s.wake:
+		case <-ticker.C:
+			s.closeIdle()
+		case <-heartbeat.C:
+			s.heartbeat()
+		case <-release.C:
+			s.releaseShared()
+		case <-s.resets:
+			s.resetSession(errDeviceReset)
+		case <-sessionConfigChanged:
+			ticker.Reset(cfg().Pool.CleanupTick)
+			heartbeat.Reset(cfg().Health.Interval)
+		}
+	}
+}
+
+// isStopped reports whether stop was called
+func (s *deviceSession) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// next pops the most urgent job, or returns nil when the queue is empty
+func (s *deviceSession) next() *sessionJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) == 0 {
+		return nil
+	}
+	return heap.Pop(&s.queue).(*sessionJob)
+}
+
+// execute runs a job unless it was cancelled while queued
+func (s *deviceSession) execute(job *sessionJob) {
+	if !job.state.CompareAndSwap(jobQueued, jobRunning) {
+		return
+	}
+	defer close(job.done)
+
+	if job.exclusive {
+		s.closeDevice()
+		job.err = runJob(job.fn, nil)
+		return
+	}
+
+	dev, err := s.device()
+	if err != nil {
+		job.err = err
+		health.observe(err)
+		return
+	}
+
+	job.err = runJob(job.fn, dev)
+	var partial *partialSuccessError
+	if sessionLost(job.err) && !errors.As(job.err, &partial) && s.resetSession(job.err) == nil {
+		// The device refused the operation, so it runs again in the new session
+		job.err = runJob(job.fn, s.dev)
+	}
+	s.lastUsed = time.Now()
+	health.observe(job.err)
+
+	if job.err != nil && (isDeviceClosedError(job.err) || errors.Is(job.err, usb.ERROR_NO_DEVICE) || errors.Is(job.err, errTransferAbandoned)) {
+		// The next job opens a new session
+		poolLog.Info("device session was closed, reopening on the next operation")
+		metrics.pool(func(p *PoolStats) { p.Closed++ })
+		s.dropDevice()
+	}
+}
+
+// runJob calls fn, a panic fails the job instead of stopping the session goroutine
+func runJob(fn func(Device) error, dev Device) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			poolLog.Error("panic in device operation", "panic", r)
+			err = fmt.Errorf("panic in device operation: %v", r)
+		}
+	}()
+	return fn(dev)
+}
+
+// device returns the open session, opening one when there is none
+func (s *deviceSession) device() (Device, error) {
+	if s.dev != nil {
+		// A reset reported since the last job ends the session before the next job runs into it
+		select {
+		case <-s.resets:
+			s.resetSession(errDeviceReset)
+		default:
+		}
+	}
+	if s.dev != nil {
+		metrics.pool(func(p *PoolStats) { p.Hits++ })
+		return s.dev, nil
+	}
+
+	dev, err := openDevice()
+	if err != nil {
+		metrics.pool(func(p *PoolStats) { p.OpenFailures++ })
+		if claimRefused(err) {
+			// Not a failure of the device, so the libusb error is not wrapped for the breaker and the retries
+			usbLog.Info("device is in use by another process", "error", err)
+			return nil, fmt.Errorf("%w: %w: %v", errOpenFailed, ErrDeviceInUse, err)
+		}
+		return nil, fmt.Errorf("%w: %w", errOpenFailed, err)
+	}
+
+	// The serial number tells a reconnect of the same device from another device
+	var info mtp.DeviceInfo
+	if err := dev.GetDeviceInfo(&info); err != nil {
+		metrics.pool(func(p *PoolStats) { p.OpenFailures++ })
+		disposeDevice(dev)
+		return nil, fmt.Errorf("%w: GetDeviceInfo failed: %w", errOpenFailed, err)
+	}
+	health.identify(info.SerialNumber)
+	breaker.forDevice(info.SerialNumber)
+	knownHandles.forDevice(info.SerialNumber)
+
+	poolLog.Debug("opened device session", "serial", info.SerialNumber)
+	metrics.pool(func(p *PoolStats) { p.Misses++ })
+	s.dev = &metricsDevice{dev: dev}
+	s.open.Store(true)
+	if n, ok := dev.(resetNotifier); ok {
+		s.resets = n.DeviceReset()
+	}
+	return s.dev, nil
+}
+
+// resetSession replaces the session the device lost with a new one on the same connection
+// The device may have renumbered its objects meanwhile, so remembered handles are resolved again by path
+// When no session can be opened the device is released, the next job opens it from scratch
+func (s *deviceSession) resetSession(cause error) error {
+	poolLog.Info("device lost the session, opening a new one", "cause", cause)
+	handleEpoch.Add(1)
+
+	s.dev.SetTimeout(cfg().Health.Timeout)
+	if err := s.dev.ResetSession(); err != nil {
+		poolLog.Warn("failed to open a new session, reopening the device", "error", err)
+		metrics.pool(func(p *PoolStats) { p.Closed++ })
+		s.dropDevice()
+		return err
+	}
+	metrics.pool(func(p *PoolStats) { p.SessionResets++ })
+	return nil
+}
+
+// sessionLost reports responses of a device that no longer knows the session, e.g. after it was reset
+func sessionLost(err error) bool {
+	var rc mtp.RCError
+	return errors.As(err, &rc) && (rc == mtp.RCError(mtp.RC_SessionNotOpen) || rc == mtp.RCError(mtp.RC_InvalidTransactionID))
+}
+
+// closeDevice ends the session with CloseSession and releases the device, if a session is open
+func (s *deviceSession) closeDevice() {
+	if s.dev == nil {
+		return
+	}
+	poolLog.Debug("closing device session")
+	s.dev.SetTimeout(cfg().Health.Timeout)
+	if err := s.dev.CloseSession(); err != nil {
+		poolLog.Debug("CloseSession failed", "error", err)
+	}
+	s.dropDevice()
+}
+
+// dropDevice releases the device without ending the session, for sessions that are already broken
+func (s *deviceSession) dropDevice() {
+	if s.dev == nil {
+		return
+	}
+	disposeDevice(s.dev)
+	s.dev = nil
+	s.resets = nil
+	s.open.Store(false)
+}
+
+// isOpen reports whether a session with the device is open, it may be called from any goroutine
+func (s *deviceSession) isOpen() bool {
+	return s.open.Load()
+}
+
+// heartbeat checks the device when no job talked to it for Health.Interval
+// An open session is asked for its device info; without one the device is only looked for after
+// it went missing or stopped answering, so the probe neither claims a device, keeps an idle one open nor reopens an ejected one
+// While the circuit breaker is open the device is left alone until Retry.BreakerCooldown passed, then the heartbeat is its half-open probe
+func (s *deviceSession) heartbeat() {
+	conf := cfg()
+	probe := breaker.startProbe(conf.Retry.BreakerCooldown)
+	if !probe && breaker.get() == BreakerOpen {
+		return
+	}
+
+	if s.dev == nil {
+		if state := health.get().State; !probe && (state == DeviceConnected || state == DeviceUnknown || state == DeviceEjected ||
+			state == DeviceReleased || state == DeviceInUse) {
+			return
+		}
+		// Opening a session asks for the device info, which is the probe
+		_, err := s.device()
+		health.observe(err)
+		if probe {
+			breaker.probed(err)
+		}
+		if err == nil {
+			s.lastUsed = time.Now()
+		}
+		return
+	}
+	if !probe && time.Since(s.lastUsed) < conf.Health.Interval {
+		return
+	}
+
+	s.dev.SetTimeout(conf.Health.Timeout)
+	var info mtp.DeviceInfo
+	err := s.dev.GetDeviceInfo(&info)
+	health.observe(err)
+	if probe {
+		breaker.probed(err)
+	} else {
+		breaker.record(err)
+	}
+
+	if err != nil {
+		usbLog.Debug("heartbeat failed", "error", err)
+		if deviceStateFor(err) == DeviceDisconnected || isDeviceClosedError(err) {
+			s.dropDevice()
+		}
+	}
+}
+
+// closeIdle ends the session when no job used it for Pool.EntryTTL
+func (s *deviceSession) closeIdle() {
+	if s.dev != nil && time.Since(s.lastUsed) >= cfg().Pool.EntryTTL {
+		poolLog.Debug("closing idle device session")
+		s.closeDevice()
+	}
+}
+
+// releaseShared closes the idle session in shared mode, releasing the interface so other processes can claim the device
+// The next operation claims it again
+func (s *deviceSession) releaseShared() {
+	conf := cfg()
+	if s.dev == nil || !conf.Shared.Enabled || time.Since(s.lastUsed) < conf.Shared.IdleRelease {
+		return
+	}
+
+	poolLog.Info("releasing idle device to other processes", "idle", time.Since(s.lastUsed).Round(time.Millisecond))
+	s.closeDevice()
+	health.release()
+	metrics.pool(func(p *PoolStats) { p.SharedReleases++ })
+}
+
+// do queues fn and waits for its result
+// ctx cancels a job that has not started yet; a running job is waited for, fn can watch ctx itself
+func (s *deviceSession) do(ctx context.Context, priority int, exclusive bool, fn func(Device) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	job := &sessionJob{priority: priority, exclusive: exclusive, fn: fn, done: make(chan struct{})}
+
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return errShuttingDown
+	}
+	if !s.running {
+		s.launch()
+	}
+	s.seq++
+	job.seq = s.seq
+	heap.Push(&s.queue, job)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-job.done:
+		return job.err
+	case <-ctx.Done():
+		if job.state.CompareAndSwap(jobQueued, jobCancelled) {
+			return ctx.Err()
+		}
+		<-job.done
+		return job.err
+	}
+}
+
+// exclusive closes the session and runs fn on the session goroutine, no other job runs meanwhile
+func (s *deviceSession) exclusive(ctx context.Context, fn func() error) error {
+	return s.do(ctx, priorityControl, true, func(Device) error {
+		return fn()
+	})
+}
+
+// notifySessionConfig makes the session goroutine pick up changed timer settings
+func notifySessionConfig() {
+	select {
+	case sessionConfigChanged <- struct{}{}:
+	default:
+	}
+}
+
+// disposeDevice closes a device connection and drops any per-device state cached by the bridge
+func disposeDevice(dev Device) {
+	partialReadSupportCache.Delete(dev)
+	dev.Close()
+}
+
+// isDeviceClosedError reports errors of operations on a session that is no longer open
+func isDeviceClosedError(err error) bool {
+	errorStr := strings.ToLower(err.Error())
+	return strings.Contains(errorStr, "device is not open") ||
+		strings.Contains(errorStr, "device closed")
+}
+
+// sleepContext pauses for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withDeviceQuick executes a scan with the short scan timeout
+// ctx cancels waiting for the device and further retries, not an operation already running
+func withDeviceQuick(ctx context.Context, fn func(Device) error) error {
+	return withDeviceFor(ctx, ClassScan, fn)
+}
+
+// withDevice executes a metadata operation with the normal timeout
+// ctx cancels waiting for the device and further retries, not an operation already running
+func withDevice(ctx context.Context, fn func(Device) error) error {
+	return withDeviceFor(ctx, ClassMetadata, fn)
+}
+
+// withDeviceFor executes an operation of class, retrying it by the retry policy of the class
+// Transfers are queued behind metadata jobs, so listings run between the chunks of a download
+func withDeviceFor(ctx context.Context, class OperationClass, fn func(Device) error) error {
+	ctx, end, err := beginOperation(ctx)
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	// A configuration change applies to the next operation, not to the attempts of this one
+	conf := cfg()
+
+	timeout := conf.Timeouts.NormalOperation
+	priority := priorityMetadata
+	switch class {
+	case ClassScan:
+		timeout = conf.Timeouts.QuickScan
+	case ClassTransfer:
+		priority = priorityTransfer
+	}
+
+	err = retry(ctx, class, conf.retryPolicy(class), func() error {
+		return doAwaitingReconnect(ctx, priority, func(dev Device) error {
+			dev.SetTimeout(timeout)
+			return fn(dev)
+		})
+	})
+	// The breaker counts operations, the attempts of one are a single failure
+	breaker.record(err)
+	return err
+}
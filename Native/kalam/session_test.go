@@ -0,0 +1,332 @@
+package kalam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/usb"
+)
+
+// blockSession holds the session goroutine until the returned function is called
+func blockSession(t *testing.T) func() {
+	t.Helper()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	go session.exclusive(context.Background(), func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	t.Cleanup(unblock)
+	return unblock
+}
+
+// waitQueued waits until n jobs are queued
+func waitQueued(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		session.mu.Lock()
+		queued := len(session.queue)
+		session.mu.Unlock()
+		if queued >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued jobs, got %d", n, queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSessionRunsMetadataBeforeTransfers(t *testing.T) {
+	useSimDevice(t, NewDemoDevice())
+	unblock := blockSession(t)
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	submit := func(name string, priority int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session.do(context.Background(), priority, false, func(Device) error {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				return nil
+			})
+		}()
+	}
+
+	submit("transfer 1", priorityTransfer)
+	waitQueued(t, 1)
+	submit("transfer 2", priorityTransfer)
+	waitQueued(t, 2)
+	submit("listing", priorityMetadata)
+	waitQueued(t, 3)
+
+	unblock()
+	wg.Wait()
+
+	want := []string{"listing", "transfer 1", "transfer 2"}
+	for i := range want {
+		if i >= len(order) || order[i] != want[i] {
+			t.Fatalf("run order = %v, want %v", order, want)
+		}
+	}
+}
+
+func TestSessionCancelsQueuedJob(t *testing.T) {
+	useSimDevice(t, NewDemoDevice())
+	unblock := blockSession(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := false
+	result := make(chan error, 1)
+	go func() {
+		result <- session.do(ctx, priorityMetadata, false, func(Device) error {
+			ran = true
+			return nil
+		})
+	}()
+	waitQueued(t, 1)
+
+	cancel()
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the queued job to be cancelled, got %v", err)
+	}
+
+	unblock()
+	if err := session.do(context.Background(), priorityMetadata, false, func(Device) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if ran {
+		t.Errorf("a cancelled job must not run")
+	}
+}
+
+func TestSessionInterleavesChunkedDownload(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useConfig(t, func(c *Config) { c.Stream.ChunkSize = 1024 })
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	id := sim.AddFile(65537, RootParentID, "large.bin", data)
+	sim.SetLatency(mtp.OC_GetPartialObject, 5*time.Millisecond)
+
+	dest := filepath.Join(t.TempDir(), "large.bin")
+	downloaded := make(chan error, 1)
+	go func() { downloaded <- client.DownloadFile(ctx, id, dest) }()
+
+	// List the root once the download is under way
+	deadline := time.Now().Add(5 * time.Second)
+	for sim.Calls(mtp.OC_GetPartialObject) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the download did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-downloaded:
+		t.Fatalf("the listing waited for the whole download (%v)", err)
+	default:
+	}
+
+	if err := <-downloaded; err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dest)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("downloaded %d bytes, want %d (%v)", len(got), len(data), err)
+	}
+	if n := sim.OpenSessions(); n != 1 {
+		t.Errorf("expected one long-lived session, got %d", n)
+	}
+}
+
+func TestSessionResetAfterSessionNotOpen(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	ctx := context.Background()
+
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatal(err)
+	}
+	resets := GetStats().Pool.SessionResets
+
+	// The device forgets the session without telling, the listing gets SessionNotOpen
+	sim.Reset(false)
+	files, err := client.ListFiles(ctx, 65537, RootParentID)
+	if err != nil || len(files) != 3 {
+		t.Fatalf("ListFiles after the reset = %d files, %v", len(files), err)
+	}
+	if calls := sim.Calls(mtp.OC_OpenSession); calls != 1 {
+		t.Errorf("expected the session to be reopened once, got %d OpenSession calls", calls)
+	}
+	if n := GetStats().Pool.SessionResets - resets; n != 1 {
+		t.Errorf("expected one session reset, got %d", n)
+	}
+	if n := sim.OpenSessions(); n != 1 {
+		t.Errorf("expected the connection to be kept, %d are open", n)
+	}
+}
+
+func TestSessionResetOnDeviceResetEvent(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	ctx := context.Background()
+
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatal(err)
+	}
+
+	sim.Reset(true)
+	deadline := time.Now().Add(3 * time.Second)
+	for sim.Calls(mtp.OC_OpenSession) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the idle session did not react to EC_DeviceReset")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	before := sim.Calls(mtp.OC_GetObjectHandles)
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatal(err)
+	}
+	if calls := sim.Calls(mtp.OC_GetObjectHandles) - before; calls != 1 {
+		t.Errorf("expected the listing to run once in the new session, got %d GetObjectHandles calls", calls)
+	}
+}
+
+func TestSessionResetResolvesHandlesByPath(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useConfig(t, func(c *Config) { c.Stream.ChunkSize = 1024 })
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	id := sim.AddFile(65537, RootParentID, "clip.bin", data)
+
+	// Halfway through, the device resets and gives its objects new handles
+	var once sync.Once
+	ctx := WithProgress(context.Background(), func(done, total int64) {
+		if done >= total/2 {
+			once.Do(func() {
+				sim.Reset(true)
+				sim.RenumberObjects()
+			})
+		}
+	})
+
+	dest := filepath.Join(t.TempDir(), "clip.bin")
+	if err := client.DownloadFile(ctx, id, dest); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(dest); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("downloaded %d bytes, want %d (%v)", len(got), len(data), err)
+	}
+}
+
+func TestSharedModeReleasesIdleDevice(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useConfig(t, func(c *Config) {
+		c.Shared.Enabled = true
+		c.Shared.IdleRelease = 20 * time.Millisecond
+	})
+	ctx := context.Background()
+
+	if _, err := client.ListStorages(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Idle, the session is closed so adb or another MTP client can claim the device
+	deadline := time.Now().Add(3 * time.Second)
+	for sim.OpenSessions() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle device was not released")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if state := client.DeviceHealth().State; state != DeviceReleased {
+		t.Fatalf("state after release = %s, want %s", state, DeviceReleased)
+	}
+
+	sim.SetInUse(true)
+	if _, err := client.ListStorages(ctx); !errors.Is(err, ErrDeviceInUse) {
+		t.Fatalf("ListStorages while another process holds the device = %v, want %v", err, ErrDeviceInUse)
+	}
+	if state := client.DeviceHealth().State; state != DeviceInUse {
+		t.Fatalf("state while in use = %s, want %s", state, DeviceInUse)
+	}
+
+	// Once the other process lets go, the next operation claims the device again
+	sim.SetInUse(false)
+	if _, err := client.ListStorages(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if state := client.DeviceHealth().State; state != DeviceConnected {
+		t.Fatalf("state after reclaiming = %s, want %s", state, DeviceConnected)
+	}
+	if n := GetStats().Pool.SharedReleases; n == 0 {
+		t.Error("release not counted")
+	}
+}
+
+func TestClaimRefused(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{usb.ERROR_BUSY, true},
+		{fmt.Errorf("open: %w", usb.ERROR_ACCESS), true},
+		// mtpx formats the errors of Configure with %v
+		{fmt.Errorf("OpenSession after reset: %v", usb.ERROR_BUSY), true},
+		{usb.ERROR_TIMEOUT, false},
+		{errors.New("no MTP devices found"), false},
+	} {
+		if got := claimRefused(tc.err); got != tc.want {
+			t.Errorf("claimRefused(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestSessionStartsWithFirstJob(t *testing.T) {
+	s := &deviceSession{wake: make(chan struct{}, 1)}
+	if s.running {
+		t.Fatal("a new session should not run its goroutine")
+	}
+
+	if err := s.exclusive(context.Background(), func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if !s.running {
+		t.Fatal("the first job should start the session goroutine")
+	}
+
+	s.stop()
+	if err := s.exclusive(context.Background(), func() error { return nil }); !errors.Is(err, errShuttingDown) {
+		t.Fatalf("a job after stop = %v, want %v", err, errShuttingDown)
+	}
+	if s.running {
+		t.Fatal("a job after stop should not start the session goroutine again")
+	}
+}
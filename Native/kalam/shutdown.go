@@ -0,0 +1,111 @@
+package kalam
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConnectedDeviceID is the ID of the connected device in scan results
+const ConnectedDeviceID = 1
+
+type operationKey struct{}
+
+// operations counts the running client operations, so Shutdown can wait for them
+var operations = struct {
+	mu       sync.Mutex
+	running  int
+	shutdown bool
+	// abort is cancelled when Shutdown stops waiting, which cancels the running operations
+	abort  context.Context
+	cancel context.CancelFunc
+}{}
+
+func init() {
+	operations.abort, operations.cancel = context.WithCancel(context.Background())
+}
+
+// beginOperation admits an operation unless the bridge is shutting down
+// Calls made within an admitted operation, such as the chunks of a download, are always admitted
+func beginOperation(ctx context.Context) (context.Context, func(), error) {
+	if ctx.Value(operationKey{}) != nil {
+		return ctx, func() {}, nil
+	}
+
+	operations.mu.Lock()
+	if operations.shutdown {
+		operations.mu.Unlock()
+		return nil, nil, errShuttingDown
+	}
+	operations.running++
+	abort := operations.abort
+	operations.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, operationKey{}, true))
+	stop := context.AfterFunc(abort, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		operations.mu.Lock()
+		operations.running--
+		operations.mu.Unlock()
+	}, nil
+}
+
+// runningOperations returns the number of admitted operations that did not end yet
+func runningOperations() int {
+	operations.mu.Lock()
+	defer operations.mu.Unlock()
+	return operations.running
+}
+
+// Shutdown rejects new operations and lets the running ones finish until ctx is done, then cancels them
+// It closes the session with CloseSession and stops the session goroutine; Open starts the bridge again
+// The error is ctx.Err() when operations had to be cancelled
+func (c *Client) Shutdown(ctx context.Context) error {
+	poolLog.Info("shutting down", "operations", runningOperations())
+
+	operations.mu.Lock()
+	operations.shutdown = true
+	operations.mu.Unlock()
+
+	var drainErr error
+	for runningOperations() > 0 {
+		if err := sleepContext(ctx, 10*time.Millisecond); err != nil {
+			poolLog.Warn("cancelling operations still running", "operations", runningOperations())
+			drainErr = err
+			break
+		}
+	}
+
+	operations.mu.Lock()
+	operations.cancel()
+	operations.abort, operations.cancel = context.WithCancel(context.Background())
+	operations.mu.Unlock()
+
+	session.stop()
+	poolLog.Info("shut down")
+	return drainErr
+}
+
+// Eject runs the operations queued before it, then ends the session with CloseSession and releases
+// the USB interface so the device can be unplugged safely; the next operation opens it again
+func (c *Client) Eject(ctx context.Context, deviceID int) error {
+	if deviceID != ConnectedDeviceID {
+		return fmt.Errorf("unknown device %d", deviceID)
+	}
+
+	ctx, end, err := beginOperation(ctx)
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	return session.do(ctx, priorityEject, true, func(Device) error {
+		health.eject()
+		scans.forget()
+		poolLog.Info("device ejected")
+		return nil
+	})
+}
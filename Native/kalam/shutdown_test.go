@@ -0,0 +1,139 @@
+package kalam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// waitRunning waits until an operation was admitted
+func waitRunning(t *testing.T) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runningOperations() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the operation did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShutdownDrainsOperations(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	t.Cleanup(client.Open)
+	ctx := context.Background()
+
+	sim.SetLatency(mtp.OC_GetObjectHandles, 50*time.Millisecond)
+	listed := make(chan error, 1)
+	go func() {
+		_, err := client.ListFiles(ctx, 65537, RootParentID)
+		listed <- err
+	}()
+	waitRunning(t)
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := client.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+	if err := <-listed; err != nil {
+		t.Errorf("the running listing should have finished, got %v", err)
+	}
+
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); !errors.Is(err, errShuttingDown) {
+		t.Errorf("expected operations after Shutdown to fail, got %v", err)
+	}
+	if n := sim.OpenSessions(); n != 0 {
+		t.Errorf("expected the session to be closed, %d open", n)
+	}
+	if n := sim.Calls(mtp.OC_CloseSession); n != 1 {
+		t.Errorf("expected one CloseSession, got %d", n)
+	}
+	if session.running {
+		t.Errorf("expected the session goroutine to stop")
+	}
+
+	client.Open()
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Errorf("ListFiles after Open failed: %v", err)
+	}
+}
+
+func TestShutdownCancelsAfterTimeout(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	t.Cleanup(client.Open)
+	useConfig(t, func(c *Config) { c.Stream.ChunkSize = 1024 })
+	ctx := context.Background()
+
+	id := sim.AddFile(65537, RootParentID, "large.bin", bytes.Repeat([]byte("0123456789abcdef"), 4096))
+	sim.SetLatency(mtp.OC_GetPartialObject, 5*time.Millisecond)
+
+	downloaded := make(chan error, 1)
+	go func() { downloaded <- client.DownloadFile(ctx, id, filepath.Join(t.TempDir(), "large.bin")) }()
+	waitRunning(t)
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := client.Shutdown(shutdownCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Shutdown to give up waiting, got %v", err)
+	}
+
+	select {
+	case err := <-downloaded:
+		if err == nil {
+			t.Errorf("expected the download to be cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the download kept running after Shutdown")
+	}
+	if n := sim.OpenSessions(); n != 0 {
+		t.Errorf("expected the session to be closed, %d open", n)
+	}
+}
+
+func TestEjectReleasesDevice(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	useConfig(t, func(c *Config) { c.Health.Interval = 5 * time.Millisecond })
+	ctx := context.Background()
+
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Eject(ctx, 2); err == nil {
+		t.Errorf("expected an unknown device to be rejected")
+	}
+	if err := client.Eject(ctx, ConnectedDeviceID); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := sim.OpenSessions(); n != 0 {
+		t.Errorf("expected the session to be closed, %d open", n)
+	}
+	if n := sim.Calls(mtp.OC_CloseSession); n != 1 {
+		t.Errorf("expected one CloseSession, got %d", n)
+	}
+	if got := client.DeviceHealth().State; got != DeviceEjected {
+		t.Errorf("expected the device to be ejected, got %s", got)
+	}
+
+	// The heartbeat leaves an ejected device alone, an operation opens it again
+	time.Sleep(30 * time.Millisecond)
+	if n := sim.OpenSessions(); n != 0 {
+		t.Errorf("the heartbeat reopened the ejected device")
+	}
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.DeviceHealth().State; got != DeviceConnected {
+		t.Errorf("expected the device to be connected again, got %s", got)
+	}
+}
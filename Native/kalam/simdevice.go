@@ -0,0 +1,1055 @@
+package kalam
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/usb"
+)
+
+// SimDevice is an in-memory MTP device for tests and demos
+// It holds storages and a folder tree, and injects latency and faults into operations
+// Use SetDeviceOpener(sim.Open) to run the bridge against it
+type SimDevice struct {
+	mu         sync.Mutex
+	info       mtp.DeviceInfo
+	storages   []*simStorage
+	objects    map[uint32]*simObject
+	nextHandle uint32
+	latency    map[uint16]time.Duration
+	faults     []*simFault
+	calls      map[uint16]int
+	generation int
+	unplugged  bool
+	inUse      bool
+	sessions   int
+
+	// resets counts device resets, sessions opened before the last one are unknown to the device
+	resets   int
+	watchers []chan struct{}
+}
+
+// SimFault makes matching operations of a SimDevice fail
+// Use usb.ERROR_TIMEOUT for timeouts and mtp.RCError for response codes such as RC_DeviceBusy
+type SimFault struct {
+	Op         uint16 // operation code to fail, 0 matches every operation
+	Skip       int    // matching operations that succeed before the fault triggers
+	Times      int    // matching operations to fail once triggered, 0 fails all of them
+	Err        error  // error returned by the failing operation
+	Disconnect bool   // unplug the device instead of returning Err
+}
+
+type simFault struct {
+	SimFault
+	seen  int
+	fired int
+}
+
+type simStorage struct {
+	id       uint32
+	info     mtp.StorageInfo
+	capacity uint64
+}
+
+type simObject struct {
+	info  mtp.ObjectInfo
+	data  []byte
+	thumb []byte
+}
+
+// simOperations lists the operations advertised in the DeviceInfo of a SimDevice
+var simOperations = []uint16{
+	mtp.OC_GetDeviceInfo,
+	mtp.OC_OpenSession,
+	mtp.OC_CloseSession,
+	mtp.OC_GetStorageIDs,
+	mtp.OC_GetStorageInfo,
+	mtp.OC_GetObjectHandles,
+	mtp.OC_GetObjectInfo,
+	mtp.OC_GetObject,
+	mtp.OC_GetThumb,
+	mtp.OC_DeleteObject,
+	mtp.OC_SendObjectInfo,
+	mtp.OC_SendObject,
+	mtp.OC_MoveObject,
+	mtp.OC_GetPartialObject,
+	mtp.OC_MTP_GetObjectPropValue,
+	mtp.OC_MTP_SetObjectPropValue,
+	mtp.OC_ANDROID_GET_PARTIAL_OBJECT64,
+}
+
+// NewSimDevice returns a plugged-in simulated device without storages
+func NewSimDevice() *SimDevice {
+	return &SimDevice{
+		info: mtp.DeviceInfo{
+			StandardVersion:     100,
+			MTPVersion:          100,
+			OperationsSupported: slices.Clone(simOperations),
+			Manufacturer:        "Kalam",
+			Model:               "Simulated Device",
+			DeviceVersion:       "1.0",
+			SerialNumber:        "SIM0001",
+		},
+		objects:    make(map[uint32]*simObject),
+		nextHandle: 1,
+		latency:    make(map[uint16]time.Duration),
+		calls:      make(map[uint16]int),
+	}
+}
+
+// NewDemoDevice returns a simulated phone with sample photos, music and documents
+func NewDemoDevice() *SimDevice {
+	s := NewSimDevice()
+	s.SetIdentity("Google", "Pixel 8 (simulated)", "SIMDEMO01")
+
+	internal := StorageID(65537)
+	s.AddStorage(internal, "Internal shared storage", 128<<30)
+	s.AddStorage(131073, "SD card", 64<<30)
+
+	dcim := s.AddFolder(internal, RootParentID, "DCIM")
+	camera := s.AddFolder(internal, ParentID(dcim), "Camera")
+	for i := 1; i <= 3; i++ {
+		photo := s.AddFile(internal, ParentID(camera), fmt.Sprintf("IMG_%04d.jpg", i), simContent(i, 256<<10))
+		s.SetThumbnail(photo, simContent(i, 4<<10))
+	}
+
+	music := s.AddFolder(internal, RootParentID, "Music")
+	s.AddFile(internal, ParentID(music), "song.mp3", simContent(7, 3<<20))
+
+	download := s.AddFolder(internal, RootParentID, "Download")
+	s.AddFile(internal, ParentID(download), "readme.txt", []byte("Files on this device are simulated.\n"))
+
+	return s
+}
+
+// simContent returns size bytes of deterministic filler
+func simContent(seed, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + seed)
+	}
+	return data
+}
+
+// SetIdentity sets the manufacturer, model and serial number reported in DeviceInfo
+func (s *SimDevice) SetIdentity(manufacturer, model, serial string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.info.Manufacturer = manufacturer
+	s.info.Model = model
+	s.info.SerialNumber = serial
+}
+
+// AddStorage adds a storage with the given capacity in bytes
+func (s *SimDevice) AddStorage(storageID StorageID, description string, capacity uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.storages = append(s.storages, &simStorage{
+		id:       uint32(storageID),
+		capacity: capacity,
+		info: mtp.StorageInfo{
+			StorageType:        mtp.ST_FixedRAM,
+			FilesystemType:     mtp.FST_GenericHierarchical,
+			AccessCapability:   mtp.AC_ReadWrite,
+			MaxCapability:      capacity,
+			StorageDescription: description,
+		},
+	})
+}
+
+// AddFolder adds a folder and returns its handle
+func (s *SimDevice) AddFolder(storageID StorageID, parentID ParentID, name string) ObjectID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return ObjectID(s.addObject(uint32(storageID), uint32(parentID), name, ObjectFormatFolder, nil))
+}
+
+// AddFile adds a file holding data and returns its handle
+func (s *SimDevice) AddFile(storageID StorageID, parentID ParentID, name string, data []byte) ObjectID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	format := uint16(ObjectFormatGenericFile)
+	if ext := strings.ToLower(path.Ext(name)); ext == ".jpg" || ext == ".jpeg" {
+		format = mtp.OFC_EXIF_JPEG
+	}
+	return ObjectID(s.addObject(uint32(storageID), uint32(parentID), name, format, data))
+}
+
+// SetThumbnail sets the thumbnail returned by GetThumb for an object
+func (s *SimDevice) SetThumbnail(objectID ObjectID, thumb []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if obj, ok := s.objects[uint32(objectID)]; ok {
+		obj.thumb = thumb
+		obj.info.ThumbFormat = mtp.OFC_EXIF_JPEG
+		obj.info.ThumbCompressedSize = uint32(len(thumb))
+	}
+}
+
+// FileData returns a copy of the contents of a file
+func (s *SimDevice) FileData(objectID ObjectID) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[uint32(objectID)]
+	if !ok || obj.info.ObjectFormat == ObjectFormatFolder {
+		return nil, false
+	}
+	return slices.Clone(obj.data), true
+}
+
+// SetLatency delays every call of op by d, op 0 delays all operations
+// Calls whose latency reaches the session timeout fail with a USB timeout
+func (s *SimDevice) SetLatency(op uint16, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latency[op] = d
+}
+
+// InjectFault adds a fault, faults are checked in the order they were added
+func (s *SimDevice) InjectFault(f SimFault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = append(s.faults, &simFault{SimFault: f})
+}
+
+// ClearFaults removes all injected faults and latencies
+func (s *SimDevice) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = nil
+	s.latency = make(map[uint16]time.Duration)
+}
+
+// Calls returns how often op was attempted, including failed attempts
+func (s *SimDevice) Calls(op uint16) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[op]
+}
+
+// OpenSessions returns the number of sessions opened and not yet closed
+func (s *SimDevice) OpenSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sessions
+}
+
+// Unplug disconnects the device, open sessions fail and Open finds no device
+func (s *SimDevice) Unplug() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.unplug()
+}
+
+func (s *SimDevice) unplug() {
+	if !s.unplugged {
+		s.unplugged = true
+		s.generation++
+	}
+}
+
+// Plug reconnects the device, sessions opened before Unplug stay broken
+func (s *SimDevice) Plug() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.unplugged = false
+}
+
+// SetInUse simulates another process holding the interface of the device, Open then fails with LIBUSB_ERROR_BUSY
+func (s *SimDevice) SetInUse(inUse bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inUse = inUse
+}
+
+// Presence lists the device as it appears on the bus, nothing while it is unplugged; it is a PresenceProbe
+func (s *SimDevice) Presence() ([]PresenceJSON, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.unplugged {
+		return nil, nil
+	}
+	// The IDs of an Android phone in MTP mode
+	return []PresenceJSON{{VendorID: 0x18d1, ProductID: 0x4ee1, SerialNumber: s.info.SerialNumber}}, nil
+}
+
+// Reset simulates a device reset without leaving the bus: open sessions answer SessionNotOpen until
+// they are reset, and with event set they receive EC_DeviceReset
+func (s *SimDevice) Reset(event bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.resets++
+	if !event {
+		return
+	}
+	for _, ch := range s.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// RenumberObjects gives every object a new handle, as devices may do between sessions
+func (s *SimDevice) RenumberObjects() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	handles := make(map[uint32]uint32, len(s.objects))
+	for old := range s.objects {
+		handles[old] = s.nextHandle
+		s.nextHandle++
+	}
+
+	objects := make(map[uint32]*simObject, len(s.objects))
+	for old, obj := range s.objects {
+		if parent, ok := handles[obj.info.ParentObject]; ok {
+			obj.info.ParentObject = parent
+		}
+		objects[handles[old]] = obj
+	}
+	s.objects = objects
+}
+
+// Open opens a session with the device, it is a DeviceOpener
+func (s *SimDevice) Open() (Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.unplugged {
+		return nil, fmt.Errorf("no MTP devices found")
+	}
+	if s.inUse {
+		return nil, usb.ERROR_BUSY
+	}
+
+	s.sessions++
+	resets := make(chan struct{}, 1)
+	s.watchers = append(s.watchers, resets)
+	return &simSession{dev: s, generation: s.generation, session: s.resets, resets: resets}, nil
+}
+
+// addObject adds an object to the tree, the caller holds s.mu
+func (s *SimDevice) addObject(storageID, parent uint32, name string, format uint16, data []byte) uint32 {
+	if parent == uint32(RootParentID) {
+		parent = 0
+	}
+
+	handle := s.nextHandle
+	s.nextHandle++
+
+	now := time.Now()
+	s.objects[handle] = &simObject{
+		data: data,
+		info: mtp.ObjectInfo{
+			StorageID:        storageID,
+			ObjectFormat:     format,
+			CompressedSize:   uint32(min(uint64(len(data)), 0xFFFFFFFF)),
+			ParentObject:     parent,
+			Filename:         name,
+			CaptureDate:      now,
+			ModificationDate: now,
+		},
+	}
+	return handle
+}
+
+// storage finds a storage, the caller holds s.mu
+func (s *SimDevice) storage(storageID uint32) (*simStorage, error) {
+	for _, st := range s.storages {
+		if st.id == storageID {
+			return st, nil
+		}
+	}
+	return nil, mtp.RCError(mtp.RC_InvalidStorageId)
+}
+
+// object finds an object, the caller holds s.mu
+func (s *SimDevice) object(handle uint32) (*simObject, error) {
+	obj, ok := s.objects[handle]
+	if !ok {
+		return nil, mtp.RCError(mtp.RC_InvalidObjectHandle)
+	}
+	return obj, nil
+}
+
+// parentFolder resolves a parent parameter to the stored ParentObject, the caller holds s.mu
+func (s *SimDevice) parentFolder(storageID, parent uint32) (uint32, error) {
+	if parent == 0 || parent == uint32(RootParentID) {
+		return 0, nil
+	}
+
+	obj, ok := s.objects[parent]
+	if !ok || obj.info.ObjectFormat != ObjectFormatFolder || obj.info.StorageID != storageID {
+		return 0, mtp.RCError(mtp.RC_InvalidParentObject)
+	}
+	return parent, nil
+}
+
+// usedSpace sums the size of the files on a storage, the caller holds s.mu
+func (s *SimDevice) usedSpace(storageID uint32) uint64 {
+	var used uint64
+	for _, obj := range s.objects {
+		if obj.info.StorageID == storageID {
+			used += uint64(len(obj.data))
+		}
+	}
+	return used
+}
+
+// deleteTree removes an object and everything below it, the caller holds s.mu
+func (s *SimDevice) deleteTree(handle uint32) {
+	for h, obj := range s.objects {
+		if obj.info.ParentObject == handle {
+			s.deleteTree(h)
+		}
+	}
+	delete(s.objects, handle)
+}
+
+// simSession is an open session with a SimDevice
+type simSession struct {
+	dev        *SimDevice
+	generation int
+	timeout    time.Duration
+	closed     bool
+	pending    uint32 // object created by SendObjectInfo that awaits SendObject
+
+	session int           // device resets seen when the session was opened
+	resets  chan struct{} // receives EC_DeviceReset
+}
+
+// begin runs the checks, faults and latency shared by every operation
+func (c *simSession) begin(op uint16) error {
+	s := c.dev
+
+	s.mu.Lock()
+	s.calls[op]++
+
+	if c.closed {
+		s.mu.Unlock()
+		return fmt.Errorf("mtp: cannot run operation %v, device is not open", mtp.OC_names[int(op)])
+	}
+	if s.unplugged || c.generation != s.generation {
+		s.mu.Unlock()
+		return usb.ERROR_NO_DEVICE
+	}
+	// GetDeviceInfo and the session operations work without a session
+	if c.session != s.resets && op != mtp.OC_GetDeviceInfo && op != mtp.OC_OpenSession && op != mtp.OC_CloseSession {
+		s.mu.Unlock()
+		return mtp.RCError(mtp.RC_SessionNotOpen)
+	}
+
+	var fault *SimFault
+	for _, f := range s.faults {
+		if f.Op != 0 && f.Op != op {
+			continue
+		}
+		f.seen++
+		if f.seen <= f.Skip || (f.Times > 0 && f.fired >= f.Times) {
+			continue
+		}
+		f.fired++
+		fault = &f.SimFault
+		break
+	}
+
+	if fault != nil && fault.Disconnect {
+		s.unplug()
+		s.mu.Unlock()
+		return usb.ERROR_NO_DEVICE
+	}
+
+	latency, ok := s.latency[op]
+	if !ok {
+		latency = s.latency[0]
+	}
+	timeout := c.timeout
+	s.mu.Unlock()
+
+	if latency > 0 {
+		if timeout > 0 && latency >= timeout {
+			time.Sleep(timeout)
+			return usb.ERROR_TIMEOUT
+		}
+		time.Sleep(latency)
+	}
+
+	if fault != nil {
+		return fault.Err
+	}
+	return nil
+}
+
+// SetTimeout sets how long an operation may be delayed before it times out
+func (c *simSession) SetTimeout(timeout time.Duration) {
+	c.dev.mu.Lock()
+	defer c.dev.mu.Unlock()
+
+	c.timeout = timeout
+}
+
+// CloseSession ends the session, later operations fail as on a closed device
+func (c *simSession) CloseSession() error {
+	if err := c.begin(mtp.OC_CloseSession); err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// ResetSession opens a new session on the same connection
+func (c *simSession) ResetSession() error {
+	if err := c.begin(mtp.OC_OpenSession); err != nil {
+		return err
+	}
+
+	c.dev.mu.Lock()
+	defer c.dev.mu.Unlock()
+
+	c.session = c.dev.resets
+	c.pending = 0
+	return nil
+}
+
+// DeviceReset receives the EC_DeviceReset events of Reset
+func (c *simSession) DeviceReset() <-chan struct{} {
+	return c.resets
+}
+
+// Close ends the session
+func (c *simSession) Close() error {
+	c.dev.mu.Lock()
+	defer c.dev.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		c.dev.sessions--
+	}
+	return nil
+}
+
+// GetDeviceInfo returns the DeviceInfo dataset
+func (c *simSession) GetDeviceInfo(info *mtp.DeviceInfo) error {
+	if err := c.begin(mtp.OC_GetDeviceInfo); err != nil {
+		return err
+	}
+
+	c.dev.mu.Lock()
+	defer c.dev.mu.Unlock()
+
+	*info = c.dev.info
+	info.OperationsSupported = slices.Clone(c.dev.info.OperationsSupported)
+	return nil
+}
+
+// GetStorageIDs lists the storages
+func (c *simSession) GetStorageIDs(ids *mtp.Uint32Array) error {
+	if err := c.begin(mtp.OC_GetStorageIDs); err != nil {
+		return err
+	}
+
+	c.dev.mu.Lock()
+	defer c.dev.mu.Unlock()
+
+	ids.Values = nil
+	for _, st := range c.dev.storages {
+		ids.Values = append(ids.Values, st.id)
+	}
+	return nil
+}
+
+// GetStorageInfo returns the info of a storage with its current free space
+func (c *simSession) GetStorageInfo(storageID uint32, info *mtp.StorageInfo) error {
+	if err := c.begin(mtp.OC_GetStorageInfo); err != nil {
+		return err
+	}
+
+	c.dev.mu.Lock()
+	defer c.dev.mu.Unlock()
+
+	st, err := c.dev.storage(storageID)
+	if err != nil {
+		return err
+	}
+
+	*info = st.info
+	info.FreeSpaceInBytes = st.capacity - min(c.dev.usedSpace(storageID), st.capacity)
+	return nil
+}
+
+// GetObjectHandles lists the objects in a folder, parent 0 lists the whole storage
+func (c *simSession) GetObjectHandles(storageID, objFormatCode, parent uint32, handles *mtp.Uint32Array) error {
+	if err := c.begin(mtp.OC_GetObjectHandles); err != nil {
+		return err
+	}
+
+	c.dev.mu.Lock()
+	defer c.dev.mu.Unlock()
+
+	allStorages := storageID == 0xFFFFFFFF
+	if !allStorages {
+		if _, err := c.dev.storage(storageID); err != nil {
+			return err
+		}
+	}
+
+	allObjects := parent == 0
+	if !allObjects {
+		var err error
+		if parent, err = c.dev.parentFolder(storageID, parent); err != nil {
+			return err
+		}
+	}
+
+	handles.Values = nil
+	for h, obj := range c.dev.objects {
+		if (allStorages || obj.info.StorageID == storageID) &&
+			(allObjects || obj.info.ParentObject == parent) &&
+			(objFormatCode == 0 || uint32(obj.info.ObjectFormat) == objFormatCode) {
+			handles.Values = append(handles.Values, h)
+		}
+	}
+	slices.Sort(handles.Values)
+	return nil
+}
+
+// GetObjectInfo returns the ObjectInfo dataset of an object
+func (c *simSession) GetObjectInfo(handle uint32, info *mtp.ObjectInfo) error {
+	if err := c.begin(mtp.OC_GetObjectInfo); err != nil {
+		return err
+	}
+
+	c.dev.mu.Lock()
+	defer c.dev.mu.Unlock()
+
+	obj, err := c.dev.object(handle)
+	if err != nil {
+		return err
+	}
+
+	*info = obj.info
+	return nil
+}
+
+// GetObjectPropValue supports the object size and file name properties
+func (c *simSession) GetObjectPropValue(handle uint32, propCode uint16, value interface{}) error {
+	if err := c.begin(mtp.OC_MTP_GetObjectPropValue); err != nil {
+		return err
+	}
+
+	c.dev.mu.Lock()
+	defer c.dev.mu.Unlock()
+
+	obj, err := c.dev.object(handle)
+	if err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case *mtp.Uint64Value:
+		if propCode == mtp.OPC_ObjectSize {
+			v.Value = uint64(len(obj.data))
+			return nil
+		}
+	case *mtp.StringValue:
+		if propCode == mtp.OPC_ObjectFileName {
+			v.Value = obj.info.Filename
+			return nil
+		}
+	}
+	return mtp.RCError(mtp.RC_MTP_ObjectProp_Not_Supported)
+}
+
+// SetObjectPropValue supports renaming through the file name property
+func (c *simSession) SetObjectPropValue(handle uint32, propCode uint16, value interface{}) error {
+	if err := c.begin(mtp.OC_MTP_SetObjectPropValue); err != nil {
+		return err
+	}
+
+	c.dev.mu.Lock()
+	defer c.dev.mu.Unlock()
+
+	obj, err := c.dev.object(handle)
+	if err != nil {
+		return err
+	}
+
+	v, ok := value.(*mtp.StringValue)
+	if !ok || propCode != mtp.OPC_ObjectFileName {
+		return mtp.RCError(mtp.RC_MTP_ObjectProp_Not_Supported)
+	}
+
+	obj.info.Filename = v.Value
+	return nil
+}
+
+// GetObject writes the contents of a file in chunks, reporting progress after each
+func (c *simSession) GetObject(handle uint32, w io.Writer, progressCb mtp.ProgressFunc) error {
+	if err := c.begin(mtp.OC_GetObject); err != nil {
+		return err
+	}
+
+	c.dev.mu.Lock()
+	obj, err := c.dev.object(handle)
+	var data []byte
+	if err == nil {
+		if obj.info.ObjectFormat == ObjectFormatFolder {
+			err = mtp.RCError(mtp.RC_InvalidObjectHandle)
+		}
+		data = obj.data
+	}
+	c.dev.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	const chunkSize = 64 * 1024
+	var sent int64
+	for len(data) > 0 {
+		n := min(len(data), chunkSize)
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+		sent += int64(n)
+		if err := progressCb(sent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AndroidGetPartialObject64 writes up to size bytes of a file starting at offset
+func (c *simSession) AndroidGetPartialObject64(handle uint32, w io.Writer, offset int64, size uint32) error {
+	if err := c.begin(mtp.OC_ANDROID_GET_PARTIAL_OBJECT64); err != nil {
+		return err
+	}
+	return c.writeRange(handle, w, offset, size)
+}
+
+// writeRange writes a section of a file
+func (c *simSession) writeRange(handle uint32, w io.Writer, offset int64, size uint32) error {
+	c.dev.mu.Lock()
+	obj, err := c.dev.object(handle)
+	var data []byte
+	if err == nil {
+		data = obj.data
+	}
+	c.dev.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if offset < 0 || offset > int64(len(data)) {
+		return mtp.RCError(mtp.RC_InvalidParameter)
+	}
+	end := min(offset+int64(size), int64(len(data)))
+	_, err = w.Write(data[offset:end])
+	return err
+}
+
+// SendObjectInfo creates an object, files receive their contents with the following SendObject
+func (c *simSession) SendObjectInfo(wantStorageID, wantParent uint32, info *mtp.ObjectInfo) (storageID, parent, handle uint32, err error) {
+	if err := c.begin(mtp.OC_SendObjectInfo); err != nil {
+		return 0, 0, 0, err
+	}
+
+	c.dev.mu.Lock()
+	defer c.dev.mu.Unlock()
+
+	st, err := c.dev.storage(wantStorageID)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	parentObject, err := c.dev.parentFolder(wantStorageID, wantParent)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if uint64(info.CompressedSize) > st.capacity-min(c.dev.usedSpace(wantStorageID), st.capacity) {
+		return 0, 0, 0, mtp.RCError(mtp.RC_StoreFull)
+	}
+
+	handle = c.dev.addObject(wantStorageID, parentObject, info.Filename, info.ObjectFormat, nil)
+	c.pending = 0
+	if info.ObjectFormat != ObjectFormatFolder {
+		c.pending = handle
+	}
+	return wantStorageID, wantParent, handle, nil
+}
+
+// SendObject stores size bytes from r as the contents of the object created by SendObjectInfo
+// The object is removed when the transfer fails, as Android does
+func (c *simSession) SendObject(r io.Reader, size int64, progressCb mtp.ProgressFunc) error {
+	if err := c.begin(mtp.OC_SendObject); err != nil {
+		return err
+	}
+
+	c.dev.mu.Lock()
+	handle := c.pending
+	c.pending = 0
+	c.dev.mu.Unlock()
+
+	if handle == 0 {
+		return mtp.RCError(mtp.RC_NoValidObjectInfo)
+	}
+
+	data := make([]byte, 0, size)
+	buf := make([]byte, 64*1024)
+	var err error
+	for int64(len(data)) < size {
+		n, readErr := r.Read(buf[:min(int64(len(buf)), size-int64(len(data)))])
+		data = append(data, buf[:n]...)
+		if n > 0 {
+			if err = progressCb(int64(len(data))); err != nil {
+				break
+			}
+		}
+		if int64(len(data)) == size {
+			break
+		}
+		if readErr == io.EOF {
+			err = io.ErrUnexpectedEOF
+			break
+		}
+		if readErr != nil {
+			err = readErr
+			break
+		}
+	}
+
+	c.dev.mu.Lock()
+	defer c.dev.mu.Unlock()
+
+	obj, ok := c.dev.objects[handle]
+	if !ok {
+		return mtp.RCError(mtp.RC_InvalidObjectHandle)
+	}
+	if err != nil {
+		delete(c.dev.objects, handle)
+		return err
+	}
+
+	obj.data = data
+	obj.info.CompressedSize = uint32(min(uint64(len(data)), 0xFFFFFFFF))
+	return nil
+}
+
+// DeleteObject deletes an object, folders are deleted with their contents
+func (c *simSession) DeleteObject(handle uint32) error {
+	if err := c.begin(mtp.OC_DeleteObject); err != nil {
+		return err
+	}
+
+	c.dev.mu.Lock()
+	defer c.dev.mu.Unlock()
+
+	if _, err := c.dev.object(handle); err != nil {
+		return err
+	}
+	c.dev.deleteTree(handle)
+	return nil
+}
+
+// RunTransaction carries the operations of the dedicated methods as raw datasets, as a USB device does,
+// and supports GetPartialObject, GetThumb and MoveObject
+func (c *simSession) RunTransaction(req *mtp.Container, rep *mtp.Container, dest io.Writer, src io.Reader, writeSize int64, progressCb mtp.ProgressFunc) error {
+	err := c.datasetTransaction(req, rep, dest, src, writeSize, progressCb)
+	if err == errNoDataset {
+		if err = c.begin(req.Code); err == nil {
+			err = c.runTransaction(req, dest)
+		}
+	}
+
+	rep.Code = mtp.RC_OK
+	if rc, ok := err.(mtp.RCError); ok {
+		rep.Code = uint16(rc)
+	}
+	return err
+}
+
+// errNoDataset is returned by datasetTransaction for operations without a dedicated method
+var errNoDataset = errors.New("no dedicated method")
+
+// datasetTransaction runs an operation that has a dedicated method, encoding and decoding its datasets
+func (c *simSession) datasetTransaction(req *mtp.Container, rep *mtp.Container, dest io.Writer, src io.Reader, writeSize int64, progressCb mtp.ProgressFunc) error {
+	param := func(i int) uint32 {
+		if i < len(req.Param) {
+			return req.Param[i]
+		}
+		return 0
+	}
+	// encode writes the dataset an operation returned
+	encode := func(value interface{}, err error) error {
+		if err != nil {
+			return err
+		}
+		return mtp.Encode(dest, value)
+	}
+	// decode reads the dataset sent with an operation
+	decode := func(value interface{}) error {
+		if src == nil {
+			return mtp.RCError(mtp.RC_InvalidParameter)
+		}
+		return mtp.Decode(io.LimitReader(src, writeSize), value)
+	}
+
+	switch req.Code {
+	case mtp.OC_GetDeviceInfo:
+		var info mtp.DeviceInfo
+		return encode(&info, c.GetDeviceInfo(&info))
+
+	case mtp.OC_GetStorageIDs:
+		var ids mtp.Uint32Array
+		return encode(&ids, c.GetStorageIDs(&ids))
+
+	case mtp.OC_GetStorageInfo:
+		var info mtp.StorageInfo
+		return encode(&info, c.GetStorageInfo(param(0), &info))
+
+	case mtp.OC_GetObjectHandles:
+		var handles mtp.Uint32Array
+		return encode(&handles, c.GetObjectHandles(param(0), param(1), param(2), &handles))
+
+	case mtp.OC_GetObjectInfo:
+		var info mtp.ObjectInfo
+		return encode(&info, c.GetObjectInfo(param(0), &info))
+
+	case mtp.OC_MTP_GetObjectPropValue:
+		var value interface{} = &mtp.StringValue{}
+		if uint16(param(1)) == mtp.OPC_ObjectSize {
+			value = &mtp.Uint64Value{}
+		}
+		return encode(value, c.GetObjectPropValue(param(0), uint16(param(1)), value))
+
+	case mtp.OC_MTP_SetObjectPropValue:
+		var value mtp.StringValue
+		if err := decode(&value); err != nil {
+			return err
+		}
+		return c.SetObjectPropValue(param(0), uint16(param(1)), &value)
+
+	case mtp.OC_GetObject:
+		return c.GetObject(param(0), dest, progressCb)
+
+	case mtp.OC_ANDROID_GET_PARTIAL_OBJECT64:
+		return c.AndroidGetPartialObject64(param(0), dest, int64(param(1))|int64(param(2))<<32, param(3))
+
+	case mtp.OC_SendObjectInfo:
+		var info mtp.ObjectInfo
+		if err := decode(&info); err != nil {
+			return err
+		}
+		storageID, parent, handle, err := c.SendObjectInfo(param(0), param(1), &info)
+		if err == nil {
+			rep.Param = []uint32{storageID, parent, handle}
+		}
+		return err
+
+	case mtp.OC_SendObject:
+		return c.SendObject(src, writeSize, progressCb)
+
+	case mtp.OC_DeleteObject:
+		return c.DeleteObject(param(0))
+
+	default:
+		return errNoDataset
+	}
+}
+
+func (c *simSession) runTransaction(req *mtp.Container, dest io.Writer) error {
+	param := func(i int) uint32 {
+		if i < len(req.Param) {
+			return req.Param[i]
+		}
+		return 0
+	}
+
+	switch req.Code {
+	case mtp.OC_GetPartialObject:
+		return c.writeRange(param(0), dest, int64(param(1)), param(2))
+
+	case mtp.OC_GetThumb:
+		c.dev.mu.Lock()
+		obj, err := c.dev.object(param(0))
+		var thumb []byte
+		if err == nil {
+			thumb = obj.thumb
+		}
+		c.dev.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if thumb == nil {
+			return mtp.RCError(mtp.RC_NoThumbnailPresent)
+		}
+		_, err = dest.Write(thumb)
+		return err
+
+	case mtp.OC_MoveObject:
+		c.dev.mu.Lock()
+		defer c.dev.mu.Unlock()
+
+		obj, err := c.dev.object(param(0))
+		if err != nil {
+			return err
+		}
+		if _, err := c.dev.storage(param(1)); err != nil {
+			return err
+		}
+		parent, err := c.dev.parentFolder(param(1), param(2))
+		if err != nil {
+			return err
+		}
+		for p := parent; p != 0; p = c.dev.objects[p].info.ParentObject {
+			if p == param(0) {
+				return mtp.RCError(mtp.RC_InvalidParentObject)
+			}
+		}
+
+		c.moveTree(obj, param(0), param(1), parent)
+		return nil
+
+	default:
+		return mtp.RCError(mtp.RC_OperationNotSupported)
+	}
+}
+
+// moveTree moves an object under parent, its descendants follow it to the new storage
+func (c *simSession) moveTree(obj *simObject, handle, storageID, parent uint32) {
+	obj.info.StorageID = storageID
+	obj.info.ParentObject = parent
+
+	var relabel func(uint32)
+	relabel = func(h uint32) {
+		for child, o := range c.dev.objects {
+			if o.info.ParentObject == h {
+				o.info.StorageID = storageID
+				relabel(child)
+			}
+		}
+	}
+	relabel(handle)
+}
@@ -0,0 +1,269 @@
+package kalam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+	"github.com/ganeshrvel/usb"
+)
+
+// useSimDevice runs the bridge against sim with short backoffs until the test ends
+func useSimDevice(t *testing.T, sim *SimDevice) *Client {
+	t.Helper()
+
+	useConfig(t, func(c *Config) {
+		for _, p := range []*RetryPolicy{&c.Retry.Scan, &c.Retry.Metadata, &c.Retry.Transfer, &c.Retry.Mutation} {
+			p.BaseDelay, p.MaxDelay = time.Millisecond, time.Millisecond
+		}
+		c.Reconnect.GracePeriod = 0
+	})
+
+	SetDeviceOpener(sim.Open)
+	client := NewClient()
+	client.Open()
+
+	t.Cleanup(func() {
+		SetDeviceOpener(nil)
+	})
+	return client
+}
+
+func TestSimDeviceClientEndToEnd(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	ctx := context.Background()
+
+	devices, err := client.Scan(ctx)
+	if err != nil || len(devices) != 1 || devices[0].SerialNumber != "SIMDEMO01" || len(devices[0].Storage) != 2 {
+		t.Fatalf("Scan = %+v, %v", devices, err)
+	}
+
+	root, err := client.ListFiles(ctx, 65537, RootParentID)
+	if err != nil || len(root) != 3 {
+		t.Fatalf("ListFiles(root) = %+v, %v", root, err)
+	}
+
+	folderID, err := client.CreateFolder(ctx, 65537, RootParentID, "Backup")
+	if err != nil {
+		t.Fatalf("CreateFolder failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "report.pdf")
+	content := bytes.Repeat([]byte("kalam"), 40000)
+	if err := os.WriteFile(src, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fileID, err := client.UploadFile(ctx, 65537, ParentID(folderID), src)
+	if err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	if data, ok := sim.FileData(fileID); !ok || !bytes.Equal(data, content) {
+		t.Fatalf("device holds %d bytes after upload, want %d", len(data), len(content))
+	}
+
+	dest := filepath.Join(dir, "copy.pdf")
+	if err := client.DownloadFile(ctx, fileID, dest); err != nil {
+		t.Fatalf("DownloadFile failed: %v", err)
+	}
+	if data, err := os.ReadFile(dest); err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("downloaded file does not match upload (%v)", err)
+	}
+
+	part, err := client.ReadRange(ctx, fileID, 5, 10)
+	if err != nil || !bytes.Equal(part, content[5:15]) {
+		t.Fatalf("ReadRange = %q, %v", part, err)
+	}
+
+	if err := client.RenameObject(ctx, fileID, "final.pdf"); err != nil {
+		t.Fatalf("RenameObject failed: %v", err)
+	}
+	if err := client.MoveObject(ctx, fileID, 131073, RootParentID); err != nil {
+		t.Fatalf("MoveObject failed: %v", err)
+	}
+	sdFiles, err := client.ListFiles(ctx, 131073, RootParentID)
+	if err != nil || len(sdFiles) != 1 || sdFiles[0].Name != "final.pdf" {
+		t.Fatalf("ListFiles(SD card) = %+v, %v", sdFiles, err)
+	}
+
+	if err := client.DeleteObject(ctx, folderID); err != nil {
+		t.Fatalf("DeleteObject failed: %v", err)
+	}
+	if root, _ := client.ListFiles(ctx, 65537, RootParentID); len(root) != 3 {
+		t.Fatalf("expected Backup to be deleted, got %+v", root)
+	}
+}
+
+func TestSimDeviceThumbnail(t *testing.T) {
+	sim := NewSimDevice()
+	sim.AddStorage(1, "Internal", 1<<20)
+	photo := sim.AddFile(1, RootParentID, "IMG_0001.jpg", []byte("not really a jpeg"))
+	sim.SetThumbnail(photo, []byte("thumb"))
+	client := useSimDevice(t, sim)
+
+	thumb, err := client.Thumbnail(context.Background(), photo)
+	if err != nil || string(thumb) != "thumb" {
+		t.Fatalf("Thumbnail = %q, %v", thumb, err)
+	}
+}
+
+func TestSimDeviceBusyIsRetried(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	sim.InjectFault(SimFault{Op: mtp.OC_GetObjectHandles, Times: 2, Err: mtp.RCError(mtp.RC_DeviceBusy)})
+
+	files, err := client.ListFiles(context.Background(), 65537, RootParentID)
+	if err != nil || len(files) != 3 {
+		t.Fatalf("ListFiles = %+v, %v", files, err)
+	}
+	if got := sim.Calls(mtp.OC_GetObjectHandles); got != 3 {
+		t.Fatalf("expected 2 busy responses and 1 success, got %d calls", got)
+	}
+}
+
+func TestSimDeviceRCErrorIsNotRetried(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	sim.InjectFault(SimFault{Op: mtp.OC_DeleteObject, Err: mtp.RCError(mtp.RC_ObjectWriteProtected)})
+
+	err := client.DeleteObject(context.Background(), 1)
+	if !errors.Is(err, mtp.RCError(mtp.RC_ObjectWriteProtected)) {
+		t.Fatalf("expected ObjectWriteProtected, got %v", err)
+	}
+	if got := sim.Calls(mtp.OC_DeleteObject); got != 1 {
+		t.Fatalf("expected a single DeleteObject call, got %d", got)
+	}
+}
+
+func TestSimDeviceLatencyTimesOut(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	// Without the circuit breaker every attempt reaches the device
+	useConfig(t, func(c *Config) {
+		c.Timeouts.NormalOperation = 10 * time.Millisecond
+		c.Retry.MaxConsecutiveFailures = 0
+	})
+	sim.SetLatency(mtp.OC_GetObjectHandles, 50*time.Millisecond)
+
+	_, err := client.ListFiles(context.Background(), 65537, RootParentID)
+	if !errors.Is(err, usb.ERROR_TIMEOUT) {
+		t.Fatalf("expected USB timeout, got %v", err)
+	}
+	if got := sim.Calls(mtp.OC_GetObjectHandles); got != cfg().Retry.Metadata.Attempts {
+		t.Fatalf("expected %d attempts, got %d", cfg().Retry.Metadata.Attempts, got)
+	}
+
+	sim.ClearFaults()
+	if _, err := client.ListFiles(context.Background(), 65537, RootParentID); err != nil {
+		t.Fatalf("ListFiles after clearing latency failed: %v", err)
+	}
+}
+
+// slowWriter counts writes and takes delay for each
+type slowWriter struct {
+	delay  time.Duration
+	writes atomic.Int64
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	w.writes.Add(1)
+	return len(p), nil
+}
+
+func TestDownloadTimeoutStopsTransfer(t *testing.T) {
+	dev, err := NewDemoDevice().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	// song.mp3 (handle 7) arrives in 48 chunks of 5ms, far more than fit in the timeout
+	w := &slowWriter{delay: 5 * time.Millisecond}
+	err = getObjectWithTimeout(context.Background(), dev, 7, w, func(int64) error { return nil }, 10*time.Millisecond)
+	if !errors.Is(err, errTransferAbandoned) {
+		t.Fatalf("getObjectWithTimeout = %v, want %v", err, errTransferAbandoned)
+	}
+
+	writes := w.writes.Load()
+	time.Sleep(50 * time.Millisecond)
+	if now := w.writes.Load(); now != writes {
+		t.Fatalf("the transfer went on after the timeout, %d writes became %d", writes, now)
+	}
+}
+
+func TestSimDeviceDisconnect(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	ctx := context.Background()
+
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+
+	sim.InjectFault(SimFault{Op: mtp.OC_GetObjectHandles, Times: 1, Disconnect: true})
+	_, err := client.ListFiles(ctx, 65537, RootParentID)
+	if err == nil || !strings.Contains(err.Error(), "no MTP devices found") {
+		t.Fatalf("expected the unplugged device to be missing, got %v", err)
+	}
+
+	// The replugged device gets a fresh session in place of the broken pooled one
+	sim.Plug()
+	if _, err := client.ListFiles(ctx, 65537, RootParentID); err != nil {
+		t.Fatalf("ListFiles after replug failed: %v", err)
+	}
+	if got := sim.OpenSessions(); got != 1 {
+		t.Fatalf("expected 1 open session after replug, got %d", got)
+	}
+}
+
+func TestSimDeviceSessionRules(t *testing.T) {
+	sim := NewSimDevice()
+	sim.AddStorage(1, "Internal", 100)
+	dev, err := sim.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dev.SendObject(strings.NewReader("x"), 1, mtp.EmptyProgressFunc); !errors.Is(err, mtp.RCError(mtp.RC_NoValidObjectInfo)) {
+		t.Errorf("SendObject without SendObjectInfo = %v", err)
+	}
+
+	info := mtp.ObjectInfo{Filename: "big.bin", ObjectFormat: ObjectFormatGenericFile, CompressedSize: 101}
+	if _, _, _, err := dev.SendObjectInfo(1, uint32(RootParentID), &info); !errors.Is(err, mtp.RCError(mtp.RC_StoreFull)) {
+		t.Errorf("SendObjectInfo beyond capacity = %v", err)
+	}
+	if _, _, _, err := dev.SendObjectInfo(1, 999, &info); !errors.Is(err, mtp.RCError(mtp.RC_InvalidParentObject)) {
+		t.Errorf("SendObjectInfo into missing parent = %v", err)
+	}
+
+	// A failed transfer leaves no object behind
+	info.CompressedSize = 10
+	if _, _, _, err := dev.SendObjectInfo(1, uint32(RootParentID), &info); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.SendObject(strings.NewReader("short"), 10, mtp.EmptyProgressFunc); err == nil {
+		t.Errorf("expected short upload to fail")
+	}
+	var handles mtp.Uint32Array
+	if err := dev.GetObjectHandles(1, 0, uint32(RootParentID), &handles); err != nil || len(handles.Values) != 0 {
+		t.Errorf("expected no objects after failed upload, got %v (%v)", handles.Values, err)
+	}
+
+	dev.Close()
+	if err := dev.GetStorageIDs(&handles); err == nil || !strings.Contains(err.Error(), "device is not open") {
+		t.Errorf("operation on closed session = %v", err)
+	}
+	if got := sim.OpenSessions(); got != 0 {
+		t.Errorf("expected no open sessions, got %d", got)
+	}
+}
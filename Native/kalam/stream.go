@@ -0,0 +1,222 @@
+package kalam
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// streamChunk is a contiguous section of an object held in memory
+type streamChunk struct {
+	offset int64
+	data   []byte
+	err    error
+}
+
+// contains reports whether the chunk holds the byte at pos
+func (c *streamChunk) contains(pos int64) bool {
+	return c != nil && c.err == nil && pos >= c.offset && pos < c.offset+int64(len(c.data))
+}
+
+// chunkFetcher reads length bytes of the streamed object at offset
+type chunkFetcher func(offset int64, length uint32) ([]byte, error)
+
+// readStream is a seekable reader over an object on the device
+// Data is fetched in aligned chunks with partial object reads and the next chunk is read ahead in the
+// background. Each chunk takes the device lock separately, so metadata operations can run between chunks.
+type readStream struct {
+	mu        sync.Mutex
+	fetch     chunkFetcher
+	chunkSize int64
+	size      int64
+	pos       int64
+	current   *streamChunk
+	ahead     chan *streamChunk
+	aheadAt   int64
+	closed    bool
+}
+
+// newReadStream creates a stream over an object of the given size
+func newReadStream(size int64, chunkSize uint32, fetch chunkFetcher) *readStream {
+	return &readStream{
+		fetch:     fetch,
+		chunkSize: int64(chunkSize),
+		size:      size,
+	}
+}
+
+// chunkStart returns the aligned start of the chunk containing pos
+func (s *readStream) chunkStart(pos int64) int64 {
+	return pos - pos%s.chunkSize
+}
+
+// fetchChunk reads the chunk starting at offset
+func (s *readStream) fetchChunk(offset int64) *streamChunk {
+	length := s.chunkSize
+	if remaining := s.size - offset; remaining < length {
+		length = remaining
+	}
+
+	data, err := s.fetch(offset, uint32(length))
+	if err == nil && len(data) == 0 {
+		err = fmt.Errorf("device returned no data at offset %d", offset)
+	}
+	return &streamChunk{offset: offset, data: data, err: err}
+}
+
+// startReadAhead fetches the chunk at offset in the background; must be called with mu held
+func (s *readStream) startReadAhead(offset int64) {
+	if s.ahead != nil || offset >= s.size {
+		return
+	}
+
+	ahead := make(chan *streamChunk, 1)
+	s.ahead = ahead
+	s.aheadAt = offset
+
+	go func() {
+		ahead <- s.fetchChunk(offset)
+	}()
+}
+
+// loadChunk makes the chunk containing pos current; must be called with mu held
+func (s *readStream) loadChunk(pos int64) error {
+	start := s.chunkStart(pos)
+
+	var chunk *streamChunk
+	if s.ahead != nil && s.aheadAt == start {
+		chunk = <-s.ahead
+		s.ahead = nil
+	} else {
+		// Seeked away from the read-ahead; let it complete in the background and read synchronously
+		s.ahead = nil
+		chunk = s.fetchChunk(start)
+	}
+
+	if chunk.err != nil {
+		return chunk.err
+	}
+
+	s.current = chunk
+	return nil
+}
+
+// Read implements io.Reader
+func (s *readStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, fmt.Errorf("stream is closed")
+	}
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if !s.current.contains(s.pos) {
+		if err := s.loadChunk(s.pos); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.current.data[s.pos-s.current.offset:])
+	s.pos += int64(n)
+
+	// Keep one chunk ahead of a sequential reader
+	s.startReadAhead(s.current.offset + int64(len(s.current.data)))
+
+	return n, nil
+}
+
+// Seek implements io.Seeker
+func (s *readStream) Seek(offset int64, whence int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, fmt.Errorf("stream is closed")
+	}
+
+	var newPos int64
+	switch whence {
+	case io.SeekStart:
+		newPos = offset
+	case io.SeekCurrent:
+		newPos = s.pos + offset
+	case io.SeekEnd:
+		newPos = s.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if newPos < 0 {
+		return 0, fmt.Errorf("negative position %d", newPos)
+	}
+
+	s.pos = newPos
+	return newPos, nil
+}
+
+// Close releases the buffered data; a pending read-ahead finishes into its buffered channel
+func (s *readStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.current = nil
+	s.ahead = nil
+	return nil
+}
+
+// OpenReader opens a seekable reader over a file on the device
+// Data is read in chunks of Stream.ChunkSize with partial object reads; ctx bounds every chunk read
+func (c *Client) OpenReader(ctx context.Context, objectID ObjectID) (io.ReadSeekCloser, error) {
+	if err := objectID.Validate(); err != nil {
+		return nil, err
+	}
+
+	var size int64
+
+	err := withObjectDevice(ctx, ClassMetadata, objectID, func(dev Device, handle uint32) error {
+		var objInfo mtp.ObjectInfo
+		if err := dev.GetObjectInfo(handle, &objInfo); err != nil {
+			return fmt.Errorf("failed to get object info: %w", err)
+		}
+
+		if objInfo.ObjectFormat == ObjectFormatFolder {
+			return fmt.Errorf("cannot stream a folder: %s", objInfo.Filename)
+		}
+
+		// Objects over 4GB report 0xFFFFFFFF and need the 64-bit size property
+		objSize, err := objectSize(dev, &objInfo, handle)
+		if err != nil {
+			return fmt.Errorf("failed to get object size: %w", err)
+		}
+
+		// Fail on open rather than on the first read if partial reads are unavailable
+		support, err := detectPartialReadSupport(dev)
+		if err != nil {
+			return err
+		}
+		if _, err := selectPartialReadOp(support, uint64(objSize), 0); err != nil {
+			return err
+		}
+
+		size = objSize
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newReadStream(size, cfg().Stream.ChunkSize, func(offset int64, length uint32) ([]byte, error) {
+		return c.ReadRange(ctx, objectID, offset, length)
+	}), nil
+}
@@ -0,0 +1,98 @@
+package kalam
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+)
+
+// fakeObjectFetcher serves partial reads from an in-memory object and records requested offsets
+type fakeObjectFetcher struct {
+	mu      sync.Mutex
+	data    []byte
+	offsets []int64
+}
+
+func (f *fakeObjectFetcher) fetch(offset int64, length uint32) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.offsets = append(f.offsets, offset)
+	end := offset + int64(length)
+	if end > int64(len(f.data)) {
+		end = int64(len(f.data))
+	}
+	return append([]byte(nil), f.data[offset:end]...), nil
+}
+
+func newTestObject(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestReadStreamSequentialRead(t *testing.T) {
+	fetcher := &fakeObjectFetcher{data: newTestObject(10000)}
+	stream := newReadStream(int64(len(fetcher.data)), 1024, fetcher.fetch)
+	defer stream.Close()
+
+	got, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+	if !bytes.Equal(got, fetcher.data) {
+		t.Fatalf("streamed data does not match object")
+	}
+
+	fetcher.mu.Lock()
+	defer fetcher.mu.Unlock()
+	if len(fetcher.offsets) != 10 {
+		t.Fatalf("expected 10 chunk reads, got %d: %v", len(fetcher.offsets), fetcher.offsets)
+	}
+}
+
+func TestReadStreamSeek(t *testing.T) {
+	fetcher := &fakeObjectFetcher{data: newTestObject(5000)}
+	stream := newReadStream(int64(len(fetcher.data)), 1024, fetcher.fetch)
+	defer stream.Close()
+
+	if pos, err := stream.Seek(-100, io.SeekEnd); err != nil || pos != 4900 {
+		t.Fatalf("Seek(-100, SeekEnd) = %d, %v", pos, err)
+	}
+
+	buf := make([]byte, 200)
+	n, err := io.ReadFull(stream, buf)
+	if err != io.ErrUnexpectedEOF || n != 100 {
+		t.Fatalf("expected short read of 100 bytes at end, got %d, %v", n, err)
+	}
+	if !bytes.Equal(buf[:n], fetcher.data[4900:]) {
+		t.Fatalf("tail data does not match object")
+	}
+
+	if pos, err := stream.Seek(2000, io.SeekStart); err != nil || pos != 2000 {
+		t.Fatalf("Seek(2000, SeekStart) = %d, %v", pos, err)
+	}
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatalf("ReadFull after seek returned error: %v", err)
+	}
+	if !bytes.Equal(buf, fetcher.data[2000:2200]) {
+		t.Fatalf("data after seek does not match object")
+	}
+
+	if _, err := stream.Seek(-1, io.SeekStart); err == nil {
+		t.Fatalf("expected negative seek to be rejected")
+	}
+}
+
+func TestReadStreamClosed(t *testing.T) {
+	fetcher := &fakeObjectFetcher{data: newTestObject(10)}
+	stream := newReadStream(int64(len(fetcher.data)), 1024, fetcher.fetch)
+	stream.Close()
+
+	if _, err := stream.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected read on closed stream to fail")
+	}
+}
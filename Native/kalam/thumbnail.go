@@ -0,0 +1,254 @@
+package kalam
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// EXIF/TIFF tags locating the embedded JPEG thumbnail in IFD1
+const (
+	exifTagJPEGInterchangeFormat       = 0x0201
+	exifTagJPEGInterchangeFormatLength = 0x0202
+)
+
+var (
+	errNoEXIFThumbnail = errors.New("no embedded EXIF thumbnail")
+	errEXIFTruncated   = errors.New("EXIF block extends beyond the data read")
+)
+
+// getThumb fetches the device-generated thumbnail of an object
+func getThumb(dev Device, handle uint32, w io.Writer) error {
+	var req, rep mtp.Container
+	req.Code = mtp.OC_GetThumb
+	req.Param = []uint32{handle}
+	return dev.RunTransaction(&req, &rep, w, nil, 0, mtp.EmptyProgressFunc)
+}
+
+// readObjectPrefix reads up to size bytes from the start of an object
+func readObjectPrefix(dev Device, handle uint32, size uint32) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := readObjectRange(dev, handle, 0, size, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// extractEXIFThumbnail returns the JPEG thumbnail embedded in the APP1 EXIF block of a JPEG prefix
+func extractEXIFThumbnail(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, fmt.Errorf("not a JPEG file")
+	}
+
+	pos := 2
+	for {
+		if pos+4 > len(data) {
+			return nil, errEXIFTruncated
+		}
+		if data[pos] != 0xFF {
+			return nil, fmt.Errorf("invalid JPEG marker at offset %d", pos)
+		}
+
+		marker := data[pos+1]
+		if marker == 0xFF {
+			// Fill byte before the actual marker
+			pos++
+			continue
+		}
+
+		// Start of scan or end of image: no APP1 EXIF before image data
+		if marker == 0xDA || marker == 0xD9 {
+			return nil, errNoEXIFThumbnail
+		}
+
+		segmentLen := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if segmentLen < 2 {
+			return nil, fmt.Errorf("invalid JPEG segment length %d", segmentLen)
+		}
+		segmentStart := pos + 4
+		segmentEnd := pos + 2 + segmentLen
+
+		if marker == 0xE1 {
+			if segmentEnd > len(data) {
+				return nil, errEXIFTruncated
+			}
+			segment := data[segmentStart:segmentEnd]
+			if len(segment) >= 6 && string(segment[:6]) == "Exif\x00\x00" {
+				return extractTIFFThumbnail(segment[6:])
+			}
+		}
+
+		pos = segmentEnd
+	}
+}
+
+// extractTIFFThumbnail locates the thumbnail referenced by IFD1 of a TIFF structure
+func extractTIFFThumbnail(tiff []byte) ([]byte, error) {
+	if len(tiff) < 8 {
+		return nil, fmt.Errorf("TIFF header too short")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid TIFF byte order")
+	}
+
+	if order.Uint16(tiff[2:]) != 42 {
+		return nil, fmt.Errorf("invalid TIFF magic")
+	}
+
+	// IFD0 is followed by the offset of IFD1, which describes the thumbnail
+	ifd0 := order.Uint32(tiff[4:])
+	ifd0Count, err := ifdEntryCount(tiff, order, ifd0)
+	if err != nil {
+		return nil, err
+	}
+	nextOffset := int(ifd0) + 2 + ifd0Count*12
+	if nextOffset+4 > len(tiff) {
+		return nil, fmt.Errorf("IFD0 exceeds EXIF block")
+	}
+	ifd1 := order.Uint32(tiff[nextOffset:])
+	if ifd1 == 0 {
+		return nil, errNoEXIFThumbnail
+	}
+
+	ifd1Count, err := ifdEntryCount(tiff, order, ifd1)
+	if err != nil {
+		return nil, err
+	}
+
+	var thumbOffset, thumbLength uint32
+	for i := 0; i < ifd1Count; i++ {
+		entry := tiff[int(ifd1)+2+i*12:]
+		switch order.Uint16(entry) {
+		case exifTagJPEGInterchangeFormat:
+			thumbOffset = order.Uint32(entry[8:])
+		case exifTagJPEGInterchangeFormatLength:
+			thumbLength = order.Uint32(entry[8:])
+		}
+	}
+
+	if thumbOffset == 0 || thumbLength == 0 {
+		return nil, errNoEXIFThumbnail
+	}
+	if uint64(thumbOffset)+uint64(thumbLength) > uint64(len(tiff)) {
+		return nil, fmt.Errorf("thumbnail exceeds EXIF block")
+	}
+
+	thumb := tiff[thumbOffset : thumbOffset+thumbLength]
+	if len(thumb) < 2 || thumb[0] != 0xFF || thumb[1] != 0xD8 {
+		return nil, fmt.Errorf("embedded thumbnail is not a JPEG")
+	}
+
+	result := make([]byte, len(thumb))
+	copy(result, thumb)
+	return result, nil
+}
+
+// ifdEntryCount validates an IFD offset and returns its number of entries
+func ifdEntryCount(tiff []byte, order binary.ByteOrder, offset uint32) (int, error) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return 0, fmt.Errorf("IFD offset %d exceeds EXIF block", offset)
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	if int(offset)+2+count*12 > len(tiff) {
+		return 0, fmt.Errorf("IFD at offset %d exceeds EXIF block", offset)
+	}
+	return count, nil
+}
+
+// fetchEXIFThumbnail extracts the embedded thumbnail of a JPEG object using partial reads only
+func fetchEXIFThumbnail(dev Device, handle uint32) ([]byte, error) {
+	readSize := cfg().Thumbnail.PartialReadSize
+
+	for {
+		prefix, err := readObjectPrefix(dev, handle, readSize)
+		if err != nil {
+			return nil, fmt.Errorf("partial read failed: %w", err)
+		}
+
+		thumb, err := extractEXIFThumbnail(prefix)
+		if err == errEXIFTruncated && uint32(len(prefix)) == readSize && readSize < cfg().Thumbnail.MaxPartialReadSize {
+			// APP1 block is larger than the first read, try once more with the maximum size
+			readSize = cfg().Thumbnail.MaxPartialReadSize
+			continue
+		}
+		return thumb, err
+	}
+}
+
+// Thumbnail returns a JPEG thumbnail of an object
+// The device-generated thumbnail is preferred, JPEG photos fall back to their embedded EXIF thumbnail
+func (c *Client) Thumbnail(ctx context.Context, objectID ObjectID) ([]byte, error) {
+	if err := objectID.Validate(); err != nil {
+		return nil, err
+	}
+
+	var thumb []byte
+
+	err := withObjectDevice(ctx, ClassMetadata, objectID, func(dev Device, handle uint32) error {
+		var objInfo mtp.ObjectInfo
+		if err := dev.GetObjectInfo(handle, &objInfo); err != nil {
+			return fmt.Errorf("failed to get object info: %w", err)
+		}
+
+		// Prefer the thumbnail generated by the device
+		if objInfo.ThumbCompressedSize > 0 {
+			var buf bytes.Buffer
+			if err := getThumb(dev, handle, &buf); err == nil && buf.Len() > 0 {
+				thumb = buf.Bytes()
+				return nil
+			} else if err != nil {
+				transferLog.Debug("GetThumb failed", "name", objInfo.Filename, "error", err)
+			}
+		}
+
+		// Many Android devices return nothing from GetThumb, read the EXIF thumbnail instead
+		if objInfo.ObjectFormat != mtp.OFC_EXIF_JPEG && objInfo.ObjectFormat != mtp.OFC_JFIF {
+			return fmt.Errorf("no thumbnail available for %s", objInfo.Filename)
+		}
+
+		exifThumb, err := fetchEXIFThumbnail(dev, handle)
+		if err != nil {
+			return fmt.Errorf("EXIF thumbnail extraction failed for %s: %w", objInfo.Filename, err)
+		}
+
+		thumb = exifThumb
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return thumb, nil
+}
+
+// DownloadThumbnail writes the thumbnail of an object to destPath and returns its size
+func (c *Client) DownloadThumbnail(ctx context.Context, objectID ObjectID, destPath string) (int, error) {
+	validatedPath, err := ValidateDestinationPath(destPath)
+	if err != nil {
+		return 0, err
+	}
+
+	thumb, err := c.Thumbnail(ctx, objectID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.WriteFile(validatedPath, thumb, 0600); err != nil {
+		return 0, fmt.Errorf("failed to write thumbnail to %s: %w", validatedPath, err)
+	}
+
+	return len(thumb), nil
+}
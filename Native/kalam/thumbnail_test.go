@@ -0,0 +1,85 @@
+package kalam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// buildEXIFJPEG builds a minimal JPEG whose APP1 block embeds thumb in IFD1
+func buildEXIFJPEG(order binary.ByteOrder, thumb []byte) []byte {
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(&tiff, order, uint16(42))
+	binary.Write(&tiff, order, uint32(8)) // IFD0 offset
+
+	// IFD0: no entries, next IFD at 14
+	binary.Write(&tiff, order, uint16(0))
+	binary.Write(&tiff, order, uint32(14))
+
+	// IFD1: two entries pointing at the thumbnail right after the IFD
+	thumbOffset := uint32(14 + 2 + 2*12 + 4)
+	binary.Write(&tiff, order, uint16(2))
+	for _, entry := range []struct {
+		tag   uint16
+		value uint32
+	}{
+		{exifTagJPEGInterchangeFormat, thumbOffset},
+		{exifTagJPEGInterchangeFormatLength, uint32(len(thumb))},
+	} {
+		binary.Write(&tiff, order, entry.tag)
+		binary.Write(&tiff, order, uint16(4)) // LONG
+		binary.Write(&tiff, order, uint32(1))
+		binary.Write(&tiff, order, entry.value)
+	}
+	binary.Write(&tiff, order, uint32(0))
+	tiff.Write(thumb)
+
+	var jpeg bytes.Buffer
+	jpeg.Write([]byte{0xFF, 0xD8})
+	jpeg.Write([]byte{0xFF, 0xE1})
+	binary.Write(&jpeg, binary.BigEndian, uint16(2+6+tiff.Len()))
+	jpeg.WriteString("Exif\x00\x00")
+	jpeg.Write(tiff.Bytes())
+	jpeg.Write([]byte{0xFF, 0xDA, 0x00, 0x02})
+	jpeg.Write(bytes.Repeat([]byte{0x42}, 64))
+	return jpeg.Bytes()
+}
+
+func TestExtractEXIFThumbnail(t *testing.T) {
+	thumb := []byte{0xFF, 0xD8, 0x01, 0x02, 0x03, 0xFF, 0xD9}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		got, err := extractEXIFThumbnail(buildEXIFJPEG(order, thumb))
+		if err != nil {
+			t.Fatalf("extractEXIFThumbnail(%v) returned error: %v", order, err)
+		}
+		if !bytes.Equal(got, thumb) {
+			t.Fatalf("extractEXIFThumbnail(%v) = %x, want %x", order, got, thumb)
+		}
+	}
+}
+
+func TestExtractEXIFThumbnailTruncated(t *testing.T) {
+	jpeg := buildEXIFJPEG(binary.LittleEndian, []byte{0xFF, 0xD8, 0xFF, 0xD9})
+
+	if _, err := extractEXIFThumbnail(jpeg[:20]); err != errEXIFTruncated {
+		t.Fatalf("expected errEXIFTruncated, got %v", err)
+	}
+}
+
+func TestExtractEXIFThumbnailWithoutEXIF(t *testing.T) {
+	jpeg := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x04, 0x00, 0x00, 0xFF, 0xDA, 0x00, 0x02}
+
+	if _, err := extractEXIFThumbnail(jpeg); err != errNoEXIFThumbnail {
+		t.Fatalf("expected errNoEXIFThumbnail, got %v", err)
+	}
+
+	if _, err := extractEXIFThumbnail([]byte("not a jpeg")); err == nil {
+		t.Fatalf("expected non-JPEG data to be rejected")
+	}
+}
@@ -0,0 +1,136 @@
+package kalam
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// transactionOps builds the dataset operations of Device on RunTransaction the way mtp.Device does
+// Devices that only carry raw containers, such as replays and PTP/IP connections, embed it
+type transactionOps struct {
+	run func(req *mtp.Container, rep *mtp.Container, dest io.Writer, src io.Reader, writeSize int64, progressCb mtp.ProgressFunc) error
+}
+
+// getData runs a transaction and decodes the dataset it returned
+func (o transactionOps) getData(req *mtp.Container, value interface{}) error {
+	var buf bytes.Buffer
+	var rep mtp.Container
+	if err := o.run(req, &rep, &buf, nil, 0, mtp.EmptyProgressFunc); err != nil {
+		return err
+	}
+	return mtp.Decode(&buf, value)
+}
+
+// sendData encodes a dataset and runs a transaction sending it
+func (o transactionOps) sendData(req *mtp.Container, rep *mtp.Container, value interface{}) error {
+	var buf bytes.Buffer
+	if err := mtp.Encode(&buf, value); err != nil {
+		return err
+	}
+	return o.run(req, rep, nil, &buf, int64(buf.Len()), mtp.EmptyProgressFunc)
+}
+
+// CloseSession ends the session
+func (o transactionOps) CloseSession() error {
+	var rep mtp.Container
+	return o.run(&mtp.Container{Code: mtp.OC_CloseSession}, &rep, nil, nil, 0, mtp.EmptyProgressFunc)
+}
+
+// ResetSession ends the session, which the device may have lost already, and opens a new one
+func (o transactionOps) ResetSession() error {
+	var rep mtp.Container
+	// A device that lost the session answers SessionNotOpen
+	o.run(&mtp.Container{Code: mtp.OC_CloseSession}, &rep, nil, nil, 0, mtp.EmptyProgressFunc)
+	return o.run(&mtp.Container{Code: mtp.OC_OpenSession, Param: []uint32{newSessionID()}}, &rep, nil, nil, 0, mtp.EmptyProgressFunc)
+}
+
+// newSessionID returns a random session ID, 0 and 0xFFFFFFFF are reserved
+func newSessionID() uint32 {
+	var sid [4]byte
+	rand.Read(sid[:])
+	return binary.LittleEndian.Uint32(sid[:])>>1 | 1
+}
+
+// GetDeviceInfo retrieves the DeviceInfo dataset
+func (o transactionOps) GetDeviceInfo(info *mtp.DeviceInfo) error {
+	return o.getData(&mtp.Container{Code: mtp.OC_GetDeviceInfo}, info)
+}
+
+// GetStorageIDs lists the storages
+func (o transactionOps) GetStorageIDs(ids *mtp.Uint32Array) error {
+	return o.getData(&mtp.Container{Code: mtp.OC_GetStorageIDs}, ids)
+}
+
+// GetStorageInfo retrieves the StorageInfo dataset
+func (o transactionOps) GetStorageInfo(storageID uint32, info *mtp.StorageInfo) error {
+	return o.getData(&mtp.Container{Code: mtp.OC_GetStorageInfo, Param: []uint32{storageID}}, info)
+}
+
+// GetObjectHandles lists the objects in a folder
+func (o transactionOps) GetObjectHandles(storageID, objFormatCode, parent uint32, handles *mtp.Uint32Array) error {
+	return o.getData(&mtp.Container{Code: mtp.OC_GetObjectHandles, Param: []uint32{storageID, objFormatCode, parent}}, handles)
+}
+
+// GetObjectInfo retrieves the ObjectInfo dataset
+func (o transactionOps) GetObjectInfo(handle uint32, info *mtp.ObjectInfo) error {
+	return o.getData(&mtp.Container{Code: mtp.OC_GetObjectInfo, Param: []uint32{handle}}, info)
+}
+
+// GetObjectPropValue retrieves an object property
+func (o transactionOps) GetObjectPropValue(handle uint32, propCode uint16, value interface{}) error {
+	return o.getData(&mtp.Container{Code: mtp.OC_MTP_GetObjectPropValue, Param: []uint32{handle, uint32(propCode)}}, value)
+}
+
+// SetObjectPropValue changes an object property
+func (o transactionOps) SetObjectPropValue(handle uint32, propCode uint16, value interface{}) error {
+	var rep mtp.Container
+	return o.sendData(&mtp.Container{Code: mtp.OC_MTP_SetObjectPropValue, Param: []uint32{handle, uint32(propCode)}}, &rep, value)
+}
+
+// GetObject writes the contents of a file
+func (o transactionOps) GetObject(handle uint32, w io.Writer, progressCb mtp.ProgressFunc) error {
+	var rep mtp.Container
+	return o.run(&mtp.Container{Code: mtp.OC_GetObject, Param: []uint32{handle}}, &rep, w, nil, 0, progressCb)
+}
+
+// AndroidGetPartialObject64 writes a section of a file
+func (o transactionOps) AndroidGetPartialObject64(handle uint32, w io.Writer, offset int64, size uint32) error {
+	var rep mtp.Container
+	req := mtp.Container{
+		Code:  mtp.OC_ANDROID_GET_PARTIAL_OBJECT64,
+		Param: []uint32{handle, uint32(offset & 0xFFFFFFFF), uint32(offset >> 32), size},
+	}
+	return o.run(&req, &rep, w, nil, 0, mtp.EmptyProgressFunc)
+}
+
+// SendObjectInfo creates an object
+func (o transactionOps) SendObjectInfo(wantStorageID, wantParent uint32, info *mtp.ObjectInfo) (storageID, parent, handle uint32, err error) {
+	var rep mtp.Container
+	req := mtp.Container{Code: mtp.OC_SendObjectInfo, Param: []uint32{wantStorageID, wantParent}}
+	if err = o.sendData(&req, &rep, info); err != nil {
+		return
+	}
+
+	if len(rep.Param) < 3 {
+		err = fmt.Errorf("SendObjectInfo: got %v, need 3 response parameters", rep.Param)
+		return
+	}
+	return rep.Param[0], rep.Param[1], rep.Param[2], nil
+}
+
+// SendObject sends the contents of the object created by SendObjectInfo
+func (o transactionOps) SendObject(r io.Reader, size int64, progressCb mtp.ProgressFunc) error {
+	var rep mtp.Container
+	return o.run(&mtp.Container{Code: mtp.OC_SendObject}, &rep, nil, r, size, progressCb)
+}
+
+// DeleteObject deletes an object
+func (o transactionOps) DeleteObject(handle uint32) error {
+	var rep mtp.Container
+	return o.run(&mtp.Container{Code: mtp.OC_DeleteObject, Param: []uint32{handle, 0}}, &rep, nil, nil, 0, mtp.EmptyProgressFunc)
+}
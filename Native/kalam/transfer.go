@@ -0,0 +1,473 @@
+package kalam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+// ProgressFunc receives the bytes transferred so far and the size of the transfer
+type ProgressFunc func(done, total int64)
+
+type progressKey struct{}
+
+// WithProgress returns a context whose downloads and uploads report their progress to fn
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// reportProgress passes transfer progress to the ProgressFunc of ctx, if any
+func reportProgress(ctx context.Context, done, total int64) {
+	if fn, ok := ctx.Value(progressKey{}).(ProgressFunc); ok && fn != nil {
+		fn(done, total)
+	}
+}
+
+// DownloadFile downloads an object to destPath, retrying recoverable failures
+func (c *Client) DownloadFile(ctx context.Context, objectID ObjectID, destPath string) error {
+	return fileSystemMgr.DownloadFile(ctx, objectID, destPath)
+}
+
+// UploadFile uploads the local file at srcPath into parentID and returns the new object
+func (c *Client) UploadFile(ctx context.Context, storageID StorageID, parentID ParentID, srcPath string) (ObjectID, error) {
+	return fileSystemMgr.UploadFile(ctx, storageID, parentID, srcPath)
+}
+
+// UploadReader uploads size bytes from r as a new file named name
+// r is rewound before every attempt, so it must be seekable
+func (c *Client) UploadReader(ctx context.Context, storageID StorageID, parentID ParentID, name string, r io.ReadSeeker, size int64) (ObjectID, error) {
+	if err := validateObjectName(name); err != nil {
+		return 0, err
+	}
+
+	var newHandle uint32
+	defer objectsChanged()
+
+	err := withObjectDevice(ctx, ClassTransfer, ObjectID(parentID), func(dev Device, parent uint32) error {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek upload data: %w", err)
+		}
+
+		var objInfo mtp.ObjectInfo
+		objInfo.StorageID = uint32(storageID)
+		objInfo.ParentObject = parent
+		objInfo.Filename = name
+		objInfo.ObjectFormat = ObjectFormatGenericFile
+		objInfo.CompressedSize = uint32(size)
+		if size > 0xFFFFFFFF {
+			objInfo.CompressedSize = 0xFFFFFFFF
+		}
+		objInfo.ModificationDate = time.Now()
+
+		_, _, handle, err := dev.SendObjectInfo(uint32(storageID), parent, &objInfo)
+		if err != nil {
+			return fmt.Errorf("SendObjectInfo failed: %w", err)
+		}
+		rememberChild(ObjectID(handle), storageID, ParentID(parent), name)
+
+		progressCb := func(sent int64) error {
+			reportProgress(ctx, sent, size)
+			return ctx.Err()
+		}
+		// The object exists now, another attempt would create a second one
+		if err := dev.SendObject(r, size, progressCb); err != nil {
+			return partialSuccess(fmt.Errorf("SendObject failed: %w", err))
+		}
+
+		newHandle = handle
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+	return ObjectID(newHandle), nil
+}
+
+// downloadFile downloads an object to destPath, the transfer retry policy retries its device calls
+// Downloads are abandoned between retries and chunks once ctx is done
+func downloadFile(ctx context.Context, objectIDTyped ObjectID, destPath string) error {
+	if err := objectIDTyped.Validate(); err != nil {
+		return err
+	}
+
+	// The retries and chunks below are one operation, a shutdown lets them finish
+	ctx, end, err := beginOperation(ctx)
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	// Basic path validation (no directory restriction since user chooses location via NSSavePanel)
+	// Only check for dangerous patterns and normalize the path
+	validatedPath, err := ValidateDestinationPath(destPath)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Check if destination directory exists
+	dir := filepath.Dir(validatedPath)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+
+	// Check if file already exists
+	if _, err := os.Stat(validatedPath); err == nil {
+		transferLog.Debug("replacing existing file", "path", validatedPath)
+		// Remove existing file to ensure clean download
+		if removeErr := os.Remove(validatedPath); removeErr != nil {
+			return fmt.Errorf("failed to remove existing file %s: %w", validatedPath, removeErr)
+		}
+	}
+
+	// A configuration change applies to the next download, not to its retries
+	conf := cfg()
+
+	file, err := os.Create(validatedPath)
+	if err != nil {
+		transferLog.Error("failed to create file", "path", validatedPath, "error", err)
+		return err
+	}
+
+	// Use defer to ensure file is always closed, even if panic occurs
+	defer file.Close()
+
+	// Track file size for validation
+	var writtenBytes, totalBytes int64
+
+	// Simplified progress callback to avoid cross-language crashes
+	progressCb := func(sent int64) error {
+		writtenBytes = sent
+		reportProgress(ctx, sent, totalBytes)
+
+		// Check for cancellation during download
+		if err := ctx.Err(); err != nil {
+			transferLog.Info("download cancelled", "received", sent)
+			return err
+		}
+		return nil
+	}
+
+	// Object info decides between one GetObject and a chunked download
+	// A chunked download remembers the path of the object, so it can resume after a reconnect
+	// The handle may have been renumbered since it was listed, the object is then found by its path
+	var resumable *resumableObject
+	downloadErr := withObjectDevice(ctx, ClassMetadata, objectIDTyped, func(dev Device, handle uint32) error {
+		objectIDTyped = ObjectID(handle)
+
+		// Validate object exists before download
+		var objInfo mtp.ObjectInfo
+		if err := dev.GetObjectInfo(uint32(objectIDTyped), &objInfo); err != nil {
+			return fmt.Errorf("failed to get object info: %w", err)
+		}
+
+		transferLog.Info("starting download", "name", objInfo.Filename, "size", objInfo.CompressedSize)
+		if size, err := objectSize(dev, &objInfo, uint32(objectIDTyped)); err == nil {
+			totalBytes = size
+		}
+
+		// For large files, warn about potential timeouts
+		if int64(objInfo.CompressedSize) > conf.FileSize.LargeThreshold {
+			transferLog.Debug("large file detected, download may take time", "size", objInfo.CompressedSize)
+		} // Progress monitoring disabled for stability
+
+		// Chunks queued one at a time let other operations run during a long download
+		if totalBytes > int64(conf.Stream.ChunkSize) {
+			if support, err := detectPartialReadSupport(dev); err == nil {
+				if _, opErr := selectPartialReadOp(support, uint64(totalBytes), 0); opErr == nil {
+					obj, err := newResumableObject(dev, objectIDTyped, &objInfo)
+					if err != nil {
+						return err
+					}
+					resumable = obj
+				}
+			}
+		}
+		return nil
+	})
+
+	// Every device call below is retried by the transfer policy, a chunked download chunk by chunk
+	switch {
+	case downloadErr != nil:
+		// The object could not be inspected
+	case resumable != nil:
+		downloadErr = downloadChunks(ctx, resumable, file, totalBytes, conf.Stream.ChunkSize, progressCb)
+	default:
+		downloadErr = withDeviceFor(ctx, ClassTransfer, func(dev Device) error {
+			// Set very long timeout for large file downloads
+			dev.SetTimeout(conf.Timeouts.LargeFileDownload)
+
+			// A retry, or a job run again after a reconnect, starts the file over
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to rewind download: %w", err)
+			}
+			if err := file.Truncate(0); err != nil {
+				return fmt.Errorf("failed to truncate download: %w", err)
+			}
+			return getObjectWithTimeout(ctx, dev, uint32(objectIDTyped), file, progressCb, conf.Timeouts.LargeFileDownload)
+		})
+	}
+
+	// Ensure file is closed properly and synced to disk
+	if syncErr := file.Sync(); syncErr != nil {
+		transferLog.Warn("failed to sync file", "path", validatedPath, "error", syncErr)
+	}
+	if cerr := file.Close(); cerr != nil {
+		transferLog.Warn("failed to close file", "path", validatedPath, "error", cerr)
+	}
+
+	if downloadErr == nil {
+		// Download succeeded, validate the file
+		if stat, err := os.Stat(validatedPath); err != nil {
+			transferLog.Warn("failed to stat downloaded file", "path", validatedPath, "error", err)
+			downloadErr = err
+		} else if stat.Size() == 0 {
+			transferLog.Warn("downloaded file is empty", "path", validatedPath)
+			downloadErr = fmt.Errorf("downloaded file is empty")
+		} else {
+			transferLog.Info("download completed", "path", validatedPath, "size", stat.Size(), "tracked", writtenBytes)
+			return nil
+		}
+	}
+
+	transferLog.Warn("download failed", "error", downloadErr)
+
+	// Remove partial file
+	if removeErr := os.Remove(validatedPath); removeErr != nil {
+		transferLog.Warn("failed to remove partial file", "path", validatedPath, "error", removeErr)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return downloadErr
+}
+
+// errTransferAbandoned fails a transfer given up half-way, the device may still be sending its data phase
+// so the session is not used again
+var errTransferAbandoned = errors.New("transfer abandoned")
+
+// getObjectWithTimeout reads an object into w with GetObject, giving up after timeout
+// On timeout the transfer is aborted at the next progress callback and waited for, so it no longer drives the device
+// or writes to w when the next job runs. A panic in the mtp package fails the download instead of the bridge
+func getObjectWithTimeout(ctx context.Context, dev Device, handle uint32, w io.Writer, progressCb func(int64) error, timeout time.Duration) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			transferLog.Error("panic during download", "panic", r)
+			err = fmt.Errorf("panic during download: %v", r)
+		}
+	}()
+
+	// Use a context with timeout for the download operation
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var timedOut atomic.Bool
+	abortable := func(received int64) error {
+		if timedOut.Load() {
+			return errTransferAbandoned
+		}
+		return progressCb(received)
+	}
+
+	downloadChan := make(chan error, 1)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				downloadChan <- fmt.Errorf("panic in download goroutine: %v", r)
+			}
+		}()
+
+		downloadChan <- dev.GetObject(handle, w, abortable)
+	}()
+
+	// Wait for download completion or timeout
+	select {
+	case err := <-downloadChan:
+		if err != nil {
+			return fmt.Errorf("download failed: %w", err)
+		}
+		return nil
+	case <-timeoutCtx.Done():
+		if ctx.Err() != nil {
+			// Cancellation is seen by progressCb, wait for GetObject to return
+			if err := <-downloadChan; err != nil {
+				return fmt.Errorf("download failed: %w", err)
+			}
+			return nil
+		}
+		transferLog.Warn("download timed out, aborting", "timeout", timeout)
+		timedOut.Store(true)
+		<-downloadChan
+		return fmt.Errorf("download timed out after %d seconds: %w", int(timeout.Seconds()), errTransferAbandoned)
+	}
+}
+
+// downloadChunks writes an object to w with partial reads of chunkSize
+// Every chunk is a job of its own, so operations queued meanwhile run between the chunks
+// and a download interrupted by a reconnect continues at the chunk it was reading
+func downloadChunks(ctx context.Context, obj *resumableObject, w io.Writer, size int64, chunkSize uint32, progressCb func(int64) error) error {
+	var chunk bytes.Buffer
+	for offset := int64(0); offset < size; {
+		length := chunkSize
+		if remaining := size - offset; remaining < int64(length) {
+			length = uint32(remaining)
+		}
+
+		err := withDeviceFor(ctx, ClassTransfer, func(dev Device) error {
+			chunk.Reset()
+			handle, err := obj.handle(dev)
+			if err != nil {
+				return err
+			}
+			return readObjectRange(dev, handle, uint64(offset), length, &chunk)
+		})
+		if err != nil {
+			return fmt.Errorf("download failed at offset %d: %w", offset, err)
+		}
+		if chunk.Len() == 0 {
+			return fmt.Errorf("download failed: no data at offset %d", offset)
+		}
+
+		if _, err := w.Write(chunk.Bytes()); err != nil {
+			return fmt.Errorf("failed to write download: %w", err)
+		}
+		offset += int64(chunk.Len())
+
+		if err := progressCb(offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadFile uploads the local file at path into parentID and returns the handle of the new object
+func uploadFile(ctx context.Context, storageIDTyped StorageID, parentIDTyped ParentID, path string) (ObjectID, error) {
+	if err := storageIDTyped.Validate(); err != nil {
+		return 0, err
+	}
+	if err := parentIDTyped.Validate(); err != nil {
+		return 0, err
+	}
+
+	if path == "" {
+		return 0, fmt.Errorf("empty source path")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// Check if file exists
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("file not found: %w", err)
+	}
+
+	if fileInfo.IsDir() {
+		return 0, fmt.Errorf("cannot upload directories: %s", path)
+	}
+
+	fileSize := fileInfo.Size()
+	fileName := filepath.Base(path)
+
+	transferLog.Info("starting upload", "name", fileName, "size", fileSize)
+
+	var result ObjectID
+	defer objectsChanged()
+
+	err = withObjectDevice(ctx, ClassTransfer, ObjectID(parentIDTyped), func(dev Device, parent uint32) error {
+		// Step 1: Send object info
+		var objInfo mtp.ObjectInfo
+		objInfo.StorageID = uint32(storageIDTyped)
+		objInfo.ParentObject = parent
+		objInfo.Filename = fileName
+		objInfo.ObjectFormat = ObjectFormatGenericFile
+		objInfo.CompressedSize = uint32(fileSize)
+		objInfo.ModificationDate = time.Now()
+
+		transferLog.Debug("sending object info", "name", fileName)
+
+		// Use a more conservative approach with error handling
+		_, _, newHandle, err := dev.SendObjectInfo(uint32(storageIDTyped), parent, &objInfo)
+		if err != nil {
+			transferLog.Warn("SendObjectInfo failed", "name", fileName, "error", err)
+			return fmt.Errorf("SendObjectInfo failed: %w", err)
+		}
+		rememberChild(ObjectID(newHandle), storageIDTyped, ParentID(parent), fileName)
+
+		transferLog.Debug("got object handle", "name", fileName, "handle", newHandle)
+
+		if err := ctx.Err(); err != nil {
+			transferLog.Info("upload cancelled before data transfer", "name", fileName)
+			return err
+		}
+
+		// Step 2: Open the file for reading
+		file, err := os.Open(path)
+		if err != nil {
+			transferLog.Error("failed to open file", "error", err)
+			return partialSuccess(fmt.Errorf("failed to open file: %w", err))
+		}
+
+		// Step 3: Send file data using the correct SendObject signature
+		transferLog.Debug("starting data transfer", "name", fileName)
+
+		// SendObject expects: (io.Reader, int64, mtp.ProgressFunc)
+		// We need to seek back to beginning of file and provide size
+		if _, err := file.Seek(0, 0); err != nil {
+			file.Close()
+			transferLog.Error("failed to seek file", "error", err)
+			return partialSuccess(fmt.Errorf("failed to seek file: %w", err))
+		}
+
+		// Create progress callback to check cancellation during transfer
+		progressCb := func(sent int64) error {
+			if err := ctx.Err(); err != nil {
+				transferLog.Info("upload cancelled during transfer", "name", fileName, "sent", sent)
+				return err
+			}
+			reportProgress(ctx, sent, fileSize)
+			return nil
+		}
+
+		// Try to send the object with cancellation checking
+		err = dev.SendObject(file, fileSize, progressCb)
+		file.Close() // Close file immediately after SendObject
+
+		if err != nil {
+			transferLog.Warn("SendObject failed", "name", fileName, "error", err)
+			// The object exists now, another attempt would create a second one
+			return partialSuccess(fmt.Errorf("SendObject failed: %w", err))
+		}
+
+		transferLog.Info("upload completed", "name", fileName, "size", fileSize)
+
+		// Add a small delay to ensure the operation completes
+		time.Sleep(100 * time.Millisecond)
+
+		result = ObjectID(newHandle)
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,622 @@
+package kalam
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DAVPrefix is the URL prefix of the WebDAV gateway
+const DAVPrefix = "/dav"
+
+// DAVBackend is the writable view of the device served over WebDAV
+type DAVBackend interface {
+	HTTPBackend
+
+	// CreateFolder creates a new folder
+	CreateFolder(ctx context.Context, storageID StorageID, parentID ParentID, name string) (ObjectID, error)
+
+	// UploadReader uploads size bytes from r as a new file
+	UploadReader(ctx context.Context, storageID StorageID, parentID ParentID, name string, r io.ReadSeeker, size int64) (ObjectID, error)
+
+	// DeleteObject deletes a file or folder
+	DeleteObject(ctx context.Context, objectID ObjectID) error
+
+	// RenameObject renames a file or folder
+	RenameObject(ctx context.Context, objectID ObjectID, newName string) error
+
+	// MoveObject moves a file or folder to another parent, possibly on another storage
+	MoveObject(ctx context.Context, objectID ObjectID, storageID StorageID, parentID ParentID) error
+}
+
+// -- WebDAV Handler --
+
+// davTarget is a resource addressed by a WebDAV URL
+// A zero storage ID addresses the gateway root, an empty path addresses a storage root
+type davTarget struct {
+	storageID  StorageID
+	objectPath string
+}
+
+// isStorageRoot reports whether the target is the root of a storage
+func (t davTarget) isStorageRoot() bool {
+	return t.storageID != 0 && t.objectPath == ""
+}
+
+// split returns the parent path and the name of the target object
+func (t davTarget) split() (string, string) {
+	parent, name := path.Split(t.objectPath)
+	return strings.TrimSuffix(parent, "/"), name
+}
+
+// components returns the names along the path of the target, none for a storage root
+func (t davTarget) components() []string {
+	if t.objectPath == "" {
+		return nil
+	}
+	return strings.Split(strings.Trim(t.objectPath, "/"), "/")
+}
+
+// href returns the escaped URL path of the target
+func (t davTarget) href(isCollection bool) string {
+	p := DAVPrefix + "/"
+	if t.storageID != 0 {
+		p += strconv.FormatUint(uint64(t.storageID), 10) + "/"
+		if t.objectPath != "" {
+			p += t.objectPath
+			if isCollection {
+				p += "/"
+			}
+		}
+	}
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// parseDAVPath parses /dav/<storageID>/<path> into a target
+func parseDAVPath(urlPath string) (davTarget, error) {
+	rest, ok := strings.CutPrefix(path.Clean("/"+urlPath), DAVPrefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return davTarget{}, fmt.Errorf("%w: %s", ErrObjectNotFound, urlPath)
+	}
+	rest = strings.TrimPrefix(rest, "/")
+	if rest == "" {
+		return davTarget{}, nil
+	}
+
+	idPart, objectPath, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseUint(idPart, 10, 32)
+	if err != nil || StorageID(id).Validate() != nil {
+		return davTarget{}, fmt.Errorf("%w: invalid storage ID %s", ErrObjectNotFound, idPart)
+	}
+
+	return davTarget{storageID: StorageID(id), objectPath: objectPath}, nil
+}
+
+// davHandler is a WebDAV class 1 server backed by the bridge's file operations
+// It has no LOCK, so macOS Finder mounts it read-only; clients that write without locking, such as rclone, can write
+type davHandler struct {
+	backend DAVBackend
+	paths   *pathCache
+}
+
+// ServeHTTP implements http.Handler
+func (h *davHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD, PUT, DELETE, MKCOL, MOVE")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	target, err := parseDAVPath(r.URL.Path)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	// Paths resolved before a change may name other objects now
+	switch r.Method {
+	case http.MethodPut, "MKCOL", http.MethodDelete, "MOVE":
+		defer h.paths.forget()
+	}
+
+	switch r.Method {
+	case "PROPFIND":
+		h.handlePropfind(w, r, target)
+	case http.MethodGet, http.MethodHead:
+		h.handleGet(w, r, target)
+	case http.MethodPut:
+		h.handlePut(w, r, target)
+	case "MKCOL":
+		h.handleMkcol(w, r, target)
+	case http.MethodDelete:
+		h.handleDelete(w, r, target)
+	case "MOVE":
+		h.handleMove(w, r, target)
+	default:
+		http.Error(w, fmt.Sprintf("%s is not supported", r.Method), http.StatusNotImplemented)
+	}
+}
+
+// resolve returns the object addressed by a target inside a storage
+func (h *davHandler) resolve(ctx context.Context, target davTarget) (FileJSON, error) {
+	return resolvePath(ctx, h.backend, h.paths, target.storageID, target.objectPath)
+}
+
+// resolveParent returns the parent ID of the object addressed by a target
+func (h *davHandler) resolveParent(ctx context.Context, target davTarget) (ParentID, error) {
+	parentPath, _ := target.split()
+	if parentPath == "" {
+		return RootParentID, nil
+	}
+
+	parent, err := resolvePath(ctx, h.backend, h.paths, target.storageID, parentPath)
+	if err != nil {
+		return 0, err
+	}
+	if !parent.IsFolder {
+		return 0, fmt.Errorf("%w: %s is not a folder", ErrObjectNotFound, parentPath)
+	}
+	return ParentID(parent.ID), nil
+}
+
+// handleGet serves file contents and JSON listings for collections
+func (h *davHandler) handleGet(w http.ResponseWriter, r *http.Request, target davTarget) {
+	if target.storageID == 0 {
+		storages, err := h.backend.ListStorages(r.Context())
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		writeJSON(w, storages)
+		return
+	}
+
+	parentID := RootParentID
+	if !target.isStorageRoot() {
+		file, err := h.resolve(r.Context(), target)
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		if !file.IsFolder {
+			serveObjectContent(w, r, h.backend, file)
+			return
+		}
+		parentID = ParentID(file.ID)
+	}
+
+	files, err := h.backend.ListFiles(r.Context(), target.storageID, parentID)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	if files == nil {
+		files = []FileJSON{}
+	}
+	writeJSON(w, files)
+}
+
+// davTempName returns a unique name for an object that takes the place of another once it is complete
+func davTempName() string {
+	return fmt.Sprintf(".kalam-%x.tmp", time.Now().UnixNano())
+}
+
+// handlePut uploads the request body, replacing an existing file
+// An existing file is deleted only once its replacement is on the device, a failed upload leaves it untouched
+func (h *davHandler) handlePut(w http.ResponseWriter, r *http.Request, target davTarget) {
+	if target.storageID == 0 || target.isStorageRoot() {
+		http.Error(w, "cannot write to a collection", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parentID, err := h.resolveParent(r.Context(), target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	existing, err := h.resolve(r.Context(), target)
+	replace := err == nil
+	if replace && existing.IsFolder {
+		http.Error(w, "cannot overwrite a collection", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		writeHTTPError(w, err)
+		return
+	}
+
+	// MTP needs the size before any data is sent, so spool the body to disk first
+	spool, err := os.CreateTemp("", "kalam-dav-*")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	parentPath, name := target.split()
+	if !replace {
+		if _, err := h.backend.UploadReader(r.Context(), target.storageID, parentID, name, spool, size); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	tempName := davTempName()
+	newID, err := h.backend.UploadReader(r.Context(), target.storageID, parentID, tempName, spool, size)
+	// The body is on the device or failed for good, a client going away no longer stops the replacement
+	ctx := context.WithoutCancel(r.Context())
+	if err != nil {
+		// A partial upload leaves an incomplete object behind
+		h.discard(ctx, davTarget{storageID: target.storageID, objectPath: path.Join(parentPath, tempName)})
+		writeHTTPError(w, err)
+		return
+	}
+
+	if err := h.backend.DeleteObject(ctx, ObjectID(existing.ID)); err != nil {
+		if err := h.backend.DeleteObject(ctx, newID); err != nil {
+			bridgeLog.Warn("failed to delete the upload of a failed replacement", "path", target.objectPath, "temp", tempName, "error", err)
+		}
+		writeHTTPError(w, err)
+		return
+	}
+	if err := h.backend.RenameObject(ctx, newID, name); err != nil {
+		bridgeLog.Error("replaced file left under a temporary name", "path", target.objectPath, "temp", tempName, "error", err)
+		writeHTTPError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// discard deletes the object at target, if any, after a failed operation
+func (h *davHandler) discard(ctx context.Context, target davTarget) {
+	file, err := ResolvePath(ctx, h.backend, target.storageID, target.objectPath)
+	if err != nil {
+		return
+	}
+	if err := h.backend.DeleteObject(ctx, ObjectID(file.ID)); err != nil {
+		bridgeLog.Warn("failed to delete the remains of a failed operation", "path", target.objectPath, "error", err)
+	}
+}
+
+// handleMkcol creates a folder
+func (h *davHandler) handleMkcol(w http.ResponseWriter, r *http.Request, target davTarget) {
+	if r.ContentLength > 0 {
+		http.Error(w, "MKCOL with a body is not supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	if target.storageID == 0 || target.isStorageRoot() {
+		http.Error(w, "collection already exists", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := h.resolve(r.Context(), target); err == nil {
+		http.Error(w, "resource already exists", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parentID, err := h.resolveParent(r.Context(), target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	_, name := target.split()
+	if _, err := h.backend.CreateFolder(r.Context(), target.storageID, parentID, name); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleDelete deletes a file or folder
+func (h *davHandler) handleDelete(w http.ResponseWriter, r *http.Request, target davTarget) {
+	if target.storageID == 0 || target.isStorageRoot() {
+		http.Error(w, "cannot delete a storage", http.StatusForbidden)
+		return
+	}
+
+	file, err := h.resolve(r.Context(), target)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	if err := h.backend.DeleteObject(r.Context(), ObjectID(file.ID)); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMove renames and/or moves a file or folder to the Destination URL
+func (h *davHandler) handleMove(w http.ResponseWriter, r *http.Request, target davTarget) {
+	if target.storageID == 0 || target.isStorageRoot() {
+		http.Error(w, "cannot move a storage", http.StatusForbidden)
+		return
+	}
+
+	destURL, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || destURL.Path == "" {
+		http.Error(w, "invalid Destination header", http.StatusBadRequest)
+		return
+	}
+	dest, err := parseDAVPath(destURL.Path)
+	if err != nil || dest.storageID == 0 || dest.isStorageRoot() {
+		http.Error(w, "invalid Destination path", http.StatusBadGateway)
+		return
+	}
+
+	source, err := h.resolve(r.Context(), target)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	destParentID, err := h.resolveParent(r.Context(), dest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	existing, err := h.resolve(r.Context(), dest)
+	replace := err == nil
+	if replace {
+		if existing.ID == source.ID {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Header.Get("Overwrite") == "F" {
+			http.Error(w, "destination exists", http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	if !replace {
+		if err := h.moveTo(r.Context(), source, dest, destParentID); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	// The destination is deleted only once the source sits next to it under a temporary name,
+	// a failed move leaves both where they were
+	sourceParentID, err := h.resolveParent(r.Context(), target)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	ctx := context.WithoutCancel(r.Context())
+	tempName := davTempName()
+	temp := davTarget{storageID: dest.storageID, objectPath: path.Join(path.Dir(dest.objectPath), tempName)}
+
+	if err := h.backend.RenameObject(ctx, ObjectID(source.ID), tempName); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	restore := func(moved bool) {
+		if moved {
+			if err := h.backend.MoveObject(ctx, ObjectID(source.ID), target.storageID, sourceParentID); err != nil {
+				bridgeLog.Error("moved object left under a temporary name", "path", temp.objectPath, "source", target.objectPath, "error", err)
+				return
+			}
+		}
+		if err := h.backend.RenameObject(ctx, ObjectID(source.ID), source.Name); err != nil {
+			bridgeLog.Error("moved object left under a temporary name", "name", tempName, "source", target.objectPath, "error", err)
+		}
+	}
+
+	moved := dest.storageID != target.storageID || !SameParent(source.ParentID, destParentID)
+	if moved {
+		if err := h.backend.MoveObject(ctx, ObjectID(source.ID), dest.storageID, destParentID); err != nil {
+			restore(false)
+			writeHTTPError(w, err)
+			return
+		}
+	}
+
+	if err := h.backend.DeleteObject(ctx, ObjectID(existing.ID)); err != nil {
+		restore(moved)
+		writeHTTPError(w, err)
+		return
+	}
+
+	_, name := dest.split()
+	if err := h.backend.RenameObject(ctx, ObjectID(source.ID), name); err != nil {
+		bridgeLog.Error("moved object left under a temporary name", "path", temp.objectPath, "destination", dest.objectPath, "error", err)
+		writeHTTPError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// moveTo moves and renames source to dest, which does not exist
+func (h *davHandler) moveTo(ctx context.Context, source FileJSON, dest davTarget, destParentID ParentID) error {
+	if StorageID(source.StorageID) != dest.storageID || !SameParent(source.ParentID, destParentID) {
+		if err := h.backend.MoveObject(ctx, ObjectID(source.ID), dest.storageID, destParentID); err != nil {
+			return err
+		}
+	}
+
+	if _, name := dest.split(); name != source.Name {
+		return h.backend.RenameObject(ctx, ObjectID(source.ID), name)
+	}
+	return nil
+}
+
+// -- PROPFIND --
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *uint64         `xml:"D:getcontentlength,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+// davCollectionResponse describes a collection in a PROPFIND response
+func davCollectionResponse(href string, name string) davResponse {
+	return davResponse{
+		Href: href,
+		Propstat: davPropstat{
+			Prop: davProp{
+				DisplayName:  name,
+				ResourceType: davResourceType{Collection: &struct{}{}},
+			},
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+// davFileResponse describes a file or folder object in a PROPFIND response
+func davFileResponse(target davTarget, file FileJSON) davResponse {
+	if file.IsFolder {
+		resp := davCollectionResponse(target.href(true), file.Name)
+		resp.Propstat.Prop.LastModified = time.Unix(file.ModTime, 0).UTC().Format(http.TimeFormat)
+		return resp
+	}
+
+	size := file.Size
+	return davResponse{
+		Href: target.href(false),
+		Propstat: davPropstat{
+			Prop: davProp{
+				DisplayName:   file.Name,
+				ContentLength: &size,
+				LastModified:  time.Unix(file.ModTime, 0).UTC().Format(http.TimeFormat),
+			},
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+// davFiniteDepthError is the RFC 4918 precondition sent when a PROPFIND asks for Depth infinity
+const davFiniteDepthError = `<?xml version="1.0" encoding="utf-8"?>
+<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>
+`
+
+// handlePropfind returns all properties of a resource and, for Depth 1, of its children
+// Depth infinity, which a missing Depth header means, is refused: walking the whole device takes minutes over MTP
+func (h *davHandler) handlePropfind(w http.ResponseWriter, r *http.Request, target davTarget) {
+	var withChildren bool
+	switch depth := r.Header.Get("Depth"); depth {
+	case "0":
+	case "1":
+		withChildren = true
+	case "", "infinity":
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, davFiniteDepthError)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("invalid Depth: %s", depth), http.StatusBadRequest)
+		return
+	}
+	var responses []davResponse
+
+	switch {
+	case target.storageID == 0:
+		responses = append(responses, davCollectionResponse(target.href(true), "device"))
+		if withChildren {
+			storages, err := h.backend.ListStorages(r.Context())
+			if err != nil {
+				writeHTTPError(w, err)
+				return
+			}
+			for _, s := range storages {
+				child := davTarget{storageID: StorageID(s.ID)}
+				responses = append(responses, davCollectionResponse(child.href(true), s.Description))
+			}
+		}
+
+	default:
+		parentID := RootParentID
+		if target.isStorageRoot() {
+			responses = append(responses, davCollectionResponse(target.href(true), strconv.FormatUint(uint64(target.storageID), 10)))
+		} else {
+			file, err := h.resolve(r.Context(), target)
+			if err != nil {
+				writeHTTPError(w, err)
+				return
+			}
+			responses = append(responses, davFileResponse(target, file))
+			if !file.IsFolder {
+				withChildren = false
+			}
+			parentID = ParentID(file.ID)
+		}
+
+		if withChildren {
+			files, err := h.backend.ListFiles(r.Context(), target.storageID, parentID)
+			if err != nil {
+				writeHTTPError(w, err)
+				return
+			}
+			// Clients usually open one of the children next
+			h.paths.putListing(target.storageID, target.components(), files)
+			for _, f := range files {
+				child := davTarget{storageID: target.storageID, objectPath: path.Join(target.objectPath, f.Name)}
+				responses = append(responses, davFileResponse(child, f))
+			}
+		}
+	}
+
+	body, err := xml.Marshal(davMultistatus{Namespace: "DAV:", Responses: responses})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
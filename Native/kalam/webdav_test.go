@@ -0,0 +1,313 @@
+package kalam
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ganeshrvel/go-mtpfs/mtp"
+)
+
+func davRequest(t *testing.T, server *httptest.Server, method, path string, body string, header map[string]string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body of %s %s failed: %v", method, path, err)
+	}
+	return resp, data
+}
+
+// propfindHrefs parses a multistatus response into href -> isCollection
+func propfindHrefs(t *testing.T, body []byte) map[string]bool {
+	t.Helper()
+
+	var ms struct {
+		Responses []struct {
+			Href       string `xml:"href"`
+			Collection *struct {
+			} `xml:"propstat>prop>resourcetype>collection"`
+		} `xml:"response"`
+	}
+	if err := xml.Unmarshal(body, &ms); err != nil {
+		t.Fatalf("invalid multistatus XML: %v\n%s", err, body)
+	}
+
+	hrefs := make(map[string]bool)
+	for _, r := range ms.Responses {
+		hrefs[r.Href] = r.Collection != nil
+	}
+	return hrefs
+}
+
+func TestParseDAVPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    davTarget
+		wantErr bool
+	}{
+		{"/dav", davTarget{}, false},
+		{"/dav/", davTarget{}, false},
+		{"/dav/65537", davTarget{storageID: 65537}, false},
+		{"/dav/65537/DCIM/clip.mp4", davTarget{storageID: 65537, objectPath: "DCIM/clip.mp4"}, false},
+		{"/dav/65537/DCIM/../notes.txt", davTarget{storageID: 65537, objectPath: "notes.txt"}, false},
+		{"/dav/abc/x", davTarget{}, true},
+		{"/dav/0/x", davTarget{}, true},
+		{"/davx/1", davTarget{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseDAVPath(tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDAVPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseDAVPath(%q) = %+v, want %+v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestDAVOptions(t *testing.T) {
+	server, _ := newHTTPTestServer(t)
+
+	resp, _ := davRequest(t, server, http.MethodOptions, "/dav/", "", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("DAV") != "1" {
+		t.Fatalf("OPTIONS = %d, DAV %q", resp.StatusCode, resp.Header.Get("DAV"))
+	}
+}
+
+func TestDAVPropfind(t *testing.T) {
+	server, _ := newHTTPTestServer(t)
+
+	resp, body := davRequest(t, server, "PROPFIND", "/dav/", "", map[string]string{"Depth": "1"})
+	if resp.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND /dav/ status = %d", resp.StatusCode)
+	}
+	hrefs := propfindHrefs(t, body)
+	if isCol, ok := hrefs["/dav/65537/"]; !ok || !isCol {
+		t.Errorf("storage collection missing from %v", hrefs)
+	}
+
+	_, body = davRequest(t, server, "PROPFIND", "/dav/65537/", "", map[string]string{"Depth": "1"})
+	hrefs = propfindHrefs(t, body)
+	if len(hrefs) != 3 {
+		t.Errorf("expected storage root and 2 children, got %v", hrefs)
+	}
+	if isCol := hrefs["/dav/65537/DCIM/"]; !isCol {
+		t.Errorf("DCIM should be a collection: %v", hrefs)
+	}
+	if isCol, ok := hrefs["/dav/65537/notes.txt"]; !ok || isCol {
+		t.Errorf("notes.txt should be a file: %v", hrefs)
+	}
+
+	_, body = davRequest(t, server, "PROPFIND", "/dav/65537/DCIM/", "", map[string]string{"Depth": "0"})
+	if hrefs = propfindHrefs(t, body); len(hrefs) != 1 {
+		t.Errorf("Depth 0 should only describe the resource, got %v", hrefs)
+	}
+
+	resp, _ = davRequest(t, server, "PROPFIND", "/dav/65537/missing", "", map[string]string{"Depth": "0"})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("PROPFIND on missing path status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestDAVPropfindRefusesInfiniteDepth(t *testing.T) {
+	server, _ := newHTTPTestServer(t)
+
+	for _, headers := range []map[string]string{{"Depth": "infinity"}, nil} {
+		resp, body := davRequest(t, server, "PROPFIND", "/dav/65537/", "", headers)
+		if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "propfind-finite-depth") {
+			t.Errorf("PROPFIND with Depth %q = %d %s, want 403 propfind-finite-depth", headers["Depth"], resp.StatusCode, body)
+		}
+	}
+	if resp, _ := davRequest(t, server, "PROPFIND", "/dav/65537/", "", map[string]string{"Depth": "2"}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("PROPFIND with Depth 2 = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestDAVMkcolAndPut(t *testing.T) {
+	server, _ := newHTTPTestServer(t)
+
+	if resp, _ := davRequest(t, server, "MKCOL", "/dav/65537/Music", "", nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("MKCOL status = %d, want 201", resp.StatusCode)
+	}
+	if resp, _ := davRequest(t, server, "MKCOL", "/dav/65537/Music", "", nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("MKCOL on existing folder status = %d, want 405", resp.StatusCode)
+	}
+	if resp, _ := davRequest(t, server, "MKCOL", "/dav/65537/a/b", "", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("MKCOL with missing parent status = %d, want 409", resp.StatusCode)
+	}
+
+	if resp, _ := davRequest(t, server, http.MethodPut, "/dav/65537/Music/song.mp3", "la la la", nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT status = %d, want 201", resp.StatusCode)
+	}
+	if resp, _ := davRequest(t, server, http.MethodPut, "/dav/65537/Music/song.mp3", "la la", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT overwrite status = %d, want 204", resp.StatusCode)
+	}
+
+	resp, body := davRequest(t, server, http.MethodGet, "/dav/65537/Music/song.mp3", "", nil)
+	if resp.StatusCode != http.StatusOK || string(body) != "la la" {
+		t.Errorf("GET after PUT = %d %q", resp.StatusCode, body)
+	}
+
+	if resp, _ := davRequest(t, server, http.MethodPut, "/dav/65537/missing/song.mp3", "x", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("PUT with missing parent status = %d, want 409", resp.StatusCode)
+	}
+}
+
+func TestDAVMoveAndDelete(t *testing.T) {
+	server, client := newHTTPTestServer(t)
+	ctx := context.Background()
+	notes, err := ResolvePath(ctx, client, 65537, "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rename in place
+	resp, _ := davRequest(t, server, "MOVE", "/dav/65537/notes.txt", "", map[string]string{"Destination": server.URL + "/dav/65537/todo.txt"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("MOVE rename status = %d, want 201", resp.StatusCode)
+	}
+	if f, err := ResolvePath(ctx, client, 65537, "todo.txt"); err != nil || f.ID != notes.ID {
+		t.Errorf("after rename got %+v (%v)", f, err)
+	}
+
+	// Move into a folder with a new name
+	resp, _ = davRequest(t, server, "MOVE", "/dav/65537/todo.txt", "", map[string]string{"Destination": "/dav/65537/DCIM/done.txt"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("MOVE status = %d, want 201", resp.StatusCode)
+	}
+	if f, err := ResolvePath(ctx, client, 65537, "DCIM/done.txt"); err != nil || f.ID != notes.ID {
+		t.Errorf("after move got %+v (%v)", f, err)
+	}
+
+	// Refuse to overwrite when asked not to
+	resp, _ = davRequest(t, server, "MOVE", "/dav/65537/DCIM/done.txt", "", map[string]string{
+		"Destination": "/dav/65537/DCIM/clip.mp4",
+		"Overwrite":   "F",
+	})
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("MOVE with Overwrite F status = %d, want 412", resp.StatusCode)
+	}
+
+	if resp, _ := davRequest(t, server, http.MethodDelete, "/dav/65537/DCIM/done.txt", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE status = %d, want 204", resp.StatusCode)
+	}
+	if _, err := ResolvePath(ctx, client, 65537, "DCIM/done.txt"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("object still present after DELETE: %v", err)
+	}
+	if resp, _ := davRequest(t, server, http.MethodDelete, "/dav/65537/", "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("DELETE storage root status = %d, want 403", resp.StatusCode)
+	}
+}
+
+// davNames lists the names in a folder of the internal storage of a simulated device
+func davNames(t *testing.T, client *Client, folder string) []string {
+	t.Helper()
+
+	var names []string
+	for _, f := range listPath(t, client, folder) {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestDAVFailedOverwriteKeepsOriginal(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	server := httptest.NewServer(NewHTTPHandler(client))
+	defer server.Close()
+
+	readme := "/dav/65537/Download/readme.txt"
+	_, original := davRequest(t, server, http.MethodGet, readme, "", nil)
+
+	sim.InjectFault(SimFault{Op: mtp.OC_SendObject, Err: mtp.RCError(mtp.RC_StoreFull)})
+	if resp, _ := davRequest(t, server, http.MethodPut, readme, "new contents", nil); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("PUT overwrite with a failing upload status = %d, want 502", resp.StatusCode)
+	}
+	sim.ClearFaults()
+
+	if resp, body := davRequest(t, server, http.MethodGet, readme, "", nil); resp.StatusCode != http.StatusOK || string(body) != string(original) {
+		t.Fatalf("original after a failed overwrite = %d %q, want %q", resp.StatusCode, body, original)
+	}
+	if names := davNames(t, client, "Download"); len(names) != 1 {
+		t.Fatalf("Download holds %v after a failed overwrite, want the original only", names)
+	}
+
+	if resp, _ := davRequest(t, server, http.MethodPut, readme, "new contents", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT overwrite status = %d, want 204", resp.StatusCode)
+	}
+	if _, body := davRequest(t, server, http.MethodGet, readme, "", nil); string(body) != "new contents" {
+		t.Fatalf("GET after overwrite = %q", body)
+	}
+	if names := davNames(t, client, "Download"); len(names) != 1 || names[0] != "readme.txt" {
+		t.Fatalf("Download holds %v after an overwrite, want readme.txt only", names)
+	}
+}
+
+func TestDAVFailedMoveOverwriteKeepsDestination(t *testing.T) {
+	sim := NewDemoDevice()
+	client := useSimDevice(t, sim)
+	server := httptest.NewServer(NewHTTPHandler(client))
+	defer server.Close()
+
+	moveSong := map[string]string{"Destination": "/dav/65537/Download/readme.txt"}
+	sim.InjectFault(SimFault{Op: mtp.OC_MoveObject, Err: mtp.RCError(mtp.RC_AccessDenied)})
+	if resp, _ := davRequest(t, server, "MOVE", "/dav/65537/Music/song.mp3", "", moveSong); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("MOVE overwrite with a failing move status = %d, want 502", resp.StatusCode)
+	}
+	sim.ClearFaults()
+
+	if names := davNames(t, client, "Download"); len(names) != 1 || names[0] != "readme.txt" {
+		t.Fatalf("Download holds %v after a failed move, want readme.txt", names)
+	}
+	if names := davNames(t, client, "Music"); len(names) != 1 || names[0] != "song.mp3" {
+		t.Fatalf("Music holds %v after a failed move, want song.mp3 back under its name", names)
+	}
+
+	if resp, _ := davRequest(t, server, "MOVE", "/dav/65537/Music/song.mp3", "", moveSong); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("MOVE overwrite status = %d, want 204", resp.StatusCode)
+	}
+	if resp, body := davRequest(t, server, http.MethodGet, "/dav/65537/Download/readme.txt", "", nil); resp.StatusCode != http.StatusOK || len(body) != 3<<20 {
+		t.Fatalf("destination after the move = %d, %d bytes, want the song", resp.StatusCode, len(body))
+	}
+	if names := davNames(t, client, "Music"); len(names) != 0 {
+		t.Fatalf("Music holds %v after the move, want nothing", names)
+	}
+}
+
+func TestValidateObjectName(t *testing.T) {
+	valid := []string{"photo.jpg", "My Folder", "a"}
+	invalid := []string{"", ".", "..", "a/b", "a\\b", "what?", strings.Repeat("x", cfg().Security.MaxFolderNameLength+1)}
+
+	for _, name := range valid {
+		if err := validateObjectName(name); err != nil {
+			t.Errorf("validateObjectName(%q) = %v, want nil", name, err)
+		}
+	}
+	for _, name := range invalid {
+		if err := validateObjectName(name); err == nil {
+			t.Errorf("validateObjectName(%q) = nil, want error", name)
+		}
+	}
+}
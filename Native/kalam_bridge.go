@@ -6,27 +6,29 @@ package main
 import "C"
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 	"unsafe"
 
-	"github.com/ganeshrvel/go-mtpfs/mtp"
-	"github.com/ganeshrvel/go-mtpx"
+	"kalam-bridge/kalam"
 )
 
+// client is the device handle behind every exported function
+var client = kalam.NewClient()
+
 var (
-	cancelledTasks   sync.Map
 	allocatedStrings = make(map[*C.char]time.Time)
 	stringMu         sync.Mutex
 )
 
 // safeCString safely allocates a C string with size limit
 func safeCString(s string) *C.char {
-	if len(s) > cfg.Security.MaxCStringSize {
-		fmt.Printf("safeCString: String too large (%d bytes, max %d)\n", len(s), cfg.Security.MaxCStringSize)
+	maxSize := kalam.CurrentConfig().Security.MaxCStringSize
+	if len(s) > maxSize {
+		bridgeLog.Warn("string too large for C", "size", len(s), "max", maxSize)
 		return nil
 	}
 	return C.CString(s)
@@ -36,86 +38,42 @@ func safeCString(s string) *C.char {
 
 //export Kalam_Init
 func Kalam_Init() {
-	bridgeShutdownFlag.Store(false)
-	fmt.Println("Kalam Kernel Bridge Initialized")
+	client.Open()
+	bridgeLog.Info("Kalam Kernel Bridge initialized")
 }
 
-//export Kalam_Scan
-func Kalam_Scan() *C.char {
-	var result string
-
-	// Use a faster, more lightweight scan for device detection
-	err := withDeviceQuick(func(dev *mtp.Device) error {
-		// First try just getting device info for quick detection
-		info, err := mtpx.FetchDeviceInfo(dev)
-		if err != nil {
-			return fmt.Errorf("FetchDeviceInfo failed: %w", err)
-		}
-
-		// Only fetch storage if device info succeeded
-		var storages []mtpx.StorageData
-		storages, err = mtpx.FetchStorages(dev)
-		if err != nil {
-			fmt.Printf("Kalam_Scan: FetchStorages failed: %v\n", err)
-			storages = []mtpx.StorageData{}
-		}
-
-		var deviceList []DeviceJSON
-
-		deviceName := info.Model
-		if info.Manufacturer != "" && !containsIgnoreCase(info.Model, info.Manufacturer) {
-			deviceName = info.Manufacturer + " " + info.Model
-		}
-
-		majorVersion := info.MTPVersion / 100
-		minorVersion := (info.MTPVersion % 100) / 10
-		mtpVersion := fmt.Sprintf("%d.%d", majorVersion, minorVersion)
-
-		mtpSupport := MTPSupportJSON{
-			MtpVersion:      mtpVersion,
-			DeviceVersion:   info.DeviceVersion,
-			VendorExtension: info.Manufacturer,
-		}
-
-		d := DeviceJSON{
-			ID:           1,
-			Name:         deviceName,
-			Manufacturer: info.Manufacturer,
-			Model:        info.Model,
-			SerialNumber: info.SerialNumber,
-			Storage:      []StorageJSON{},
-			MTPSupport:   mtpSupport,
-		}
-
-		for _, s := range storages {
-			d.Storage = append(d.Storage, StorageJSON{
-				ID:          s.Sid,
-				Description: s.Info.StorageDescription,
-				FreeSpace:   s.Info.FreeSpaceInBytes,
-				MaxCapacity: s.Info.MaxCapability,
-			})
-		}
-
-		deviceList = append(deviceList, d)
+//export Kalam_UsePTPIP
+func Kalam_UsePTPIP(addr *C.char) {
+	// An empty address switches back to USB
+	if addr == nil || C.GoString(addr) == "" {
+		kalam.SetDeviceOpener(nil)
+		bridgeLog.Info("using USB devices", "op", "Kalam_UsePTPIP")
+		return
+	}
 
-		jsonData, err := json.Marshal(deviceList)
-		if err != nil {
-			return fmt.Errorf("JSON marshal failed: %w", err)
-		}
+	address := C.GoString(addr)
+	kalam.SetDeviceOpener(kalam.PTPIPOpener(address))
+	bridgeLog.Info("using PTP/IP device", "op", "Kalam_UsePTPIP", "addr", address)
+}
 
-		result = string(jsonData)
+//export Kalam_Scan
+func Kalam_Scan() *C.char {
+	devices, err := client.Scan(context.Background())
+	if err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_Scan", "error", err)
+		// Return nil instead of empty array to indicate no devices found
 		return nil
-	})
+	}
 
+	jsonData, err := json.Marshal(devices)
 	if err != nil {
-		fmt.Printf("Kalam_Scan: %v\n", err)
-		// Return nil instead of empty array to indicate no devices found
+		bridgeLog.Error("JSON marshal failed", "op", "Kalam_Scan", "error", err)
 		return nil
 	}
 
-	cStr := safeCString(result)
+	cStr := safeCString(string(jsonData))
 	if cStr == nil {
-		fmt.Printf("Kalam_Scan: Failed to allocate C string for result\n")
+		bridgeLog.Warn("failed to allocate C string for result", "op", "Kalam_Scan")
 		return nil
 	}
 
@@ -130,70 +88,37 @@ func Kalam_Scan() *C.char {
 //export Kalam_ListFiles
 func Kalam_ListFiles(storageID uint32, parentID uint32) *C.char {
 	// Convert to custom types for validation
-	storageIDTyped := StorageID(storageID)
-	parentIDTyped := ParentID(parentID)
+	storageIDTyped := kalam.StorageID(storageID)
+	parentIDTyped := kalam.ParentID(parentID)
 
 	// Validate inputs and return error JSON if validation fails
 	if err := storageIDTyped.Validate(); err != nil {
-		fmt.Printf("Kalam_ListFiles: %v\n", err)
+		bridgeLog.Warn("operation failed", "op", "Kalam_ListFiles", "error", err)
 		errorJSON := fmt.Sprintf(`{"error": "INVALID_STORAGE_ID", "message": "%v"}`, err)
 		return safeCString(errorJSON)
 	}
 	if err := parentIDTyped.Validate(); err != nil {
-		fmt.Printf("Kalam_ListFiles: %v\n", err)
+		bridgeLog.Warn("operation failed", "op", "Kalam_ListFiles", "error", err)
 		errorJSON := fmt.Sprintf(`{"error": "INVALID_PARENT_ID", "message": "%v"}`, err)
 		return safeCString(errorJSON)
 	}
 
-	var result string
-
-	err := withDevice(func(dev *mtp.Device) error {
-		var handles mtp.Uint32Array
-		if err := dev.GetObjectHandles(uint32(storageIDTyped), 0, uint32(parentIDTyped), &handles); err != nil {
-			return fmt.Errorf("GetObjectHandles failed: %w", err)
-		}
-
-		var files []FileJSON
-		for _, handle := range handles.Values {
-			var info mtp.ObjectInfo
-			if err := dev.GetObjectInfo(handle, &info); err != nil {
-				fmt.Printf("Kalam_ListFiles: GetObjectInfo failed for handle %d: %v\n", handle, err)
-				continue
-			}
-
-			files = append(files, FileJSON{
-				ID:        handle,
-				ParentID:  info.ParentObject,
-				StorageID: info.StorageID,
-				Name:      info.Filename,
-				Size:      uint64(info.CompressedSize),
-				IsFolder:  info.ObjectFormat == 0x3001,
-				ModTime:   info.ModificationDate.Unix(),
-			})
-		}
-
-		if files == nil {
-			files = []FileJSON{}
-		}
-
-		jsonData, err := json.Marshal(files)
-		if err != nil {
-			return fmt.Errorf("JSON marshal failed: %w", err)
-		}
-
-		result = string(jsonData)
+	files, err := client.ListFiles(context.Background(), storageIDTyped, parentIDTyped)
+	if err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_ListFiles", "error", err)
+		// Unified error handling: return nil to indicate error
 		return nil
-	})
+	}
 
+	jsonData, err := json.Marshal(files)
 	if err != nil {
-		fmt.Printf("Kalam_ListFiles: %v\n", err)
-		// Unified error handling: return nil to indicate error
+		bridgeLog.Error("JSON marshal failed", "op", "Kalam_ListFiles", "error", err)
 		return nil
 	}
 
-	cStr := safeCString(result)
+	cStr := safeCString(string(jsonData))
 	if cStr == nil {
-		fmt.Printf("Kalam_ListFiles: Failed to allocate C string for result\n")
+		bridgeLog.Warn("failed to allocate C string for result", "op", "Kalam_ListFiles")
 		return nil
 	}
 
@@ -222,92 +147,111 @@ func Kalam_FreeString(str *C.char) {
 //export Kalam_CreateFolder
 func Kalam_CreateFolder(storageID uint32, parentID uint32, folderName *C.char) uint32 {
 	// Convert to custom types for validation
-	storageIDTyped := StorageID(storageID)
-	parentIDTyped := ParentID(parentID)
+	storageIDTyped := kalam.StorageID(storageID)
+	parentIDTyped := kalam.ParentID(parentID)
 
 	// Validate inputs and return error codes if validation fails
 	if err := storageIDTyped.Validate(); err != nil {
-		fmt.Printf("Kalam_CreateFolder: %v\n", err)
+		bridgeLog.Warn("operation failed", "op", "Kalam_CreateFolder", "error", err)
 		return 0xFFFFFFFF // Error code: INVALID_STORAGE_ID
 	}
 	if err := parentIDTyped.Validate(); err != nil {
-		fmt.Printf("Kalam_CreateFolder: %v\n", err)
+		bridgeLog.Warn("operation failed", "op", "Kalam_CreateFolder", "error", err)
 		return 0xFFFFFFFE // Error code: INVALID_PARENT_ID
 	}
 
 	if folderName == nil {
-		fmt.Printf("Kalam_CreateFolder: folderName is nil\n")
+		bridgeLog.Warn("folderName is nil", "op", "Kalam_CreateFolder")
 		return 0xFFFFFFFD // Error code: INVALID_ARGUMENT
 	}
 
 	name := C.GoString(folderName)
 	if name == "" {
-		fmt.Printf("Kalam_CreateFolder: folderName is empty\n")
+		bridgeLog.Warn("folderName is empty", "op", "Kalam_CreateFolder")
 		return 0xFFFFFFFD // Error code: INVALID_ARGUMENT
 	}
 
 	// Validate folder name length
-	if len(name) > cfg.Security.MaxFolderNameLength {
-		fmt.Printf("Kalam_CreateFolder: folder name too long (%d chars)\n", len(name))
+	if len(name) > kalam.CurrentConfig().Security.MaxFolderNameLength {
+		bridgeLog.Warn("folder name too long", "op", "Kalam_CreateFolder", "length", len(name))
 		return 0xFFFFFFFC // Error code: NAME_TOO_LONG
 	}
 
-	// Check for invalid characters
-	invalidChars := []string{"/", "\\", ":", "*", "?", "\"", "<", ">", "|"}
-	for _, char := range invalidChars {
-		if strings.Contains(name, char) {
-			fmt.Printf("Kalam_CreateFolder: folder name contains invalid character: %s\n", char)
-			return 0
-		}
+	newHandle, err := client.CreateFolder(context.Background(), storageIDTyped, parentIDTyped, name)
+	if err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_CreateFolder", "error", err)
+		return 0
 	}
 
-	var newHandle uint32
-
-	err := withDevice(func(dev *mtp.Device) error {
-		var objInfo mtp.ObjectInfo
-		objInfo.StorageID = uint32(storageIDTyped)
-		objInfo.ParentObject = uint32(parentIDTyped)
-		objInfo.Filename = name
-		objInfo.ObjectFormat = ObjectFormatFolder
-		objInfo.CompressedSize = 0
+	return uint32(newHandle)
+}
 
-		_, _, handle, err := dev.SendObjectInfo(uint32(storageIDTyped), uint32(parentIDTyped), &objInfo)
-		if err != nil {
-			return fmt.Errorf("SendObjectInfo failed: %w", err)
-		}
+//export Kalam_DeleteObject
+func Kalam_DeleteObject(objectID uint32) int32 {
+	// Convert to custom type for validation
+	objectIDTyped := kalam.ObjectID(objectID)
 
-		newHandle = handle
-		return nil
-	})
+	// Validate input
+	if err := objectIDTyped.Validate(); err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_DeleteObject", "error", err)
+		return 0
+	}
 
-	if err != nil {
-		fmt.Printf("Kalam_CreateFolder: %v\n", err)
+	if err := client.DeleteObject(context.Background(), objectIDTyped); err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_DeleteObject", "error", err)
 		return 0
 	}
 
-	return newHandle
+	return 1
 }
 
-//export Kalam_DeleteObject
-func Kalam_DeleteObject(objectID uint32) int32 {
+//export Kalam_RenameObject
+func Kalam_RenameObject(objectID uint32, newName *C.char) int32 {
 	// Convert to custom type for validation
-	objectIDTyped := ObjectID(objectID)
+	objectIDTyped := kalam.ObjectID(objectID)
 
 	// Validate input
 	if err := objectIDTyped.Validate(); err != nil {
-		fmt.Printf("Kalam_DeleteObject: %v\n", err)
+		bridgeLog.Warn("operation failed", "op", "Kalam_RenameObject", "error", err)
 		return 0
 	}
 
-	err := withDevice(func(dev *mtp.Device) error {
-		if err := dev.DeleteObject(uint32(objectIDTyped)); err != nil {
-			return fmt.Errorf("DeleteObject failed: %w", err)
-		}
-		return nil
-	})
+	if newName == nil {
+		bridgeLog.Warn("newName is nil", "op", "Kalam_RenameObject")
+		return 0
+	}
 
-	if err != nil {
-		fmt.Printf("Kalam_DeleteObject: %v\n", err)
+	if err := client.RenameObject(context.Background(), objectIDTyped, C.GoString(newName)); err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_RenameObject", "error", err)
+		return 0
+	}
+
+	return 1
+}
+
+//export Kalam_MoveObject
+func Kalam_MoveObject(objectID uint32, storageID uint32, parentID uint32) int32 {
+	// Convert to custom types for validation
+	objectIDTyped := kalam.ObjectID(objectID)
+	storageIDTyped := kalam.StorageID(storageID)
+	parentIDTyped := kalam.ParentID(parentID)
+
+	// Validate inputs
+	if err := objectIDTyped.Validate(); err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_MoveObject", "error", err)
+		return 0
+	}
+	if err := storageIDTyped.Validate(); err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_MoveObject", "error", err)
+		return 0
+	}
+	if err := parentIDTyped.Validate(); err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_MoveObject", "error", err)
+		return 0
+	}
+
+	if err := client.MoveObject(context.Background(), objectIDTyped, storageIDTyped, parentIDTyped); err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_MoveObject", "error", err)
 		return 0
 	}
 
@@ -317,61 +261,34 @@ func Kalam_DeleteObject(objectID uint32) int32 {
 //export Kalam_RefreshStorage
 func Kalam_RefreshStorage(storageID uint32) int32 {
 	// Convert to custom type for validation
-	storageIDTyped := StorageID(storageID)
+	storageIDTyped := kalam.StorageID(storageID)
 
 	// Validate input
 	if err := storageIDTyped.Validate(); err != nil {
-		fmt.Printf("Kalam_RefreshStorage: %v\n", err)
+		bridgeLog.Warn("operation failed", "op", "Kalam_RefreshStorage", "error", err)
 		return 0
 	}
 
-	err := withDevice(func(dev *mtp.Device) error {
-		// Try to refresh the device storage
-		// This helps to clear the cache after file operations
-		fmt.Printf("Kalam_RefreshStorage: Refreshing storage %d\n", uint32(storageIDTyped))
-
-		// Get storage info to trigger refresh
-		var info mtp.StorageInfo
-		if err := dev.GetStorageInfo(uint32(storageIDTyped), &info); err != nil {
-			fmt.Printf("Kalam_RefreshStorage: GetStorageInfo failed: %v\n", err)
-			return err
-		}
-
-		fmt.Printf("Kalam_RefreshStorage: Storage refreshed successfully\n")
-		return nil
-	})
-
-	if err != nil {
-		fmt.Printf("Kalam_RefreshStorage: %v\n", err)
+	bridgeLog.Debug("refreshing storage", "op", "Kalam_RefreshStorage", "storageID", storageID)
+	if err := client.RefreshStorage(context.Background(), storageIDTyped); err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_RefreshStorage", "error", err)
 		return 0
 	}
 
+	bridgeLog.Info("storage refreshed successfully", "op", "Kalam_RefreshStorage")
 	return 1
 }
 
 //export Kalam_ResetDeviceCache
 func Kalam_ResetDeviceCache() int32 {
-	fmt.Printf("Kalam_ResetDeviceCache: Attempting to reset device cache\n")
-
-	// Force a device reset by closing and reopening
-	// This is more aggressive but should clear all caches
-	err := withDevice(func(dev *mtp.Device) error {
-		// Try to get device info to ensure connection is active
-		var info mtp.DeviceInfo
-		if err := dev.GetDeviceInfo(&info); err != nil {
-			fmt.Printf("Kalam_ResetDeviceCache: GetDeviceInfo failed: %v\n", err)
-			return err
-		}
+	bridgeLog.Debug("attempting to reset device cache", "op", "Kalam_ResetDeviceCache")
 
-		fmt.Printf("Kalam_ResetDeviceCache: Device cache reset successfully\n")
-		return nil
-	})
-
-	if err != nil {
-		fmt.Printf("Kalam_ResetDeviceCache: %v\n", err)
+	if err := client.ResetDeviceCache(context.Background()); err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_ResetDeviceCache", "error", err)
 		return 0
 	}
 
+	bridgeLog.Info("device cache reset successfully", "op", "Kalam_ResetDeviceCache")
 	return 1
 }
 
@@ -386,7 +303,7 @@ func cleanupLeakedStrings() {
 
 	for str, allocTime := range allocatedStrings {
 		if now.Sub(allocTime) > maxAge {
-			fmt.Printf("Cleaning up leaked string allocated at %v\n", allocTime)
+			bridgeLog.Warn("cleaning up leaked string", "allocated", allocTime)
 			C.free(unsafe.Pointer(str))
 			delete(allocatedStrings, str)
 		}
@@ -400,25 +317,7 @@ func Kalam_CleanupLeakedStrings() {
 
 //export Kalam_CleanupDevicePool
 func Kalam_CleanupDevicePool() {
-	fmt.Printf("Kalam_CleanupDevicePool: Cleaning up all device connections\n")
-	bridgeShutdownFlag.Store(true)
-
-	// Serialize teardown with all bridge operations that use pooled devices.
-	deviceMu.Lock()
-	defer deviceMu.Unlock()
-
-	devicePoolMu.Lock()
-	defer devicePoolMu.Unlock()
-
-	for _, entry := range devicePool {
-		if entry.device != nil {
-			fmt.Printf("Kalam_CleanupDevicePool: Disposing device connection\n")
-			mtpx.Dispose(entry.device)
-		}
-	}
-
-	devicePool = nil
-	fmt.Printf("Kalam_CleanupDevicePool: Device pool cleanup completed\n")
+	client.Close()
 }
 
 func main() {}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
+
+	"kalam-bridge/kalam"
 )
 
 func TestSafeCStringRejectsOversizeInput(t *testing.T) {
-	tooLarge := strings.Repeat("a", cfg.Security.MaxCStringSize+1)
+	tooLarge := strings.Repeat("a", kalam.CurrentConfig().Security.MaxCStringSize+1)
 	if got := safeCString(tooLarge); got != nil {
 		t.Fatalf("expected nil for oversize C string")
 	}
@@ -46,3 +50,48 @@ func TestCleanupEntrypointsDoNotPanic(t *testing.T) {
 	Kalam_Init()
 	Kalam_CleanupLeakedStrings()
 }
+
+func TestExportsAgainstSimDevice(t *testing.T) {
+	sim := kalam.NewDemoDevice()
+	kalam.SetDeviceOpener(sim.Open)
+	defer kalam.SetDeviceOpener(nil)
+	Kalam_Init()
+
+	devices := Kalam_Scan()
+	if devices == nil {
+		t.Fatalf("Kalam_Scan found no device")
+	}
+	Kalam_FreeString(devices)
+
+	files := Kalam_ListFiles(65537, uint32(kalam.RootParentID))
+	if files == nil {
+		t.Fatalf("Kalam_ListFiles failed")
+	}
+	Kalam_FreeString(files)
+
+	folderName := safeCString("Exports")
+	defer Kalam_FreeString(folderName)
+	folderID := Kalam_CreateFolder(65537, uint32(kalam.RootParentID), folderName)
+	if folderID == 0 || folderID >= 0xFFFFFFFC {
+		t.Fatalf("Kalam_CreateFolder = %#x", folderID)
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(src, []byte("simulated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srcPath, taskID := safeCString(src), safeCString("sim-upload")
+	defer Kalam_FreeString(srcPath)
+	defer Kalam_FreeString(taskID)
+	if got := Kalam_UploadFile(65537, folderID, srcPath, taskID); got != 1 {
+		t.Fatalf("Kalam_UploadFile = %d", got)
+	}
+
+	if got := Kalam_DeleteObject(folderID); got != 1 {
+		t.Fatalf("Kalam_DeleteObject = %d", got)
+	}
+	if got := Kalam_RefreshStorage(65537); got != 1 {
+		t.Fatalf("Kalam_RefreshStorage = %d", got)
+	}
+}
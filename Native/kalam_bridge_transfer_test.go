@@ -24,6 +24,26 @@ func TestTransferTaskCancellationState(t *testing.T) {
 	}
 }
 
+func TestTaskContextCancellation(t *testing.T) {
+	ctx, done := taskContext("transfer-task-3")
+	defer done()
+
+	if ctx.Err() != nil {
+		t.Fatalf("running task should not start cancelled")
+	}
+	markTaskCancelled("transfer-task-3")
+	if ctx.Err() == nil {
+		t.Fatalf("cancelling a running task should cancel its context")
+	}
+
+	markTaskCancelled("transfer-task-4")
+	early, earlyDone := taskContext("transfer-task-4")
+	defer earlyDone()
+	if early.Err() == nil {
+		t.Fatalf("task cancelled before start should begin cancelled")
+	}
+}
+
 func TestSetProgressCallbackNoop(t *testing.T) {
 	Kalam_SetProgressCallback(0)
 }
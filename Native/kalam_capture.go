@@ -0,0 +1,39 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import "kalam-bridge/kalam"
+
+// -- Transaction Capture --
+
+//export Kalam_StartRecording
+func Kalam_StartRecording(path *C.char) int32 {
+	if path == nil {
+		bridgeLog.Warn("path is nil", "op", "Kalam_StartRecording")
+		return 0
+	}
+
+	capturePath, err := kalam.ValidateDestinationPath(C.GoString(path))
+	if err != nil {
+		bridgeLog.Warn("invalid capture path", "op", "Kalam_StartRecording", "error", err)
+		return 0
+	}
+
+	if err := kalam.StartRecording(capturePath); err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_StartRecording", "error", err)
+		return 0
+	}
+	return 1
+}
+
+//export Kalam_StopRecording
+func Kalam_StopRecording() int32 {
+	if err := kalam.StopRecording(); err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_StopRecording", "error", err)
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"kalam-bridge/kalam"
+)
+
+func TestRecordingExports(t *testing.T) {
+	sim := kalam.NewDemoDevice()
+	kalam.SetDeviceOpener(sim.Open)
+	defer kalam.SetDeviceOpener(nil)
+	Kalam_Init()
+
+	if Kalam_StopRecording() != 0 {
+		t.Fatalf("expected Kalam_StopRecording to fail when not recording")
+	}
+
+	capturePath := filepath.Join(t.TempDir(), "capture.jsonl")
+	path := safeCString(capturePath)
+	defer Kalam_FreeString(path)
+	if Kalam_StartRecording(path) != 1 {
+		t.Fatalf("Kalam_StartRecording failed")
+	}
+
+	files := Kalam_ListFiles(65537, uint32(kalam.RootParentID))
+	if files == nil {
+		t.Fatalf("Kalam_ListFiles failed")
+	}
+	Kalam_FreeString(files)
+
+	if Kalam_StopRecording() != 1 {
+		t.Fatalf("Kalam_StopRecording failed")
+	}
+
+	replay, err := kalam.LoadReplay(capturePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stopping closes the recorded session, so the capture ends with CloseSession
+	if entries := replay.Unused(); len(entries) < 2 || entries[len(entries)-2].OpName != "GetObjectInfo" || entries[len(entries)-1].OpName != "CloseSession" {
+		t.Fatalf("unexpected capture %+v", entries)
+	}
+}
@@ -1,44 +1,37 @@
 package main
 
 import (
-	"path/filepath"
 	"testing"
-)
+	"time"
 
-func TestContainsIgnoreCase(t *testing.T) {
-	if !containsIgnoreCase("Samsung Galaxy", "samsung") {
-		t.Fatalf("expected case-insensitive match")
-	}
-	if containsIgnoreCase("Pixel", "iphone") {
-		t.Fatalf("unexpected match")
-	}
-}
+	"kalam-bridge/kalam"
+)
 
-func TestValidateAndCleanPath(t *testing.T) {
-	baseDir := t.TempDir()
-	validPath := filepath.Join(baseDir, "sub", "file.txt")
+func TestConfigExports(t *testing.T) {
+	prev := kalam.CurrentConfig()
+	defer kalam.SetConfig(prev)
 
-	got, err := validateAndCleanPath(validPath, baseDir)
-	if err != nil {
-		t.Fatalf("validateAndCleanPath(valid) returned error: %v", err)
-	}
-	expected, err := filepath.Abs(validPath)
-	if err != nil {
-		t.Fatalf("filepath.Abs failed: %v", err)
-	}
-	if got != expected {
-		t.Fatalf("validateAndCleanPath(valid) = %q, want %q", got, expected)
+	current := Kalam_GetConfig()
+	if current == nil {
+		t.Fatalf("Kalam_GetConfig returned nil")
 	}
+	Kalam_FreeString(current)
 
-	if _, err := validateAndCleanPath(filepath.Join(baseDir, "..", "etc", "passwd"), baseDir); err == nil {
-		t.Fatalf("expected traversal path to be rejected")
+	update := safeCString(`{"pool": {"entryTTL": "30s"}, "retry": {"transfer": {"attempts": 5}}}`)
+	defer Kalam_FreeString(update)
+	if Kalam_SetConfig(update) != 1 {
+		t.Fatalf("Kalam_SetConfig failed")
 	}
-
-	if _, err := validateAndCleanPath("bad\npath", baseDir); err == nil {
-		t.Fatalf("expected dangerous characters to be rejected")
+	if c := kalam.CurrentConfig(); c.Pool.EntryTTL != 30*time.Second || c.Retry.Transfer.Attempts != 5 || c.Pool.CleanupTick != prev.Pool.CleanupTick {
+		t.Errorf("unexpected configuration after Kalam_SetConfig: %+v %+v", c.Pool, c.Retry.Transfer)
 	}
 
-	if _, err := validateAndCleanPath("", baseDir); err == nil {
-		t.Fatalf("expected empty path to be rejected")
+	invalid := safeCString(`{"pool": {"cleanupTick": "0s"}}`)
+	defer Kalam_FreeString(invalid)
+	if Kalam_SetConfig(invalid) != 0 || Kalam_SetConfig(nil) != 0 {
+		t.Errorf("expected invalid configurations to be rejected")
+	}
+	if kalam.CurrentConfig().Pool.CleanupTick != prev.Pool.CleanupTick {
+		t.Errorf("a rejected configuration must not be applied")
 	}
 }
@@ -0,0 +1,49 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// -- Diagnostics --
+
+//export Kalam_RunDiagnostics
+func Kalam_RunDiagnostics(taskID *C.char) *C.char {
+	if taskID == nil {
+		bridgeLog.Warn("taskID is nil", "op", "Kalam_RunDiagnostics")
+		return nil
+	}
+
+	ctx, done := taskContext(C.GoString(taskID))
+	defer done()
+
+	// A failing device still produces a report naming the failed step
+	report, err := client.RunDiagnostics(ctx)
+	if err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_RunDiagnostics", "error", err)
+		return nil
+	}
+
+	jsonData, err := json.Marshal(report)
+	if err != nil {
+		bridgeLog.Error("JSON marshal failed", "op", "Kalam_RunDiagnostics", "error", err)
+		return nil
+	}
+
+	cStr := safeCString(string(jsonData))
+	if cStr == nil {
+		bridgeLog.Warn("failed to allocate C string for result", "op", "Kalam_RunDiagnostics")
+		return nil
+	}
+
+	stringMu.Lock()
+	allocatedStrings[cStr] = time.Now()
+	stringMu.Unlock()
+
+	return cStr
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"kalam-bridge/kalam"
+)
+
+func TestDiagnosticsExport(t *testing.T) {
+	sim := kalam.NewDemoDevice()
+	kalam.SetDeviceOpener(sim.Open)
+	defer kalam.SetDeviceOpener(nil)
+	Kalam_Init()
+
+	if Kalam_RunDiagnostics(nil) != nil {
+		t.Errorf("expected a nil taskID to be rejected")
+	}
+
+	taskID := safeCString("diagnostics-test")
+	defer Kalam_FreeString(taskID)
+
+	report := Kalam_RunDiagnostics(taskID)
+	if report == nil {
+		t.Fatalf("Kalam_RunDiagnostics returned nil")
+	}
+	Kalam_FreeString(report)
+
+	if sim.OpenSessions() != 0 {
+		t.Errorf("diagnostics left %d sessions open", sim.OpenSessions())
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// -- Device health --
+
+//export Kalam_GetDeviceState
+func Kalam_GetDeviceState() *C.char {
+	jsonData, err := json.Marshal(client.DeviceHealth())
+	if err != nil {
+		bridgeLog.Error("JSON marshal failed", "op", "Kalam_GetDeviceState", "error", err)
+		return nil
+	}
+
+	cStr := safeCString(string(jsonData))
+	if cStr == nil {
+		bridgeLog.Warn("failed to allocate C string for result", "op", "Kalam_GetDeviceState")
+		return nil
+	}
+
+	stringMu.Lock()
+	allocatedStrings[cStr] = time.Now()
+	stringMu.Unlock()
+
+	return cStr
+}
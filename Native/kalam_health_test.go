@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"kalam-bridge/kalam"
+)
+
+func TestDeviceStateExport(t *testing.T) {
+	sim := kalam.NewDemoDevice()
+	kalam.SetDeviceOpener(sim.Open)
+	defer kalam.SetDeviceOpener(nil)
+	Kalam_Init()
+
+	files := Kalam_ListFiles(65537, uint32(kalam.RootParentID))
+	if files == nil {
+		t.Fatalf("Kalam_ListFiles failed")
+	}
+	Kalam_FreeString(files)
+
+	state := Kalam_GetDeviceState()
+	if state == nil {
+		t.Fatalf("Kalam_GetDeviceState returned nil")
+	}
+	Kalam_FreeString(state)
+
+	if health := client.DeviceHealth(); health.State != kalam.DeviceConnected {
+		t.Errorf("expected the device to be connected, got %+v", health)
+	}
+}
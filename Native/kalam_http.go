@@ -0,0 +1,101 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"kalam-bridge/kalam"
+)
+
+// -- Server Lifecycle --
+
+var (
+	httpServer   *http.Server
+	httpServerMu sync.Mutex
+)
+
+// startHTTPServer listens on addr and serves handler in the background
+func startHTTPServer(addr string, handler http.Handler) (string, error) {
+	httpServerMu.Lock()
+	defer httpServerMu.Unlock()
+
+	if httpServer != nil {
+		return "", fmt.Errorf("HTTP server already running on %s", httpServer.Addr)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	server := &http.Server{
+		Addr:              listener.Addr().String(),
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			bridgeLog.Warn("HTTP server stopped", "error", err)
+		}
+	}()
+
+	httpServer = server
+	return server.Addr, nil
+}
+
+// stopHTTPServer gracefully stops the running server
+func stopHTTPServer() error {
+	httpServerMu.Lock()
+	defer httpServerMu.Unlock()
+
+	if httpServer == nil {
+		return fmt.Errorf("HTTP server is not running")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := httpServer.Shutdown(ctx)
+	httpServer = nil
+	return err
+}
+
+//export Kalam_StartHTTPServer
+func Kalam_StartHTTPServer(addr *C.char) int32 {
+	listenAddr := kalam.CurrentConfig().HTTP.DefaultAddr
+	if addr != nil {
+		if a := C.GoString(addr); a != "" {
+			listenAddr = a
+		}
+	}
+
+	boundAddr, err := startHTTPServer(listenAddr, kalam.NewHTTPHandler(client))
+	if err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_StartHTTPServer", "error", err)
+		return 0
+	}
+
+	bridgeLog.Info("serving device storages over HTTP and WebDAV", "op", "Kalam_StartHTTPServer", "storage", "http://"+boundAddr+"/storage", "webdav", "http://"+boundAddr+kalam.DAVPrefix+"/")
+	return 1
+}
+
+//export Kalam_StopHTTPServer
+func Kalam_StopHTTPServer() int32 {
+	if err := stopHTTPServer(); err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_StopHTTPServer", "error", err)
+		return 0
+	}
+
+	bridgeLog.Info("HTTP server stopped", "op", "Kalam_StopHTTPServer")
+	return 1
+}
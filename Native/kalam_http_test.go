@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStartStopHTTPServer(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	addr, err := startHTTPServer("127.0.0.1:0", handler)
+	if err != nil {
+		t.Fatalf("startHTTPServer failed: %v", err)
+	}
+
+	if _, err := startHTTPServer("127.0.0.1:0", handler); err == nil {
+		t.Fatalf("expected second start to fail while running")
+	}
+
+	resp, err := http.Get("http://" + addr + "/storage")
+	if err != nil {
+		t.Fatalf("GET against running server failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected handler response, got %d", resp.StatusCode)
+	}
+
+	if err := stopHTTPServer(); err != nil {
+		t.Fatalf("stopHTTPServer failed: %v", err)
+	}
+	if err := stopHTTPServer(); err == nil {
+		t.Fatalf("expected stopping a stopped server to fail")
+	}
+}
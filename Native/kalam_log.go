@@ -0,0 +1,95 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"bytes"
+	"time"
+
+	"kalam-bridge/kalam"
+)
+
+// bridgeLog is the logger of the exported functions
+var bridgeLog = kalam.Logger(kalam.LogBridge)
+
+// -- Logging --
+
+//export Kalam_SetLogLevel
+func Kalam_SetLogLevel(level *C.char) int32 {
+	if level == nil {
+		bridgeLog.Warn("level is nil", "op", "Kalam_SetLogLevel")
+		return 0
+	}
+
+	parsed, err := kalam.ParseLogLevel(C.GoString(level))
+	if err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_SetLogLevel", "error", err)
+		return 0
+	}
+	kalam.SetLogLevel(parsed)
+	return 1
+}
+
+//export Kalam_SetLogFile
+func Kalam_SetLogFile(path *C.char) int32 {
+	// A nil or empty path stops writing the log file
+	logPath := ""
+	if path != nil {
+		logPath = C.GoString(path)
+	}
+
+	if logPath != "" {
+		validated, err := kalam.ValidateDestinationPath(logPath)
+		if err != nil {
+			bridgeLog.Warn("invalid log path", "op", "Kalam_SetLogFile", "error", err)
+			return 0
+		}
+		logPath = validated
+	}
+
+	if err := kalam.SetLogFile(logPath); err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_SetLogFile", "error", err)
+		return 0
+	}
+	return 1
+}
+
+//export Kalam_GetRecentLogs
+func Kalam_GetRecentLogs() *C.char {
+	records := kalam.RecentLogs()
+
+	// Drop the oldest records when the array would not fit in a C string
+	maxSize := kalam.CurrentConfig().Security.MaxCStringSize
+	size := 2
+	for _, record := range records {
+		size += len(record) + 1
+	}
+	for len(records) > 0 && size > maxSize {
+		size -= len(records[0]) + 1
+		records = records[1:]
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, record := range records {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(record)
+	}
+	buf.WriteByte(']')
+
+	cStr := safeCString(buf.String())
+	if cStr == nil {
+		return nil
+	}
+
+	stringMu.Lock()
+	allocatedStrings[cStr] = time.Now()
+	stringMu.Unlock()
+
+	return cStr
+}
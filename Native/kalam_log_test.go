@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"kalam-bridge/kalam"
+)
+
+// TestMain keeps the bridge's text records out of the test output
+func TestMain(m *testing.M) {
+	kalam.SetLogOutput(nil)
+	os.Exit(m.Run())
+}
+
+func TestLogExports(t *testing.T) {
+	debug := safeCString("debug")
+	defer Kalam_FreeString(debug)
+	if Kalam_SetLogLevel(debug) != 1 {
+		t.Fatalf("Kalam_SetLogLevel(debug) failed")
+	}
+
+	invalid := safeCString("chatty")
+	defer Kalam_FreeString(invalid)
+	if Kalam_SetLogLevel(invalid) != 0 || Kalam_SetLogLevel(nil) != 0 {
+		t.Errorf("expected invalid levels to be rejected")
+	}
+
+	info := safeCString("info")
+	defer Kalam_FreeString(info)
+	Kalam_SetLogLevel(info)
+
+	logs := Kalam_GetRecentLogs()
+	if logs == nil {
+		t.Fatalf("Kalam_GetRecentLogs returned nil")
+	}
+	Kalam_FreeString(logs)
+
+	if Kalam_SetLogFile(nil) != 1 {
+		t.Errorf("expected a nil path to disable the log file")
+	}
+	relative := safeCString("kalam.log")
+	defer Kalam_FreeString(relative)
+	if Kalam_SetLogFile(relative) != 0 {
+		t.Errorf("expected a relative log path to be rejected")
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"context"
+
+	"kalam-bridge/kalam"
+)
+
+//export Kalam_ReadRange
+func Kalam_ReadRange(objectID uint32, offset uint64, length uint32, destinationPath *C.char) int64 {
+	if destinationPath == nil {
+		bridgeLog.Warn("destinationPath is nil", "op", "Kalam_ReadRange")
+		return -1
+	}
+
+	written, err := client.DownloadRange(context.Background(), kalam.ObjectID(objectID), offset, length, C.GoString(destinationPath))
+	if err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_ReadRange", "error", err)
+		return -1
+	}
+
+	return written
+}
@@ -0,0 +1,40 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// -- Device presence --
+
+//export Kalam_QuickPresence
+func Kalam_QuickPresence() *C.char {
+	devices, err := client.QuickPresence()
+	if err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_QuickPresence", "error", err)
+		return nil
+	}
+
+	jsonData, err := json.Marshal(devices)
+	if err != nil {
+		bridgeLog.Error("JSON marshal failed", "op", "Kalam_QuickPresence", "error", err)
+		return nil
+	}
+
+	cStr := safeCString(string(jsonData))
+	if cStr == nil {
+		bridgeLog.Warn("failed to allocate C string for result", "op", "Kalam_QuickPresence")
+		return nil
+	}
+
+	stringMu.Lock()
+	allocatedStrings[cStr] = time.Now()
+	stringMu.Unlock()
+
+	return cStr
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"kalam-bridge/kalam"
+)
+
+func TestQuickPresenceExport(t *testing.T) {
+	sim := kalam.NewDemoDevice()
+	kalam.SetDeviceOpener(sim.Open)
+	defer kalam.SetDeviceOpener(nil)
+	kalam.SetPresenceProbe(sim.Presence)
+	Kalam_Init()
+
+	presence := Kalam_QuickPresence()
+	if presence == nil {
+		t.Fatalf("Kalam_QuickPresence returned nil")
+	}
+	Kalam_FreeString(presence)
+
+	// Without a probe, presence cannot be detected
+	kalam.SetPresenceProbe(nil)
+	if presence := Kalam_QuickPresence(); presence != nil {
+		Kalam_FreeString(presence)
+		t.Errorf("expected nil without a presence probe")
+	}
+}
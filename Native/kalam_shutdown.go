@@ -0,0 +1,48 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"context"
+	"time"
+)
+
+// -- Shutdown --
+
+//export Kalam_Shutdown
+func Kalam_Shutdown(timeoutMs int32) int32 {
+	bridgeLog.Info("shutting down", "op", "Kalam_Shutdown", "timeoutMs", timeoutMs)
+
+	// The HTTP server would start new operations while the running ones drain
+	httpServerMu.Lock()
+	running := httpServer != nil
+	httpServerMu.Unlock()
+	if running {
+		if err := stopHTTPServer(); err != nil {
+			bridgeLog.Warn("failed to stop HTTP server", "op", "Kalam_Shutdown", "error", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	if err := client.Shutdown(ctx); err != nil {
+		bridgeLog.Warn("tasks were cancelled", "op", "Kalam_Shutdown", "error", err)
+		return 0
+	}
+	return 1
+}
+
+//export Kalam_EjectDevice
+func Kalam_EjectDevice(deviceID int32) int32 {
+	if err := client.Eject(context.Background(), int(deviceID)); err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_EjectDevice", "error", err)
+		return 0
+	}
+
+	bridgeLog.Info("device ejected, safe to unplug", "op", "Kalam_EjectDevice", "deviceID", deviceID)
+	return 1
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"kalam-bridge/kalam"
+)
+
+func TestShutdownExports(t *testing.T) {
+	sim := kalam.NewDemoDevice()
+	kalam.SetDeviceOpener(sim.Open)
+	defer kalam.SetDeviceOpener(nil)
+	Kalam_Init()
+	defer Kalam_Init()
+
+	files := Kalam_ListFiles(65537, uint32(kalam.RootParentID))
+	if files == nil {
+		t.Fatalf("Kalam_ListFiles failed")
+	}
+	Kalam_FreeString(files)
+
+	if Kalam_EjectDevice(7) != 0 {
+		t.Errorf("expected an unknown device to be rejected")
+	}
+	if Kalam_EjectDevice(kalam.ConnectedDeviceID) != 1 || sim.OpenSessions() != 0 {
+		t.Errorf("expected Kalam_EjectDevice to close the session")
+	}
+
+	if Kalam_Shutdown(1000) != 1 {
+		t.Fatalf("Kalam_Shutdown failed")
+	}
+	if files := Kalam_ListFiles(65537, uint32(kalam.RootParentID)); files != nil {
+		Kalam_FreeString(files)
+		t.Errorf("expected operations to fail after Kalam_Shutdown")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"time"
+
+	"kalam-bridge/kalam"
+)
+
+// -- Metrics --
+
+//export Kalam_GetStats
+func Kalam_GetStats() *C.char {
+	jsonData, err := json.Marshal(kalam.GetStats())
+	if err != nil {
+		bridgeLog.Error("JSON marshal failed", "op", "Kalam_GetStats", "error", err)
+		return nil
+	}
+
+	cStr := safeCString(string(jsonData))
+	if cStr == nil {
+		bridgeLog.Warn("failed to allocate C string for result", "op", "Kalam_GetStats")
+		return nil
+	}
+
+	stringMu.Lock()
+	allocatedStrings[cStr] = time.Now()
+	stringMu.Unlock()
+
+	return cStr
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"kalam-bridge/kalam"
+)
+
+func TestStatsExport(t *testing.T) {
+	sim := kalam.NewDemoDevice()
+	kalam.SetDeviceOpener(sim.Open)
+	defer kalam.SetDeviceOpener(nil)
+	Kalam_Init()
+	kalam.ResetStats()
+
+	files := Kalam_ListFiles(65537, uint32(kalam.RootParentID))
+	if files == nil {
+		t.Fatalf("Kalam_ListFiles failed")
+	}
+	Kalam_FreeString(files)
+
+	stats := Kalam_GetStats()
+	if stats == nil {
+		t.Fatalf("Kalam_GetStats returned nil")
+	}
+	Kalam_FreeString(stats)
+
+	if ops := kalam.GetStats().Operations; ops["GetObjectHandles"] == nil || ops["GetObjectHandles"].Calls == 0 {
+		t.Errorf("expected Kalam_ListFiles to be counted, got %+v", ops)
+	}
+}
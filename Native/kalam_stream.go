@@ -0,0 +1,117 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"kalam-bridge/kalam"
+)
+
+// -- Stream Handles --
+
+var (
+	readStreams      = make(map[uint32]io.ReadSeekCloser)
+	readStreamsMu    sync.Mutex
+	nextStreamHandle atomic.Uint32
+)
+
+// getReadStream looks up an open stream by handle
+func getReadStream(handle uint32) io.ReadSeekCloser {
+	readStreamsMu.Lock()
+	defer readStreamsMu.Unlock()
+	return readStreams[handle]
+}
+
+//export Kalam_OpenReadStream
+func Kalam_OpenReadStream(objectID uint32) uint32 {
+	stream, err := client.OpenReader(context.Background(), kalam.ObjectID(objectID))
+	if err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_OpenReadStream", "error", err)
+		return 0
+	}
+
+	handle := nextStreamHandle.Add(1)
+
+	readStreamsMu.Lock()
+	readStreams[handle] = stream
+	readStreamsMu.Unlock()
+
+	bridgeLog.Debug("opened stream", "op", "Kalam_OpenReadStream", "handle", handle, "objectID", objectID)
+	return handle
+}
+
+//export Kalam_ReadStream
+func Kalam_ReadStream(handle uint32, buf *C.char, length uint32) int64 {
+	if buf == nil {
+		bridgeLog.Warn("buf is nil", "op", "Kalam_ReadStream")
+		return -1
+	}
+
+	stream := getReadStream(handle)
+	if stream == nil {
+		bridgeLog.Warn("unknown stream handle", "op", "Kalam_ReadStream", "handle", handle)
+		return -1
+	}
+
+	dest := unsafe.Slice((*byte)(unsafe.Pointer(buf)), length)
+
+	// Fill the caller's buffer as far as possible, chunks may end mid-buffer
+	var total int
+	for total < len(dest) {
+		n, err := stream.Read(dest[total:])
+		total += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			bridgeLog.Warn("read failed", "op", "Kalam_ReadStream", "handle", handle, "error", err)
+			if total > 0 {
+				return int64(total)
+			}
+			return -1
+		}
+	}
+
+	return int64(total)
+}
+
+//export Kalam_SeekStream
+func Kalam_SeekStream(handle uint32, offset int64, whence int32) int64 {
+	stream := getReadStream(handle)
+	if stream == nil {
+		bridgeLog.Warn("unknown stream handle", "op", "Kalam_SeekStream", "handle", handle)
+		return -1
+	}
+
+	pos, err := stream.Seek(offset, int(whence))
+	if err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_SeekStream", "error", err)
+		return -1
+	}
+
+	return pos
+}
+
+//export Kalam_CloseStream
+func Kalam_CloseStream(handle uint32) int32 {
+	readStreamsMu.Lock()
+	stream, ok := readStreams[handle]
+	delete(readStreams, handle)
+	readStreamsMu.Unlock()
+
+	if !ok {
+		bridgeLog.Warn("unknown stream handle", "op", "Kalam_CloseStream", "handle", handle)
+		return 0
+	}
+
+	stream.Close()
+	return 1
+}
@@ -0,0 +1,12 @@
+package main
+
+import "testing"
+
+func TestStreamUnknownHandle(t *testing.T) {
+	if got := Kalam_SeekStream(12345, 0, 0); got != -1 {
+		t.Fatalf("expected seeking unknown handle to fail, got %d", got)
+	}
+	if got := Kalam_CloseStream(12345); got != 0 {
+		t.Fatalf("expected closing unknown handle to fail, got %d", got)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"context"
+
+	"kalam-bridge/kalam"
+)
+
+//export Kalam_GetThumbnail
+func Kalam_GetThumbnail(objectID uint32, destinationPath *C.char) int32 {
+	if destinationPath == nil {
+		bridgeLog.Warn("destinationPath is nil", "op", "Kalam_GetThumbnail")
+		return 0
+	}
+
+	destPath := C.GoString(destinationPath)
+	size, err := client.DownloadThumbnail(context.Background(), kalam.ObjectID(objectID), destPath)
+	if err != nil {
+		bridgeLog.Warn("operation failed", "op", "Kalam_GetThumbnail", "error", err)
+		return 0
+	}
+
+	bridgeLog.Debug("wrote thumbnail", "op", "Kalam_GetThumbnail", "size", size, "path", destPath)
+	return 1
+}
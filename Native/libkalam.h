@@ -101,6 +101,30 @@ extern GoInt32 Kalam_RefreshStorage(GoUint32 storageID);
 extern GoInt32 Kalam_ResetDeviceCache(void);
 extern void Kalam_CleanupLeakedStrings(void);
 extern void Kalam_CleanupDevicePool(void);
+extern GoInt32 Kalam_GetThumbnail(GoUint32 objectID, char* destinationPath);
+extern GoInt64 Kalam_ReadRange(GoUint32 objectID, GoUint64 offset, GoUint32 length, char* destinationPath);
+extern GoUint32 Kalam_OpenReadStream(GoUint32 objectID);
+extern GoInt64 Kalam_ReadStream(GoUint32 handle, char* buf, GoUint32 length);
+extern GoInt64 Kalam_SeekStream(GoUint32 handle, GoInt64 offset, GoInt32 whence);
+extern GoInt32 Kalam_CloseStream(GoUint32 handle);
+extern GoInt32 Kalam_StartHTTPServer(char* addr);
+extern GoInt32 Kalam_StopHTTPServer(void);
+extern GoInt32 Kalam_RenameObject(GoUint32 objectID, char* newName);
+extern GoInt32 Kalam_MoveObject(GoUint32 objectID, GoUint32 storageID, GoUint32 parentID);
+extern GoInt32 Kalam_StartRecording(char* path);
+extern GoInt32 Kalam_StopRecording(void);
+extern void Kalam_UsePTPIP(char* addr);
+extern GoInt32 Kalam_SetLogLevel(char* level);
+extern GoInt32 Kalam_SetLogFile(char* path);
+extern char* Kalam_GetRecentLogs(void);
+extern char* Kalam_GetStats(void);
+extern char* Kalam_RunDiagnostics(char* taskID);
+extern char* Kalam_GetConfig(void);
+extern GoInt32 Kalam_SetConfig(char* configJSON);
+extern char* Kalam_GetDeviceState(void);
+extern GoInt32 Kalam_Shutdown(GoInt32 timeoutMs);
+extern GoInt32 Kalam_EjectDevice(GoInt32 deviceID);
+extern char* Kalam_QuickPresence(void);
 
 #ifdef __cplusplus
 }